@@ -0,0 +1,110 @@
+// delta.go
+
+// Package delta codifica los shards en el formato delta con que el
+// coordinador los envía a los nodos: cantidad de usuarios y, por usuario, la
+// diferencia con el anterior y la cantidad de películas; por película, la
+// diferencia con la anterior y el rating en centésimas, todo como uvarint. El
+// coordinador escribe y los nodos leen, así que ambos lados deben usar el
+// mismo código.
+package delta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Registro es un rating con los IDs de usuario y película como enteros.
+type Registro struct {
+    Usuario  uint64
+    Pelicula uint64
+    Rating   float64
+}
+
+// Escribir ordena los registros por usuario y película y los escribe
+// agrupados por usuario. avance recibe cuántos registros lleva escritos al
+// terminar cada usuario.
+func Escribir(writer *bufio.Writer, registros []Registro, avance func(int)) error {
+    sort.Slice(registros, func(i, j int) bool {
+        if registros[i].Usuario != registros[j].Usuario {
+            return registros[i].Usuario < registros[j].Usuario
+        }
+        return registros[i].Pelicula < registros[j].Pelicula
+    })
+
+    var buf [binary.MaxVarintLen64]byte
+    escribir := func(valor uint64) error {
+        n := binary.PutUvarint(buf[:], valor)
+        _, err := writer.Write(buf[:n])
+        return err
+    }
+
+    usuarios := 0
+    for i := range registros {
+        if i == 0 || registros[i].Usuario != registros[i-1].Usuario {
+            usuarios++
+        }
+    }
+    if err := escribir(uint64(usuarios)); err != nil {
+        return err
+    }
+
+    usuarioAnterior := uint64(0)
+    for inicio := 0; inicio < len(registros); {
+        fin := inicio
+        for fin < len(registros) && registros[fin].Usuario == registros[inicio].Usuario {
+            fin++
+        }
+        escribir(registros[inicio].Usuario - usuarioAnterior)
+        escribir(uint64(fin - inicio))
+        peliculaAnterior := uint64(0)
+        for _, r := range registros[inicio:fin] {
+            escribir(r.Pelicula - peliculaAnterior)
+            if err := escribir(uint64(math.Round(r.Rating * 100))); err != nil {
+                return err
+            }
+            peliculaAnterior = r.Pelicula
+        }
+        usuarioAnterior = registros[inicio].Usuario
+        avance(fin)
+        inicio = fin
+    }
+    return nil
+}
+
+// Leer decodifica los registros que escribió Escribir, en su orden.
+func Leer(lector *bufio.Reader) ([]Registro, error) {
+    usuarios, err := binary.ReadUvarint(lector)
+    if err != nil {
+        return nil, err
+    }
+    registros := make([]Registro, 0)
+    usuario := uint64(0)
+    for u := uint64(0); u < usuarios; u++ {
+        diferencia, err := binary.ReadUvarint(lector)
+        if err != nil {
+            return nil, err
+        }
+        usuario += diferencia
+
+        cantidad, err := binary.ReadUvarint(lector)
+        if err != nil {
+            return nil, err
+        }
+        pelicula := uint64(0)
+        for p := uint64(0); p < cantidad; p++ {
+            diferencia, err := binary.ReadUvarint(lector)
+            if err != nil {
+                return nil, err
+            }
+            pelicula += diferencia
+            centesimas, err := binary.ReadUvarint(lector)
+            if err != nil {
+                return nil, err
+            }
+            registros = append(registros, Registro{Usuario: usuario, Pelicula: pelicula, Rating: float64(centesimas) / 100})
+        }
+    }
+    return registros, nil
+}
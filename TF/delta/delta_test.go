@@ -0,0 +1,134 @@
+// delta_test.go
+
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func comprimirGzip(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+func descomprimirGzip(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+
+func comprimirFlate(w io.Writer) io.WriteCloser {
+    compresor, _ := flate.NewWriter(w, flate.DefaultCompression)
+    return compresor
+}
+
+func descomprimirFlate(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil }
+
+func TestEscribirLeerIdaYVuelta(t *testing.T) {
+    // IDs no contiguos y desordenados, con saltos que ocupan varios bytes de
+    // uvarint, y ratings que no son enteros
+    enviados := []Registro{
+        {Usuario: 90210, Pelicula: 17, Rating: 3.5},
+        {Usuario: 7, Pelicula: 4500, Rating: 4.25},
+        {Usuario: 90210, Pelicula: 3, Rating: 1},
+        {Usuario: 7, Pelicula: 12, Rating: 3.333},
+        {Usuario: 1 << 40, Pelicula: 1 << 33, Rating: 4.006},
+        {Usuario: 7, Pelicula: 1, Rating: 5},
+    }
+    // Ordenados por usuario y película, con el rating en centésimas
+    esperados := []Registro{
+        {Usuario: 7, Pelicula: 1, Rating: 5},
+        {Usuario: 7, Pelicula: 12, Rating: 3.33},
+        {Usuario: 7, Pelicula: 4500, Rating: 4.25},
+        {Usuario: 90210, Pelicula: 3, Rating: 1},
+        {Usuario: 90210, Pelicula: 17, Rating: 3.5},
+        {Usuario: 1 << 40, Pelicula: 1 << 33, Rating: 4.01},
+    }
+
+    casos := []struct {
+        compresion   string
+        comprimir    func(io.Writer) io.WriteCloser
+        descomprimir func(io.Reader) (io.Reader, error)
+    }{
+        {"ninguna", nil, nil},
+        {"gzip", comprimirGzip, descomprimirGzip},
+        {"flate", comprimirFlate, descomprimirFlate},
+    }
+    for _, caso := range casos {
+        t.Run(caso.compresion, func(t *testing.T) {
+            var red bytes.Buffer
+            var destino io.Writer = &red
+            var compresor io.WriteCloser
+            if caso.comprimir != nil {
+                compresor = caso.comprimir(&red)
+                destino = compresor
+            }
+            writer := bufio.NewWriter(destino)
+            avances := []int{}
+            registros := append([]Registro(nil), enviados...)
+            if err := Escribir(writer, registros, func(n int) { avances = append(avances, n) }); err != nil {
+                t.Fatal(err)
+            }
+            // Como en el coordinador, el marcador final sigue al cuerpo binario
+            fmt.Fprintf(writer, "FIN_SHARD %d\n", len(registros))
+            if err := writer.Flush(); err != nil {
+                t.Fatal(err)
+            }
+            if compresor != nil {
+                if err := compresor.Close(); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if !reflect.DeepEqual(avances, []int{3, 5, 6}) {
+                t.Errorf("avances %v, se esperaba uno por usuario: [3 5 6]", avances)
+            }
+
+            var origen io.Reader = &red
+            if caso.descomprimir != nil {
+                var err error
+                if origen, err = caso.descomprimir(&red); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            lector := bufio.NewReader(origen)
+            leidos, err := Leer(lector)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(leidos, esperados) {
+                t.Errorf("se leyó\n%v\nse esperaba\n%v", leidos, esperados)
+            }
+            if resto, _ := lector.ReadString('\n'); resto != "FIN_SHARD 6\n" {
+                t.Errorf("después del cuerpo quedó %q, se esperaba el marcador final", resto)
+            }
+        })
+    }
+}
+
+func TestLeerTruncado(t *testing.T) {
+    var red bytes.Buffer
+    writer := bufio.NewWriter(&red)
+    if err := Escribir(writer, []Registro{{Usuario: 1, Pelicula: 2, Rating: 3}, {Usuario: 4, Pelicula: 5, Rating: 2.5}}, func(int) {}); err != nil {
+        t.Fatal(err)
+    }
+    writer.Flush()
+    completo := red.Bytes()
+    for largo := 0; largo < len(completo); largo++ {
+        if _, err := Leer(bufio.NewReader(bytes.NewReader(completo[:largo]))); err == nil {
+            t.Errorf("con %d de %d bytes se esperaba error", largo, len(completo))
+        }
+    }
+}
+
+func TestEscribirVacio(t *testing.T) {
+    var red bytes.Buffer
+    writer := bufio.NewWriter(&red)
+    if err := Escribir(writer, nil, func(int) { t.Error("sin usuarios no debería informar avance") }); err != nil {
+        t.Fatal(err)
+    }
+    writer.Flush()
+    leidos, err := Leer(bufio.NewReader(&red))
+    if err != nil || len(leidos) != 0 {
+        t.Errorf("se leyó %v (%v), se esperaba ningún registro", leidos, err)
+    }
+}
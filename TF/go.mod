@@ -0,0 +1,3 @@
+module tf
+
+go 1.22
@@ -0,0 +1,2744 @@
+// codeRedP2PHP.go
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tf/delta"
+	"tf/seguridad"
+	"tf/similitud"
+)
+
+type Rating struct {
+    UserID  string
+    MovieID string
+    Rating  float64
+}
+
+type ClientData struct {
+    JobID        string
+    ShardIdx     int
+    TargetUserID string
+    Data         []Rating
+    // Con knn-items, los ratings de las columnas de las películas del
+    // objetivo que no están en el shard (de los usuarios del shard), la
+    // media de cada usuario que aparece en ellas y la de cada columna
+    // completa
+    Referencias    []Rating
+    Medias         map[string]float64
+    MediasColumnas map[string]float64
+}
+
+// Shard es una porción del dataset que el coordinador asignó a este nodo.
+// Con replicación un nodo guarda varios shards, identificados por su índice,
+// y uno por cada esquema de partición (la parte de la versión antes de "/"),
+// así que los jobs de vecinos y de factorización no se pisan los shards.
+// Se conservan entre solicitudes y solo se reemplazan cuando cambia la versión
+// de su esquema.
+type Shard struct {
+    Version string
+    Indice  int
+    Data    []Rating
+}
+
+type recommendationPair struct {
+    MovieID string
+    Rating  float64
+}
+
+var addrs []string
+var hostIP string
+
+var (
+    // Shards guardados por claveShard(version, indice)
+    shards   = make(map[string]*Shard)
+    muShard  sync.RWMutex
+    shardDir string
+)
+
+// esquemaDeVersion es la parte de la versión que identifica el reparto.
+func esquemaDeVersion(version string) string {
+    esquema, _, _ := strings.Cut(version, "/")
+    return esquema
+}
+
+func claveShard(version string, indice int) string {
+    return fmt.Sprintf("%s/%d", esquemaDeVersion(version), indice)
+}
+
+const (
+    portHP = 9002
+)
+
+func main() {
+    hostIP = descubrirIP()
+    fmt.Printf("Mi IP es %s\n", hostIP)
+
+    if err := seguridad.Configurar(seguridad.RolNodo, hostIP); err != nil {
+        fmt.Printf("Error configurando la seguridad: %v\n", err)
+        os.Exit(1)
+    }
+
+    addrs = []string{
+        "172.30.0.5",
+    }
+
+    // Recuperar los shards guardados en el volumen local, si existen
+    shardDir = strings.TrimSpace(os.Getenv("SHARD_DIR"))
+    if shardDir != "" {
+        archivos, _ := filepath.Glob(filepath.Join(shardDir, "shard-*.csv"))
+        for _, archivo := range archivos {
+            shard, err := cargarShardLocal(archivo)
+            if err != nil {
+                fmt.Printf("Shard local %s no utilizable: %v\n", archivo, err)
+                continue
+            }
+            // Los archivos anteriores a los esquemas no dicen a cuál pertenecen
+            if archivo != rutaShardLocal(shard.Version, shard.Indice) {
+                fmt.Printf("Shard local %s de un formato anterior, se descarta\n", archivo)
+                os.Remove(archivo)
+                continue
+            }
+            shards[claveShard(shard.Version, shard.Indice)] = shard
+            fmt.Printf("Shard %d (%s) recuperado del disco (%d ratings)\n", shard.Indice, shard.Version, len(shard.Data))
+        }
+    }
+
+    // Ratings propios para el modo federado
+    if archivo := strings.TrimSpace(os.Getenv("DATOS_LOCALES")); archivo != "" {
+        ratings, err := cargarDatosLocales(archivo)
+        if err != nil {
+            fmt.Printf("No se pudieron cargar los datos locales %s: %v\n", archivo, err)
+        } else {
+            datosLocales = ratings
+            matrizLocal = createUserItemMatrix(ClientData{Data: ratings})
+            fmt.Printf("Datos locales cargados: %d ratings de %d usuarios\n", len(ratings), len(matrizLocal))
+        }
+    }
+
+    go registrarse()
+    servicioHP()
+}
+
+// Capacidad son los recursos disponibles para el contenedor del nodo.
+type Capacidad struct {
+    CPUs    float64
+    Memoria int64
+}
+
+// detectarCapacidad lee los límites de cgroup (v2 o v1) y, si no existen,
+// usa la cantidad de CPUs y la memoria total de la máquina.
+func detectarCapacidad() Capacidad {
+    capacidad := Capacidad{
+        CPUs:    float64(runtime.NumCPU()),
+        Memoria: memoriaTotal(),
+    }
+
+    if contenido, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+        campos := strings.Fields(string(contenido))
+        if len(campos) == 2 && campos[0] != "max" {
+            cuota, errCuota := strconv.ParseFloat(campos[0], 64)
+            periodo, errPeriodo := strconv.ParseFloat(campos[1], 64)
+            if errCuota == nil && errPeriodo == nil && periodo > 0 && cuota/periodo < capacidad.CPUs {
+                capacidad.CPUs = cuota / periodo
+            }
+        }
+    } else {
+        cuota, errCuota := leerEnteroArchivo("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+        periodo, errPeriodo := leerEnteroArchivo("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+        if errCuota == nil && errPeriodo == nil && cuota > 0 && periodo > 0 && float64(cuota)/float64(periodo) < capacidad.CPUs {
+            capacidad.CPUs = float64(cuota) / float64(periodo)
+        }
+    }
+
+    for _, archivo := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+        if limite, err := leerEnteroArchivo(archivo); err == nil && limite > 0 && (capacidad.Memoria == 0 || limite < capacidad.Memoria) {
+            capacidad.Memoria = limite
+            break
+        }
+    }
+    return capacidad
+}
+
+// hilosDisponibles es la cantidad de hilos que aprovecha el SGD: la cuota de
+// cgroup redondeada hacia arriba, sin pasar de GOMAXPROCS. En Go 1.22
+// runtime.NumCPU y GOMAXPROCS ven todos los CPUs del host aunque el
+// contenedor tenga un límite menor.
+func hilosDisponibles() int {
+    hilos := int(math.Ceil(detectarCapacidad().CPUs))
+    if maximo := runtime.GOMAXPROCS(0); hilos > maximo {
+        hilos = maximo
+    }
+    if hilos < 1 {
+        hilos = 1
+    }
+    return hilos
+}
+
+func leerEnteroArchivo(archivo string) (int64, error) {
+    contenido, err := os.ReadFile(archivo)
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseInt(strings.TrimSpace(string(contenido)), 10, 64)
+}
+
+func memoriaTotal() int64 {
+    file, err := os.Open("/proc/meminfo")
+    if err != nil {
+        return 0
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        campos := strings.Fields(scanner.Text())
+        if len(campos) >= 2 && campos[0] == "MemTotal:" {
+            kb, err := strconv.ParseInt(campos[1], 10, 64)
+            if err == nil {
+                return kb * 1024
+            }
+        }
+    }
+    return 0
+}
+
+// registrarse anuncia el nodo y su capacidad al coordinador. Se repite
+// periódicamente para que un coordinador reiniciado vuelva a conocerlo.
+func registrarse() {
+    capacidad := detectarCapacidad()
+    fmt.Printf("Capacidad detectada: %.2f CPUs, %d bytes de memoria\n", capacidad.CPUs, capacidad.Memoria)
+
+    serverAddr := net.JoinHostPort(addrs[0], strconv.Itoa(portHP))
+    registrado := false
+    ultimoError := ""
+    for {
+        conn, err := seguridad.Conectar(serverAddr)
+        if err == nil {
+            fmt.Fprintf(conn, "REGISTRO %s cpus=%g memoria=%d codecs=%s locales=%d\n", hostIP, capacidad.CPUs, capacidad.Memoria, strings.Join(codecsSoportados, ","), len(datosLocales))
+            respuesta, errLectura := bufio.NewReader(conn).ReadString('\n')
+            conn.Close()
+            if errLectura == nil && strings.TrimSpace(respuesta) == "OK" {
+                if !registrado {
+                    fmt.Println("Nodo registrado en el coordinador.")
+                }
+                registrado = true
+                ultimoError = ""
+            } else {
+                registrado = false
+                err = fmt.Errorf("registro rechazado: %s %v", strings.TrimSpace(respuesta), errLectura)
+            }
+        } else {
+            registrado = false
+        }
+        // Informar cada error distinto una sola vez
+        if err != nil && err.Error() != ultimoError {
+            ultimoError = err.Error()
+            fmt.Printf("No se pudo registrar el nodo: %v\n", err)
+        }
+
+        if registrado {
+            time.Sleep(30 * time.Second)
+        } else {
+            time.Sleep(2 * time.Second)
+        }
+    }
+}
+
+func descubrirIP() string {
+    var dirIP string = "127.0.0.1"
+    interfaces, _ := net.Interfaces()
+    for _, valInterface := range interfaces {
+        if strings.HasPrefix(valInterface.Name, "eth0") {
+            direcciones, _ := valInterface.Addrs()
+            for _, valDireccion := range direcciones {
+                switch d := valDireccion.(type) {
+                case *net.IPNet:
+                    if d.IP.To4() != nil {
+                        dirIP = d.IP.String()
+                    }
+                }
+            }
+        }
+    }
+    return dirIP
+}
+
+func servicioHP() {
+    localDir := fmt.Sprintf("%s:%d", hostIP, portHP)
+
+    ln, err := seguridad.Escuchar(localDir)
+    if err != nil {
+        fmt.Printf("Error al iniciar el servicio HP: %v\n", err)
+        return
+    }
+    defer ln.Close()
+
+    fmt.Printf("Servicio HP escuchando en %s\n", localDir)
+    for {
+        con, err := ln.Accept()
+        if err != nil {
+            fmt.Printf("Error aceptando conexión: %v\n", err)
+            continue
+        }
+        go handlerHP(con)
+    }
+}
+
+func handlerHP(con net.Conn) {
+    defer func() {
+        fmt.Println("Conexión cerrada con el cliente.")
+        con.Close()
+    }()
+
+    // Solo el coordinador puede enviar shards y jobs
+    autenticada, err := seguridad.AutenticarEntrante(con)
+    if err != nil {
+        fmt.Printf("Conexión rechazada de %s: %v\n", con.RemoteAddr(), err)
+        return
+    }
+    con = autenticada
+
+    reader := bufio.NewReader(con)
+    cabecera, err := reader.ReadString('\n')
+    if err != nil {
+        fmt.Println("Error leyendo la cabecera:", err)
+        return
+    }
+    campos := strings.Fields(cabecera)
+    if len(campos) < 2 {
+        fmt.Printf("Cabecera no válida: %q\n", cabecera)
+        fmt.Fprintln(con, "ERROR cabecera no válida")
+        return
+    }
+
+    switch campos[0] {
+    case "SHARD":
+        if len(campos) < 3 {
+            fmt.Fprintln(con, "ERROR se esperaba SHARD <version> <shard>")
+            return
+        }
+        indice, err := strconv.Atoi(campos[2])
+        if err != nil {
+            fmt.Fprintln(con, "ERROR índice de shard no válido")
+            return
+        }
+        // La cantidad anunciada permite reservar memoria y validar el final
+        total := -1
+        if len(campos) >= 4 {
+            if total, err = strconv.Atoi(campos[3]); err != nil {
+                total = -1
+            }
+        }
+        // Atributos opcionales clave=valor: compresión y formato del cuerpo
+        atributos := make(map[string]string)
+        for _, campo := range campos[3:] {
+            if clave, valor, ok := strings.Cut(campo, "="); ok {
+                atributos[clave] = valor
+            }
+        }
+        recibirShard(con, reader, campos[1], indice, total, atributos)
+    case "JOB":
+        if len(campos) < 4 {
+            fmt.Fprintln(con, "ERROR se esperaba JOB <version> <job> <shard>")
+            return
+        }
+        indice, err := strconv.Atoi(campos[3])
+        if err != nil {
+            fmt.Fprintln(con, "ERROR índice de shard no válido")
+            return
+        }
+        recibirJob(con, reader, campos[1], campos[2], indice)
+    case "FEDERADO":
+        if len(campos) < 3 {
+            fmt.Fprintln(con, "ERROR se esperaba FEDERADO <job> <ronda>")
+            return
+        }
+        recibirRondaFederada(con, reader, campos[1], campos[2])
+    case "VECINOS":
+        if len(campos) < 4 {
+            fmt.Fprintln(con, "ERROR se esperaba VECINOS <version> <job> <shard>")
+            return
+        }
+        indice, err := strconv.Atoi(campos[3])
+        if err != nil {
+            fmt.Fprintln(con, "ERROR índice de shard no válido")
+            return
+        }
+        recibirVecinos(con, reader, campos[1], campos[2], indice)
+    default:
+        fmt.Printf("Comando desconocido: %s\n", campos[0])
+        fmt.Fprintf(con, "ERROR comando desconocido %s\n", campos[0])
+    }
+}
+
+// parsearRating interpreta una línea "userID,movieID,rating".
+func parsearRating(line string) (Rating, bool) {
+    fields := strings.Split(line, ",")
+    if len(fields) != 3 {
+        return Rating{}, false
+    }
+    rating, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+    if err != nil {
+        return Rating{}, false
+    }
+    return Rating{
+        UserID:  strings.TrimSpace(fields[0]),
+        MovieID: strings.TrimSpace(fields[1]),
+        Rating:  rating,
+    }, true
+}
+
+// codecsSoportados son las codificaciones de shard que este nodo sabe leer;
+// se anuncian al coordinador al registrarse.
+var codecsSoportados = []string{"gzip", "flate", "delta"}
+
+func recibirShard(con net.Conn, reader *bufio.Reader, version string, indice int, total int, atributos map[string]string) {
+    fmt.Printf("Recibiendo shard %d (%s, %d ratings, %s+%s)...\n", indice, version, total, atributos["enc"], atributos["formato"])
+    shard := &Shard{
+        Version: version,
+        Indice:  indice,
+        Data:    make([]Rating, 0, max(total, 0)),
+    }
+
+    // Descomprimir el cuerpo si el coordinador lo comprimió
+    var cuerpo io.Reader = reader
+    switch atributos["enc"] {
+    case "", "ninguna":
+    case "gzip":
+        gz, err := gzip.NewReader(reader)
+        if err != nil {
+            fmt.Fprintf(con, "ERROR gzip: %v\n", err)
+            return
+        }
+        // Sin multistream el lector no espera otro miembro gzip en la conexión
+        gz.Multistream(false)
+        defer gz.Close()
+        cuerpo = gz
+    case "flate":
+        fl := flate.NewReader(reader)
+        defer fl.Close()
+        cuerpo = fl
+    default:
+        fmt.Fprintf(con, "ERROR compresión no soportada %s\n", atributos["enc"])
+        return
+    }
+    lector := bufio.NewReader(cuerpo)
+
+    if atributos["formato"] == "delta" {
+        ratings, err := leerShardDelta(lector)
+        if err != nil {
+            fmt.Printf("Error decodificando el shard %d: %v\n", indice, err)
+            fmt.Fprintln(con, "ERROR shard mal codificado")
+            return
+        }
+        shard.Data = append(shard.Data, ratings...)
+    }
+
+    scanner := bufio.NewScanner(lector)
+    completo := false
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        if strings.HasPrefix(line, "FIN_SHARD") {
+            // El marcador final repite la cantidad de ratings enviados
+            esperados, err := strconv.Atoi(strings.TrimSpace(line[len("FIN_SHARD"):]))
+            completo = err != nil || esperados == len(shard.Data)
+            if !completo {
+                fmt.Printf("Shard %d: se esperaban %d ratings y llegaron %d\n", indice, esperados, len(shard.Data))
+            }
+            break
+        }
+        if rating, ok := parsearRating(line); ok {
+            shard.Data = append(shard.Data, rating)
+        } else {
+            fmt.Println("Error procesando línea:", line)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        fmt.Println("Error leyendo datos:", err)
+    }
+    if !completo {
+        fmt.Printf("Shard %s incompleto, se descarta\n", version)
+        fmt.Fprintln(con, "ERROR shard incompleto")
+        return
+    }
+
+    // Los shards del mismo esquema con otra versión del dataset quedan
+    // obsoletos; los de otros esquemas se conservan
+    esquema := esquemaDeVersion(version)
+    muShard.Lock()
+    obsoletos := []*Shard{}
+    for clave, anterior := range shards {
+        if esquemaDeVersion(anterior.Version) == esquema && anterior.Version != version {
+            obsoletos = append(obsoletos, anterior)
+            delete(shards, clave)
+        }
+    }
+    shards[claveShard(version, indice)] = shard
+    muShard.Unlock()
+    fmt.Printf("Shard %d (%s) almacenado (%d ratings)\n", indice, version, len(shard.Data))
+
+    if shardDir != "" {
+        for _, anterior := range obsoletos {
+            if anterior.Indice != indice {
+                os.Remove(rutaShardLocal(anterior.Version, anterior.Indice))
+            }
+        }
+        if err := guardarShardLocal(shard); err != nil {
+            fmt.Printf("Error guardando el shard en %s: %v\n", shardDir, err)
+        }
+    }
+    fmt.Fprintf(con, "OK %s %d\n", version, indice)
+}
+
+func recibirJob(con net.Conn, reader *bufio.Reader, version string, jobID string, indice int) {
+    muShard.RLock()
+    shard := shards[claveShard(version, indice)]
+    muShard.RUnlock()
+    if shard == nil || shard.Version != version {
+        actual := "ninguna"
+        if shard != nil {
+            actual = shard.Version
+        }
+        fmt.Printf("Job para el shard %d (%s) pero tengo %s\n", indice, version, actual)
+        fmt.Fprintf(con, "SIN_SHARD %s\n", actual)
+        return
+    }
+
+    scanner := bufio.NewScanner(reader)
+    targetRatings := make([]Rating, 0)
+    params := make(map[string]string)
+    targetUserID := ""
+    referencias := make([]Rating, 0)
+    medias := make(map[string]float64)
+    mediasColumnas := make(map[string]float64)
+
+    fmt.Println("Recibiendo job del cliente...")
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        if line == "FIN_JOB" {
+            break
+        }
+
+        if strings.HasPrefix(line, "UserID:") {
+            targetUserID = strings.TrimSpace(line[len("UserID:"):])
+        } else if strings.HasPrefix(line, "PARAM ") {
+            clave, valor, _ := strings.Cut(strings.TrimSpace(line[len("PARAM "):]), "=")
+            params[clave] = valor
+        } else if strings.HasPrefix(line, "REF ") {
+            if rating, ok := parsearRating(line[len("REF "):]); ok {
+                referencias = append(referencias, rating)
+            }
+        } else if strings.HasPrefix(line, "MEDIA ") {
+            userID, valor, _ := strings.Cut(line[len("MEDIA "):], ",")
+            if media, err := strconv.ParseFloat(valor, 64); err == nil {
+                medias[userID] = media
+            }
+        } else if strings.HasPrefix(line, "COLUMNA ") {
+            movieID, valor, _ := strings.Cut(line[len("COLUMNA "):], ",")
+            if media, err := strconv.ParseFloat(valor, 64); err == nil {
+                mediasColumnas[movieID] = media
+            }
+        } else if rating, ok := parsearRating(line); ok {
+            targetRatings = append(targetRatings, rating)
+        } else {
+            fmt.Println("Error procesando línea:", line)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        fmt.Println("Error leyendo datos:", err)
+        return
+    }
+    fmt.Fprintln(con, "OK")
+    con.Close()
+
+    clientData := ClientData{
+        JobID:          jobID,
+        ShardIdx:       indice,
+        TargetUserID:   targetUserID,
+        Data:           combinarObjetivo(shard.Data, targetUserID, targetRatings),
+        Referencias:    referencias,
+        Medias:         medias,
+        MediasColumnas: mediasColumnas,
+    }
+    fmt.Println("\nData recibida del cliente:")
+    fmt.Printf("Job %s, UserID objetivo: %s (shard %d, %s)\n", jobID, clientData.TargetUserID, indice, shard.Version)
+
+    procesarJob(clientData, params)
+}
+
+// combinarObjetivo suma al shard los ratings del objetivo que envió el
+// coordinador, que son solo los que el shard no tiene. Si alguno corrige un
+// rating del shard (un rating nuevo del usuario), reemplaza al del shard.
+func combinarObjetivo(shard []Rating, targetUserID string, targetRatings []Rating) []Rating {
+    corregidas := make(map[string]bool, len(targetRatings))
+    for _, rating := range targetRatings {
+        corregidas[rating.MovieID] = true
+    }
+    data := make([]Rating, 0, len(shard)+len(targetRatings))
+    for _, rating := range shard {
+        if rating.UserID != targetUserID || !corregidas[rating.MovieID] {
+            data = append(data, rating)
+        }
+    }
+    return append(data, targetRatings...)
+}
+
+func paramEntero(params map[string]string, clave string, porDefecto int) int {
+    if valor, err := strconv.Atoi(params[clave]); err == nil {
+        return valor
+    }
+    return porDefecto
+}
+
+func paramFloat(params map[string]string, clave string, porDefecto float64) float64 {
+    if valor, err := strconv.ParseFloat(params[clave], 64); err == nil {
+        return valor
+    }
+    return porDefecto
+}
+
+// OpcionesEntrenamiento son los parámetros del SGD que envía el coordinador.
+type OpcionesEntrenamiento struct {
+    Factores     int
+    LearningRate float64
+    Iteraciones  int
+    // Con privacidad se entrena con DP-SGD, siempre en un solo hilo
+    Privacidad *PrivacidadDP
+    // Goroutines del SGD; con más de una se usa el SGD paralelo
+    Hilos   int
+    Hogwild bool
+    // Fracción de ratings reservada para validación y criterio de parada:
+    // se detiene tras Paciencia iteraciones que mejoran menos que Tolerancia
+    // (relativa) la pérdida monitoreada
+    Validacion float64
+    Tolerancia float64
+    Paciencia  int
+    // Seguimiento calcula la pérdida en cada iteración; sin él no hay
+    // parada temprana
+    Seguimiento bool
+    // Optimizador ("sgd", "adagrad" o "adam") y programa del learning rate
+    // ("constante", "escalon" o "exponencial") con Calentamiento iteraciones
+    // iniciales de crecimiento lineal
+    Optimizador     string
+    Programa        string
+    Decaimiento     float64
+    PasoDecaimiento int
+    Calentamiento   int
+    // Norma máxima del gradiente de cada rating; 0 no lo recorta
+    ClipGradiente float64
+    // Semilla del job: fija los factores iniciales y el orden de los
+    // ratings, así que con un hilo y sin privacidad el entrenamiento se
+    // repite exactamente
+    Seed int64
+    // Objetivo "bpr" entrena con retroalimentación implícita; son positivas
+    // las interacciones con rating de al menos UmbralPositivo
+    Objetivo       string
+    UmbralPositivo float64
+    // Algoritmo "svdpp" agrega sesgos y factores implícitos; entrena en un
+    // solo hilo y sin DP-SGD
+    Algoritmo string
+}
+
+// registrarIteraciones controla si el SGD informa cada iteración.
+var registrarIteraciones = true
+
+func opcionesDeParams(params map[string]string) OpcionesEntrenamiento {
+    opciones := OpcionesEntrenamiento{
+        Factores:     paramEntero(params, "factores", 3),
+        LearningRate: paramFloat(params, "learningRate", 0.01),
+        Iteraciones:  paramEntero(params, "iteraciones", 10),
+        Privacidad:   privacidadDeParams(params),
+        Hilos:        paramEntero(params, "hilos", 1),
+        Hogwild:      params["hogwild"] == "1",
+        Validacion:   paramFloat(params, "validacion", 0),
+        Tolerancia:   paramFloat(params, "tolerancia", 1e-3),
+        Paciencia:    paramEntero(params, "paciencia", 2),
+        Seguimiento:  true,
+
+        Optimizador:     params["optimizador"],
+        Programa:        params["programa"],
+        Decaimiento:     paramFloat(params, "decaimiento", 0.5),
+        PasoDecaimiento: paramEntero(params, "pasoDecaimiento", 5),
+        Calentamiento:   paramEntero(params, "calentamiento", 0),
+        ClipGradiente:   paramFloat(params, "clipGradiente", 0),
+    }
+    opciones.Seed, _ = strconv.ParseInt(params["seed"], 10, 64)
+    if params["objetivo"] == objetivoBPR {
+        opciones.Objetivo = objetivoBPR
+        opciones.UmbralPositivo = paramFloat(params, "positivo", 0)
+    }
+    if params["algoritmo"] == algoritmoSVDpp {
+        opciones.Algoritmo = algoritmoSVDpp
+    }
+    if !optimizadores[opciones.Optimizador] {
+        opciones.Optimizador = "sgd"
+    }
+    if opciones.Validacion < 0 || opciones.Validacion >= 1 {
+        opciones.Validacion = 0
+    }
+    // Con DP-SGD la pérdida exacta de cada iteración no sale del nodo (el
+    // contador de privacidad no la cubre) ni decide cuándo parar: se
+    // entrena con todos los ratings las iteraciones pedidas
+    if opciones.Privacidad != nil {
+        opciones.Seguimiento = false
+        opciones.Validacion = 0
+    }
+    // 0 hilos significa usar todos los CPUs asignados al contenedor
+    if opciones.Hilos <= 0 {
+        opciones.Hilos = hilosDisponibles()
+    }
+    return opciones
+}
+
+func procesarJob(clientData ClientData, params map[string]string) {
+    switch params["algoritmo"] {
+    case algoritmoKNNItems:
+        recomendaciones := recomendarKNNItems(clientData, opcionesKNNDeParams(params))
+        enviarRecomendacionesAlServidor(clientData.JobID, clientData.ShardIdx, recomendaciones, nil)
+        return
+    case algoritmoKNNUsuarios:
+        enviarEstadisticasAlServidor(clientData.JobID, clientData.ShardIdx, estadisticasKNNUsuarios(clientData, opcionesKNNDeParams(params)))
+        return
+    }
+
+    userItemMatrix := createUserItemMatrix(clientData)
+
+    // Realizar la factorización de la matriz
+    fmt.Println("\nRealizando la factorización de la matriz con SGD...")
+    opciones := opcionesDeParams(params)
+    numFactors := opciones.Factores
+    userFactors, itemFactors, curva := matrixFactorizationWithSGD(userItemMatrix, opciones)
+
+    // En modo procrustes el coordinador alinea y combina los factores de
+    // todos los nodos en lugar de fusionar sus tops
+    if params["modo"] == "procrustes" {
+        enviarModeloAlServidor(clientData.JobID, clientData.ShardIdx, numFactors, userFactors[clientData.TargetUserID], itemFactors, curva)
+        return
+    }
+
+    recommendations := calculateRecommendations(clientData.TargetUserID, userItemMatrix, userFactors, itemFactors)
+
+    var sortedRecommendations []recommendationPair
+    for movieID, score := range recommendations {
+        sortedRecommendations = append(sortedRecommendations, recommendationPair{
+            MovieID: movieID,
+            Rating:  score,
+        })
+    }
+    sort.Slice(sortedRecommendations, func(i, j int) bool {
+        return compararRecomendaciones(sortedRecommendations[i], sortedRecommendations[j])
+    })
+    if len(sortedRecommendations) > 5 {
+        sortedRecommendations = sortedRecommendations[:5]
+    }
+    fmt.Println("\nPrimeras 5 recomendaciones ordenadas:")
+    for _, rec := range sortedRecommendations {
+        fmt.Printf("MovieID: %s, Predicted Rating: %.2f\n", rec.MovieID, rec.Rating)
+    }
+    enviarRecomendacionesAlServidor(clientData.JobID, clientData.ShardIdx, sortedRecommendations, curva)
+    fmt.Printf("\nCantidad total de recomendaciones generadas: %d\n", len(recommendations))
+}
+
+// leerShardDelta decodifica un shard en el formato del paquete delta.
+func leerShardDelta(lector *bufio.Reader) ([]Rating, error) {
+    registros, err := delta.Leer(lector)
+    if err != nil {
+        return nil, err
+    }
+    ratings := make([]Rating, len(registros))
+    userID := ""
+    for i, registro := range registros {
+        // Los registros llegan agrupados por usuario
+        if i == 0 || registro.Usuario != registros[i-1].Usuario {
+            userID = strconv.FormatUint(registro.Usuario, 10)
+        }
+        ratings[i] = Rating{
+            UserID:  userID,
+            MovieID: strconv.FormatUint(registro.Pelicula, 10),
+            Rating:  registro.Rating,
+        }
+    }
+    return ratings, nil
+}
+
+func rutaShardLocal(version string, indice int) string {
+    return filepath.Join(shardDir, fmt.Sprintf("shard-%s-%d.csv", esquemaDeVersion(version), indice))
+}
+
+// guardarShardLocal escribe el shard en un archivo temporal y lo renombra
+// para no dejar un shard a medio escribir si el contenedor se detiene.
+func guardarShardLocal(shard *Shard) error {
+    if err := os.MkdirAll(shardDir, 0755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(shardDir, "shard-*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    writer := bufio.NewWriter(tmp)
+    fmt.Fprintf(writer, "VERSION %s\n", shard.Version)
+    for _, rating := range shard.Data {
+        fmt.Fprintf(writer, "%s,%s,%.2f\n", rating.UserID, rating.MovieID, rating.Rating)
+    }
+    if err := writer.Flush(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), rutaShardLocal(shard.Version, shard.Indice))
+}
+
+func cargarShardLocal(archivo string) (*Shard, error) {
+    nombre := strings.TrimSuffix(filepath.Base(archivo), ".csv")
+    indice, err := strconv.Atoi(nombre[strings.LastIndex(nombre, "-")+1:])
+    if err != nil {
+        return nil, err
+    }
+    file, err := os.Open(archivo)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "VERSION ") {
+        return nil, fmt.Errorf("cabecera de versión ausente")
+    }
+    shard := &Shard{
+        Version: strings.TrimSpace(scanner.Text()[len("VERSION "):]),
+        Indice:  indice,
+        Data:    make([]Rating, 0),
+    }
+    for scanner.Scan() {
+        if rating, ok := parsearRating(scanner.Text()); ok {
+            shard.Data = append(shard.Data, rating)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    return shard, nil
+}
+
+func enviarRecomendacionesAlServidor(jobID string, shardIdx int, recommendations []recommendationPair, curva *CurvaPerdida) {
+    serverAddr := fmt.Sprintf("%s:%d", addrs[0], portHP)
+    conn, err := seguridad.Conectar(serverAddr)
+    if err != nil {
+        fmt.Printf("Error conectando con el servidor: %v\n", err)
+        return
+    }
+    defer conn.Close()
+
+    fmt.Println("Enviando las recomendaciones al servidor...")
+    writer := bufio.NewWriter(conn)
+    fmt.Fprintf(writer, "RESULTADO %s %d\n", jobID, shardIdx)
+    escribirCurva(writer, curva)
+    for _, rec := range recommendations {
+        fmt.Fprintf(writer, "%s,%.2f\n", rec.MovieID, rec.Rating)
+    }
+    fmt.Fprintln(writer, "FIN_TOP5")
+    if err := writer.Flush(); err != nil {
+        fmt.Printf("Error enviando las recomendaciones: %v\n", err)
+        return
+    }
+    fmt.Println("Recomendaciones enviadas al servidor.")
+}
+
+// enviarModeloAlServidor envía los factores del usuario objetivo y de cada
+// película: "MODELO <job> <shard> <factores>", la curva de pérdida,
+// "USUARIO f1,f2,...", una línea "movieID,f1,f2,..." por película y
+// "FIN_MODELO".
+func enviarModeloAlServidor(jobID string, shardIdx int, numFactors int, userFactors []float64, itemFactors map[string][]float64, curva *CurvaPerdida) {
+    serverAddr := net.JoinHostPort(addrs[0], strconv.Itoa(portHP))
+    conn, err := seguridad.Conectar(serverAddr)
+    if err != nil {
+        fmt.Printf("Error conectando con el servidor: %v\n", err)
+        return
+    }
+    defer conn.Close()
+
+    writer := bufio.NewWriter(conn)
+    fmt.Fprintf(writer, "MODELO %s %d %d\n", jobID, shardIdx, numFactors)
+    escribirCurva(writer, curva)
+    fmt.Fprintf(writer, "USUARIO %s\n", formatearFactores(userFactors))
+    for movieID, factores := range itemFactors {
+        fmt.Fprintf(writer, "%s,%s\n", movieID, formatearFactores(factores))
+    }
+    fmt.Fprintln(writer, "FIN_MODELO")
+    if err := writer.Flush(); err != nil {
+        fmt.Printf("Error enviando el modelo: %v\n", err)
+        return
+    }
+    fmt.Printf("Modelo del job %s enviado al servidor: %d películas\n", jobID, len(itemFactors))
+}
+
+func formatearFactores(factores []float64) string {
+    partes := make([]string, len(factores))
+    for i, valor := range factores {
+        partes[i] = strconv.FormatFloat(valor, 'g', 8, 64)
+    }
+    return strings.Join(partes, ",")
+}
+
+func createUserItemMatrix(clientData ClientData) map[string]map[string]float64 {
+    matrix := make(map[string]map[string]float64)
+    for _, rating := range clientData.Data {
+        if _, exists := matrix[rating.UserID]; !exists {
+            matrix[rating.UserID] = make(map[string]float64)
+        }
+        matrix[rating.UserID][rating.MovieID] = rating.Rating
+    }
+    return matrix
+}
+
+func matrixFactorizationWithSGD(matrix map[string]map[string]float64, opciones OpcionesEntrenamiento) (map[string][]float64, map[string][]float64, *CurvaPerdida) {
+    if opciones.Algoritmo == algoritmoSVDpp {
+        return entrenarSVDpp(matrix, opciones)
+    }
+    userFactors, itemFactors := inicializarFactores(matrix, opciones.Factores, opciones.Seed)
+    curva := entrenarDesde(matrix, userFactors, itemFactors, opciones)
+    return userFactors, itemFactors, curva
+}
+
+// inicializarFactores genera factores aleatorios que dependen solo de la
+// semilla y del ID, no del orden de iteración de los mapas.
+func inicializarFactores(matrix map[string]map[string]float64, numFactors int, seed int64) (map[string][]float64, map[string][]float64) {
+    userFactors := make(map[string][]float64)
+    itemFactors := make(map[string][]float64)
+
+    for userID, movies := range matrix {
+        userFactors[userID] = factorInicial(seed, "u:"+userID, numFactors)
+        for movieID := range movies {
+            if _, existe := itemFactors[movieID]; !existe {
+                itemFactors[movieID] = factorInicial(seed, "m:"+movieID, numFactors)
+            }
+        }
+    }
+
+    return userFactors, itemFactors
+}
+
+// compararRecomendaciones ordena por predicción descendente y, a igual
+// predicción, por ID para que el orden no dependa de los mapas.
+func compararRecomendaciones(a, b recommendationPair) bool {
+    if a.Rating != b.Rating {
+        return a.Rating > b.Rating
+    }
+    return a.MovieID < b.MovieID
+}
+
+// ejemplosOrdenados lista los ratings ordenados por usuario y película.
+func ejemplosOrdenados(matrix map[string]map[string]float64) []ejemploRating {
+    usuarios := make([]string, 0, len(matrix))
+    for userID := range matrix {
+        usuarios = append(usuarios, userID)
+    }
+    sort.Strings(usuarios)
+    ejemplos := []ejemploRating{}
+    for _, userID := range usuarios {
+        peliculas := make([]string, 0, len(matrix[userID]))
+        for movieID := range matrix[userID] {
+            peliculas = append(peliculas, movieID)
+        }
+        sort.Strings(peliculas)
+        for _, movieID := range peliculas {
+            ejemplos = append(ejemplos, ejemploRating{userID, movieID, matrix[userID][movieID]})
+        }
+    }
+    return ejemplos
+}
+
+// PuntoPerdida es la raíz del error cuadrático medio (o la pérdida BPR) tras
+// una iteración, sobre los ratings de entrenamiento y los reservados para
+// validación.
+type PuntoPerdida struct {
+    Iteracion     int
+    Entrenamiento float64
+    Validacion    float64
+}
+
+// CurvaPerdida es la evolución del entrenamiento y por qué se detuvo:
+// "iteraciones", "convergencia" o "divergencia". Tras divergir, Restaurada
+// es la iteración cuyos factores se conservaron (0 son los iniciales).
+type CurvaPerdida struct {
+    Puntos     []PuntoPerdida
+    Motivo     string
+    Restaurada int
+}
+
+// umbralDivergencia es cuántas veces puede superar la pérdida a la mejor
+// observada antes de considerar que el SGD divergió.
+const umbralDivergencia = 1.5
+
+// escribirCurva envía la curva como líneas "PERDIDA <iter> <entr> <valid>"
+// seguidas de "PARADA <motivo>", o "PARADA divergencia <restaurada>".
+func escribirCurva(w io.Writer, curva *CurvaPerdida) {
+    if curva == nil {
+        return
+    }
+    for _, punto := range curva.Puntos {
+        fmt.Fprintf(w, "PERDIDA %d %g %g\n", punto.Iteracion, punto.Entrenamiento, punto.Validacion)
+    }
+    if curva.Motivo == "divergencia" {
+        fmt.Fprintf(w, "PARADA %s %d\n", curva.Motivo, curva.Restaurada)
+        return
+    }
+    fmt.Fprintf(w, "PARADA %s\n", curva.Motivo)
+}
+
+// escribirConteos envía, por película, la cantidad y la suma de los ratings
+// locales como líneas "CONTEO <movieId>,<n>,<suma>", con las que el
+// coordinador calcula la media y los sesgos del modelo global.
+func escribirConteos(w io.Writer, matrix map[string]map[string]float64) {
+    conteos := make(map[string]int)
+    sumas := make(map[string]float64)
+    for _, movies := range matrix {
+        for movieID, rating := range movies {
+            conteos[movieID]++
+            sumas[movieID] += rating
+        }
+    }
+    for movieID, n := range conteos {
+        fmt.Fprintf(w, "CONTEO %s,%d,%g\n", movieID, n, sumas[movieID])
+    }
+}
+
+// separarValidacion reserva aproximadamente la fracción indicada de ratings
+// para validación. La elección depende solo del par usuario/película, y
+// nunca se reserva un rating de usuarios con menos de tres.
+func separarValidacion(matrix map[string]map[string]float64, fraccion float64) (map[string]map[string]float64, []ejemploRating) {
+    if fraccion <= 0 {
+        return matrix, nil
+    }
+    entrenamiento := make(map[string]map[string]float64, len(matrix))
+    validacion := []ejemploRating{}
+    for _, ejemplo := range ejemplosOrdenados(matrix) {
+        movies := matrix[ejemplo.usuario]
+        if entrenamiento[ejemplo.usuario] == nil {
+            entrenamiento[ejemplo.usuario] = make(map[string]float64, len(movies))
+        }
+        h := fnv.New32a()
+        fmt.Fprintf(h, "%s|%s", ejemplo.usuario, ejemplo.pelicula)
+        if len(movies) >= 3 && float64(h.Sum32()%10000) < fraccion*10000 {
+            validacion = append(validacion, ejemplo)
+            continue
+        }
+        entrenamiento[ejemplo.usuario][ejemplo.pelicula] = ejemplo.rating
+    }
+    return entrenamiento, validacion
+}
+
+// conjuntosDeEntrenamiento separa los ratings de validación si se sigue la
+// pérdida; sin seguimiento se entrena con todos.
+func conjuntosDeEntrenamiento(matrix map[string]map[string]float64, opciones OpcionesEntrenamiento) (map[string]map[string]float64, []ejemploRating) {
+    if !opciones.Seguimiento {
+        return matrix, nil
+    }
+    return separarValidacion(matrix, opciones.Validacion)
+}
+
+func rmseEjemplos(ejemplos []ejemploRating, userFactors, itemFactors map[string][]float64) float64 {
+    if len(ejemplos) == 0 {
+        return 0
+    }
+    suma := 0.0
+    for _, ejemplo := range ejemplos {
+        d := ejemplo.rating - predictRating(userFactors[ejemplo.usuario], itemFactors[ejemplo.pelicula])
+        suma += d * d
+    }
+    return math.Sqrt(suma / float64(len(ejemplos)))
+}
+
+// Optimizadores y programas de learning rate. El SGD original usa el mismo
+// learningRate para todos los parámetros e iteraciones; AdaGrad y Adam lo
+// adaptan por parámetro según la historia de sus gradientes, y el programa
+// lo varía entre iteraciones.
+
+var optimizadores = map[string]bool{"sgd": true, "adagrad": true, "adam": true}
+
+const (
+    beta1Adam   = 0.9
+    beta2Adam   = 0.999
+    epsilonAdam = 1e-8
+)
+
+// estadoFila es el estado del optimizador para un vector de factores: la
+// suma de gradientes al cuadrado en AdaGrad, o los momentos y la cantidad de
+// pasos en Adam, que cuenta los de la fila porque los gradientes son dispersos.
+type estadoFila struct {
+    m []float64
+    v []float64
+    t int
+}
+
+func nuevoEstadoFila(optimizador string, numFactors int) *estadoFila {
+    switch optimizador {
+    case "adagrad":
+        return &estadoFila{v: make([]float64, numFactors)}
+    case "adam":
+        return &estadoFila{m: make([]float64, numFactors), v: make([]float64, numFactors)}
+    }
+    return nil
+}
+
+// estadosFilas crea el estado del optimizador de cada vector de factores, o
+// nil con SGD.
+func estadosFilas(optimizador string, factores map[string][]float64, numFactors int) map[string]*estadoFila {
+    if nuevoEstadoFila(optimizador, numFactors) == nil {
+        return nil
+    }
+    estados := make(map[string]*estadoFila, len(factores))
+    for id := range factores {
+        estados[id] = nuevoEstadoFila(optimizador, numFactors)
+    }
+    return estados
+}
+
+// aplicarGradiente avanza x en la dirección del gradiente, que como en el
+// SGD original es la de mejora (error * factor), con el paso del
+// optimizador. Sin estado es SGD.
+func aplicarGradiente(x, grad []float64, estado *estadoFila, tasa float64) {
+    switch {
+    case estado == nil:
+        for k := range x {
+            x[k] += tasa * grad[k]
+        }
+    case estado.m == nil:
+        for k := range x {
+            estado.v[k] += grad[k] * grad[k]
+            x[k] += tasa * grad[k] / (math.Sqrt(estado.v[k]) + epsilonAdam)
+        }
+    default:
+        estado.t++
+        correccion1 := 1 - math.Pow(beta1Adam, float64(estado.t))
+        correccion2 := 1 - math.Pow(beta2Adam, float64(estado.t))
+        for k := range x {
+            estado.m[k] = beta1Adam*estado.m[k] + (1-beta1Adam)*grad[k]
+            estado.v[k] = beta2Adam*estado.v[k] + (1-beta2Adam)*grad[k]*grad[k]
+            x[k] += tasa * (estado.m[k] / correccion1) / (math.Sqrt(estado.v[k]/correccion2) + epsilonAdam)
+        }
+    }
+}
+
+// gradienteEjemplo calcula en gradU y gradV el gradiente de un rating para
+// los factores del usuario y de la película, recortado a norma conjunta
+// recorte si es positivo.
+func gradienteEjemplo(rating float64, u, v, gradU, gradV []float64, recorte float64) {
+    error := rating - predictRating(u, v)
+    for k := range u {
+        gradU[k] = error * v[k]
+        gradV[k] = error * u[k]
+    }
+    recortarNorma(recorte, gradU, gradV)
+}
+
+// recortarNorma escala los vectores para que su norma conjunta no supere
+// recorte, si es positivo.
+func recortarNorma(recorte float64, vectores ...[]float64) {
+    if recorte <= 0 {
+        return
+    }
+    norma := 0.0
+    for _, vector := range vectores {
+        for _, valor := range vector {
+            norma += valor * valor
+        }
+    }
+    if norma = math.Sqrt(norma); norma > recorte {
+        escala := recorte / norma
+        for _, vector := range vectores {
+            for k := range vector {
+                vector[k] *= escala
+            }
+        }
+    }
+}
+
+// tasaAprendizaje es el learning rate de la iteración iter (desde 0): crece
+// linealmente durante las de calentamiento y después decae según el
+// programa, "escalon" (por Decaimiento cada PasoDecaimiento iteraciones) o
+// "exponencial" (por Decaimiento en cada una).
+func tasaAprendizaje(opciones OpcionesEntrenamiento, iter int) float64 {
+    if iter < opciones.Calentamiento {
+        return opciones.LearningRate * float64(iter+1) / float64(opciones.Calentamiento+1)
+    }
+    transcurridas := iter - opciones.Calentamiento
+    switch opciones.Programa {
+    case "escalon":
+        if opciones.PasoDecaimiento > 0 {
+            return opciones.LearningRate * math.Pow(opciones.Decaimiento, float64(transcurridas/opciones.PasoDecaimiento))
+        }
+    case "exponencial":
+        return opciones.LearningRate * math.Pow(opciones.Decaimiento, float64(transcurridas))
+    }
+    return opciones.LearningRate
+}
+
+// copiarFactores copia los vectores de origen en destino, creando los que
+// falten.
+func copiarFactores(destino, origen map[string][]float64) {
+    for id, vector := range origen {
+        if copia, existe := destino[id]; existe {
+            copy(copia, vector)
+        } else {
+            destino[id] = append([]float64(nil), vector...)
+        }
+    }
+}
+
+// pasoSecuencial prepara una iteración del SGD sobre los mapas; la iteración
+// recibe el learning rate que le corresponde y recorre los ratings barajados
+// con la semilla del job.
+func pasoSecuencial(matrix map[string]map[string]float64, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) func(float64) {
+    estadosU := estadosFilas(opciones.Optimizador, userFactors, opciones.Factores)
+    estadosI := estadosFilas(opciones.Optimizador, itemFactors, opciones.Factores)
+    gradU := make([]float64, opciones.Factores)
+    gradV := make([]float64, opciones.Factores)
+    ejemplos := ejemplosOrdenados(matrix)
+    generador := rand.New(rand.NewSource(opciones.Seed))
+    return func(learningRate float64) {
+        generador.Shuffle(len(ejemplos), func(i, j int) { ejemplos[i], ejemplos[j] = ejemplos[j], ejemplos[i] })
+        for _, ejemplo := range ejemplos {
+            u, v := userFactors[ejemplo.usuario], itemFactors[ejemplo.pelicula]
+            gradienteEjemplo(ejemplo.rating, u, v, gradU, gradV, opciones.ClipGradiente)
+            aplicarGradiente(u, gradU, estadosU[ejemplo.usuario], learningRate)
+            aplicarGradiente(v, gradV, estadosI[ejemplo.pelicula], learningRate)
+        }
+    }
+}
+
+// entrenarDesde ejecuta las iteraciones de SGD a partir de los factores dados,
+// que se actualizan en el lugar. Con privacidad se usa DP-SGD y con varios
+// hilos el SGD paralelo; con objetivo BPR se ordenan pares en lugar de
+// aproximar ratings, y SVD++ usa su propio paso con sesgos e implícitos.
+// Tras cada iteración mide la pérdida y se detiene antes si deja de mejorar
+// o diverge; la pérdida monitoreada es la de validación si hay ratings
+// reservados. Si diverge, los factores vuelven a los de la última iteración
+// sana.
+func entrenarDesde(matrix map[string]map[string]float64, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) *CurvaPerdida {
+    entrenamiento, validacion := conjuntosDeEntrenamiento(matrix, opciones)
+
+    var paso func(float64)
+    switch {
+    case opciones.Algoritmo == algoritmoSVDpp:
+        paso = pasoSVDpp(entrenamiento, userFactors, itemFactors, opciones)
+    case opciones.Objetivo == objetivoBPR:
+        paso = pasoBPR(entrenamiento, matrix, userFactors, itemFactors, opciones)
+    case opciones.Privacidad != nil:
+        paso = pasoPrivado(entrenamiento, userFactors, itemFactors, opciones)
+    case opciones.Hilos > 1:
+        paso = pasoParalelo(entrenamiento, userFactors, itemFactors, opciones)
+    default:
+        paso = pasoSecuencial(entrenamiento, userFactors, itemFactors, opciones)
+    }
+
+    // La pérdida se suma en orden fijo para que se repita exactamente
+    var perdidaEntrenamiento, perdidaValidacion func() float64
+    hayValidacion := len(validacion) > 0
+    nombrePerdida := "RMSE"
+    var sanosU, sanosI map[string][]float64
+    if opciones.Seguimiento {
+        if opciones.Algoritmo == algoritmoSVDpp {
+            perdidaEntrenamiento, perdidaValidacion = perdidasSVDpp(entrenamiento, validacion, userFactors, itemFactors, opciones)
+        } else if opciones.Objetivo == objetivoBPR {
+            nombrePerdida = "pérdida BPR"
+            perdidaEntrenamiento, perdidaValidacion, hayValidacion = perdidasBPR(matrix, entrenamiento, validacion, userFactors, itemFactors, opciones)
+        } else {
+            ejemplosEntrenamiento := ejemplosOrdenados(entrenamiento)
+            perdidaEntrenamiento = func() float64 { return rmseEjemplos(ejemplosEntrenamiento, userFactors, itemFactors) }
+            perdidaValidacion = func() float64 { return rmseEjemplos(validacion, userFactors, itemFactors) }
+        }
+        sanosU, sanosI = make(map[string][]float64, len(userFactors)), make(map[string][]float64, len(itemFactors))
+        copiarFactores(sanosU, userFactors)
+        copiarFactores(sanosI, itemFactors)
+    }
+
+    curva := &CurvaPerdida{Motivo: "iteraciones"}
+    mejor := math.Inf(1)
+    sinMejora := 0
+    for iter := 0; iter < opciones.Iteraciones; iter++ {
+        paso(tasaAprendizaje(opciones, iter))
+        if !opciones.Seguimiento {
+            continue
+        }
+
+        punto := PuntoPerdida{
+            Iteracion:     iter + 1,
+            Entrenamiento: perdidaEntrenamiento(),
+            Validacion:    perdidaValidacion(),
+        }
+        curva.Puntos = append(curva.Puntos, punto)
+        if registrarIteraciones {
+            fmt.Printf("Iteración %d: %s entrenamiento %.4f, validación %.4f\n", punto.Iteracion, nombrePerdida, punto.Entrenamiento, punto.Validacion)
+        }
+
+        monitoreada := punto.Entrenamiento
+        if hayValidacion {
+            monitoreada = punto.Validacion
+        }
+        if math.IsNaN(monitoreada) || math.IsInf(monitoreada, 0) || monitoreada > umbralDivergencia*mejor {
+            curva.Motivo = "divergencia"
+            curva.Restaurada = iter
+            copiarFactores(userFactors, sanosU)
+            copiarFactores(itemFactors, sanosI)
+            fmt.Printf("El SGD divergió en la iteración %d (%s %g, mejor %.4f); se restauran los factores de la iteración %d\n",
+                punto.Iteracion, nombrePerdida, monitoreada, mejor, curva.Restaurada)
+            break
+        }
+        copiarFactores(sanosU, userFactors)
+        copiarFactores(sanosI, itemFactors)
+        if mejor-monitoreada < opciones.Tolerancia*mejor {
+            sinMejora++
+        } else {
+            sinMejora = 0
+        }
+        mejor = math.Min(mejor, monitoreada)
+        if opciones.Paciencia > 0 && sinMejora >= opciones.Paciencia {
+            curva.Motivo = "convergencia"
+            fmt.Printf("El SGD convergió en la iteración %d (%s %.4f)\n", punto.Iteracion, nombrePerdida, mejor)
+            break
+        }
+    }
+    return curva
+}
+
+func predictRating(userFactors, itemFactors []float64) float64 {
+    var predictedRating float64
+    for i := 0; i < len(userFactors); i++ {
+        predictedRating += userFactors[i] * itemFactors[i]
+    }
+    return predictedRating
+}
+
+func calculateRecommendations(targetUserID string, userItemMatrix map[string]map[string]float64, userFactors map[string][]float64, itemFactors map[string][]float64) map[string]float64 {
+    recommendations := make(map[string]float64)
+
+    // Generar recomendaciones para el usuario objetivo
+    for movieID := range itemFactors {
+        if _, rated := userItemMatrix[targetUserID][movieID]; !rated {
+            predictedRating := predictRating(userFactors[targetUserID], itemFactors[movieID])
+            recommendations[movieID] = predictedRating
+        }
+    }
+
+    return recommendations
+}
+
+// Aprendizaje federado. Con DATOS_LOCALES el nodo carga sus propios ratings,
+// que nunca salen de él: en cada ronda recibe los factores globales de las
+// películas, entrena localmente y devuelve solo los factores actualizados de
+// sus películas. Los factores de los usuarios quedan en el nodo entre rondas.
+
+var (
+    datosLocales []Rating
+    matrizLocal  map[string]map[string]float64
+
+    sesionesFederadas = make(map[string]*sesionFederada)
+    muSesiones        sync.Mutex
+)
+
+// sesionFederada guarda los factores de los usuarios locales de un job.
+type sesionFederada struct {
+    usuarios  map[string][]float64
+    ultimoUso time.Time
+    mu        sync.Mutex
+}
+
+// vencimientoSesion es cuánto se conserva una sesión sin rondas nuevas.
+const vencimientoSesion = time.Hour
+
+// cargarDatosLocales lee un CSV con el formato del dataset del coordinador
+// (MovieID,UserID,Rating); las columnas se ubican por el encabezado si existe.
+func cargarDatosLocales(archivo string) ([]Rating, error) {
+    file, err := os.Open(archivo)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    columnaPelicula, columnaUsuario, columnaRating := 0, 1, 2
+    ratings := []Rating{}
+    descartadas := 0
+    scanner := bufio.NewScanner(file)
+    for primera := true; scanner.Scan(); primera = false {
+        campos := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+        if primera {
+            encabezado := false
+            for i, campo := range campos {
+                switch strings.ToLower(strings.TrimSpace(campo)) {
+                case "movieid":
+                    columnaPelicula, encabezado = i, true
+                case "userid":
+                    columnaUsuario, encabezado = i, true
+                case "rating":
+                    columnaRating, encabezado = i, true
+                }
+            }
+            if encabezado {
+                continue
+            }
+        }
+        if len(campos) <= columnaPelicula || len(campos) <= columnaUsuario || len(campos) <= columnaRating {
+            descartadas++
+            continue
+        }
+        valor, err := strconv.ParseFloat(strings.TrimSpace(campos[columnaRating]), 64)
+        if err != nil || valor < 1 || valor > 5 {
+            descartadas++
+            continue
+        }
+        ratings = append(ratings, Rating{
+            UserID:  strings.TrimSpace(campos[columnaUsuario]),
+            MovieID: strings.TrimSpace(campos[columnaPelicula]),
+            Rating:  valor,
+        })
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if descartadas > 0 {
+        fmt.Printf("%d filas de %s descartadas por estar malformadas\n", descartadas, archivo)
+    }
+    return ratings, nil
+}
+
+// factorInicial genera factores pseudoaleatorios que dependen solo de la
+// semilla del job y del ID, para que todos los nodos partan del mismo punto
+// para las películas que el coordinador aún no conoce.
+func factorInicial(seed int64, id string, numFactors int) []float64 {
+    h := fnv.New64a()
+    fmt.Fprintf(h, "%d:%s", seed, id)
+    generador := rand.New(rand.NewSource(int64(h.Sum64())))
+    factores := make([]float64, numFactors)
+    for i := range factores {
+        factores[i] = generador.Float64()
+    }
+    return factores
+}
+
+func sesionDeJob(jobID string) *sesionFederada {
+    muSesiones.Lock()
+    defer muSesiones.Unlock()
+    for id, sesion := range sesionesFederadas {
+        if time.Since(sesion.ultimoUso) > vencimientoSesion {
+            delete(sesionesFederadas, id)
+        }
+    }
+    sesion, existe := sesionesFederadas[jobID]
+    if !existe {
+        sesion = &sesionFederada{usuarios: make(map[string][]float64)}
+        sesionesFederadas[jobID] = sesion
+    }
+    sesion.ultimoUso = time.Now()
+    return sesion
+}
+
+// recibirRondaFederada atiende "FEDERADO <job> <ronda>": parámetros, factores
+// globales y FIN_MODELO. En una ronda de entrenamiento responde
+// "ACTUALIZACION <ratings>" con la curva, los conteos de sus ratings (sin DP)
+// y los factores de las películas que entrenó; en la ronda "final" responde
+// el top del usuario objetivo, o SIN_USUARIO si no es local. Si el modelo
+// global llega mal formado responde ERROR y no participa de la ronda.
+func recibirRondaFederada(con net.Conn, reader *bufio.Reader, jobID string, ronda string) {
+    params := make(map[string]string)
+    global := make(map[string][]float64)
+    var errModelo error
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            fmt.Println("Error leyendo la ronda federada:", err)
+            return
+        }
+        line = strings.TrimSpace(line)
+        if line == "FIN_MODELO" {
+            break
+        }
+        if strings.HasPrefix(line, "PARAM ") {
+            clave, valor, _ := strings.Cut(strings.TrimSpace(line[len("PARAM "):]), "=")
+            params[clave] = valor
+            continue
+        }
+        if errModelo != nil {
+            continue
+        }
+        movieID, valores, _ := strings.Cut(line, ",")
+        factores := []float64{}
+        for _, valor := range strings.Split(valores, ",") {
+            numero, err := strconv.ParseFloat(valor, 64)
+            if err != nil || math.IsNaN(numero) || math.IsInf(numero, 0) {
+                errModelo = fmt.Errorf("factores de la película %s inválidos: %q", movieID, valor)
+                break
+            }
+            factores = append(factores, numero)
+        }
+        global[movieID] = factores
+    }
+
+    writer := bufio.NewWriter(con)
+    defer writer.Flush()
+    if len(datosLocales) == 0 {
+        fmt.Fprintln(writer, "SIN_DATOS")
+        return
+    }
+
+    opciones := opcionesDeParams(params)
+    numFactors, seed := opciones.Factores, opciones.Seed
+    if errModelo == nil {
+        for movieID, factores := range global {
+            if len(factores) != numFactors {
+                errModelo = fmt.Errorf("la película %s tiene %d factores y se esperaban %d", movieID, len(factores), numFactors)
+                break
+            }
+        }
+    }
+    if errModelo != nil {
+        fmt.Printf("Job federado %s, ronda %s: modelo global rechazado: %v\n", jobID, ronda, errModelo)
+        fmt.Fprintf(writer, "ERROR %v\n", errModelo)
+        return
+    }
+
+    sesion := sesionDeJob(jobID)
+    sesion.mu.Lock()
+    defer sesion.mu.Unlock()
+
+    // Partir de los factores globales; las películas que el coordinador aún
+    // no conoce y los usuarios nuevos se inicializan de forma determinista
+    itemFactors := make(map[string][]float64)
+    for _, movies := range matrizLocal {
+        for movieID := range movies {
+            if factores, existe := global[movieID]; existe {
+                itemFactors[movieID] = append([]float64(nil), factores...)
+            } else if _, existe := itemFactors[movieID]; !existe {
+                itemFactors[movieID] = factorInicial(seed, "m:"+movieID, numFactors)
+            }
+        }
+    }
+    for userID := range matrizLocal {
+        if _, existe := sesion.usuarios[userID]; !existe {
+            sesion.usuarios[userID] = factorInicial(seed, "u:"+userID, numFactors)
+        }
+    }
+
+    if ronda == "final" {
+        usuario := params["usuario"]
+        vistas, existe := matrizLocal[usuario]
+        if !existe {
+            fmt.Fprintln(writer, "SIN_USUARIO")
+            return
+        }
+        var top []recommendationPair
+        for movieID, factores := range global {
+            if _, vista := vistas[movieID]; vista {
+                continue
+            }
+            top = append(top, recommendationPair{MovieID: movieID, Rating: predictRating(sesion.usuarios[usuario], factores)})
+        }
+        sort.Slice(top, func(i, j int) bool { return compararRecomendaciones(top[i], top[j]) })
+        if len(top) > 5 {
+            top = top[:5]
+        }
+        for _, rec := range top {
+            fmt.Fprintf(writer, "%s,%.2f\n", rec.MovieID, rec.Rating)
+        }
+        fmt.Fprintln(writer, "FIN_TOP5")
+        muSesiones.Lock()
+        delete(sesionesFederadas, jobID)
+        muSesiones.Unlock()
+        fmt.Printf("Job federado %s: top del usuario %s enviado\n", jobID, usuario)
+        return
+    }
+
+    fmt.Printf("Job federado %s, ronda %s: entrenando con %d ratings locales\n", jobID, ronda, len(datosLocales))
+    curva := entrenarDesde(matrizLocal, sesion.usuarios, itemFactors, opciones)
+    // Solo las películas con ratings de entrenamiento cambiaron en la ronda;
+    // las demás el coordinador las conserva de la ronda anterior
+    entrenadas := make(map[string]bool)
+    entrenamiento, _ := conjuntosDeEntrenamiento(matrizLocal, opciones)
+    for _, movies := range entrenamiento {
+        for movieID := range movies {
+            entrenadas[movieID] = true
+        }
+    }
+    fmt.Fprintf(writer, "ACTUALIZACION %d\n", len(datosLocales))
+    escribirCurva(writer, curva)
+    // Con DP los conteos exactos revelarían los ratings locales
+    if opciones.Privacidad == nil {
+        escribirConteos(writer, matrizLocal)
+    }
+    for movieID, factores := range itemFactors {
+        if entrenadas[movieID] {
+            fmt.Fprintf(writer, "%s,%s\n", movieID, formatearFactores(factores))
+        }
+    }
+    fmt.Fprintln(writer, "FIN_MODELO")
+}
+
+// Privacidad diferencial. Con PARAM dp=1 el entrenamiento usa DP-SGD: en cada
+// paso se muestrea un lote de ratings (cada uno con probabilidad lote/N), el
+// gradiente de cada rating se recorta a norma clip y a la suma se le agrega
+// ruido gaussiano de desvío ruido*clip en todos los factores. Así los factores
+// y puntajes que salen del nodo no dependen demasiado de ningún rating.
+
+// PrivacidadDP son los parámetros de DP-SGD que envía el coordinador.
+type PrivacidadDP struct {
+    Clip  float64
+    Ruido float64
+    Lote  int
+}
+
+func privacidadDeParams(params map[string]string) *PrivacidadDP {
+    if params["dp"] != "1" {
+        return nil
+    }
+    privacidad := &PrivacidadDP{
+        Clip:  paramFloat(params, "clip", 1),
+        Ruido: paramFloat(params, "ruido", 1),
+        Lote:  paramEntero(params, "lote", 64),
+    }
+    if privacidad.Clip <= 0 || privacidad.Ruido < 0 || privacidad.Lote <= 0 {
+        fmt.Printf("Parámetros de privacidad inválidos %+v, se usan los valores por defecto\n", *privacidad)
+        privacidad = &PrivacidadDP{Clip: 1, Ruido: 1, Lote: 64}
+    }
+    return privacidad
+}
+
+type ejemploRating struct {
+    usuario  string
+    pelicula string
+    rating   float64
+}
+
+// pasoPrivado prepara una iteración de DP-SGD. Cada iteración da
+// ceil(N/lote) pasos, de modo que en promedio recorre una vez los ratings
+// como el SGD común; el paso suma los gradientes del lote en lugar de
+// promediarlos para que learningRate tenga la misma escala que sin
+// privacidad. El optimizador recibe el gradiente ya con ruido, así que no
+// altera la garantía de privacidad. El muestreo y el ruido no usan la
+// semilla del job, que viaja en la respuesta: conocerla permitiría
+// reconstruir el ruido y restarlo.
+//
+// El lote se muestrea con saltos geométricos y, con SGD, el ruido de una
+// fila que no entra en el lote se acumula hasta que se la vuelve a usar o
+// termina la iteración: la suma de t ruidos gaussianos independientes es un
+// ruido de desvío sqrt(t) veces mayor, así que el modelo final tiene la misma
+// distribución que sumando ruido a todas las filas en cada paso, pero un paso
+// cuesta O(lote). Adagrad y Adam dependen del gradiente de cada paso, así que
+// con ellos el ruido se sigue sumando a todas las filas en cada paso.
+func pasoPrivado(matrix map[string]map[string]float64, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) func(float64) {
+    numFactors, privacidad := opciones.Factores, opciones.Privacidad
+    ejemplos := ejemplosOrdenados(matrix)
+    var semilla [8]byte
+    crand.Read(semilla[:])
+    generador := rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(semilla[:]))))
+    if len(ejemplos) == 0 {
+        return func(float64) {}
+    }
+    tasa := math.Min(1, float64(privacidad.Lote)/float64(len(ejemplos)))
+    pasos := (len(ejemplos) + privacidad.Lote - 1) / privacidad.Lote
+    desvio := privacidad.Ruido * privacidad.Clip
+
+    gradUsuarios := make(map[string][]float64, len(userFactors))
+    for userID := range userFactors {
+        gradUsuarios[userID] = make([]float64, numFactors)
+    }
+    gradItems := make(map[string][]float64, len(itemFactors))
+    for movieID := range itemFactors {
+        gradItems[movieID] = make([]float64, numFactors)
+    }
+    gradU := make([]float64, numFactors)
+    gradV := make([]float64, numFactors)
+    estadosU := estadosFilas(opciones.Optimizador, userFactors, numFactors)
+    estadosI := estadosFilas(opciones.Optimizador, itemFactors, numFactors)
+    perezoso := estadosU == nil
+
+    // Paso hasta el que cada fila ya recibió su ruido en la iteración
+    ruidoU := make(map[string]int, len(userFactors))
+    ruidoI := make(map[string]int, len(itemFactors))
+    sumarRuido := func(x []float64, pendientes int, learningRate float64) {
+        escala := learningRate * desvio * math.Sqrt(float64(pendientes))
+        for k := range x {
+            x[k] += escala * generador.NormFloat64()
+        }
+    }
+    // ponerAlDia aplica a una fila el ruido de los pasos en que no se usó
+    ponerAlDia := func(x []float64, ruido map[string]int, id string, paso int, learningRate float64) {
+        if pendientes := paso - ruido[id]; pendientes > 0 {
+            sumarRuido(x, pendientes, learningRate)
+        }
+        ruido[id] = paso
+    }
+    aplicarLote := func(factores, grads map[string][]float64, estados map[string]*estadoFila, ids []string, learningRate float64) {
+        for _, id := range ids {
+            grad := grads[id]
+            for k := range grad {
+                grad[k] += desvio * generador.NormFloat64()
+            }
+            aplicarGradiente(factores[id], grad, estados[id], learningRate)
+            for k := range grad {
+                grad[k] = 0
+            }
+        }
+    }
+
+    var lote []int
+    var usuariosLote, itemsLote []string
+    return func(learningRate float64) {
+        for paso := 0; paso < pasos; paso++ {
+            // Gradientes recortados de los ratings muestreados
+            lote = muestrearLote(generador, len(ejemplos), tasa, lote[:0])
+            usuariosLote, itemsLote = usuariosLote[:0], itemsLote[:0]
+            for _, i := range lote {
+                ejemplo := ejemplos[i]
+                if perezoso {
+                    if ruidoU[ejemplo.usuario] <= paso {
+                        ponerAlDia(userFactors[ejemplo.usuario], ruidoU, ejemplo.usuario, paso, learningRate)
+                        ruidoU[ejemplo.usuario] = paso + 1
+                        usuariosLote = append(usuariosLote, ejemplo.usuario)
+                    }
+                    if ruidoI[ejemplo.pelicula] <= paso {
+                        ponerAlDia(itemFactors[ejemplo.pelicula], ruidoI, ejemplo.pelicula, paso, learningRate)
+                        ruidoI[ejemplo.pelicula] = paso + 1
+                        itemsLote = append(itemsLote, ejemplo.pelicula)
+                    }
+                }
+                gradienteEjemplo(ejemplo.rating, userFactors[ejemplo.usuario], itemFactors[ejemplo.pelicula], gradU, gradV, privacidad.Clip)
+                for k := 0; k < numFactors; k++ {
+                    gradUsuarios[ejemplo.usuario][k] += gradU[k]
+                    gradItems[ejemplo.pelicula][k] += gradV[k]
+                }
+            }
+
+            if perezoso {
+                // Las filas del lote reciben el ruido del paso con su
+                // gradiente; el resto lo recibe al ponerse al día
+                aplicarLote(userFactors, gradUsuarios, nil, usuariosLote, learningRate)
+                aplicarLote(itemFactors, gradItems, nil, itemsLote, learningRate)
+                continue
+            }
+            // Ruido en todos los factores, hayan sido muestreados o no
+            for userID, grad := range gradUsuarios {
+                for k := range grad {
+                    grad[k] += desvio * generador.NormFloat64()
+                }
+                aplicarGradiente(userFactors[userID], grad, estadosU[userID], learningRate)
+                for k := range grad {
+                    grad[k] = 0
+                }
+            }
+            for movieID, grad := range gradItems {
+                for k := range grad {
+                    grad[k] += desvio * generador.NormFloat64()
+                }
+                aplicarGradiente(itemFactors[movieID], grad, estadosI[movieID], learningRate)
+                for k := range grad {
+                    grad[k] = 0
+                }
+            }
+        }
+        if perezoso {
+            // El ruido pendiente de la iteración, antes de medir la pérdida
+            for userID, x := range userFactors {
+                ponerAlDia(x, ruidoU, userID, pasos, learningRate)
+                ruidoU[userID] = 0
+            }
+            for movieID, x := range itemFactors {
+                ponerAlDia(x, ruidoI, movieID, pasos, learningRate)
+                ruidoI[movieID] = 0
+            }
+        }
+    }
+}
+
+// muestrearLote agrega a lote los índices de un muestreo de Poisson de n
+// ejemplos con probabilidad tasa. Los saltos entre índices elegidos son
+// geométricos, así que cuesta O(tasa*n) y no O(n).
+func muestrearLote(generador *rand.Rand, n int, tasa float64, lote []int) []int {
+    if tasa >= 1 {
+        for i := 0; i < n; i++ {
+            lote = append(lote, i)
+        }
+        return lote
+    }
+    logNoElegir := math.Log1p(-tasa)
+    for i := -1; ; {
+        salto := math.Floor(math.Log(1-generador.Float64()) / logNoElegir)
+        if salto >= float64(n-i) {
+            return lote
+        }
+        i += int(salto) + 1
+        if i >= n {
+            return lote
+        }
+        lote = append(lote, i)
+    }
+}
+
+// Retroalimentación implícita con Bayesian Personalized Ranking (Rendle et
+// al., 2009). Los ratings se toman como interacciones: son positivas las que
+// alcanzan UmbralPositivo y, para cada una, se muestrea una película del
+// shard con la que el usuario no interactuó. El modelo aprende a puntuar la
+// positiva por encima de la negativa, así que las predicciones son puntajes
+// para ordenar y no estrellas. Entrena en un solo hilo y sin DP-SGD.
+
+const objetivoBPR = "bpr"
+
+const (
+    // Regularización L2 de los factores; sin ella BPR los hace crecer sin
+    // límite para separar más los pares
+    regularizacionBPR = 0.01
+    // Intentos de encontrar una negativa antes de descartar la positiva
+    intentosNegativa = 20
+)
+
+// tripletaBPR es una película positiva y una negativa del mismo usuario.
+type tripletaBPR struct {
+    usuario  string
+    positiva string
+    negativa string
+}
+
+// peliculasDe lista en orden las películas con algún rating en matrix.
+func peliculasDe(matrix map[string]map[string]float64) []string {
+    vistas := make(map[string]bool)
+    for _, movies := range matrix {
+        for movieID := range movies {
+            vistas[movieID] = true
+        }
+    }
+    peliculas := make([]string, 0, len(vistas))
+    for movieID := range vistas {
+        peliculas = append(peliculas, movieID)
+    }
+    sort.Strings(peliculas)
+    return peliculas
+}
+
+// tripletasBPR arma una tripleta por cada ejemplo positivo, con la negativa
+// elegida entre las películas con las que el usuario no tiene interacción en
+// interacciones.
+func tripletasBPR(ejemplos []ejemploRating, interacciones map[string]map[string]float64, peliculas []string, umbral float64, generador *rand.Rand) []tripletaBPR {
+    tripletas := make([]tripletaBPR, 0, len(ejemplos))
+    for _, ejemplo := range ejemplos {
+        if ejemplo.rating < umbral {
+            continue
+        }
+        for intento := 0; intento < intentosNegativa; intento++ {
+            negativa := peliculas[generador.Intn(len(peliculas))]
+            if _, vista := interacciones[ejemplo.usuario][negativa]; !vista {
+                tripletas = append(tripletas, tripletaBPR{ejemplo.usuario, ejemplo.pelicula, negativa})
+                break
+            }
+        }
+    }
+    return tripletas
+}
+
+// perdidaBPR es el promedio de -ln σ(x_uij), con x_uij la diferencia de
+// puntaje entre la positiva y la negativa.
+func perdidaBPR(tripletas []tripletaBPR, userFactors, itemFactors map[string][]float64) float64 {
+    if len(tripletas) == 0 {
+        return 0
+    }
+    suma := 0.0
+    for _, t := range tripletas {
+        u := userFactors[t.usuario]
+        x := predictRating(u, itemFactors[t.positiva]) - predictRating(u, itemFactors[t.negativa])
+        // -ln σ(x) = ln(1 + e^-x), calculado sin desbordes
+        if x > 0 {
+            suma += math.Log1p(math.Exp(-x))
+        } else {
+            suma += -x + math.Log1p(math.Exp(x))
+        }
+    }
+    return suma / float64(len(tripletas))
+}
+
+// pasoBPR prepara una iteración de BPR: una tripleta nueva por cada
+// interacción positiva de entrenamiento, en orden barajado. todas son las
+// interacciones del shard incluidas las reservadas para validación, para no
+// muestrear una de ellas como negativa.
+func pasoBPR(entrenamiento, todas map[string]map[string]float64, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) func(float64) {
+    numFactors := opciones.Factores
+    ejemplos := ejemplosOrdenados(entrenamiento)
+    peliculas := peliculasDe(todas)
+    if len(peliculas) == 0 {
+        return func(float64) {}
+    }
+    estadosU := estadosFilas(opciones.Optimizador, userFactors, numFactors)
+    estadosI := estadosFilas(opciones.Optimizador, itemFactors, numFactors)
+    gradU := make([]float64, numFactors)
+    gradI := make([]float64, numFactors)
+    gradJ := make([]float64, numFactors)
+    generador := rand.New(rand.NewSource(opciones.Seed))
+
+    return func(learningRate float64) {
+        tripletas := tripletasBPR(ejemplos, todas, peliculas, opciones.UmbralPositivo, generador)
+        generador.Shuffle(len(tripletas), func(a, b int) { tripletas[a], tripletas[b] = tripletas[b], tripletas[a] })
+        for _, t := range tripletas {
+            u, i, j := userFactors[t.usuario], itemFactors[t.positiva], itemFactors[t.negativa]
+            // Ascenso por ln σ(x_uij): el peso es σ(-x_uij)
+            x := predictRating(u, i) - predictRating(u, j)
+            peso := 1 / (1 + math.Exp(x))
+            for k := 0; k < numFactors; k++ {
+                gradU[k] = peso*(i[k]-j[k]) - regularizacionBPR*u[k]
+                gradI[k] = peso*u[k] - regularizacionBPR*i[k]
+                gradJ[k] = -peso*u[k] - regularizacionBPR*j[k]
+            }
+            recortarNorma(opciones.ClipGradiente, gradU, gradI, gradJ)
+            aplicarGradiente(u, gradU, estadosU[t.usuario], learningRate)
+            aplicarGradiente(i, gradI, estadosI[t.positiva], learningRate)
+            aplicarGradiente(j, gradJ, estadosI[t.negativa], learningRate)
+        }
+    }
+}
+
+// perdidasBPR devuelve cómo medir la pérdida BPR de entrenamiento y de
+// validación sobre tripletas fijas, para que las iteraciones sean
+// comparables, y si hay tripletas de validación.
+func perdidasBPR(todas, entrenamiento map[string]map[string]float64, validacion []ejemploRating, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) (func() float64, func() float64, bool) {
+    peliculas := peliculasDe(todas)
+    if len(peliculas) == 0 {
+        sinPerdida := func() float64 { return 0 }
+        return sinPerdida, sinPerdida, false
+    }
+    generador := rand.New(rand.NewSource(opciones.Seed + 1))
+    deEntrenamiento := tripletasBPR(ejemplosOrdenados(entrenamiento), todas, peliculas, opciones.UmbralPositivo, generador)
+    deValidacion := tripletasBPR(validacion, todas, peliculas, opciones.UmbralPositivo, generador)
+    return func() float64 { return perdidaBPR(deEntrenamiento, userFactors, itemFactors) },
+        func() float64 { return perdidaBPR(deValidacion, userFactors, itemFactors) },
+        len(deValidacion) > 0
+}
+
+// SVD++ (Koren, 2008). Además de los factores de la factorización, cada
+// rating se explica con la media global, un sesgo por usuario y otro por
+// película, y el usuario se complementa con la suma normalizada de factores
+// implícitos y_j de las películas que calificó:
+//
+//     r̂_ui = μ + b_u + b_i + q_i · (p_u + |N(u)|^-½ Σ_{j∈N(u)} y_j)
+//
+// Para compartir los mapas, las copias de seguridad y la ruta de predicción
+// con la factorización, los parámetros viven en los mismos vectores: el del
+// usuario es [p_u, b_u, 1] y el de la película [q_i, 1, b_i, y_i]. Al
+// terminar, consolidarSVDpp suma el término implícito y μ al usuario y
+// recorta y_i, así que predictRating da r̂_ui con el producto punto.
+
+const algoritmoSVDpp = "svdpp"
+
+const (
+    // Regularización L2 de los factores y de los sesgos
+    regularizacionSVDpp  = 0.015
+    regularizacionSesgos = 0.005
+    // Desvío de los factores iniciales; con sesgos y μ los factores solo
+    // explican el residuo, así que parten cerca de 0
+    escalaInicialSVDpp = 0.1
+)
+
+// inicializarSVDpp crea los vectores con la disposición de SVD++: factores
+// pequeños centrados en 0 a partir de la semilla, sesgos e y_j en 0.
+func inicializarSVDpp(matrix map[string]map[string]float64, numFactors int, seed int64) (map[string][]float64, map[string][]float64) {
+    userFactors := make(map[string][]float64)
+    itemFactors := make(map[string][]float64)
+    centrado := func(id string) []float64 {
+        vector := factorInicial(seed, id, numFactors)
+        for k := range vector {
+            vector[k] = (vector[k] - 0.5) * 2 * escalaInicialSVDpp
+        }
+        return vector
+    }
+    for userID, movies := range matrix {
+        userFactors[userID] = append(centrado("u:"+userID), 0, 1)
+        for movieID := range movies {
+            if _, existe := itemFactors[movieID]; !existe {
+                vector := append(centrado("m:"+movieID), 1, 0)
+                itemFactors[movieID] = append(vector, make([]float64, numFactors)...)
+            }
+        }
+    }
+    return userFactors, itemFactors
+}
+
+// mediaGlobal es el rating medio, sumado en orden fijo.
+func mediaGlobal(matrix map[string]map[string]float64) float64 {
+    ejemplos := ejemplosOrdenados(matrix)
+    if len(ejemplos) == 0 {
+        return 0
+    }
+    suma := 0.0
+    for _, ejemplo := range ejemplos {
+        suma += ejemplo.rating
+    }
+    return suma / float64(len(ejemplos))
+}
+
+// implicitoSVDpp calcula |N(u)|^-½ Σ y_j sobre las películas del usuario en
+// orden.
+func implicitoSVDpp(peliculas []string, itemFactors map[string][]float64, numFactors int) []float64 {
+    implicito := make([]float64, numFactors)
+    if len(peliculas) == 0 {
+        return implicito
+    }
+    for _, movieID := range peliculas {
+        y := itemFactors[movieID][numFactors+2:]
+        for k := range implicito {
+            implicito[k] += y[k]
+        }
+    }
+    norma := 1 / math.Sqrt(float64(len(peliculas)))
+    for k := range implicito {
+        implicito[k] *= norma
+    }
+    return implicito
+}
+
+// prediccionSVDpp es r̂_ui durante el entrenamiento, con los vectores aún sin
+// consolidar.
+func prediccionSVDpp(media float64, u, v, implicito []float64, numFactors int) float64 {
+    prediccion := media + u[numFactors] + v[numFactors+1]
+    for k := 0; k < numFactors; k++ {
+        prediccion += v[k] * (u[k] + implicito[k])
+    }
+    return prediccion
+}
+
+// peliculasPorUsuario lista en orden las películas de cada usuario: el
+// conjunto N(u) de SVD++.
+func peliculasPorUsuario(matrix map[string]map[string]float64) map[string][]string {
+    porUsuario := make(map[string][]string, len(matrix))
+    for _, ejemplo := range ejemplosOrdenados(matrix) {
+        porUsuario[ejemplo.usuario] = append(porUsuario[ejemplo.usuario], ejemplo.pelicula)
+    }
+    return porUsuario
+}
+
+// pasoSVDpp prepara una iteración de SVD++. Recorre los usuarios en orden
+// barajado con la semilla del job y, para cada uno, sus ratings; el término
+// implícito se calcula una vez por usuario y el gradiente de los y_j se
+// acumula y se aplica al terminar sus ratings, como es habitual para no
+// recorrer N(u) en cada rating.
+func pasoSVDpp(entrenamiento map[string]map[string]float64, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) func(float64) {
+    k := opciones.Factores
+    media := mediaGlobal(entrenamiento)
+    porUsuario := peliculasPorUsuario(entrenamiento)
+    usuarios := make([]string, 0, len(porUsuario))
+    for userID := range porUsuario {
+        usuarios = append(usuarios, userID)
+    }
+    sort.Strings(usuarios)
+
+    // Los y_j tienen su propio estado para que el optimizador no mezcle
+    // sus momentos con los de q_i
+    estadosU := estadosFilas(opciones.Optimizador, userFactors, k+1)
+    estadosI := estadosFilas(opciones.Optimizador, itemFactors, k+2)
+    estadosY := estadosFilas(opciones.Optimizador, itemFactors, k)
+    gradU := make([]float64, k+1)
+    gradV := make([]float64, k+2)
+    gradY := make([]float64, k)
+    acumulado := make([]float64, k)
+    generador := rand.New(rand.NewSource(opciones.Seed))
+    return func(learningRate float64) {
+        generador.Shuffle(len(usuarios), func(i, j int) { usuarios[i], usuarios[j] = usuarios[j], usuarios[i] })
+        for _, userID := range usuarios {
+            peliculas := append([]string(nil), porUsuario[userID]...)
+            implicito := implicitoSVDpp(peliculas, itemFactors, k)
+            u := userFactors[userID]
+            for i := range acumulado {
+                acumulado[i] = 0
+            }
+            generador.Shuffle(len(peliculas), func(i, j int) { peliculas[i], peliculas[j] = peliculas[j], peliculas[i] })
+            for _, movieID := range peliculas {
+                v := itemFactors[movieID]
+                error := entrenamiento[userID][movieID] - prediccionSVDpp(media, u, v, implicito, k)
+                for f := 0; f < k; f++ {
+                    gradU[f] = error*v[f] - regularizacionSVDpp*u[f]
+                    gradV[f] = error*(u[f]+implicito[f]) - regularizacionSVDpp*v[f]
+                    acumulado[f] += error * v[f]
+                }
+                gradU[k] = error - regularizacionSesgos*u[k]
+                gradV[k] = 0
+                gradV[k+1] = error - regularizacionSesgos*v[k+1]
+                recortarNorma(opciones.ClipGradiente, gradU, gradV)
+                aplicarGradiente(u[:k+1], gradU, estadosU[userID], learningRate)
+                aplicarGradiente(v[:k+2], gradV, estadosI[movieID], learningRate)
+            }
+            norma := 1 / math.Sqrt(float64(len(peliculas)))
+            for _, movieID := range porUsuario[userID] {
+                y := itemFactors[movieID][k+2:]
+                for f := range gradY {
+                    gradY[f] = norma*acumulado[f] - regularizacionSVDpp*y[f]
+                }
+                recortarNorma(opciones.ClipGradiente, gradY)
+                aplicarGradiente(y, gradY, estadosY[movieID], learningRate)
+            }
+        }
+    }
+}
+
+// perdidasSVDpp devuelve las funciones que miden el RMSE de entrenamiento y
+// de validación con la predicción de SVD++.
+func perdidasSVDpp(entrenamiento map[string]map[string]float64, validacion []ejemploRating, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) (func() float64, func() float64) {
+    k := opciones.Factores
+    media := mediaGlobal(entrenamiento)
+    porUsuario := peliculasPorUsuario(entrenamiento)
+    ejemplos := ejemplosOrdenados(entrenamiento)
+    rmse := func(ejemplos []ejemploRating) float64 {
+        if len(ejemplos) == 0 {
+            return 0
+        }
+        implicitos := make(map[string][]float64)
+        suma := 0.0
+        for _, ejemplo := range ejemplos {
+            implicito, existe := implicitos[ejemplo.usuario]
+            if !existe {
+                implicito = implicitoSVDpp(porUsuario[ejemplo.usuario], itemFactors, k)
+                implicitos[ejemplo.usuario] = implicito
+            }
+            d := ejemplo.rating - prediccionSVDpp(media, userFactors[ejemplo.usuario], itemFactors[ejemplo.pelicula], implicito, k)
+            suma += d * d
+        }
+        return math.Sqrt(suma / float64(len(ejemplos)))
+    }
+    return func() float64 { return rmse(ejemplos) }, func() float64 { return rmse(validacion) }
+}
+
+// consolidarSVDpp deja los vectores en la forma de la factorización: el del
+// usuario pasa a [p_u + implícito, μ + b_u, 1] y el de la película a
+// [q_i, 1, b_i], así que su producto punto es r̂_ui.
+func consolidarSVDpp(entrenamiento map[string]map[string]float64, userFactors, itemFactors map[string][]float64, numFactors int) {
+    media := mediaGlobal(entrenamiento)
+    porUsuario := peliculasPorUsuario(entrenamiento)
+    for userID, u := range userFactors {
+        implicito := implicitoSVDpp(porUsuario[userID], itemFactors, numFactors)
+        for k := range implicito {
+            u[k] += implicito[k]
+        }
+        u[numFactors] += media
+    }
+    for movieID, v := range itemFactors {
+        itemFactors[movieID] = v[:numFactors+2]
+    }
+}
+
+// entrenarSVDpp entrena SVD++ con el mismo ciclo de iteraciones, parada
+// temprana y restauración que la factorización.
+func entrenarSVDpp(matrix map[string]map[string]float64, opciones OpcionesEntrenamiento) (map[string][]float64, map[string][]float64, *CurvaPerdida) {
+    userFactors, itemFactors := inicializarSVDpp(matrix, opciones.Factores, opciones.Seed)
+    curva := entrenarDesde(matrix, userFactors, itemFactors, opciones)
+    entrenamiento, _ := conjuntosDeEntrenamiento(matrix, opciones)
+    consolidarSVDpp(entrenamiento, userFactors, itemFactors, opciones.Factores)
+    return userFactors, itemFactors, curva
+}
+
+// Vecinos más cercanos. Con PARAM algoritmo=knn-items o knn-usuarios el nodo
+// no factoriza: el coordinador reparte las películas por rango, así que cada
+// nodo tiene columnas completas y puntúa solo las películas de su rango. En
+// knn-items las similitudes entre películas se calculan aquí, con las
+// columnas de las películas del usuario objetivo que envía el coordinador
+// (líneas REF). En knn-usuarios el nodo devuelve estadísticas de co-ratings
+// de su rango; el coordinador las suma, elige los vecinos y se los envía
+// (VECINOS) para que cada nodo puntúe sus películas.
+
+const (
+    algoritmoKNNItems    = "knn-items"
+    algoritmoKNNUsuarios = "knn-usuarios"
+)
+
+// celdaKNN es un rating de una fila o columna: el usuario o la película y el
+// valor.
+type celdaKNN struct {
+    id    string
+    valor float64
+}
+
+// vecinoKNN es una película o un usuario similar que aporta a una
+// predicción: su similitud y su rating, centrado si la medida lo pide.
+type vecinoKNN struct {
+    id        string
+    similitud float64
+    valor     float64
+}
+
+// columnasOrdenadas agrupa la matriz por película, con los usuarios en orden
+// para que las sumas no dependan del recorrido de los mapas.
+func columnasOrdenadas(matrix map[string]map[string]float64) map[string][]celdaKNN {
+    columnas := make(map[string][]celdaKNN)
+    for _, ejemplo := range ejemplosOrdenados(matrix) {
+        columnas[ejemplo.pelicula] = append(columnas[ejemplo.pelicula], celdaKNN{id: ejemplo.usuario, valor: ejemplo.rating})
+    }
+    return columnas
+}
+
+func mediaCeldas(celdas []celdaKNN) float64 {
+    if len(celdas) == 0 {
+        return 0
+    }
+    suma := 0.0
+    for _, celda := range celdas {
+        suma += celda.valor
+    }
+    return suma / float64(len(celdas))
+}
+
+// mediaFila es el rating medio de un usuario; las claves se recorren en
+// orden por el mismo motivo que en columnasOrdenadas.
+func mediaFila(fila map[string]float64) float64 {
+    if len(fila) == 0 {
+        return 0
+    }
+    ids := make([]string, 0, len(fila))
+    for movieID := range fila {
+        ids = append(ids, movieID)
+    }
+    sort.Strings(ids)
+    suma := 0.0
+    for _, movieID := range ids {
+        suma += fila[movieID]
+    }
+    return suma / float64(len(ids))
+}
+
+// prediccionKNN promedia los valores de los vecinos ponderados por su
+// similitud y suma la base (la media, o 0 con coseno). Solo cuentan los k
+// primeros con similitud positiva; vecinos debe venir de mayor a menor.
+func prediccionKNN(base float64, vecinos []vecinoKNN, k int) (float64, int) {
+    suma, pesos, usados := 0.0, 0.0, 0
+    for _, vecino := range vecinos {
+        if usados == k || vecino.similitud <= 0 {
+            break
+        }
+        suma += vecino.similitud * vecino.valor
+        pesos += vecino.similitud
+        usados++
+    }
+    if usados == 0 {
+        return 0, 0
+    }
+    return math.Max(1, math.Min(5, base+suma/pesos)), usados
+}
+
+func ordenarVecinos(vecinos []vecinoKNN) {
+    sort.Slice(vecinos, func(i, j int) bool {
+        if vecinos[i].similitud != vecinos[j].similitud {
+            return vecinos[i].similitud > vecinos[j].similitud
+        }
+        return vecinos[i].id < vecinos[j].id
+    })
+}
+
+// puntuacionKNN es una predicción y cuántos vecinos la respaldan; con el
+// mismo puntaje gana la de más vecinos.
+type puntuacionKNN struct {
+    recommendationPair
+    vecinos int
+}
+
+func mejoresPuntuaciones(puntuaciones []puntuacionKNN, n int) []recommendationPair {
+    sort.Slice(puntuaciones, func(i, j int) bool {
+        if puntuaciones[i].Rating != puntuaciones[j].Rating {
+            return puntuaciones[i].Rating > puntuaciones[j].Rating
+        }
+        if puntuaciones[i].vecinos != puntuaciones[j].vecinos {
+            return puntuaciones[i].vecinos > puntuaciones[j].vecinos
+        }
+        return puntuaciones[i].MovieID < puntuaciones[j].MovieID
+    })
+    if len(puntuaciones) > n {
+        puntuaciones = puntuaciones[:n]
+    }
+    mejores := make([]recommendationPair, len(puntuaciones))
+    for i, puntuacion := range puntuaciones {
+        mejores[i] = puntuacion.recommendationPair
+    }
+    return mejores
+}
+
+// OpcionesKNN son los parámetros de vecinos más cercanos del coordinador.
+type OpcionesKNN struct {
+    Similitud    string
+    Vecinos      int
+    Encogimiento float64
+}
+
+func opcionesKNNDeParams(params map[string]string) OpcionesKNN {
+    opciones := OpcionesKNN{
+        Similitud:    params["similitud"],
+        Vecinos:      paramEntero(params, "vecinos", 30),
+        Encogimiento: paramFloat(params, "encogimiento", 10),
+    }
+    if opciones.Similitud == "" {
+        opciones.Similitud = similitud.Pearson
+    }
+    return opciones
+}
+
+// recomendarKNNItems puntúa las películas del rango que el objetivo no vio
+// con sus k películas vistas más similares. Las similitudes se calculan con
+// las columnas completas: las locales y las de referencia del coordinador.
+func recomendarKNNItems(clientData ClientData, opciones OpcionesKNN) []recommendationPair {
+    matrix := createUserItemMatrix(clientData)
+    objetivo := matrix[clientData.TargetUserID]
+    locales := columnasOrdenadas(matrix)
+
+    referencias := make(map[string]map[string]float64)
+    for movieID := range objetivo {
+        referencias[movieID] = make(map[string]float64)
+        for _, celda := range locales[movieID] {
+            referencias[movieID][celda.id] = celda.valor
+        }
+    }
+    for _, rating := range clientData.Referencias {
+        if columna, ok := referencias[rating.MovieID]; ok {
+            columna[rating.UserID] = rating.Rating
+        }
+    }
+    columnasReferencia := columnasOrdenadas(trasponer(referencias))
+
+    // Con coseno ajustado cada rating se centra en la media del usuario,
+    // que el coordinador calcula sobre el dataset completo
+    centrar := func(userID string, valor float64) float64 {
+        if opciones.Similitud != similitud.CosenoAjustado {
+            return valor
+        }
+        media, ok := clientData.Medias[userID]
+        if !ok {
+            media = mediaFila(matrix[userID])
+        }
+        return valor - media
+    }
+
+    // Índice invertido: por usuario, sus ratings de las películas del objetivo
+    porUsuario := make(map[string][]celdaKNN)
+    mediasReferencia := make(map[string]float64)
+    vistas := make([]string, 0, len(columnasReferencia))
+    for movieID, columna := range columnasReferencia {
+        vistas = append(vistas, movieID)
+        // Las referencias solo traen a los usuarios del shard: la media de
+        // la columna completa la manda el coordinador
+        if media, ok := clientData.MediasColumnas[movieID]; ok {
+            mediasReferencia[movieID] = media
+        } else {
+            mediasReferencia[movieID] = mediaCeldas(columna)
+        }
+    }
+    sort.Strings(vistas)
+    for _, movieID := range vistas {
+        for _, celda := range columnasReferencia[movieID] {
+            if celda.id == clientData.TargetUserID {
+                continue
+            }
+            porUsuario[celda.id] = append(porUsuario[celda.id], celdaKNN{id: movieID, valor: centrar(celda.id, celda.valor)})
+        }
+    }
+
+    puntuaciones := make([]puntuacionKNN, 0)
+    for movieID, columna := range locales {
+        if _, vista := objetivo[movieID]; vista {
+            continue
+        }
+        estadisticas := make(map[string]*similitud.Estadisticas)
+        for _, celda := range columna {
+            if celda.id == clientData.TargetUserID {
+                continue
+            }
+            x := centrar(celda.id, celda.valor)
+            for _, referencia := range porUsuario[celda.id] {
+                e := estadisticas[referencia.id]
+                if e == nil {
+                    e = &similitud.Estadisticas{}
+                    estadisticas[referencia.id] = e
+                }
+                e.Sumar(x, referencia.valor)
+            }
+        }
+        base := 0.0
+        if opciones.Similitud != similitud.Coseno {
+            base = mediaCeldas(columna)
+        }
+        vecinos := make([]vecinoKNN, 0, len(estadisticas))
+        for vista, e := range estadisticas {
+            valor := objetivo[vista]
+            if opciones.Similitud != similitud.Coseno {
+                valor -= mediasReferencia[vista]
+            }
+            vecinos = append(vecinos, vecinoKNN{id: vista, similitud: e.Similitud(opciones.Similitud, opciones.Encogimiento), valor: valor})
+        }
+        ordenarVecinos(vecinos)
+        if puntaje, usados := prediccionKNN(base, vecinos, opciones.Vecinos); usados > 0 {
+            puntuaciones = append(puntuaciones, puntuacionKNN{recommendationPair{MovieID: movieID, Rating: puntaje}, usados})
+        }
+    }
+    fmt.Printf("knn-items (%s): %d películas puntuadas con %d de referencia\n", opciones.Similitud, len(puntuaciones), len(vistas))
+    return mejoresPuntuaciones(puntuaciones, 5)
+}
+
+// trasponer convierte película -> usuario -> rating en usuario -> película ->
+// rating, la forma que usan createUserItemMatrix y ejemplosOrdenados.
+func trasponer(columnas map[string]map[string]float64) map[string]map[string]float64 {
+    filas := make(map[string]map[string]float64)
+    for movieID, columna := range columnas {
+        for userID, rating := range columna {
+            if filas[userID] == nil {
+                filas[userID] = make(map[string]float64)
+            }
+            filas[userID][movieID] = rating
+        }
+    }
+    return filas
+}
+
+// estadisticasKNNUsuarios acumula, por cada otro usuario, los co-ratings con
+// el objetivo en las películas del rango. Con coseno ajustado se centran en
+// la media de la película, que el nodo conoce completa.
+func estadisticasKNNUsuarios(clientData ClientData, opciones OpcionesKNN) map[string]*similitud.Estadisticas {
+    matrix := createUserItemMatrix(clientData)
+    objetivo := matrix[clientData.TargetUserID]
+    columnas := columnasOrdenadas(matrix)
+
+    vistas := make([]string, 0, len(objetivo))
+    for movieID := range objetivo {
+        vistas = append(vistas, movieID)
+    }
+    sort.Strings(vistas)
+
+    estadisticas := make(map[string]*similitud.Estadisticas)
+    for _, movieID := range vistas {
+        columna := columnas[movieID]
+        media := 0.0
+        if opciones.Similitud == similitud.CosenoAjustado {
+            media = mediaCeldas(columna)
+        }
+        for _, celda := range columna {
+            if celda.id == clientData.TargetUserID {
+                continue
+            }
+            e := estadisticas[celda.id]
+            if e == nil {
+                e = &similitud.Estadisticas{}
+                estadisticas[celda.id] = e
+            }
+            e.Sumar(objetivo[movieID]-media, celda.valor-media)
+        }
+    }
+    return estadisticas
+}
+
+// enviarEstadisticasAlServidor envía "ESTADISTICAS <job> <shard>", una línea
+// "userID,n,sx,sy,sxx,syy,sxy" por usuario y "FIN_ESTADISTICAS".
+func enviarEstadisticasAlServidor(jobID string, shardIdx int, estadisticas map[string]*similitud.Estadisticas) {
+    serverAddr := net.JoinHostPort(addrs[0], strconv.Itoa(portHP))
+    conn, err := seguridad.Conectar(serverAddr)
+    if err != nil {
+        fmt.Printf("Error conectando con el servidor: %v\n", err)
+        return
+    }
+    defer conn.Close()
+
+    usuarios := make([]string, 0, len(estadisticas))
+    for userID := range estadisticas {
+        usuarios = append(usuarios, userID)
+    }
+    sort.Strings(usuarios)
+
+    writer := bufio.NewWriter(conn)
+    fmt.Fprintf(writer, "ESTADISTICAS %s %d\n", jobID, shardIdx)
+    for _, userID := range usuarios {
+        e := estadisticas[userID]
+        fmt.Fprintf(writer, "%s,%d,%s,%s,%s,%s,%s\n", userID, e.N,
+            strconv.FormatFloat(e.Sx, 'g', -1, 64), strconv.FormatFloat(e.Sy, 'g', -1, 64),
+            strconv.FormatFloat(e.Sxx, 'g', -1, 64), strconv.FormatFloat(e.Syy, 'g', -1, 64),
+            strconv.FormatFloat(e.Sxy, 'g', -1, 64))
+    }
+    fmt.Fprintln(writer, "FIN_ESTADISTICAS")
+    if err := writer.Flush(); err != nil {
+        fmt.Printf("Error enviando las estadísticas: %v\n", err)
+        return
+    }
+    fmt.Printf("Estadísticas de %d usuarios enviadas al servidor.\n", len(usuarios))
+}
+
+// recibirVecinos atiende la segunda ronda de knn-usuarios:
+// "VECINOS <version> <job> <shard>", "UserID: x", los PARAM, una línea
+// "VECINO userID,similitud,media" por vecino (de mayor a menor similitud),
+// los ratings del objetivo y "FIN_VECINOS". Responde en la misma conexión
+// con el top del rango, "movieID,puntaje" y "FIN_TOP5".
+func recibirVecinos(con net.Conn, reader *bufio.Reader, version string, jobID string, indice int) {
+    muShard.RLock()
+    shard := shards[claveShard(version, indice)]
+    muShard.RUnlock()
+    if shard == nil || shard.Version != version {
+        actual := "ninguna"
+        if shard != nil {
+            actual = shard.Version
+        }
+        fmt.Printf("Vecinos para el shard %d (%s) pero tengo %s\n", indice, version, actual)
+        fmt.Fprintf(con, "SIN_SHARD %s\n", actual)
+        return
+    }
+
+    scanner := bufio.NewScanner(reader)
+    params := make(map[string]string)
+    targetUserID := ""
+    targetRatings := make([]Rating, 0)
+    vecinos := make([]vecinoKNN, 0)
+    medias := make(map[string]float64)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        if line == "FIN_VECINOS" {
+            break
+        }
+        if strings.HasPrefix(line, "UserID:") {
+            targetUserID = strings.TrimSpace(line[len("UserID:"):])
+        } else if strings.HasPrefix(line, "PARAM ") {
+            clave, valor, _ := strings.Cut(strings.TrimSpace(line[len("PARAM "):]), "=")
+            params[clave] = valor
+        } else if strings.HasPrefix(line, "VECINO ") {
+            campos := strings.Split(line[len("VECINO "):], ",")
+            if len(campos) != 3 {
+                fmt.Println("Error procesando línea:", line)
+                continue
+            }
+            sim, errSim := strconv.ParseFloat(campos[1], 64)
+            media, errMedia := strconv.ParseFloat(campos[2], 64)
+            if errSim != nil || errMedia != nil {
+                fmt.Println("Error procesando línea:", line)
+                continue
+            }
+            vecinos = append(vecinos, vecinoKNN{id: campos[0], similitud: sim})
+            medias[campos[0]] = media
+        } else if rating, ok := parsearRating(line); ok {
+            targetRatings = append(targetRatings, rating)
+        } else {
+            fmt.Println("Error procesando línea:", line)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        fmt.Println("Error leyendo datos:", err)
+        return
+    }
+
+    opciones := opcionesKNNDeParams(params)
+    clientData := ClientData{JobID: jobID, ShardIdx: indice, TargetUserID: targetUserID}
+    clientData.Data = combinarObjetivo(shard.Data, targetUserID, targetRatings)
+    matrix := createUserItemMatrix(clientData)
+    objetivo := matrix[targetUserID]
+    base := 0.0
+    if opciones.Similitud != similitud.Coseno {
+        base = paramFloat(params, "media", mediaFila(objetivo))
+    }
+
+    puntuaciones := make([]puntuacionKNN, 0)
+    for movieID := range columnasOrdenadas(matrix) {
+        if _, vista := objetivo[movieID]; vista {
+            continue
+        }
+        aportes := make([]vecinoKNN, 0, opciones.Vecinos)
+        for _, vecino := range vecinos {
+            rating, ok := matrix[vecino.id][movieID]
+            if !ok {
+                continue
+            }
+            if opciones.Similitud != similitud.Coseno {
+                rating -= medias[vecino.id]
+            }
+            aportes = append(aportes, vecinoKNN{id: vecino.id, similitud: vecino.similitud, valor: rating})
+            if len(aportes) == opciones.Vecinos {
+                break
+            }
+        }
+        if puntaje, usados := prediccionKNN(base, aportes, opciones.Vecinos); usados > 0 {
+            puntuaciones = append(puntuaciones, puntuacionKNN{recommendationPair{MovieID: movieID, Rating: puntaje}, usados})
+        }
+    }
+    mejores := mejoresPuntuaciones(puntuaciones, 5)
+    fmt.Printf("knn-usuarios (%s): job %s, %d vecinos, %d películas puntuadas\n", opciones.Similitud, jobID, len(vecinos), len(puntuaciones))
+
+    writer := bufio.NewWriter(con)
+    for _, rec := range mejores {
+        fmt.Fprintf(writer, "%s,%.2f\n", rec.MovieID, rec.Rating)
+    }
+    fmt.Fprintln(writer, "FIN_TOP5")
+    if err := writer.Flush(); err != nil {
+        fmt.Printf("Error enviando el top de vecinos: %v\n", err)
+    }
+}
+
+// SGD paralelo. Con varios hilos los ratings se pasan a arreglos indexados,
+// se barajan en cada iteración y cada goroutine recorre una porción. Los
+// factores se protegen con candados por franjas de usuarios y de películas
+// (siempre en ese orden, así no hay interbloqueos) o, en modo hogwild, se
+// actualizan sin candados: las colisiones son raras con datos dispersos y el
+// SGD las tolera.
+
+// franjasCandados es la cantidad de candados por tipo de factor.
+const franjasCandados = 256
+
+type ratingIndexado struct {
+    usuario  int32
+    pelicula int32
+    rating   float64
+}
+
+// factoresIndexados guarda los factores en arreglos contiguos, con el
+// índice de cada ID.
+type factoresIndexados struct {
+    numFactors int
+    usuarios   []string
+    peliculas  []string
+    fUsuarios  []float64
+    fPeliculas []float64
+    ejemplos   []ratingIndexado
+    // Estado del optimizador de cada fila; nil con SGD
+    estadosU []*estadoFila
+    estadosI []*estadoFila
+}
+
+func indexarFactores(matrix map[string]map[string]float64, userFactors, itemFactors map[string][]float64, numFactors int, optimizador string) *factoresIndexados {
+    f := &factoresIndexados{numFactors: numFactors}
+    indiceUsuario := make(map[string]int32, len(userFactors))
+    indicePelicula := make(map[string]int32, len(itemFactors))
+    // Orden fijo de los IDs para que el barajado dependa solo del generador
+    for userID := range userFactors {
+        f.usuarios = append(f.usuarios, userID)
+    }
+    sort.Strings(f.usuarios)
+    for movieID := range itemFactors {
+        f.peliculas = append(f.peliculas, movieID)
+    }
+    sort.Strings(f.peliculas)
+
+    f.fUsuarios = make([]float64, len(f.usuarios)*numFactors)
+    for i, userID := range f.usuarios {
+        indiceUsuario[userID] = int32(i)
+        copy(f.fUsuarios[i*numFactors:], userFactors[userID])
+    }
+    f.fPeliculas = make([]float64, len(f.peliculas)*numFactors)
+    for i, movieID := range f.peliculas {
+        indicePelicula[movieID] = int32(i)
+        copy(f.fPeliculas[i*numFactors:], itemFactors[movieID])
+    }
+    for _, userID := range f.usuarios {
+        movies := matrix[userID]
+        ids := make([]string, 0, len(movies))
+        for movieID := range movies {
+            ids = append(ids, movieID)
+        }
+        sort.Strings(ids)
+        for _, movieID := range ids {
+            f.ejemplos = append(f.ejemplos, ratingIndexado{indiceUsuario[userID], indicePelicula[movieID], movies[movieID]})
+        }
+    }
+    if nuevoEstadoFila(optimizador, numFactors) != nil {
+        f.estadosU = make([]*estadoFila, len(f.usuarios))
+        for i := range f.estadosU {
+            f.estadosU[i] = nuevoEstadoFila(optimizador, numFactors)
+        }
+        f.estadosI = make([]*estadoFila, len(f.peliculas))
+        for i := range f.estadosI {
+            f.estadosI[i] = nuevoEstadoFila(optimizador, numFactors)
+        }
+    }
+    return f
+}
+
+func (f *factoresIndexados) estados(usuario, pelicula int32) (*estadoFila, *estadoFila) {
+    if f.estadosU == nil {
+        return nil, nil
+    }
+    return f.estadosU[usuario], f.estadosI[pelicula]
+}
+
+// devolver copia los factores entrenados a los mapas originales.
+func (f *factoresIndexados) devolver(userFactors, itemFactors map[string][]float64) {
+    k := f.numFactors
+    for i, userID := range f.usuarios {
+        copy(userFactors[userID], f.fUsuarios[i*k:(i+1)*k])
+    }
+    for i, movieID := range f.peliculas {
+        copy(itemFactors[movieID], f.fPeliculas[i*k:(i+1)*k])
+    }
+}
+
+// epoca recorre una vez los ejemplos barajados con la cantidad de hilos dada.
+func (f *factoresIndexados) epoca(generador *rand.Rand, learningRate float64, recorte float64, hilos int, hogwild bool, franjasU, franjasI []sync.Mutex) {
+    generador.Shuffle(len(f.ejemplos), func(i, j int) {
+        f.ejemplos[i], f.ejemplos[j] = f.ejemplos[j], f.ejemplos[i]
+    })
+    k := f.numFactors
+    porHilo := (len(f.ejemplos) + hilos - 1) / hilos
+    var wg sync.WaitGroup
+    for inicio := 0; inicio < len(f.ejemplos); inicio += porHilo {
+        fin := inicio + porHilo
+        if fin > len(f.ejemplos) {
+            fin = len(f.ejemplos)
+        }
+        wg.Add(1)
+        go func(parte []ratingIndexado) {
+            defer wg.Done()
+            gradU := make([]float64, k)
+            gradV := make([]float64, k)
+            for _, ejemplo := range parte {
+                u := f.fUsuarios[int(ejemplo.usuario)*k : int(ejemplo.usuario+1)*k]
+                v := f.fPeliculas[int(ejemplo.pelicula)*k : int(ejemplo.pelicula+1)*k]
+                if !hogwild {
+                    franjasU[int(ejemplo.usuario)%franjasCandados].Lock()
+                    franjasI[int(ejemplo.pelicula)%franjasCandados].Lock()
+                }
+                estadoU, estadoI := f.estados(ejemplo.usuario, ejemplo.pelicula)
+                gradienteEjemplo(ejemplo.rating, u, v, gradU, gradV, recorte)
+                aplicarGradiente(u, gradU, estadoU, learningRate)
+                aplicarGradiente(v, gradV, estadoI, learningRate)
+                if !hogwild {
+                    franjasI[int(ejemplo.pelicula)%franjasCandados].Unlock()
+                    franjasU[int(ejemplo.usuario)%franjasCandados].Unlock()
+                }
+            }
+        }(f.ejemplos[inicio:fin])
+    }
+    wg.Wait()
+}
+
+// pasoParalelo prepara una iteración del SGD con opciones.Hilos goroutines;
+// al terminar cada una los factores se copian a los mapas.
+func pasoParalelo(matrix map[string]map[string]float64, userFactors, itemFactors map[string][]float64, opciones OpcionesEntrenamiento) func(float64) {
+    indexados := indexarFactores(matrix, userFactors, itemFactors, opciones.Factores, opciones.Optimizador)
+    franjasU := make([]sync.Mutex, franjasCandados)
+    franjasI := make([]sync.Mutex, franjasCandados)
+    generador := rand.New(rand.NewSource(opciones.Seed))
+    return func(learningRate float64) {
+        indexados.epoca(generador, learningRate, opciones.ClipGradiente, opciones.Hilos, opciones.Hogwild, franjasU, franjasI)
+        indexados.devolver(userFactors, itemFactors)
+    }
+}
+
@@ -0,0 +1,336 @@
+// codeRedP2PHP_test.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"tf/delta"
+)
+
+func TestMuestrearLote(t *testing.T) {
+    casos := []struct {
+        nombre string
+        n      int
+        tasa   float64
+    }{
+        {"lote chico", 100000, 64.0 / 100000},
+        {"lote grande", 10000, 0.3},
+        {"tasa uno", 500, 1},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            generador := rand.New(rand.NewSource(1))
+            const repeticiones = 2000
+            total := 0
+            var lote []int
+            for r := 0; r < repeticiones; r++ {
+                lote = muestrearLote(generador, caso.n, caso.tasa, lote[:0])
+                for i, indice := range lote {
+                    if indice < 0 || indice >= caso.n || i > 0 && indice <= lote[i-1] {
+                        t.Fatalf("índices fuera de rango o desordenados: %v", lote)
+                    }
+                }
+                total += len(lote)
+            }
+            // El tamaño del lote es binomial(n, tasa)
+            media := float64(total) / repeticiones
+            esperada := caso.tasa * float64(caso.n)
+            desvio := math.Sqrt(float64(caso.n)*caso.tasa*(1-caso.tasa)) / math.Sqrt(repeticiones)
+            if math.Abs(media-esperada) > 5*desvio+1e-9 {
+                t.Errorf("tamaño medio %g, se esperaba %g ± %g", media, esperada, 5*desvio)
+            }
+        })
+    }
+}
+
+// BenchmarkEntrenamientoSGD mide el SGD secuencial original contra el paralelo
+// con franjas de candados y con hogwild sobre un shard sintético de 400000
+// ratings, 6000 usuarios, 4000 películas y 10 factores:
+//
+//	go test ./nodo -run '^$' -bench EntrenamientoSGD -benchtime 3x
+//
+// Medido con 1 CPU (Xeon, 3 repeticiones), la aceleración respecto del
+// secuencial (0,94 s por entrenamiento) sale de los factores indexados y no de
+// los hilos, que con un solo CPU solo agregan cambios de contexto:
+//
+//	franjas, 1 hilo   1,80x    hogwild, 1 hilo   2,41x
+//	franjas, 2 hilos  2,58x    hogwild, 2 hilos  2,60x
+//	franjas, 4 hilos  1,92x    hogwild, 4 hilos  2,30x
+//	franjas, 8 hilos  2,05x    hogwild, 8 hilos  2,37x
+//
+// El RMSE de entrenamiento queda en 0,643 en todas las variantes.
+func BenchmarkEntrenamientoSGD(b *testing.B) {
+    const numFactors, numIterations, learningRate = 10, 5, 0.01
+    ratings := ratingsSinteticos(400000, 6000, 4000, numFactors)
+    matrix := createUserItemMatrix(ClientData{Data: ratings})
+
+    // Todas las variantes parten de los mismos factores iniciales
+    baseU, baseI := inicializarFactores(matrix, numFactors, 1)
+    copiar := func(origen map[string][]float64) map[string][]float64 {
+        copia := make(map[string][]float64, len(origen))
+        for id, factores := range origen {
+            copia[id] = append([]float64(nil), factores...)
+        }
+        return copia
+    }
+    medir := func(b *testing.B, entrenar func(u, i map[string][]float64)) {
+        var u, i map[string][]float64
+        for n := 0; n < b.N; n++ {
+            b.StopTimer()
+            u, i = copiar(baseU), copiar(baseI)
+            b.StartTimer()
+            entrenar(u, i)
+        }
+        b.ReportMetric(float64(len(ratings)*numIterations*b.N)/b.Elapsed().Seconds(), "ratings/s")
+        b.ReportMetric(rmseEntrenamiento(matrix, u, i), "rmse")
+    }
+
+    anterior := registrarIteraciones
+    registrarIteraciones = false
+    defer func() { registrarIteraciones = anterior }()
+
+    b.Run("secuencial", func(b *testing.B) {
+        medir(b, func(u, i map[string][]float64) {
+            entrenarDesde(matrix, u, i, OpcionesEntrenamiento{Factores: numFactors, LearningRate: learningRate, Iteraciones: numIterations, Hilos: 1})
+        })
+    })
+    for _, hilos := range []int{1, 2, 4, 8} {
+        for _, hogwild := range []bool{false, true} {
+            nombre := fmt.Sprintf("franjas/hilos=%d", hilos)
+            if hogwild {
+                nombre = fmt.Sprintf("hogwild/hilos=%d", hilos)
+            }
+            opciones := OpcionesEntrenamiento{Factores: numFactors, LearningRate: learningRate, Iteraciones: numIterations, Hilos: hilos, Hogwild: hogwild}
+            b.Run(nombre, func(b *testing.B) {
+                medir(b, func(u, i map[string][]float64) {
+                    paso := pasoParalelo(matrix, u, i, opciones)
+                    for iter := 0; iter < opciones.Iteraciones; iter++ {
+                        paso(opciones.LearningRate)
+                    }
+                })
+            })
+        }
+    }
+}
+
+// ratingsSinteticos genera ratings de un modelo de rango bajo con ruido,
+// recortados a la escala 1-5, siempre con la misma semilla.
+func ratingsSinteticos(cantidad, usuarios, peliculas, numFactors int) []Rating {
+    generador := rand.New(rand.NewSource(42))
+    vector := func() []float64 {
+        v := make([]float64, numFactors)
+        for i := range v {
+            v[i] = generador.NormFloat64() / math.Sqrt(float64(numFactors))
+        }
+        return v
+    }
+    fu := make([][]float64, usuarios)
+    for i := range fu {
+        fu[i] = vector()
+    }
+    fi := make([][]float64, peliculas)
+    for i := range fi {
+        fi[i] = vector()
+    }
+    vistos := make(map[[2]int]bool, cantidad)
+    ratings := make([]Rating, 0, cantidad)
+    for len(ratings) < cantidad && len(vistos) < usuarios*peliculas {
+        u, m := generador.Intn(usuarios), generador.Intn(peliculas)
+        if vistos[[2]int{u, m}] {
+            continue
+        }
+        vistos[[2]int{u, m}] = true
+        valor := 3.5 + predictRating(fu[u], fi[m]) + 0.5*generador.NormFloat64()
+        valor = math.Round(math.Max(1, math.Min(5, valor)))
+        ratings = append(ratings, Rating{UserID: strconv.Itoa(u + 1), MovieID: strconv.Itoa(m + 1), Rating: valor})
+    }
+    return ratings
+}
+
+func rmseEntrenamiento(matrix map[string]map[string]float64, userFactors, itemFactors map[string][]float64) float64 {
+    suma, n := 0.0, 0
+    for userID, movies := range matrix {
+        for movieID, rating := range movies {
+            d := rating - predictRating(userFactors[userID], itemFactors[movieID])
+            suma += d * d
+            n++
+        }
+    }
+    return math.Sqrt(suma / float64(n))
+}
+
+func TestLeerShardDelta(t *testing.T) {
+    var red bytes.Buffer
+    writer := bufio.NewWriter(&red)
+    registros := []delta.Registro{{Usuario: 122, Pelicula: 4500, Rating: 3.5}, {Usuario: 9, Pelicula: 30, Rating: 4.25}, {Usuario: 122, Pelicula: 7, Rating: 2}}
+    if err := delta.Escribir(writer, registros, func(int) {}); err != nil {
+        t.Fatal(err)
+    }
+    writer.Flush()
+    ratings, err := leerShardDelta(bufio.NewReader(&red))
+    if err != nil {
+        t.Fatal(err)
+    }
+    esperados := []Rating{{"9", "30", 4.25}, {"122", "7", 2}, {"122", "4500", 3.5}}
+    if !reflect.DeepEqual(ratings, esperados) {
+        t.Errorf("se leyó %v, se esperaba %v", ratings, esperados)
+    }
+}
+
+func TestAplicarGradiente(t *testing.T) {
+    const tasa = 0.1
+    casos := []struct {
+        nombre      string
+        optimizador string
+        gradientes  [][]float64
+        esperado    []float64
+    }{
+        {"sgd", "sgd", [][]float64{{3, -4}, {4, 3}}, []float64{0.7, -0.1}},
+        // AdaGrad divide por la raíz de la suma de gradientes al cuadrado:
+        // el primer paso mide tasa en cada coordenada y el segundo
+        // 0.1 * (4, 3) / 5
+        {"adagrad", "adagrad", [][]float64{{3, -4}, {4, 3}}, []float64{0.1 + 0.08, -0.1 + 0.06}},
+        // Con la corrección de sesgo el primer paso de Adam mide tasa. En el
+        // segundo, la primera coordenada tiene m̂ = (0.9·0.1·2 - 0.1)/0.19 y
+        // v̂ = (0.999·0.001·4 + 0.001)/0.001999; la segunda tiene gradiente
+        // constante y vuelve a avanzar tasa
+        {"adam", "adam", [][]float64{{2, 0.5}, {-1, 0.5}}, []float64{0.1 + tasa*(0.08/0.19)/math.Sqrt(0.004996/0.001999), 0.2}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            x := make([]float64, 2)
+            estado := nuevoEstadoFila(caso.optimizador, 2)
+            for _, gradiente := range caso.gradientes {
+                aplicarGradiente(x, gradiente, estado, tasa)
+            }
+            for k := range x {
+                if math.Abs(x[k]-caso.esperado[k]) > 1e-7 {
+                    t.Fatalf("x = %v, se esperaba %v", x, caso.esperado)
+                }
+            }
+            if caso.optimizador == "adam" && estado.t != 2 {
+                t.Errorf("Adam contó %d pasos, se esperaban 2", estado.t)
+            }
+        })
+    }
+}
+
+func TestTasaAprendizaje(t *testing.T) {
+    const lr = 0.1
+    casos := []struct {
+        nombre   string
+        opciones OpcionesEntrenamiento
+        tasas    []float64
+    }{
+        {"constante", OpcionesEntrenamiento{LearningRate: lr, Programa: "constante"}, []float64{lr, lr, lr, lr}},
+        // Durante el calentamiento crece linealmente hasta lr
+        {"calentamiento", OpcionesEntrenamiento{LearningRate: lr, Programa: "constante", Calentamiento: 2}, []float64{lr / 3, 2 * lr / 3, lr, lr}},
+        {"escalon", OpcionesEntrenamiento{LearningRate: lr, Programa: "escalon", Decaimiento: 0.5, PasoDecaimiento: 2},
+            []float64{lr, lr, lr / 2, lr / 2, lr / 4}},
+        // El decaimiento cuenta desde el final del calentamiento
+        {"escalon tras calentar", OpcionesEntrenamiento{LearningRate: lr, Programa: "escalon", Decaimiento: 0.5, PasoDecaimiento: 2, Calentamiento: 1},
+            []float64{lr / 2, lr, lr, lr / 2, lr / 2, lr / 4}},
+        {"escalon sin paso", OpcionesEntrenamiento{LearningRate: lr, Programa: "escalon", Decaimiento: 0.5}, []float64{lr, lr, lr}},
+        {"exponencial", OpcionesEntrenamiento{LearningRate: lr, Programa: "exponencial", Decaimiento: 0.5}, []float64{lr, lr / 2, lr / 4, lr / 8}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            for iter, esperada := range caso.tasas {
+                if tasa := tasaAprendizaje(caso.opciones, iter); math.Abs(tasa-esperada) > 1e-12 {
+                    t.Errorf("iteración %d: tasa %g, se esperaba %g", iter, tasa, esperada)
+                }
+            }
+        })
+    }
+}
+
+func TestEntrenarDesdeRestauraTrasDivergir(t *testing.T) {
+    anterior := registrarIteraciones
+    registrarIteraciones = false
+    defer func() { registrarIteraciones = anterior }()
+
+    const numFactors = 4
+    matrix := createUserItemMatrix(ClientData{Data: ratingsSinteticos(3000, 150, 100, numFactors)})
+    casos := []struct {
+        nombre        string
+        learningRate  float64
+        calentamiento int
+        restaurada    int
+    }{
+        // El calentamiento deja dos iteraciones sanas antes de que la
+        // pérdida crezca más de umbralDivergencia veces
+        {"tras iteraciones sanas", 0.3, 3, 2},
+        // Diverge a NaN en la primera y vuelven los factores iniciales
+        {"en la primera iteración", 1, 0, 0},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            opciones := OpcionesEntrenamiento{Factores: numFactors, LearningRate: caso.learningRate, Iteraciones: 10, Hilos: 1,
+                Seguimiento: true, Calentamiento: caso.calentamiento, Seed: 1}
+            userFactors, itemFactors := inicializarFactores(matrix, numFactors, 1)
+            curva := entrenarDesde(matrix, userFactors, itemFactors, opciones)
+            if curva.Motivo != "divergencia" || curva.Restaurada != caso.restaurada {
+                t.Fatalf("motivo %q restaurada %d, se esperaba divergencia restaurando la %d", curva.Motivo, curva.Restaurada, caso.restaurada)
+            }
+
+            // Con un hilo el entrenamiento se repite exactamente, así que
+            // los factores restaurados son los de entrenar solo las
+            // iteraciones sanas
+            sanosU, sanosI := inicializarFactores(matrix, numFactors, 1)
+            opciones.Iteraciones = caso.restaurada
+            entrenarDesde(matrix, sanosU, sanosI, opciones)
+            if !reflect.DeepEqual(userFactors, sanosU) || !reflect.DeepEqual(itemFactors, sanosI) {
+                t.Errorf("los factores no son los de la iteración %d", caso.restaurada)
+            }
+            if rmse := rmseEntrenamiento(matrix, userFactors, itemFactors); math.IsNaN(rmse) || math.IsInf(rmse, 0) {
+                t.Errorf("RMSE %g tras restaurar, se esperaban factores finitos", rmse)
+            }
+        })
+    }
+}
+
+func TestConsolidarSVDpp(t *testing.T) {
+    anterior := registrarIteraciones
+    registrarIteraciones = false
+    defer func() { registrarIteraciones = anterior }()
+
+    const numFactors = 4
+    matrix := createUserItemMatrix(ClientData{Data: ratingsSinteticos(3000, 150, 100, numFactors)})
+    // Con validación, N(u) y la media salen solo de los ratings de
+    // entrenamiento, como en entrenarSVDpp
+    opciones := OpcionesEntrenamiento{Factores: numFactors, LearningRate: 0.01, Iteraciones: 5, Hilos: 1,
+        Seguimiento: true, Validacion: 0.1, Seed: 1, Algoritmo: algoritmoSVDpp}
+    userFactors, itemFactors := inicializarSVDpp(matrix, numFactors, opciones.Seed)
+    entrenarDesde(matrix, userFactors, itemFactors, opciones)
+    entrenamiento, _ := conjuntosDeEntrenamiento(matrix, opciones)
+
+    // Predicciones antes de consolidar para todos los pares, también los
+    // que el usuario no calificó
+    media := mediaGlobal(entrenamiento)
+    porUsuario := peliculasPorUsuario(entrenamiento)
+    esperadas := make(map[[2]string]float64)
+    for userID, u := range userFactors {
+        implicito := implicitoSVDpp(porUsuario[userID], itemFactors, numFactors)
+        for movieID, v := range itemFactors {
+            esperadas[[2]string{userID, movieID}] = prediccionSVDpp(media, u, v, implicito, numFactors)
+        }
+    }
+
+    consolidarSVDpp(entrenamiento, userFactors, itemFactors, numFactors)
+    for par, esperada := range esperadas {
+        u, v := userFactors[par[0]], itemFactors[par[1]]
+        if len(u) != numFactors+2 || len(v) != numFactors+2 {
+            t.Fatalf("vectores de %d y %d componentes, se esperaban %d", len(u), len(v), numFactors+2)
+        }
+        if prediccion := predictRating(u, v); math.Abs(prediccion-esperada) > 1e-9 {
+            t.Fatalf("usuario %s película %s: %g tras consolidar, %g antes", par[0], par[1], prediccion, esperada)
+        }
+    }
+}
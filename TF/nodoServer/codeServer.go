@@ -4,19 +4,35 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"tf/delta"
+	"tf/seguridad"
+	"tf/similitud"
 )
 
 type Rating struct {
@@ -30,47 +46,550 @@ type ClientData struct {
     Data   []Rating
 }
 
+// Recommendation es una película recomendada. Rating es el puntaje predicho
+// promedio, Score el valor con el que la estrategia de agregación la ordenó y
+// Votes la cantidad de nodos que la incluyeron en su top.
 type Recommendation struct {
     MovieID string  `json:"MovieID"`
     Rating  float64 `json:"Rating"`
+    Score   float64 `json:"Score"`
+    Votes   int     `json:"Votes"`
 }
 
 var (
-    hostIP      string
-    addrs       []string
-    dataset     map[string][]Rating
-    numNodes    = 5
-    topGlobal   []Recommendation
-    muTopGlobal sync.Mutex
-    wg          sync.WaitGroup
+    hostIP         string
+    addrs          []string
+    dataset        map[string][]Rating
+    catalogo       map[string]Pelicula
+    reporteIngesta *ReporteIngesta
+    huellaDataset  string
+    numNodes       = 5
+
+    // Interacciones sin rating (DATASET_IMPLICITO), aparte de los ratings:
+    // solo entrenan el objetivo BPR
+    eventosImplicitos map[string][]Rating
+    huellaEventos     string
 )
 
 const (
-    portHP = 9002
+    portHP          = 9002
+    timeoutJob      = 10 * time.Minute
+    timeoutConexion = 30 * time.Second
+)
+
+var (
+    // Cantidad de nodos que guardan cada shard
+    factorReplicacion = 1
+    // Tiempo que se espera a una réplica antes de pasar a la siguiente
+    timeoutReplica = 5 * time.Minute
+    // Fracción de ratings nuevos que se tolera antes de volver a repartir
+    // los shards
+    toleranciaShards = 0.01
 )
 
 func main() {
+    // go run ./nodoServer gencerts [dir] [nombre=ip ...]
+    if len(os.Args) > 1 && os.Args[1] == "gencerts" {
+        if err := seguridad.GenerarCertificados(os.Args[2:]); err != nil {
+            log.Fatalf("Error generando los certificados: %v", err)
+        }
+        return
+    }
+    // CLUSTER_SECRET=... go run ./nodoServer claves [nombre=ip ...]
+    if len(os.Args) > 1 && os.Args[1] == "claves" {
+        if err := seguridad.GenerarClaves(os.Args[2:]); err != nil {
+            log.Fatalf("Error generando las claves: %v", err)
+        }
+        return
+    }
+
     hostIP = descubrirIP()
     fmt.Printf("IP del Servidor: %s\n", hostIP)
 
+    if err := seguridad.Configurar(seguridad.RolCoordinador, hostIP); err != nil {
+        log.Fatalf("Error configurando la seguridad: %v", err)
+    }
+
     addrs = []string{
         "172.30.0.2", "172.30.0.3", "172.30.0.4", "172.30.0.6", "172.30.0.7",
     }
 
+    factorReplicacion, _ = strconv.Atoi(leerEnv("REPLICACION", "1"))
+    if factorReplicacion < 1 || factorReplicacion > len(addrs) {
+        log.Fatalf("REPLICACION debe estar entre 1 y %d", len(addrs))
+    }
+    if valor, err := time.ParseDuration(leerEnv("TIMEOUT_REPLICA", "5m")); err == nil {
+        timeoutReplica = valor
+    }
+    subidasConcurrentes, err := strconv.Atoi(leerEnv("SUBIDAS_CONCURRENTES", "4"))
+    if err != nil || subidasConcurrentes < 1 {
+        subidasConcurrentes = 1
+    }
+    semaforoSubidas = make(chan struct{}, subidasConcurrentes)
+    if toleranciaShards, err = strconv.ParseFloat(leerEnv("SHARDS_TOLERANCIA", "0.01"), 64); err != nil || toleranciaShards < 0 {
+        log.Fatalf("SHARDS_TOLERANCIA debe ser un número no negativo")
+    }
+    if err := leerConfiguracionLSH(); err != nil {
+        log.Fatalf("Configuración del índice LSH: %v", err)
+    }
+    if regularizacionPlegado, err = strconv.ParseFloat(leerEnv("PLEGADO_LAMBDA", "0.1"), 64); err != nil || regularizacionPlegado <= 0 {
+        log.Fatalf("PLEGADO_LAMBDA debe ser un número positivo")
+    }
+    if regularizacionSesgoPlegado, err = strconv.ParseFloat(leerEnv("PLEGADO_LAMBDA_SESGO", "0"), 64); err != nil || regularizacionSesgoPlegado < 0 {
+        log.Fatalf("PLEGADO_LAMBDA_SESGO debe ser un número no negativo")
+    }
+    if err := leerConfiguracionModelos(); err != nil {
+        log.Fatalf("Configuración del registro de modelos: %v", err)
+    }
+    cargarRegistroModelos()
+
+    // Escuchar registros de nodos y resultados de jobs
+    go servicioHP()
+
+    // Cargar el catálogo de películas. Sin catálogo no se pueden validar los
+    // IDs de las películas, así que en modo estricto no se arranca
+    modoEstricto := leerEnvBool("MODO_ESTRICTO")
+    rutaCatalogo := leerEnv("CATALOGO_PATH", "/app/movieData.csv")
+    catalogo, err = loadCatalogo(rutaCatalogo)
+    if err != nil && modoEstricto {
+        log.Fatalf("Modo estricto: no se pudo cargar el catálogo %s: %v", rutaCatalogo, err)
+    }
+    if err != nil {
+        fmt.Printf("No se pudo cargar el catálogo %s: %v\n", rutaCatalogo, err)
+        catalogo = nil
+    }
+
+    // Iniciar el servidor HTTP
+    http.HandleFunc("/recommend", recommendationHandler)
+    http.HandleFunc("/dataset/report", reporteIngestaHandler)
+    http.HandleFunc("/nodes", nodosHandler)
+    http.HandleFunc("/jobs", jobsHandler)
+    http.HandleFunc("/movies/{id}/similar", similaresHandler)
+    http.HandleFunc("/users/{id}/ratings", usuarioHandler)
+    http.HandleFunc("/users/{id}/recommendations", usuarioHandler)
+    http.HandleFunc("/models", modelosHandler)
+    http.HandleFunc("/models/{version}", modelosHandler)
+    http.HandleFunc("/models/{version}/activate", modelosHandler)
+    http.HandleFunc("/models/rollback", modelosHandler)
+    http.HandleFunc("/predict", predecirHandler)
+
+    // Un coordinador federado no carga ratings: solo los tienen los nodos
+    if leerEnv("MODO_JOB", modoTop) == modoFederado {
+        dataset = make(map[string][]Rating)
+        fmt.Println("Modo federado: el coordinador no carga el dataset.")
+        fmt.Println("Iniciando el servidor HTTP en el puerto 8080...")
+        log.Fatal(http.ListenAndServe(":8080", nil))
+    }
+
     // Cargar el dataset
-    var err error
-    dataset, err = loadDataset("/app/dataset2M.csv", 2000000)
+    politica := leerEnv("POLITICA_DUPLICADOS", "primero")
+    if !politicasDuplicados[politica] {
+        log.Fatalf("Política de duplicados desconocida: %s", politica)
+    }
+    dataset, eventosImplicitos, reporteIngesta, err = loadDataset(leerEnv("DATASET_PATH", "/app/dataset2M.csv"), 2000000, catalogo, politica, leerEnvBool("DATASET_IMPLICITO"), modoEstricto)
     if err != nil {
         log.Fatalf("Error cargando el dataset: %v", err)
     }
+    reporteIngesta.Catalogo = rutaCatalogo
+    huellaDataset = calcularHuella(dataset)
+    huellaEventos = calcularHuella(eventosImplicitos)
+    reporteIngesta.Huella = huellaDataset
+    reporteIngesta.imprimir()
+    if reporteIngesta.ModoEstricto && reporteIngesta.Problemas() > 0 {
+        log.Fatalf("Modo estricto: el dataset tiene %d filas con problemas, abortando", reporteIngesta.Problemas())
+    }
     fmt.Println("Dataset cargado correctamente.")
 
-    // Iniciar el servidor HTTP
-    http.HandleFunc("/recommend", recommendationHandler)
+    // Reentrenar periódicamente para incorporar los ratings plegados
+    intervalo, err := time.ParseDuration(leerEnv("REENTRENAMIENTO", "0"))
+    if err != nil {
+        log.Fatalf("REENTRENAMIENTO no es una duración válida: %v", err)
+    }
+    if intervalo > 0 {
+        minimo, _ := strconv.Atoi(leerEnv("REENTRENAMIENTO_MINIMO", "1"))
+        go reentrenarPeriodicamente(intervalo, minimo)
+        fmt.Printf("Reentrenamiento cada %s con al menos %d ratings nuevos\n", intervalo, minimo)
+    }
+
     fmt.Println("Iniciando el servidor HTTP en el puerto 8080...")
     log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
+// OpcionesJob son los parámetros configurables de una solicitud de recomendación.
+type OpcionesJob struct {
+    Particion    string
+    Seed         int64
+    Factores     int
+    LearningRate float64
+    Iteraciones  int
+    // Goroutines del SGD en cada nodo (0 usa todos sus CPUs) y si se
+    // actualizan los factores sin candados
+    Hilos   int
+    Hogwild bool
+    // Modo de combinar los nodos: fusionar sus tops, alinear sus modelos o
+    // entrenar de forma federada durante Rondas rondas
+    Modo   string
+    Rondas int
+    // Si el modelo que deja el job se activa para las consultas: solo los
+    // entrenamientos globales (federados o de entrenarModeloGlobal), no cada
+    // /recommend en procrustes
+    Activar bool
+    // Agregación de los resultados de los nodos
+    Agregacion       string
+    Recorte          float64
+    DetectarAtipicos bool
+    SoporteMinimo    int
+    // Entrenamiento con privacidad diferencial (DP-SGD)
+    Privado bool
+    Clip    float64
+    Ruido   float64
+    Lote    int
+    Delta   float64
+    // Fracción de ratings que cada nodo reserva para validación y criterio
+    // de parada temprana; por defecto 0, así el modelo usa todos los
+    // ratings. Con DP-SGD los nodos la ignoran y no informan la pérdida
+    Validacion float64
+    Tolerancia float64
+    Paciencia  int
+    // Objetivo del entrenamiento: aproximar ratings ("rmse") u ordenar
+    // interacciones implícitas ("bpr"), positivas desde UmbralPositivo
+    Objetivo       string
+    UmbralPositivo float64
+    // Optimizador de los nodos y programa del learning rate
+    Optimizador     string
+    Programa        string
+    Decaimiento     float64
+    PasoDecaimiento int
+    Calentamiento   int
+    ClipGradiente   float64
+    // Algoritmo de recomendación: factorización o vecinos más cercanos por
+    // película o por usuario, con su medida de similitud, la cantidad de
+    // vecinos y el encogimiento de las similitudes con pocos co-ratings
+    Algoritmo    string
+    Similitud    string
+    Vecinos      int
+    Encogimiento float64
+}
+
+// Algoritmos de recomendación. SVD++ es la factorización con sesgos y
+// factores implícitos de las películas calificadas. Los de vecinos reparten
+// las películas por rango para que cada nodo tenga columnas completas.
+const (
+    algoritmoFactorizacion = "factorizacion"
+    algoritmoSVDpp         = "svdpp"
+    algoritmoKNNItems      = "knn-items"
+    algoritmoKNNUsuarios   = "knn-usuarios"
+)
+
+var (
+    algoritmos  = map[string]bool{algoritmoFactorizacion: true, algoritmoSVDpp: true, algoritmoKNNItems: true, algoritmoKNNUsuarios: true}
+    similitudes = map[string]bool{similitud.Coseno: true, similitud.CosenoAjustado: true, similitud.Pearson: true}
+)
+
+func esKNN(opciones OpcionesJob) bool {
+    return opciones.Algoritmo == algoritmoKNNItems || opciones.Algoritmo == algoritmoKNNUsuarios
+}
+
+// Objetivos de entrenamiento. Con BPR los nodos devuelven puntajes de
+// ranking sin escala de estrellas.
+const (
+    objetivoRMSE = "rmse"
+    objetivoBPR  = "bpr"
+)
+
+// Optimizadores y programas de learning rate que entienden los nodos.
+var (
+    optimizadores = map[string]bool{"sgd": true, "adagrad": true, "adam": true}
+    programasLR   = map[string]bool{"constante": true, "escalon": true, "exponencial": true}
+)
+
+func parsearOpcionesJob(r *http.Request) (OpcionesJob, error) {
+    query := r.URL.Query()
+    opciones := OpcionesJob{
+        Particion:    query.Get("partition"),
+        Factores:     3,
+        LearningRate: 0.01,
+        Iteraciones:  10,
+    }
+    if opciones.Particion == "" {
+        opciones.Particion = leerEnv("PARTICION", "roundrobin")
+    }
+    if _, existe := particionadores[opciones.Particion]; !existe {
+        return opciones, fmt.Errorf("unknown partition strategy %q", opciones.Particion)
+    }
+    // La semilla por defecto es fija para que los shards residentes en los
+    // nodos se reutilicen entre solicitudes
+    seed := query.Get("seed")
+    if seed == "" {
+        seed = leerEnv("SEED", "1")
+    }
+    valor, err := strconv.ParseInt(seed, 10, 64)
+    if err != nil {
+        return opciones, fmt.Errorf("invalid seed %q", seed)
+    }
+    opciones.Seed = valor
+
+    if factores := query.Get("factors"); factores != "" {
+        if opciones.Factores, err = strconv.Atoi(factores); err != nil || opciones.Factores <= 0 {
+            return opciones, fmt.Errorf("invalid factors %q", factores)
+        }
+    }
+    if lr := query.Get("learningRate"); lr != "" {
+        if opciones.LearningRate, err = strconv.ParseFloat(lr, 64); err != nil || opciones.LearningRate <= 0 {
+            return opciones, fmt.Errorf("invalid learningRate %q", lr)
+        }
+    }
+    if iteraciones := query.Get("iterations"); iteraciones != "" {
+        if opciones.Iteraciones, err = strconv.Atoi(iteraciones); err != nil || opciones.Iteraciones <= 0 {
+            return opciones, fmt.Errorf("invalid iterations %q", iteraciones)
+        }
+    }
+
+    // Quien pide una semilla quiere repetir el resultado, así que sin
+    // workers explícito se entrena en un hilo aunque HILOS_SGD diga otra cosa
+    hilos := query.Get("workers")
+    if hilos == "" && query.Get("seed") != "" {
+        hilos = "1"
+    }
+    if hilos == "" {
+        hilos = leerEnv("HILOS_SGD", "1")
+    }
+    if opciones.Hilos, err = strconv.Atoi(hilos); err != nil || opciones.Hilos < 0 {
+        return opciones, fmt.Errorf("invalid workers %q", hilos)
+    }
+    hogwild := query.Get("hogwild")
+    if hogwild == "" {
+        hogwild = leerEnv("HOGWILD", "false")
+    }
+    if opciones.Hogwild, err = strconv.ParseBool(hogwild); err != nil {
+        return opciones, fmt.Errorf("invalid hogwild %q", hogwild)
+    }
+
+    opciones.Modo = query.Get("mode")
+    if opciones.Modo == "" {
+        opciones.Modo = leerEnv("MODO_JOB", modoTop)
+    }
+    if !modosJob[opciones.Modo] {
+        return opciones, fmt.Errorf("unknown mode %q", opciones.Modo)
+    }
+    opciones.Activar = opciones.Modo == modoFederado
+    rondas := query.Get("rounds")
+    if rondas == "" {
+        rondas = leerEnv("RONDAS_FEDERADAS", "5")
+    }
+    if opciones.Rondas, err = strconv.Atoi(rondas); err != nil || opciones.Rondas <= 0 {
+        return opciones, fmt.Errorf("invalid rounds %q", rondas)
+    }
+
+    validacion := query.Get("validation")
+    if validacion == "" {
+        validacion = leerEnv("VALIDACION", "0")
+    }
+    if opciones.Validacion, err = strconv.ParseFloat(validacion, 64); err != nil || opciones.Validacion < 0 || opciones.Validacion >= 1 {
+        return opciones, fmt.Errorf("invalid validation %q", validacion)
+    }
+    tolerancia := query.Get("tolerance")
+    if tolerancia == "" {
+        tolerancia = leerEnv("TOLERANCIA", "0.001")
+    }
+    if opciones.Tolerancia, err = strconv.ParseFloat(tolerancia, 64); err != nil || opciones.Tolerancia < 0 {
+        return opciones, fmt.Errorf("invalid tolerance %q", tolerancia)
+    }
+    paciencia := query.Get("patience")
+    if paciencia == "" {
+        paciencia = leerEnv("PACIENCIA", "2")
+    }
+    if opciones.Paciencia, err = strconv.Atoi(paciencia); err != nil || opciones.Paciencia < 0 {
+        return opciones, fmt.Errorf("invalid patience %q", paciencia)
+    }
+
+    opciones.Optimizador = query.Get("optimizer")
+    if opciones.Optimizador == "" {
+        opciones.Optimizador = leerEnv("OPTIMIZADOR", "sgd")
+    }
+    if !optimizadores[opciones.Optimizador] {
+        return opciones, fmt.Errorf("unknown optimizer %q", opciones.Optimizador)
+    }
+    opciones.Programa = query.Get("schedule")
+    if opciones.Programa == "" {
+        opciones.Programa = leerEnv("PROGRAMA_LR", "constante")
+    }
+    if !programasLR[opciones.Programa] {
+        return opciones, fmt.Errorf("unknown schedule %q", opciones.Programa)
+    }
+    decaimiento := query.Get("decay")
+    if decaimiento == "" {
+        decaimiento = leerEnv("DECAIMIENTO_LR", "0.5")
+    }
+    if opciones.Decaimiento, err = strconv.ParseFloat(decaimiento, 64); err != nil || opciones.Decaimiento <= 0 || opciones.Decaimiento > 1 {
+        return opciones, fmt.Errorf("invalid decay %q", decaimiento)
+    }
+    pasoDecaimiento := query.Get("decaySteps")
+    if pasoDecaimiento == "" {
+        pasoDecaimiento = leerEnv("PASO_DECAIMIENTO", "5")
+    }
+    if opciones.PasoDecaimiento, err = strconv.Atoi(pasoDecaimiento); err != nil || opciones.PasoDecaimiento <= 0 {
+        return opciones, fmt.Errorf("invalid decaySteps %q", pasoDecaimiento)
+    }
+    calentamiento := query.Get("warmup")
+    if calentamiento == "" {
+        calentamiento = leerEnv("CALENTAMIENTO", "0")
+    }
+    if opciones.Calentamiento, err = strconv.Atoi(calentamiento); err != nil || opciones.Calentamiento < 0 {
+        return opciones, fmt.Errorf("invalid warmup %q", calentamiento)
+    }
+    clipGradiente := query.Get("gradClip")
+    if clipGradiente == "" {
+        clipGradiente = leerEnv("CLIP_GRADIENTE", "0")
+    }
+    if opciones.ClipGradiente, err = strconv.ParseFloat(clipGradiente, 64); err != nil || opciones.ClipGradiente < 0 {
+        return opciones, fmt.Errorf("invalid gradClip %q", clipGradiente)
+    }
+
+    opciones.Objetivo = query.Get("objective")
+    if opciones.Objetivo == "" {
+        opciones.Objetivo = leerEnv("OBJETIVO", objetivoRMSE)
+    }
+    if opciones.Objetivo != objetivoRMSE && opciones.Objetivo != objetivoBPR {
+        return opciones, fmt.Errorf("unknown objective %q", opciones.Objetivo)
+    }
+    umbral := query.Get("positiveThreshold")
+    if umbral == "" {
+        umbral = leerEnv("UMBRAL_POSITIVO", "0")
+    }
+    if opciones.UmbralPositivo, err = strconv.ParseFloat(umbral, 64); err != nil || opciones.UmbralPositivo > ratingMaximo {
+        return opciones, fmt.Errorf("invalid positiveThreshold %q", umbral)
+    }
+
+    // Los puntajes BPR no son comparables entre nodos, así que por defecto se
+    // combinan sus rankings
+    opciones.Agregacion = query.Get("aggregation")
+    if opciones.Agregacion == "" && opciones.Objetivo == objetivoBPR {
+        opciones.Agregacion = leerEnv("AGREGACION_IMPLICITA", "rrf")
+    }
+    if opciones.Agregacion == "" {
+        opciones.Agregacion = leerEnv("AGREGACION", "promedio")
+    }
+    if _, existe := agregadores[opciones.Agregacion]; !existe {
+        return opciones, fmt.Errorf("unknown aggregation %q", opciones.Agregacion)
+    }
+    recorte := query.Get("trim")
+    if recorte == "" {
+        recorte = leerEnv("AGREGACION_RECORTE", "0.2")
+    }
+    if opciones.Recorte, err = strconv.ParseFloat(recorte, 64); err != nil || opciones.Recorte < 0 || opciones.Recorte >= 0.5 {
+        return opciones, fmt.Errorf("invalid trim %q", recorte)
+    }
+    atipicos := query.Get("outliers")
+    if atipicos == "" {
+        atipicos = leerEnv("DETECTAR_ATIPICOS", "false")
+    }
+    if opciones.DetectarAtipicos, err = strconv.ParseBool(atipicos); err != nil {
+        return opciones, fmt.Errorf("invalid outliers %q", atipicos)
+    }
+    soporte := query.Get("minSupport")
+    if soporte == "" {
+        soporte = leerEnv("SOPORTE_MINIMO", "1")
+    }
+    if opciones.SoporteMinimo, err = strconv.Atoi(soporte); err != nil || opciones.SoporteMinimo < 1 {
+        return opciones, fmt.Errorf("invalid minSupport %q", soporte)
+    }
+
+    privado := query.Get("dp")
+    if privado == "" {
+        privado = leerEnv("DP", "false")
+    }
+    if opciones.Privado, err = strconv.ParseBool(privado); err != nil {
+        return opciones, fmt.Errorf("invalid dp %q", privado)
+    }
+    parametrosDP := []struct {
+        nombre, env, porDefecto string
+        destino                 *float64
+    }{
+        {"dpClip", "DP_CLIP", "1", &opciones.Clip},
+        {"dpNoise", "DP_RUIDO", "1.1", &opciones.Ruido},
+        {"dpDelta", "DP_DELTA", "1e-5", &opciones.Delta},
+    }
+    for _, parametro := range parametrosDP {
+        valor := query.Get(parametro.nombre)
+        if valor == "" {
+            valor = leerEnv(parametro.env, parametro.porDefecto)
+        }
+        if *parametro.destino, err = strconv.ParseFloat(valor, 64); err != nil || *parametro.destino <= 0 {
+            return opciones, fmt.Errorf("invalid %s %q", parametro.nombre, valor)
+        }
+    }
+    if opciones.Delta >= 1 {
+        return opciones, fmt.Errorf("invalid dpDelta %g", opciones.Delta)
+    }
+    lote := query.Get("dpLot")
+    if lote == "" {
+        lote = leerEnv("DP_LOTE", "64")
+    }
+    if opciones.Lote, err = strconv.Atoi(lote); err != nil || opciones.Lote <= 0 {
+        return opciones, fmt.Errorf("invalid dpLot %q", lote)
+    }
+    if opciones.Privado && opciones.Objetivo == objetivoBPR {
+        return opciones, fmt.Errorf("dp is not supported with objective %q", objetivoBPR)
+    }
+
+    opciones.Algoritmo = query.Get("algorithm")
+    if opciones.Algoritmo == "" {
+        opciones.Algoritmo = leerEnv("ALGORITMO", algoritmoFactorizacion)
+    }
+    if !algoritmos[opciones.Algoritmo] {
+        return opciones, fmt.Errorf("unknown algorithm %q", opciones.Algoritmo)
+    }
+    opciones.Similitud = query.Get("similarity")
+    if opciones.Similitud == "" {
+        opciones.Similitud = leerEnv("SIMILITUD", similitud.Pearson)
+    }
+    if !similitudes[opciones.Similitud] {
+        return opciones, fmt.Errorf("unknown similarity %q", opciones.Similitud)
+    }
+    vecinos := query.Get("neighbors")
+    if vecinos == "" {
+        vecinos = leerEnv("VECINOS", "30")
+    }
+    if opciones.Vecinos, err = strconv.Atoi(vecinos); err != nil || opciones.Vecinos <= 0 {
+        return opciones, fmt.Errorf("invalid neighbors %q", vecinos)
+    }
+    encogimiento := query.Get("shrinkage")
+    if encogimiento == "" {
+        encogimiento = leerEnv("ENCOGIMIENTO", "10")
+    }
+    if opciones.Encogimiento, err = strconv.ParseFloat(encogimiento, 64); err != nil || opciones.Encogimiento < 0 {
+        return opciones, fmt.Errorf("invalid shrinkage %q", encogimiento)
+    }
+    if opciones.Algoritmo == algoritmoSVDpp {
+        // Los vectores de SVD++ incluyen los sesgos, que no se alinean ni se
+        // promedian como factores, y el paso no tiene versión paralela ni
+        // privada
+        if opciones.Modo != modoTop {
+            return opciones, fmt.Errorf("algorithm %q only supports mode %q", opciones.Algoritmo, modoTop)
+        }
+        if opciones.Objetivo != objetivoRMSE || opciones.Privado {
+            return opciones, fmt.Errorf("algorithm %q supports neither objective %q nor dp", opciones.Algoritmo, objetivoBPR)
+        }
+    }
+    if esKNN(opciones) {
+        if opciones.Modo != modoTop {
+            return opciones, fmt.Errorf("algorithm %q only supports mode %q", opciones.Algoritmo, modoTop)
+        }
+        if opciones.Objetivo != objetivoRMSE || opciones.Privado {
+            return opciones, fmt.Errorf("algorithm %q does not train: objective and dp do not apply", opciones.Algoritmo)
+        }
+        if query.Get("partition") != "" && opciones.Particion != "rango" {
+            return opciones, fmt.Errorf("algorithm %q requires partition %q", opciones.Algoritmo, "rango")
+        }
+        // Cada película la puntúa un solo nodo, así que no hay votos que
+        // exigir ni tops que comparar entre nodos
+        opciones.Particion = "rango"
+        opciones.SoporteMinimo = 1
+    }
+    return opciones, nil
+}
+
 func recommendationHandler(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Access-Control-Allow-Origin", "*")
     userID := r.URL.Query().Get("userId")
@@ -78,282 +597,5695 @@ func recommendationHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "userId parameter is required", http.StatusBadRequest)
         return
     }
+    opciones, err := parsearOpcionesJob(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
 
-    recommendations, err := generateRecommendations(userID)
+    recommendations, reporte, err := generateRecommendations(userID, opciones)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string][]Recommendation{
+    json.NewEncoder(w).Encode(map[string]interface{}{
         "recommendations": recommendations,
+        "seed":            opciones.Seed,
+        "job":             reporte,
     })
 }
 
-func generateRecommendations(userID string) ([]Recommendation, error) {
-    // Copy the dataset to avoid modifying the original
-    userRatingsCopy := make(map[string][]Rating)
-    for k, v := range dataset {
-        userRatingsCopy[k] = v
-    }
+func reporteIngestaHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(reporteIngesta)
+}
 
-    clientData, targetCount := splitDataset(userRatingsCopy, userID, numNodes)
-    if targetCount == 0 {
-        return nil, fmt.Errorf("No data found for user %s", userID)
+func generateRecommendations(userID string, opciones OpcionesJob) ([]Recommendation, *ReporteJob, error) {
+    // En modo federado los ratings están en los nodos, no en el coordinador
+    if opciones.Modo == modoFederado {
+        return entrenarFederado(userID, opciones)
     }
 
-    recommendations, err := iniciarServidor(clientData)
-    if err != nil {
-        return nil, err
+    // Un coordinador federado no tiene ratings con los que repartir shards
+    muDataset.RLock()
+    sinDataset := huellaDataset == ""
+    muDataset.RUnlock()
+    if sinDataset {
+        return nil, nil, fmt.Errorf("mode %s needs the dataset, which this coordinator does not load; use mode=%s", opciones.Modo, modoFederado)
     }
 
-    return recommendations, nil
-}
-
-func iniciarServidor(clientData []ClientData) ([]Recommendation, error) {
-    localDir := fmt.Sprintf("%s:%d", hostIP, portHP)
+    targetUserRatings := ratingsConPendientes(userID)
+    if opciones.Objetivo == objetivoBPR {
+        targetUserRatings = agregarEventos(targetUserRatings, eventosImplicitos[userID])
+    }
+    if len(targetUserRatings) == 0 {
+        log.Printf("UserID %s does not exist in the dataset", userID)
+        return nil, nil, fmt.Errorf("No data found for user %s", userID)
+    }
 
-    ln, err := net.Listen("tcp", localDir)
-    if err != nil {
-        fmt.Printf("Error iniciando el servidor: %v\n", err)
-        return nil, err
+    shards := prepararShards(opciones)
+    clientData := ClientData{
+        UserID: userID,
+        Data:   targetUserRatings,
     }
-    defer ln.Close()
 
-    fmt.Println("Servidor escuchando en", localDir)
+    return iniciarServidor(clientData, shards, opciones)
+}
 
-    // Enviar datos a los nodos
-    enviarDatos(clientData)
+// Job es una solicitud de recomendación en curso. Los nodos identifican sus
+// resultados con el ID del job para que solicitudes concurrentes no se mezclen.
+type Job struct {
+    ID         string
+    UserID     string
+    opciones   OpcionesJob
+    topGlobal  []Recommendation
+    reporte    ReporteJob
+    mu         sync.Mutex
+    recibidos  map[int]bool
+    // Shards que el job envió a algún nodo; solo se aceptan resultados de esos
+    despachados map[int]bool
+    porShard   map[int]resultadoShard
+    modelos    map[int]modeloNodo
+    tamShards  []int
+    // Películas que el usuario ya calificó
+    calificadas map[string]bool
+    // Vecinos más cercanos: columnas de referencia por shard de origen,
+    // medias de sus usuarios y de cada columna completa, y los usuarios de
+    // las columnas que están en cada shard (knn-items); estadísticas por
+    // shard (knn-usuarios)
+    referencias    map[int][]Rating
+    medias         map[string]float64
+    mediasColumnas map[string]float64
+    coUsuarios     []map[string]bool
+    estadisticas   map[int]estadisticasShard
+    resultados chan int
+    rechazados chan int
+}
 
-    for i := 0; i < numNodes; i++ {
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            con, err := ln.Accept()
-            if err != nil {
-                fmt.Printf("Error aceptando conexión: %v\n", err)
-                return
-            }
-            manejarConexion(con)
-        }()
-    }
+var (
+    jobs         = make(map[string]*Job)
+    muJobs       sync.Mutex
+    contadorJobs int64
+)
 
-    wg.Wait()
+// ReporteJob resume cómo se resolvió un job y se devuelve junto a las
+// recomendaciones.
+type ReporteJob struct {
+    ID                  string                    `json:"id"`
+    UserID              string                    `json:"userId"`
+    Seed                int64                     `json:"seed"`
+    Reproducible        bool                      `json:"reproducible"`
+    NoReproducible      string                    `json:"noReproducible,omitempty"`
+    Objetivo            string                    `json:"objetivo"`
+    KNN                 *ReporteKNN               `json:"knn,omitempty"`
+    Transferencia       EstadisticasTransferencia `json:"transferencia"`
+    Modo                string                    `json:"modo"`
+    Alineacion          []AlineacionNodo          `json:"alineacion,omitempty"`
+    Rondas              []RondaFederada           `json:"rondas,omitempty"`
+    Convergencia        []ConvergenciaShard       `json:"convergencia,omitempty"`
+    Privacidad          *ReportePrivacidad        `json:"privacidad,omitempty"`
+    Agregacion          string                    `json:"agregacion"`
+    SoporteMinimo       int                       `json:"soporteMinimo"`
+    ResultadosAceptados int                       `json:"resultadosAceptados"`
+    Exclusiones         []ExclusionResultado      `json:"exclusiones,omitempty"`
+    // Puntajes sueltos de resultados aceptados que se descartaron por salirse
+    // de la escala más allá de margenPuntaje
+    FueraDeEscala int `json:"fueraDeEscala,omitempty"`
+}
 
-    // Calcular el top 3 final
-    finalTop3 := calcularTop3Final()
+// ExclusionResultado registra un resultado de nodo que no entró en la
+// agregación y por qué.
+type ExclusionResultado struct {
+    Shard  int    `json:"shard"`
+    Nodo   string `json:"nodo"`
+    Motivo string `json:"motivo"`
+}
 
-    return finalTop3, nil
+// EstadisticasTransferencia compara los bytes que habrían ocupado los shards
+// como texto plano con los que efectivamente viajaron por la red.
+type EstadisticasTransferencia struct {
+    ShardsEnviados int            `json:"shardsEnviados"`
+    BytesCrudos    int64          `json:"bytesCrudos"`
+    BytesRed       int64          `json:"bytesRed"`
+    Ratio          float64        `json:"ratio"`
+    Codificaciones map[string]int `json:"codificaciones"`
 }
 
-func descubrirIP() string {
-    var dirIP string = "127.0.0.1"
-    interfaces, _ := net.Interfaces()
-    for _, valInterface := range interfaces {
-        if strings.HasPrefix(valInterface.Name, "eth0") {
-            direcciones, _ := valInterface.Addrs()
-            for _, valDireccion := range direcciones {
-                switch d := valDireccion.(type) {
-                case *net.IPNet:
-                    if d.IP.To4() != nil {
-                        dirIP = d.IP.String()
-                    }
-                }
-            }
-        }
+func (e *EstadisticasTransferencia) sumar(codificacion string, crudos, red int64) {
+    if e.Codificaciones == nil {
+        e.Codificaciones = make(map[string]int)
+    }
+    e.ShardsEnviados++
+    e.BytesCrudos += crudos
+    e.BytesRed += red
+    e.Codificaciones[codificacion]++
+    if e.BytesRed > 0 {
+        e.Ratio = float64(e.BytesCrudos) / float64(e.BytesRed)
     }
-    return dirIP
 }
 
-func loadDataset(filename string, limit int) (map[string][]Rating, error) {
-    file, err := os.Open(filename)
-    if err != nil {
-        return nil, err
+func nuevoJob(userID string, opciones OpcionesJob) *Job {
+    job := &Job{
+        ID:           fmt.Sprintf("job-%d", atomic.AddInt64(&contadorJobs, 1)),
+        UserID:       userID,
+        opciones:     opciones,
+        recibidos:    make(map[int]bool),
+        despachados:  make(map[int]bool),
+        porShard:     make(map[int]resultadoShard),
+        modelos:      make(map[int]modeloNodo),
+        estadisticas: make(map[int]estadisticasShard),
+        resultados:   make(chan int, numNodes),
+        rechazados:   make(chan int, numNodes*len(addrs)),
     }
-    defer file.Close()
-
-    reader := csv.NewReader(file)
-    records, err := reader.ReadAll()
-    if err != nil {
-        return nil, err
+    motivo := motivoNoReproducible(opciones)
+    if motivo != "" {
+        fmt.Printf("Job %s: no es reproducible con la semilla %d: %s\n", job.ID, opciones.Seed, motivo)
+    }
+    job.reporte = ReporteJob{
+        ID:             job.ID,
+        UserID:         userID,
+        Seed:           opciones.Seed,
+        Reproducible:   motivo == "",
+        NoReproducible: motivo,
+        Objetivo:       opciones.Objetivo,
+        Modo:           opciones.Modo,
+        Agregacion:     nombreAgregacion(opciones),
+        SoporteMinimo:  opciones.SoporteMinimo,
     }
+    if esKNN(opciones) {
+        job.reporte.KNN = &ReporteKNN{
+            Algoritmo:    opciones.Algoritmo,
+            Similitud:    opciones.Similitud,
+            Vecinos:      opciones.Vecinos,
+            Encogimiento: opciones.Encogimiento,
+        }
+    }
+    muJobs.Lock()
+    jobs[job.ID] = job
+    muJobs.Unlock()
+    return job
+}
 
-    userRatings := make(map[string][]Rating)
-    if limit <= 0 || limit > len(records)-1 {
-        limit = len(records) - 1
+// motivoNoReproducible explica por qué repetir el job con la misma semilla
+// puede no dar el mismo resultado, o "" si lo da. La semilla fija la
+// partición, los factores iniciales y el orden de los ratings, pero con
+// varios hilos el orden de las actualizaciones depende del planificador (BPR
+// y SVD++ usan siempre uno; los vecinos no tienen azar), y el ruido de DP-SGD
+// no usa la semilla a propósito.
+func motivoNoReproducible(opciones OpcionesJob) string {
+    if esKNN(opciones) || opciones.Algoritmo == algoritmoSVDpp {
+        return ""
     }
+    if opciones.Privado {
+        return "el ruido de DP-SGD no depende de la semilla"
+    }
+    if opciones.Hilos != 1 && opciones.Objetivo != objetivoBPR {
+        if opciones.Hilos == 0 {
+            return "el SGD usa todos los CPUs de cada nodo y el orden de las actualizaciones depende del planificador"
+        }
+        return fmt.Sprintf("el SGD usa %d hilos y el orden de las actualizaciones depende del planificador", opciones.Hilos)
+    }
+    return ""
+}
 
-    for _, record := range records[1 : limit+1] {
-        movieID := record[0]
-        userID := record[1]
-        rating, _ := strconv.ParseFloat(record[2], 64)
+func buscarJob(jobID string) *Job {
+    muJobs.Lock()
+    defer muJobs.Unlock()
+    return jobs[jobID]
+}
 
-        userRatings[userID] = append(userRatings[userID], Rating{
-            UserID:  userID,
-            MovieID: movieID,
-            Rating:  rating,
-        })
+func terminarJob(job *Job) {
+    job.mu.Lock()
+    reporte := job.reporte
+    job.mu.Unlock()
+
+    muJobs.Lock()
+    delete(jobs, job.ID)
+    jobsRecientes = append(jobsRecientes, reporte)
+    if len(jobsRecientes) > maxJobsRecientes {
+        jobsRecientes = jobsRecientes[len(jobsRecientes)-maxJobsRecientes:]
     }
-    return userRatings, nil
+    muJobs.Unlock()
 }
 
-func splitDataset(userRatings map[string][]Rating, targetUserID string, numClients int) ([]ClientData, int) {
-    targetUserRatings, exists := userRatings[targetUserID]
-    if !exists {
-        log.Printf("UserID %s does not exist in the dataset", targetUserID)
-        return nil, 0
-    }
+// maxJobsRecientes es cuántos reportes de jobs terminados se conservan para
+// consultarlos en /jobs.
+const maxJobsRecientes = 20
 
-    clientData := make([]ClientData, numClients)
-    targetCount := len(targetUserRatings)
+var jobsRecientes []ReporteJob
+
+// jobsHandler devuelve el reporte parcial de los jobs en curso y el de los
+// últimos jobs terminados; con ?id= devuelve solo el de ese job.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
 
-    for i := 0; i < numClients; i++ {
-        clientData[i].UserID = targetUserID
-        clientData[i].Data = append(clientData[i].Data, targetUserRatings...)
+    muJobs.Lock()
+    activos := make([]*Job, 0, len(jobs))
+    for _, job := range jobs {
+        activos = append(activos, job)
     }
+    recientes := append([]ReporteJob(nil), jobsRecientes...)
+    muJobs.Unlock()
 
-    delete(userRatings, targetUserID)
+    enCurso := make([]ReporteJob, len(activos))
+    for i, job := range activos {
+        job.mu.Lock()
+        enCurso[i] = job.reporte
+        job.mu.Unlock()
+    }
+    sort.Slice(enCurso, func(i, j int) bool { return enCurso[i].ID < enCurso[j].ID })
 
-    i := 0
-    for _, ratings := range userRatings {
-        for _, rating := range ratings {
-            clientData[i%numClients].Data = append(clientData[i%numClients].Data, rating)
-            i++
+    if id := r.URL.Query().Get("id"); id != "" {
+        for _, reporte := range append(enCurso, recientes...) {
+            if reporte.ID == id {
+                json.NewEncoder(w).Encode(reporte)
+                return
+            }
         }
+        w.WriteHeader(http.StatusNotFound)
+        json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("unknown job %q", id)})
+        return
     }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "enCurso":    enCurso,
+        "terminados": recientes,
+    })
+}
 
-    return clientData, targetCount
+// despacho registra qué réplica está calculando un shard y desde cuándo.
+type despacho struct {
+    replica int
+    inicio  time.Time
 }
 
-func enviarDatos(clientData []ClientData) {
-    rand.Seed(time.Now().UnixNano())
-    for i, clienteIP := range addrs {
-        remoteDir := fmt.Sprintf("%s:%d", clienteIP, portHP)
-        conn, err := net.Dial("tcp", remoteDir)
-        if err != nil {
-            fmt.Printf("Error conectando con %s: %v\n", clienteIP, err)
-            continue
+func iniciarServidor(clientData ClientData, shards *ShardSet, opciones OpcionesJob) ([]Recommendation, *ReporteJob, error) {
+    job := nuevoJob(clientData.UserID, opciones)
+    defer terminarJob(job)
+    job.tamShards = make([]int, len(shards.Shards))
+    for indice, shard := range shards.Shards {
+        job.tamShards[indice] = len(shard)
+    }
+    job.calificadas = make(map[string]bool)
+    for _, rating := range clientData.Data {
+        job.calificadas[rating.MovieID] = true
+    }
+    menorShard := -1
+    for _, tam := range job.tamShards {
+        if tam > 0 && (menorShard < 0 || tam < menorShard) {
+            menorShard = tam
         }
-        defer conn.Close()
+    }
+    job.reporte.Privacidad = reportePrivacidad(opciones, menorShard+len(clientData.Data), 1)
+    if opciones.Algoritmo == algoritmoKNNItems {
+        prepararReferencias(job, clientData, shards)
+    }
 
-        fmt.Fprintf(conn, "UserID: %s\n", clientData[i].UserID)
-        for _, rating := range clientData[i].Data {
-            fmt.Fprintf(conn, "%s,%s,%.2f\n", rating.UserID, rating.MovieID, rating.Rating)
-        }
-        fmt.Printf("Datos enviados a %s\n", clienteIP)
+    // Sincronizar las réplicas desactualizadas y enviar el job a la primera
+    // réplica disponible de cada shard
+    sincronizarShards(job, shards)
+    replicasElegidas := make([]int, len(shards.Shards))
+    var wgDespacho sync.WaitGroup
+    for indice := range shards.Shards {
+        wgDespacho.Add(1)
+        go func(indice int) {
+            defer wgDespacho.Done()
+            replicasElegidas[indice] = despacharShard(job, clientData, shards, opciones, indice, 0)
+        }(indice)
     }
-}
+    wgDespacho.Wait()
 
-func manejarConexion(con net.Conn) {
-    defer con.Close()
+    despachos := make(map[int]*despacho)
+    for indice, replica := range replicasElegidas {
+        if replica >= 0 {
+            despachos[indice] = &despacho{replica: replica, inicio: time.Now()}
+        } else {
+            fmt.Printf("Job %s: ninguna réplica del shard %d aceptó el job\n", job.ID, indice)
+        }
+    }
+    if len(despachos) == 0 {
+        return nil, nil, fmt.Errorf("no worker node accepted the job")
+    }
 
-    reader := bufio.NewReader(con)
-    tempResults := []Recommendation{}
+    // Pasar un shard a su siguiente réplica, o abandonarlo si no quedan
+    reasignar := func(indice int, d *despacho) {
+        replica := despacharShard(job, clientData, shards, opciones, indice, d.replica+1)
+        if replica < 0 {
+            fmt.Printf("Job %s: no quedan réplicas para el shard %d\n", job.ID, indice)
+            delete(despachos, indice)
+            return
+        }
+        d.replica = replica
+        d.inicio = time.Now()
+    }
 
-    for {
-        line, err := reader.ReadString('\n')
-        if err != nil {
-            if err.Error() == "EOF" {
-                break
+    // Esperar un resultado por shard; si una réplica no responde a tiempo o
+    // su resultado se descarta se reenvía el shard a la siguiente
+    timeout := time.After(timeoutJob)
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+esperar:
+    for len(despachos) > 0 {
+        select {
+        case indice := <-job.resultados:
+            delete(despachos, indice)
+        case indice := <-job.rechazados:
+            if d, existe := despachos[indice]; existe {
+                reasignar(indice, d)
             }
-            fmt.Printf("Error leyendo datos: %v\n", err)
-            return
+        case <-ticker.C:
+            for indice, d := range despachos {
+                if time.Since(d.inicio) < timeoutReplica {
+                    continue
+                }
+                fmt.Printf("Job %s: la réplica %s del shard %d no respondió\n", job.ID, shards.Replicas[indice][d.replica], indice)
+                reasignar(indice, d)
+            }
+        case <-timeout:
+            fmt.Printf("Job %s: tiempo agotado con %d shards pendientes\n", job.ID, len(despachos))
+            break esperar
         }
+    }
 
-        line = strings.TrimSpace(line)
-        if line == "FIN_TOP5" {
-            fmt.Println("Fin del Top 5 recibido.")
+    // En knn-usuarios la primera ronda solo trae estadísticas; los tops
+    // llegan en la segunda, con los vecinos ya elegidos
+    if opciones.Algoritmo == algoritmoKNNUsuarios {
+        puntuarConVecinos(job, clientData, shards)
+    }
+
+    // Calcular el top 3 final
+    finalTop3 := calcularTop3Final(job)
+
+    job.mu.Lock()
+    reporte := job.reporte
+    job.mu.Unlock()
+    if reporte.Transferencia.ShardsEnviados > 0 {
+        fmt.Printf("Job %s: %d shards enviados, %d bytes crudos, %d bytes en la red (%.2fx)\n", job.ID,
+            reporte.Transferencia.ShardsEnviados, reporte.Transferencia.BytesCrudos, reporte.Transferencia.BytesRed, reporte.Transferencia.Ratio)
+    }
+
+    return finalTop3, &reporte, nil
+}
+
+// servicioHP atiende las conexiones entrantes de los nodos: registros de
+// capacidad y resultados de jobs.
+func servicioHP() {
+    localDir := fmt.Sprintf("%s:%d", hostIP, portHP)
+
+    ln, err := seguridad.Escuchar(localDir)
+    if err != nil {
+        log.Fatalf("Error iniciando el servicio HP: %v", err)
+    }
+    defer ln.Close()
+
+    fmt.Println("Servidor escuchando en", localDir)
+    for {
+        con, err := ln.Accept()
+        if err != nil {
+            fmt.Printf("Error aceptando conexión: %v\n", err)
+            continue
+        }
+        go handlerHP(con)
+    }
+}
+
+func handlerHP(con net.Conn) {
+    defer con.Close()
+
+    autenticada, err := seguridad.AutenticarEntrante(con)
+    if err != nil {
+        fmt.Printf("Conexión rechazada de %s: %v\n", con.RemoteAddr(), err)
+        return
+    }
+    con = autenticada
+
+    reader := bufio.NewReader(con)
+    cabecera, err := reader.ReadString('\n')
+    if err != nil {
+        fmt.Printf("Error leyendo la cabecera: %v\n", err)
+        return
+    }
+    campos := strings.Fields(cabecera)
+    if len(campos) < 2 {
+        fmt.Printf("Cabecera no válida: %q\n", cabecera)
+        return
+    }
+
+    switch campos[0] {
+    case "REGISTRO":
+        registrarNodo(con, campos[1], campos[2:])
+    case "RESULTADO", "MODELO", "ESTADISTICAS":
+        job := buscarJob(campos[1])
+        if job == nil {
+            fmt.Printf("Resultado para un job desconocido o vencido: %s\n", campos[1])
+            return
+        }
+        if len(campos) < 3 {
+            fmt.Printf("Resultado del %s sin índice de shard\n", job.ID)
+            return
+        }
+        indice, err := strconv.Atoi(campos[2])
+        job.mu.Lock()
+        despachado := job.despachados[indice]
+        job.mu.Unlock()
+        if err != nil || !despachado {
+            fmt.Printf("Índice de shard no válido para el %s: %s\n", job.ID, campos[2])
+            return
+        }
+        nodo := seguridad.IdentidadPar(con)
+        if nodo == "" {
+            nodo, _, _ = net.SplitHostPort(con.RemoteAddr().String())
+        }
+        switch campos[0] {
+        case "RESULTADO":
+            manejarConexion(reader, job, indice, nodo)
+            return
+        case "ESTADISTICAS":
+            manejarEstadisticas(reader, job, indice, nodo)
+            return
+        }
+        factores := 0
+        if len(campos) > 3 {
+            factores, _ = strconv.Atoi(campos[3])
+        }
+        manejarModelo(reader, job, indice, nodo, factores)
+    default:
+        fmt.Printf("Comando desconocido: %s\n", campos[0])
+    }
+}
+
+// InfoNodo es la capacidad que informó un nodo al registrarse.
+type InfoNodo struct {
+    IP       string    `json:"ip"`
+    CPUs     float64   `json:"cpus"`
+    Memoria  int64     `json:"memoria"`
+    Registro time.Time `json:"registro"`
+    Codecs   []string  `json:"codecs"`
+    // Versión de cada shard guardado, por "<esquema>/<shard>"
+    Shards map[string]string `json:"shards"`
+    // Ratings propios del nodo para el modo federado
+    RatingsLocales int `json:"ratingsLocales"`
+}
+
+var (
+    nodos   = make(map[string]*InfoNodo)
+    muNodos sync.Mutex
+)
+
+func registrarNodo(con net.Conn, ip string, atributos []string) {
+    conocido := false
+    for _, addr := range addrs {
+        if addr == ip {
+            conocido = true
+        }
+    }
+    if !conocido {
+        fmt.Printf("Registro rechazado de un nodo desconocido: %s\n", ip)
+        fmt.Fprintln(con, "ERROR nodo desconocido")
+        return
+    }
+    // Con HMAC la clave con la que el nodo se autenticó es la de su IP
+    if id := seguridad.IdentidadPar(con); id != "" && id != ip {
+        fmt.Printf("Registro rechazado: %s se autenticó como %s\n", ip, id)
+        fmt.Fprintln(con, "ERROR la clave no corresponde a la IP")
+        return
+    }
+    // Con TLS el certificado del nodo debe corresponder a la IP que declara
+    if cert := seguridad.CertificadoPar(con); cert != nil {
+        valido := false
+        for _, certIP := range cert.IPAddresses {
+            if certIP.String() == ip {
+                valido = true
+            }
+        }
+        if !valido {
+            fmt.Printf("Registro rechazado: el certificado no corresponde a %s\n", ip)
+            fmt.Fprintln(con, "ERROR certificado no corresponde a la IP")
+            return
+        }
+    }
+
+    info := &InfoNodo{IP: ip, Registro: time.Now()}
+    for _, atributo := range atributos {
+        clave, valor, _ := strings.Cut(atributo, "=")
+        switch clave {
+        case "cpus":
+            info.CPUs, _ = strconv.ParseFloat(valor, 64)
+        case "memoria":
+            info.Memoria, _ = strconv.ParseInt(valor, 10, 64)
+        case "codecs":
+            info.Codecs = strings.Split(valor, ",")
+        case "locales":
+            info.RatingsLocales, _ = strconv.Atoi(valor)
+        }
+    }
+
+    muNodos.Lock()
+    anterior := nodos[ip]
+    nodos[ip] = info
+    muNodos.Unlock()
+    if anterior == nil || anterior.CPUs != info.CPUs || anterior.Memoria != info.Memoria {
+        fmt.Printf("Nodo %s registrado: %.2f CPUs, %d MiB\n", ip, info.CPUs, info.Memoria>>20)
+    }
+    fmt.Fprintln(con, "OK")
+}
+
+// desproporcionMaxima acota la capacidad que cuenta de cada nodo a entre
+// 1/desproporcionMaxima y desproporcionMaxima veces la mediana de los
+// registrados, para que un nodo que informa valores absurdos (un cgroup sin
+// límite de memoria, por ejemplo) no se lleve casi todo el dataset ni deje a
+// los demás sin ratings.
+const desproporcionMaxima = 8
+
+// acotarCapacidades aplica desproporcionMaxima a los valores, en su orden.
+// Usa la mediana inferior para que con dos nodos el valor absurdo no la mueva.
+func acotarCapacidades(valores []float64) []float64 {
+    ordenados := append([]float64(nil), valores...)
+    sort.Float64s(ordenados)
+    centro := ordenados[(len(ordenados)-1)/2]
+    acotados := make([]float64, len(valores))
+    for i, valor := range valores {
+        acotados[i] = math.Max(centro/desproporcionMaxima, math.Min(centro*desproporcionMaxima, valor))
+    }
+    return acotados
+}
+
+// pesosNodos devuelve la fracción del dataset que le corresponde a cada nodo
+// de addrs según su capacidad. Un nodo recibe la menor de sus fracciones de
+// CPU y de memoria para que ningún recurso quede sobrecargado, con las
+// capacidades acotadas por desproporcionMaxima. Los nodos que aún no se
+// registraron, o que informaron capacidades nulas, infinitas o no numéricas,
+// reciben el peso promedio.
+func pesosNodos() []float64 {
+    muNodos.Lock()
+    defer muNodos.Unlock()
+
+    var registrados []int
+    var cpus, memorias []float64
+    for i, addr := range addrs {
+        info, existe := nodos[addr]
+        if !existe || !(info.CPUs > 0) || math.IsInf(info.CPUs, 1) || info.Memoria <= 0 {
+            continue
+        }
+        registrados = append(registrados, i)
+        cpus = append(cpus, info.CPUs)
+        memorias = append(memorias, float64(info.Memoria))
+    }
+
+    pesos := make([]float64, len(addrs))
+    if len(registrados) == 0 {
+        for i := range pesos {
+            pesos[i] = 1.0 / float64(len(addrs))
+        }
+        return pesos
+    }
+
+    cpus, memorias = acotarCapacidades(cpus), acotarCapacidades(memorias)
+    totalCPUs, totalMemoria := 0.0, 0.0
+    for j := range registrados {
+        totalCPUs += cpus[j]
+        totalMemoria += memorias[j]
+    }
+    suma := 0.0
+    for j, i := range registrados {
+        pesos[i] = math.Min(cpus[j]/totalCPUs, memorias[j]/totalMemoria)
+        suma += pesos[i]
+    }
+    promedioRegistrados := suma / float64(len(registrados))
+    for i := range pesos {
+        if pesos[i] == 0 {
+            pesos[i] = promedioRegistrados
+            suma += promedioRegistrados
+        }
+    }
+    for i := range pesos {
+        pesos[i] /= suma
+    }
+    return pesos
+}
+
+func nodosHandler(w http.ResponseWriter, r *http.Request) {
+    pesos := pesosNodos()
+
+    muShards.Lock()
+    muNodos.Lock()
+    listado := make([]InfoNodo, len(addrs))
+    for i, addr := range addrs {
+        listado[i] = InfoNodo{IP: addr}
+        if info, existe := nodos[addr]; existe {
+            listado[i] = *info
+        }
+        listado[i].Shards = make(map[string]string)
+        for clave, version := range estadoReplicas[addr] {
+            listado[i].Shards[clave] = version
+        }
+    }
+    muNodos.Unlock()
+
+    // Estado de las réplicas de cada shard respecto de la versión vigente de
+    // su esquema
+    esquemas := make([]string, 0, len(conjuntosShards))
+    for esquema := range conjuntosShards {
+        esquemas = append(esquemas, esquema)
+    }
+    sort.Strings(esquemas)
+    replicas := []map[string]interface{}{}
+    for _, esquema := range esquemas {
+        conjunto := conjuntosShards[esquema]
+        for indice := range conjunto.Shards {
+            sincronizadas := []string{}
+            pendientes := []string{}
+            for _, addr := range conjunto.Replicas[indice] {
+                if estadoReplicas[addr][claveReplica(conjunto.Version, indice)] == conjunto.Version {
+                    sincronizadas = append(sincronizadas, addr)
+                } else {
+                    pendientes = append(pendientes, addr)
+                }
+            }
+            replicas = append(replicas, map[string]interface{}{
+                "esquema":       esquema,
+                "shard":         indice,
+                "version":       conjunto.Version,
+                "ratings":       len(conjunto.Shards[indice]),
+                "sincronizadas": sincronizadas,
+                "pendientes":    pendientes,
+            })
+        }
+    }
+    muShards.Unlock()
+
+    respuesta := make([]map[string]interface{}, len(listado))
+    for i, info := range listado {
+        respuesta[i] = map[string]interface{}{
+            "nodo": info,
+            "peso": pesos[i],
+        }
+    }
+
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "nodes":       respuesta,
+        "replication": factorReplicacion,
+        "shards":      replicas,
+        "uploads":     copiaProgresoSubidas(),
+    })
+}
+
+func descubrirIP() string {
+    var dirIP string = "127.0.0.1"
+    interfaces, _ := net.Interfaces()
+    for _, valInterface := range interfaces {
+        if strings.HasPrefix(valInterface.Name, "eth0") {
+            direcciones, _ := valInterface.Addrs()
+            for _, valDireccion := range direcciones {
+                switch d := valDireccion.(type) {
+                case *net.IPNet:
+                    if d.IP.To4() != nil {
+                        dirIP = d.IP.String()
+                    }
+                }
+            }
+        }
+    }
+    return dirIP
+}
+
+// ReporteIngesta resume los problemas encontrados al cargar el dataset.
+type ReporteIngesta struct {
+    Archivo               string   `json:"archivo"`
+    Catalogo              string   `json:"catalogo"`
+    CatalogoDisponible    bool     `json:"catalogoDisponible"`
+    FilasLeidas           int      `json:"filasLeidas"`
+    FilasAceptadas        int      `json:"filasAceptadas"`
+    FilasMalformadas      int      `json:"filasMalformadas"`
+    RatingsNoNumericos    int      `json:"ratingsNoNumericos"`
+    FueraDeRango          int      `json:"fueraDeRango"`
+    Duplicados            int      `json:"duplicados"`
+    PoliticaDuplicados    string   `json:"politicaDuplicados"`
+    FilasPeliculaNoExiste int      `json:"filasPeliculaDesconocida"`
+    PeliculasDesconocidas []string `json:"peliculasDesconocidas"`
+    EventosImplicitos     int      `json:"eventosImplicitos"`
+    Usuarios              int      `json:"usuarios"`
+    Peliculas             int      `json:"peliculas"`
+    Ejemplos              []string `json:"ejemplos"`
+    ModoEstricto          bool     `json:"modoEstricto"`
+    Huella                string   `json:"huella"`
+}
+
+// Pelicula es una entrada del catálogo (movieData.csv: id,año,título).
+type Pelicula struct {
+    MovieID string `json:"movieId"`
+    Anio    string `json:"anio"`
+    Titulo  string `json:"titulo"`
+}
+
+// La escala es la del Netflix Prize, de donde vienen el dataset y
+// movieData.csv: estrellas enteras de 1 a 5. Las predicciones se recortan a
+// este rango.
+const (
+    ratingMinimo       = 1.0
+    ratingMaximo       = 5.0
+    maxEjemplosReporte = 20
+)
+
+var politicasDuplicados = map[string]bool{
+    "primero":   true, // conservar la primera aparición
+    "ultimo":    true, // conservar la última aparición
+    "promedio":  true, // promediar todas las apariciones
+    "descartar": true, // eliminar el par usuario/película por completo
+}
+
+func leerEnv(clave, porDefecto string) string {
+    if valor := strings.TrimSpace(os.Getenv(clave)); valor != "" {
+        return valor
+    }
+    return porDefecto
+}
+
+func leerEnvBool(clave string) bool {
+    valor, err := strconv.ParseBool(leerEnv(clave, "false"))
+    return err == nil && valor
+}
+
+func (r *ReporteIngesta) agregarEjemplo(formato string, args ...interface{}) {
+    if len(r.Ejemplos) < maxEjemplosReporte {
+        r.Ejemplos = append(r.Ejemplos, fmt.Sprintf(formato, args...))
+    }
+}
+
+// Problemas devuelve la cantidad de filas con algún defecto. Los duplicados
+// no cuentan porque la política de duplicados ya los resolvió.
+func (r *ReporteIngesta) Problemas() int {
+    return r.FilasMalformadas + r.RatingsNoNumericos + r.FueraDeRango + r.FilasPeliculaNoExiste
+}
+
+func (r *ReporteIngesta) imprimir() {
+    fmt.Println("Reporte de ingesta del dataset:")
+    fmt.Printf("  Filas leídas: %d, aceptadas: %d\n", r.FilasLeidas, r.FilasAceptadas)
+    fmt.Printf("  Malformadas: %d, ratings no numéricos: %d, fuera de rango [%.0f,%.0f]: %d\n",
+        r.FilasMalformadas, r.RatingsNoNumericos, ratingMinimo, ratingMaximo, r.FueraDeRango)
+    fmt.Printf("  Pares usuario/película duplicados: %d (política: %s)\n", r.Duplicados, r.PoliticaDuplicados)
+    if r.EventosImplicitos > 0 {
+        fmt.Printf("  Eventos sin rating (interacciones implícitas, solo para BPR): %d\n", r.EventosImplicitos)
+    }
+    if r.CatalogoDisponible {
+        fmt.Printf("  Filas con película fuera del catálogo: %d (%d películas distintas)\n",
+            r.FilasPeliculaNoExiste, len(r.PeliculasDesconocidas))
+    } else {
+        fmt.Printf("  Catálogo %s no disponible, no se validaron los MovieID\n", r.Catalogo)
+    }
+    fmt.Printf("  Usuarios: %d, películas: %d\n", r.Usuarios, r.Peliculas)
+    fmt.Printf("  Huella: %s\n", r.Huella)
+    for _, ejemplo := range r.Ejemplos {
+        fmt.Printf("    - %s\n", ejemplo)
+    }
+}
+
+func loadCatalogo(filename string) (map[string]Pelicula, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    reader := csv.NewReader(file)
+    reader.FieldsPerRecord = -1
+    reader.LazyQuotes = true
+
+    catalogo := make(map[string]Pelicula)
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if len(record) < 3 {
+            continue
+        }
+        // Los títulos pueden contener comas sin comillas
+        catalogo[strings.TrimSpace(record[0])] = Pelicula{
+            MovieID: strings.TrimSpace(record[0]),
+            Anio:    strings.TrimSpace(record[1]),
+            Titulo:  strings.TrimSpace(strings.Join(record[2:], ",")),
+        }
+    }
+    return catalogo, nil
+}
+
+// loadDataset lee filas movieID,userID,rating. Con implicito también acepta
+// eventos sin rating (movieID,userID, como vistas o clics), que se devuelven
+// aparte con el rating máximo como marca de interacción positiva: solo los
+// usa el objetivo BPR, así que no cuentan en el RMSE, los vecinos, las
+// estadísticas ni la huella. Un evento repetido o sobre una película que el
+// usuario calificó no agrega nada.
+// En modo estricto se rechazan las filas cuya película no está en el
+// catálogo.
+func loadDataset(filename string, limit int, catalogo map[string]Pelicula, politica string, implicito bool, estricto bool) (map[string][]Rating, map[string][]Rating, *ReporteIngesta, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    defer file.Close()
+
+    reporte := &ReporteIngesta{
+        Archivo:               filename,
+        CatalogoDisponible:    catalogo != nil,
+        PoliticaDuplicados:    politica,
+        ModoEstricto:          estricto,
+        PeliculasDesconocidas: []string{},
+        Ejemplos:              []string{},
+    }
+
+    reader := csv.NewReader(file)
+    reader.FieldsPerRecord = -1
+    reader.ReuseRecord = true
+
+    // Saltar la cabecera
+    if _, err := reader.Read(); err != nil {
+        if err == io.EOF {
+            return map[string][]Rating{}, map[string][]Rating{}, reporte, nil
+        }
+        return nil, nil, nil, err
+    }
+
+    userRatings := make(map[string][]Rating)
+    eventos := make(map[string][]Rating)
+    eventosVistos := make(map[string]bool)
+    // Posición de cada par usuario/película dentro de userRatings[userID]
+    vistos := make(map[string]int)
+    apariciones := make(map[string]int)
+    descartados := make(map[string]bool)
+    desconocidas := make(map[string]bool)
+
+    for linea := 2; limit <= 0 || reporte.FilasLeidas < limit; linea++ {
+        record, err := reader.Read()
+        if err == io.EOF {
             break
         }
+        reporte.FilasLeidas++
+        if err != nil {
+            if _, ok := err.(*csv.ParseError); !ok {
+                return nil, nil, nil, err
+            }
+            reporte.FilasMalformadas++
+            reporte.agregarEjemplo("línea %d: %v", linea, err)
+            continue
+        }
+        evento := implicito && (len(record) == 2 || len(record) == 3 && strings.TrimSpace(record[2]) == "")
+        if len(record) < 3 && !evento || strings.TrimSpace(record[0]) == "" || strings.TrimSpace(record[1]) == "" {
+            reporte.FilasMalformadas++
+            reporte.agregarEjemplo("línea %d: se esperaban movieID,userID,rating y se leyó %q", linea, strings.Join(record, ","))
+            continue
+        }
+
+        movieID := strings.TrimSpace(record[0])
+        userID := strings.TrimSpace(record[1])
+        rating, err := ratingMaximo, error(nil)
+        if !evento {
+            rating, err = strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+        }
+        if err != nil {
+            reporte.RatingsNoNumericos++
+            reporte.agregarEjemplo("línea %d: rating no numérico %q", linea, record[2])
+            continue
+        }
+        if math.IsNaN(rating) || rating < ratingMinimo || rating > ratingMaximo {
+            reporte.FueraDeRango++
+            reporte.agregarEjemplo("línea %d: rating %v fuera de rango", linea, rating)
+            continue
+        }
+        if catalogo != nil {
+            if _, existe := catalogo[movieID]; !existe {
+                reporte.FilasPeliculaNoExiste++
+                if !desconocidas[movieID] {
+                    desconocidas[movieID] = true
+                    reporte.PeliculasDesconocidas = append(reporte.PeliculasDesconocidas, movieID)
+                    reporte.agregarEjemplo("línea %d: MovieID %s no está en el catálogo", linea, movieID)
+                }
+                if estricto {
+                    continue
+                }
+            }
+        }
+
+        clave := userID + "|" + movieID
+        if evento {
+            if !eventosVistos[clave] {
+                eventosVistos[clave] = true
+                eventos[userID] = append(eventos[userID], Rating{UserID: userID, MovieID: movieID, Rating: rating})
+            }
+            continue
+        }
+        pos, duplicado := vistos[clave]
+        if !duplicado {
+            vistos[clave] = len(userRatings[userID])
+            apariciones[clave] = 1
+            userRatings[userID] = append(userRatings[userID], Rating{
+                UserID:  userID,
+                MovieID: movieID,
+                Rating:  rating,
+            })
+            continue
+        }
+
+        reporte.Duplicados++
+        reporte.agregarEjemplo("línea %d: par usuario %s / película %s duplicado", linea, userID, movieID)
+        switch politica {
+        case "ultimo":
+            userRatings[userID][pos].Rating = rating
+        case "promedio":
+            n := float64(apariciones[clave])
+            userRatings[userID][pos].Rating = (userRatings[userID][pos].Rating*n + rating) / (n + 1)
+        case "descartar":
+            descartados[clave] = true
+        }
+        apariciones[clave]++
+    }
+
+    if len(descartados) > 0 {
+        for userID, ratings := range userRatings {
+            filtrados := ratings[:0]
+            for _, rating := range ratings {
+                if !descartados[userID+"|"+rating.MovieID] {
+                    filtrados = append(filtrados, rating)
+                }
+            }
+            if len(filtrados) == 0 {
+                delete(userRatings, userID)
+            } else {
+                userRatings[userID] = filtrados
+            }
+        }
+    }
+
+    for userID, interacciones := range eventos {
+        calificadas := make(map[string]bool, len(userRatings[userID]))
+        for _, rating := range userRatings[userID] {
+            calificadas[rating.MovieID] = true
+        }
+        nuevos := interacciones[:0]
+        for _, interaccion := range interacciones {
+            if !calificadas[interaccion.MovieID] {
+                nuevos = append(nuevos, interaccion)
+            }
+        }
+        if len(nuevos) == 0 {
+            delete(eventos, userID)
+        } else {
+            eventos[userID] = nuevos
+        }
+        reporte.EventosImplicitos += len(nuevos)
+    }
+
+    peliculas := make(map[string]bool)
+    for _, ratings := range userRatings {
+        reporte.FilasAceptadas += len(ratings)
+        for _, rating := range ratings {
+            peliculas[rating.MovieID] = true
+        }
+    }
+    reporte.Usuarios = len(userRatings)
+    reporte.Peliculas = len(peliculas)
+    sort.Strings(reporte.PeliculasDesconocidas)
+
+    return userRatings, eventos, reporte, nil
+}
+
+// Particionador reparte los ratings de entrenamiento entre los nodos. Cada
+// partición recibe aproximadamente la fracción pesos[i] de los ratings y, para
+// una misma entrada, pesos y semilla, el resultado es siempre el mismo.
+type Particionador interface {
+    Nombre() string
+    Particionar(ratings []Rating, pesos []float64, seed int64) [][]Rating
+}
+
+var particionadores = map[string]Particionador{
+    "roundrobin":   particionRoundRobin{},
+    "hash-usuario": particionHash{porItem: false},
+    "hash-item":    particionHash{porItem: true},
+    "rango":        particionRango{},
+}
+
+// particionRoundRobin baraja los ratings con la semilla y los reparte en turno
+// (round-robin ponderado suave, que con pesos iguales es el turno clásico).
+type particionRoundRobin struct{}
+
+func (particionRoundRobin) Nombre() string { return "roundrobin" }
+
+func (particionRoundRobin) Particionar(ratings []Rating, pesos []float64, seed int64) [][]Rating {
+    orden := rand.New(rand.NewSource(seed)).Perm(len(ratings))
+    particiones := make([][]Rating, len(pesos))
+    actual := make([]float64, len(pesos))
+    for _, idx := range orden {
+        elegido := 0
+        for i, peso := range pesos {
+            actual[i] += peso
+            if actual[i] > actual[elegido] {
+                elegido = i
+            }
+        }
+        actual[elegido] -= 1.0
+        particiones[elegido] = append(particiones[elegido], ratings[idx])
+    }
+    return particiones
+}
+
+// particionHash asigna cada rating según el hash de su usuario o de su
+// película, de modo que todos los ratings de una misma clave van al mismo nodo.
+type particionHash struct {
+    porItem bool
+}
+
+func (p particionHash) Nombre() string {
+    if p.porItem {
+        return "hash-item"
+    }
+    return "hash-usuario"
+}
+
+func (p particionHash) Particionar(ratings []Rating, pesos []float64, seed int64) [][]Rating {
+    acumulados := acumularPesos(pesos)
+    particiones := make([][]Rating, len(pesos))
+    for _, rating := range ratings {
+        clave := rating.UserID
+        if p.porItem {
+            clave = rating.MovieID
+        }
+        // Los 53 bits altos del hash dan un punto uniforme en [0, 1)
+        punto := float64(hashClave(clave, seed)>>11) / (1 << 53)
+        idx := elegirPorPeso(acumulados, punto)
+        particiones[idx] = append(particiones[idx], rating)
+    }
+    return particiones
+}
+
+func hashClave(clave string, seed int64) uint64 {
+    h := fnv.New64a()
+    var buf [8]byte
+    binary.LittleEndian.PutUint64(buf[:], uint64(seed))
+    h.Write(buf[:])
+    h.Write([]byte(clave))
+    // Mezcla final (fmix64 de MurmurHash3): FNV reparte mal los bits altos
+    // cuando las claves son cortas, como los IDs numéricos
+    x := h.Sum64()
+    x ^= x >> 33
+    x *= 0xff51afd7ed558ccd
+    x ^= x >> 33
+    x *= 0xc4ceb9fe1a85ec53
+    x ^= x >> 33
+    return x
+}
+
+// acumularPesos devuelve los límites superiores de cada partición en [0, 1].
+func acumularPesos(pesos []float64) []float64 {
+    acumulados := make([]float64, len(pesos))
+    suma := 0.0
+    for i, peso := range pesos {
+        suma += peso
+        acumulados[i] = suma
+    }
+    for i := range acumulados {
+        acumulados[i] /= suma
+    }
+    return acumulados
+}
+
+func elegirPorPeso(acumulados []float64, punto float64) int {
+    idx := sort.SearchFloat64s(acumulados, punto)
+    // SearchFloat64s devuelve el primer límite >= punto; un punto igual al
+    // límite pertenece a la partición siguiente
+    for idx < len(acumulados)-1 && acumulados[idx] <= punto {
+        idx++
+    }
+    if idx >= len(acumulados) {
+        idx = len(acumulados) - 1
+    }
+    return idx
+}
+
+// particionRango ordena las películas por ID y asigna a cada nodo un bloque
+// contiguo de películas con una cantidad de ratings proporcional a su peso.
+type particionRango struct{}
+
+func (particionRango) Nombre() string { return "rango" }
+
+func (particionRango) Particionar(ratings []Rating, pesos []float64, seed int64) [][]Rating {
+    conteo := make(map[string]int)
+    for _, rating := range ratings {
+        conteo[rating.MovieID]++
+    }
+    peliculas := make([]string, 0, len(conteo))
+    for movieID := range conteo {
+        peliculas = append(peliculas, movieID)
+    }
+    sort.Slice(peliculas, func(i, j int) bool {
+        return compararIDs(peliculas[i], peliculas[j]) < 0
+    })
+
+    acumulados := acumularPesos(pesos)
+    bloque := make(map[string]int, len(peliculas))
+    acumulado := 0
+    for _, movieID := range peliculas {
+        // El bloque se decide por el punto medio de los ratings de la película
+        medio := float64(acumulado) + float64(conteo[movieID])/2
+        bloque[movieID] = elegirPorPeso(acumulados, medio/float64(len(ratings)))
+        acumulado += conteo[movieID]
+    }
+
+    particiones := make([][]Rating, len(pesos))
+    for _, rating := range ratings {
+        idx := bloque[rating.MovieID]
+        particiones[idx] = append(particiones[idx], rating)
+    }
+    return particiones
+}
+
+// compararIDs ordena numéricamente los IDs enteros y alfabéticamente el resto.
+func compararIDs(a, b string) int {
+    na, errA := strconv.ParseInt(a, 10, 64)
+    nb, errB := strconv.ParseInt(b, 10, 64)
+    if errA == nil && errB == nil {
+        switch {
+        case na < nb:
+            return -1
+        case na > nb:
+            return 1
+        }
+    }
+    // IDs no numéricos, o iguales como número ("7" y "07")
+    return strings.Compare(a, b)
+}
+
+// ratingsOrdenados devuelve los ratings de todos los usuarios salvo el
+// objetivo en un orden estable, independiente del orden de iteración del map.
+func ratingsOrdenados(userRatings map[string][]Rating, excluirUserID string) []Rating {
+    usuarios := make([]string, 0, len(userRatings))
+    total := 0
+    for userID, ratings := range userRatings {
+        if userID != excluirUserID {
+            usuarios = append(usuarios, userID)
+            total += len(ratings)
+        }
+    }
+    sort.Slice(usuarios, func(i, j int) bool {
+        return compararIDs(usuarios[i], usuarios[j]) < 0
+    })
+
+    ratings := make([]Rating, 0, total)
+    for _, userID := range usuarios {
+        ratings = append(ratings, userRatings[userID]...)
+    }
+    return ratings
+}
+
+func splitDataset(userRatings map[string][]Rating, pesos []float64, particionador Particionador, seed int64) [][]Rating {
+    particiones := particionador.Particionar(ratingsOrdenados(userRatings, ""), pesos, seed)
+    fmt.Printf("Dataset particionado con %s (seed %d):", particionador.Nombre(), seed)
+    for i, particion := range particiones {
+        fmt.Printf(" %d (%.1f%%)", len(particion), pesos[i]*100)
+    }
+    fmt.Println()
+    return particiones
+}
+
+// ShardSet es el reparto del dataset entre los nodos para una versión dada.
+// La versión es "<esquema>/<huella>-<semilla>-<pesos>": el esquema es la
+// estrategia de partición (con "+eventos" si incluye los eventos implícitos
+// de BPR) y la huella la del dataset (y la de los eventos), de modo que la
+// versión cambia si cambia cualquiera de ellos.
+type ShardSet struct {
+    Version string
+    Shards  [][]Rating
+    // Nodos que guardan cada shard, empezando por el primario
+    Replicas [][]string
+    // Semilla y pesos del reparto, ratings repartidos y ratings incorporados
+    // al dataset hasta entonces, para decidir si un reentrenamiento lo renueva
+    Firma        string
+    Ratings      int
+    Incorporados int
+}
+
+var (
+    // Un reparto vigente por esquema: los nodos guardan un shard por esquema
+    // e índice, así que alternar entre vecinos (rango) y factorización
+    // (roundrobin) o correr ambos a la vez no vuelve a subir los shards
+    conjuntosShards = make(map[string]*ShardSet)
+    // Versión confirmada de cada shard en cada nodo:
+    // estadoReplicas[nodo][claveReplica(version, shard)]
+    estadoReplicas = make(map[string]map[string]string)
+    muShards       sync.Mutex
+)
+
+// esquemaDeVersion es la parte de la versión que identifica el reparto.
+func esquemaDeVersion(version string) string {
+    esquema, _, _ := strings.Cut(version, "/")
+    return esquema
+}
+
+func claveReplica(version string, indice int) string {
+    return fmt.Sprintf("%s/%d", esquemaDeVersion(version), indice)
+}
+
+// ubicarReplicas elige los nodos que guardan cada shard. El primario del
+// shard i es el nodo i, cuyo shard ya tiene el tamaño de su capacidad. Cada
+// réplica extra va al nodo sin ese shard que quede con menos carga relativa a
+// su peso, así que un nodo con el doble de capacidad guarda el doble de
+// réplicas. Los shards se ubican de mayor a menor para repartir mejor.
+func ubicarReplicas(pesos []float64, replicacion int) [][]string {
+    carga := append([]float64(nil), pesos...)
+    orden := make([]int, len(pesos))
+    for i := range orden {
+        orden[i] = i
+    }
+    sort.SliceStable(orden, func(a, b int) bool { return pesos[orden[a]] > pesos[orden[b]] })
+
+    replicas := make([][]string, len(pesos))
+    for _, i := range orden {
+        replicas[i] = []string{addrs[i]}
+        usados := map[int]bool{i: true}
+        for r := 1; r < replicacion; r++ {
+            elegido := -1
+            for j := range pesos {
+                if usados[j] || pesos[j] <= 0 {
+                    continue
+                }
+                if elegido < 0 || (carga[j]+pesos[i])/pesos[j] < (carga[elegido]+pesos[i])/pesos[elegido] {
+                    elegido = j
+                }
+            }
+            if elegido < 0 {
+                break
+            }
+            usados[elegido] = true
+            carga[elegido] += pesos[i]
+            replicas[i] = append(replicas[i], addrs[elegido])
+        }
+    }
+    return replicas
+}
+
+func replicaSincronizada(addr string, indice int, version string) bool {
+    muShards.Lock()
+    defer muShards.Unlock()
+    return estadoReplicas[addr][claveReplica(version, indice)] == version
+}
+
+func marcarReplica(addr string, indice int, version string) {
+    muShards.Lock()
+    defer muShards.Unlock()
+    if estadoReplicas[addr] == nil {
+        estadoReplicas[addr] = make(map[string]string)
+    }
+    estadoReplicas[addr][claveReplica(version, indice)] = version
+}
+
+// olvidarReplica registra que el nodo ya no tiene el shard del esquema de
+// version.
+func olvidarReplica(addr string, indice int, version string) {
+    muShards.Lock()
+    defer muShards.Unlock()
+    delete(estadoReplicas[addr], claveReplica(version, indice))
+}
+
+func calcularHuella(userRatings map[string][]Rating) string {
+    h := sha256.New()
+    writer := bufio.NewWriter(h)
+    for _, rating := range ratingsOrdenados(userRatings, "") {
+        fmt.Fprintf(writer, "%s,%s,%g\n", rating.UserID, rating.MovieID, rating.Rating)
+    }
+    writer.Flush()
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// agregarEventos suma a los ratings de un usuario sus interacciones sin
+// rating en películas que no calificó.
+func agregarEventos(ratings, eventos []Rating) []Rating {
+    if len(eventos) == 0 {
+        return ratings
+    }
+    calificadas := make(map[string]bool, len(ratings))
+    for _, rating := range ratings {
+        calificadas[rating.MovieID] = true
+    }
+    combinados := append(make([]Rating, 0, len(ratings)+len(eventos)), ratings...)
+    for _, evento := range eventos {
+        if !calificadas[evento.MovieID] {
+            combinados = append(combinados, evento)
+        }
+    }
+    return combinados
+}
+
+func prepararShards(opciones OpcionesJob) *ShardSet {
+    pesos := pesosNodos()
+    firmaPesos := fnv.New32a()
+    for _, peso := range pesos {
+        fmt.Fprintf(firmaPesos, "%.3f;", peso)
+    }
+
+    muDataset.RLock()
+    actual, huella, incorporados := dataset, huellaDataset[:12], ratingsIncorporados
+    muDataset.RUnlock()
+    // BPR entrena también con las interacciones sin rating
+    esquema := opciones.Particion
+    conEventos := opciones.Objetivo == objetivoBPR && len(eventosImplicitos) > 0
+    if conEventos {
+        esquema += "+eventos"
+        huella += "+" + huellaEventos[:8]
+    }
+
+    muShards.Lock()
+    defer muShards.Unlock()
+
+    firma := fmt.Sprintf("%d-%08x", opciones.Seed, firmaPesos.Sum32())
+    version := fmt.Sprintf("%s/%s-%s", esquema, huella, firma)
+    actuales := conjuntosShards[esquema]
+    if actuales != nil && actuales.Version == version {
+        return actuales
+    }
+    // Si desde el reparto se incorporaron pocos ratings los nodos conservan
+    // sus shards: el usuario objetivo viaja con el job con todos sus ratings
+    // y un cambio mayor que la tolerancia vuelve a repartir
+    if actuales != nil && actuales.Firma == firma && float64(incorporados-actuales.Incorporados) <= toleranciaShards*float64(actuales.Ratings) {
+        return actuales
+    }
+    if conEventos {
+        combinado := make(map[string][]Rating, len(actual)+len(eventosImplicitos))
+        for userID, ratings := range actual {
+            combinado[userID] = ratings
+        }
+        for userID, eventos := range eventosImplicitos {
+            combinado[userID] = agregarEventos(actual[userID], eventos)
+        }
+        actual = combinado
+    }
+    shards := splitDataset(actual, pesos, particionadores[opciones.Particion], opciones.Seed)
+    repartidos := 0
+    for _, shard := range shards {
+        repartidos += len(shard)
+    }
+    conjuntosShards[esquema] = &ShardSet{
+        Version:      version,
+        Shards:       shards,
+        Replicas:     ubicarReplicas(pesos, factorReplicacion),
+        Firma:        firma,
+        Ratings:      repartidos,
+        Incorporados: incorporados,
+    }
+    return conjuntosShards[esquema]
+}
+
+// ProgresoSubida describe el avance del envío de un shard a una réplica.
+type ProgresoSubida struct {
+    Nodo         string    `json:"nodo"`
+    Shard        int       `json:"shard"`
+    Version      string    `json:"version"`
+    Enviados     int       `json:"enviados"`
+    Total        int       `json:"total"`
+    Estado       string    `json:"estado"`
+    Error        string    `json:"error,omitempty"`
+    Codificacion string    `json:"codificacion"`
+    BytesCrudos  int64     `json:"bytesCrudos"`
+    BytesRed     int64     `json:"bytesRed"`
+    Inicio       time.Time `json:"inicio"`
+    Fin          time.Time `json:"fin,omitempty"`
+}
+
+var (
+    progresoSubidas = make(map[string]*ProgresoSubida)
+    muProgreso      sync.Mutex
+    // Un candado por nodo y shard evita subir dos veces la misma réplica
+    // cuando dos jobs la necesitan a la vez
+    candadosSubida = make(map[string]*sync.Mutex)
+    // Limita las subidas simultáneas y con ello la memoria de los buffers
+    semaforoSubidas chan struct{}
+)
+
+const tamBufferSubida = 64 * 1024
+
+func candadoSubida(clienteIP string, version string, indice int) *sync.Mutex {
+    muProgreso.Lock()
+    defer muProgreso.Unlock()
+    clave := clienteIP + "/" + claveReplica(version, indice)
+    if candadosSubida[clave] == nil {
+        candadosSubida[clave] = &sync.Mutex{}
+    }
+    return candadosSubida[clave]
+}
+
+func actualizarProgreso(progreso *ProgresoSubida, enviados int, estado string, err error) {
+    muProgreso.Lock()
+    defer muProgreso.Unlock()
+    progreso.Enviados = enviados
+    progreso.Estado = estado
+    if err != nil {
+        progreso.Error = err.Error()
+    }
+    if estado != "enviando" {
+        progreso.Fin = time.Now()
+    }
+}
+
+func copiaProgresoSubidas() []ProgresoSubida {
+    muProgreso.Lock()
+    defer muProgreso.Unlock()
+    listado := make([]ProgresoSubida, 0, len(progresoSubidas))
+    for _, progreso := range progresoSubidas {
+        listado = append(listado, *progreso)
+    }
+    sort.Slice(listado, func(i, j int) bool {
+        if listado[i].Shard != listado[j].Shard {
+            return listado[i].Shard < listado[j].Shard
+        }
+        return listado[i].Nodo < listado[j].Nodo
+    })
+    return listado
+}
+
+// contadorEscritura cuenta los bytes que pasan hacia el escritor subyacente.
+type contadorEscritura struct {
+    w     io.Writer
+    bytes int64
+}
+
+func (c *contadorEscritura) Write(p []byte) (int, error) {
+    n, err := c.w.Write(p)
+    c.bytes += int64(n)
+    return n, err
+}
+
+// Codificación de un shard en la red: compresión del flujo (gzip o flate) y
+// formato de los registros (texto "user,movie,rating" o delta con varints).
+type codificacionShard struct {
+    Compresion string
+    Formato    string
+}
+
+func (c codificacionShard) String() string {
+    return c.Compresion + "+" + c.Formato
+}
+
+// negociarCodificacion elige la codificación preferida por el coordinador
+// entre las que el nodo anunció al registrarse.
+func negociarCodificacion(clienteIP string) codificacionShard {
+    codificacion := codificacionShard{Compresion: "ninguna", Formato: "texto"}
+
+    muNodos.Lock()
+    soportados := make(map[string]bool)
+    if info, existe := nodos[clienteIP]; existe {
+        for _, codec := range info.Codecs {
+            soportados[codec] = true
+        }
+    }
+    muNodos.Unlock()
+
+    if preferida := leerEnv("COMPRESION", "gzip"); soportados[preferida] {
+        codificacion.Compresion = preferida
+    }
+    if leerEnv("FORMATO_SHARD", "delta") == "delta" && soportados["delta"] {
+        codificacion.Formato = "delta"
+    }
+    return codificacion
+}
+
+// enviarShard transmite el shard en streaming a través de buffers de tamaño
+// fijo. La cabecera anuncia la cantidad de ratings y la codificación del
+// cuerpo, y el marcador final repite la cantidad para que el nodo pueda
+// verificar que recibió el shard completo.
+func enviarShard(job *Job, clienteIP string, version string, indice int, shard []Rating) (err error) {
+    codificacion := negociarCodificacion(clienteIP)
+    if codificacion.Formato == "delta" && !idsEnteros(shard) {
+        codificacion.Formato = "texto"
+    }
+    progreso := &ProgresoSubida{
+        Nodo:         clienteIP,
+        Shard:        indice,
+        Version:      version,
+        Total:        len(shard),
+        Estado:       "enviando",
+        Codificacion: codificacion.String(),
+        Inicio:       time.Now(),
+    }
+    muProgreso.Lock()
+    progresoSubidas[clienteIP+"/"+claveReplica(version, indice)] = progreso
+    muProgreso.Unlock()
+
+    enviados := 0
+    defer func() {
+        if err != nil {
+            actualizarProgreso(progreso, enviados, "error", err)
+        }
+    }()
+
+    semaforoSubidas <- struct{}{}
+    defer func() { <-semaforoSubidas }()
+
+    remoteDir := net.JoinHostPort(clienteIP, strconv.Itoa(portHP))
+    conn, err := seguridad.Conectar(remoteDir)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(timeoutReplica))
+    red := &contadorEscritura{w: conn}
+    salida := bufio.NewWriterSize(red, tamBufferSubida)
+    fmt.Fprintf(salida, "SHARD %s %d %d enc=%s formato=%s\n", version, indice, len(shard), codificacion.Compresion, codificacion.Formato)
+
+    var compresor io.WriteCloser
+    switch codificacion.Compresion {
+    case "gzip":
+        compresor = gzip.NewWriter(salida)
+    case "flate":
+        compresor, _ = flate.NewWriter(salida, flate.DefaultCompression)
+    }
+    var cuerpo *bufio.Writer
+    if compresor != nil {
+        cuerpo = bufio.NewWriterSize(compresor, tamBufferSubida)
+    } else {
+        cuerpo = salida
+    }
+
+    var crudos int64
+    ultimaActualizacion := 0
+    siguienteReporte := len(shard) / 4
+    avance := func(n int) {
+        enviados = n
+        if enviados-ultimaActualizacion >= 10000 {
+            actualizarProgreso(progreso, enviados, "enviando", nil)
+            ultimaActualizacion = enviados
+        }
+        if siguienteReporte > 0 && enviados >= siguienteReporte && enviados < len(shard) {
+            fmt.Printf("Shard %d -> %s: %d%% (%d/%d)\n", indice, clienteIP, enviados*100/len(shard), enviados, len(shard))
+            for siguienteReporte <= enviados {
+                siguienteReporte += len(shard) / 4
+            }
+        }
+    }
+    if codificacion.Formato == "delta" {
+        crudos, err = escribirShardDelta(cuerpo, shard, avance)
+    } else {
+        crudos, err = escribirShardTexto(cuerpo, shard, avance)
+    }
+    if err != nil {
+        return err
+    }
+    enviados = len(shard)
+    fmt.Fprintf(cuerpo, "FIN_SHARD %d\n", len(shard))
+    if err := cuerpo.Flush(); err != nil {
+        return err
+    }
+    if compresor != nil {
+        if err := compresor.Close(); err != nil {
+            return err
+        }
+        if err := salida.Flush(); err != nil {
+            return err
+        }
+    }
+
+    respuesta, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        return err
+    }
+    if strings.TrimSpace(respuesta) != fmt.Sprintf("OK %s %d", version, indice) {
+        return fmt.Errorf("respuesta inesperada: %s", strings.TrimSpace(respuesta))
+    }
+
+    marcarReplica(clienteIP, indice, version)
+    muProgreso.Lock()
+    progreso.BytesCrudos = crudos
+    progreso.BytesRed = red.bytes
+    muProgreso.Unlock()
+    actualizarProgreso(progreso, enviados, "completo", nil)
+    if job != nil {
+        job.mu.Lock()
+        job.reporte.Transferencia.sumar(codificacion.String(), crudos, red.bytes)
+        job.mu.Unlock()
+    }
+    fmt.Printf("Shard %d (%s) enviado a %s: %d ratings, %d bytes crudos, %d en la red con %s, en %v\n",
+        indice, version, clienteIP, len(shard), crudos, red.bytes, codificacion, time.Since(progreso.Inicio).Round(time.Millisecond))
+    return nil
+}
+
+func longitudTexto(rating Rating) int64 {
+    return int64(len(rating.UserID) + len(rating.MovieID) + len(strconv.FormatFloat(rating.Rating, 'f', 2, 64)) + 3)
+}
+
+// escribirShardTexto envía una línea "user,movie,rating" por rating y
+// devuelve los bytes escritos sin comprimir.
+func escribirShardTexto(writer *bufio.Writer, shard []Rating, avance func(int)) (int64, error) {
+    var crudos int64
+    for i, rating := range shard {
+        writer.WriteString(rating.UserID)
+        writer.WriteByte(',')
+        writer.WriteString(rating.MovieID)
+        writer.WriteByte(',')
+        writer.WriteString(strconv.FormatFloat(rating.Rating, 'f', 2, 64))
+        if err := writer.WriteByte('\n'); err != nil {
+            return crudos, err
+        }
+        crudos += longitudTexto(rating)
+        avance(i + 1)
+    }
+    return crudos, nil
+}
+
+// idsEnteros indica si todos los IDs son enteros en forma canónica (sin ceros
+// a la izquierda), de modo que el nodo los reconstruya idénticos.
+func idsEnteros(shard []Rating) bool {
+    canonico := func(id string) bool {
+        valor, err := strconv.ParseUint(id, 10, 63)
+        return err == nil && strconv.FormatUint(valor, 10) == id
+    }
+    for _, rating := range shard {
+        if !canonico(rating.UserID) || !canonico(rating.MovieID) {
+            return false
+        }
+    }
+    return true
+}
+
+// escribirShardDelta envía el shard en el formato del paquete delta, que
+// exige IDs enteros (idsEnteros). Devuelve los bytes que habría ocupado el
+// shard como texto.
+func escribirShardDelta(writer *bufio.Writer, shard []Rating, avance func(int)) (int64, error) {
+    registros := make([]delta.Registro, len(shard))
+    var crudos int64
+    for i, rating := range shard {
+        usuario, _ := strconv.ParseUint(rating.UserID, 10, 63)
+        pelicula, _ := strconv.ParseUint(rating.MovieID, 10, 63)
+        registros[i] = delta.Registro{Usuario: usuario, Pelicula: pelicula, Rating: rating.Rating}
+        crudos += longitudTexto(rating)
+    }
+    return crudos, delta.Escribir(writer, registros, avance)
+}
+
+// sincronizarReplica sube el shard a la réplica si todavía no tiene la
+// versión vigente.
+func sincronizarReplica(job *Job, clienteIP string, shards *ShardSet, indice int) error {
+    candado := candadoSubida(clienteIP, shards.Version, indice)
+    candado.Lock()
+    defer candado.Unlock()
+    if replicaSincronizada(clienteIP, indice, shards.Version) {
+        return nil
+    }
+    return enviarShard(job, clienteIP, shards.Version, indice, shards.Shards[indice])
+}
+
+// ratingsFueraDelShard devuelve los ratings del usuario objetivo que el shard
+// no tiene ya con el mismo valor. El nodo entrena con el shard más estos
+// ratings, así que cada rating del objetivo viaja y cuenta una sola vez.
+func ratingsFueraDelShard(objetivo []Rating, shard []Rating) []Rating {
+    if len(objetivo) == 0 {
+        return objetivo
+    }
+    enShard := make(map[string]float64)
+    for _, rating := range shard {
+        if rating.UserID == objetivo[0].UserID {
+            enShard[rating.MovieID] = rating.Rating
+        }
+    }
+    faltantes := make([]Rating, 0, len(objetivo))
+    for _, rating := range objetivo {
+        if valor, existe := enShard[rating.MovieID]; !existe || valor != rating.Rating {
+            faltantes = append(faltantes, rating)
+        }
+    }
+    return faltantes
+}
+
+// enviarJob manda al nodo los ratings del usuario objetivo que su shard no
+// tiene y los hiperparámetros. Devuelve errSinShard si el nodo no tiene la
+// versión pedida.
+func enviarJob(clienteIP string, shards *ShardSet, indice int, job *Job, clientData ClientData, opciones OpcionesJob) error {
+    remoteDir := net.JoinHostPort(clienteIP, strconv.Itoa(portHP))
+    conn, err := seguridad.Conectar(remoteDir)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(timeoutConexion))
+    writer := bufio.NewWriter(conn)
+    fmt.Fprintf(writer, "JOB %s %s %d\n", shards.Version, job.ID, indice)
+    fmt.Fprintf(writer, "UserID: %s\n", clientData.UserID)
+    if esKNN(opciones) {
+        escribirParamsKNN(writer, opciones)
+    } else {
+        escribirParamsEntrenamiento(writer, opciones)
+    }
+    fmt.Fprintf(writer, "PARAM modo=%s\n", opciones.Modo)
+    for _, rating := range ratingsFueraDelShard(clientData.Data, shards.Shards[indice]) {
+        fmt.Fprintf(writer, "%s,%s,%.2f\n", rating.UserID, rating.MovieID, rating.Rating)
+    }
+    if opciones.Algoritmo == algoritmoKNNItems {
+        escribirReferencias(writer, job, indice)
+    }
+    fmt.Fprintln(writer, "FIN_JOB")
+    if err := writer.Flush(); err != nil {
+        return err
+    }
+
+    respuesta, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        return err
+    }
+    respuesta = strings.TrimSpace(respuesta)
+    if strings.HasPrefix(respuesta, "SIN_SHARD") {
+        olvidarReplica(clienteIP, indice, shards.Version)
+        return errSinShard
+    }
+    if respuesta != "OK" {
+        return fmt.Errorf("respuesta inesperada: %s", respuesta)
+    }
+    return nil
+}
+
+var errSinShard = errors.New("el nodo no tiene el shard vigente")
+
+// sincronizarShards envía en paralelo cada shard a las réplicas que no tienen
+// la versión vigente. Una réplica que falla queda pendiente y se reintenta al
+// usarla.
+func sincronizarShards(job *Job, shards *ShardSet) {
+    var wg sync.WaitGroup
+    for indice := range shards.Shards {
+        for _, clienteIP := range shards.Replicas[indice] {
+            if replicaSincronizada(clienteIP, indice, shards.Version) {
+                continue
+            }
+            wg.Add(1)
+            go func(clienteIP string, indice int) {
+                defer wg.Done()
+                if err := sincronizarReplica(job, clienteIP, shards, indice); err != nil {
+                    fmt.Printf("Error enviando el shard %d a %s: %v\n", indice, clienteIP, err)
+                }
+            }(clienteIP, indice)
+        }
+    }
+    wg.Wait()
+}
+
+// despacharShard envía el job del shard a sus réplicas, empezando por la
+// réplica desde, hasta que una lo acepte. Devuelve la réplica elegida o -1.
+func despacharShard(job *Job, clientData ClientData, shards *ShardSet, opciones OpcionesJob, indice int, desde int) int {
+    replicas := shards.Replicas[indice]
+    for r := desde; r < len(replicas); r++ {
+        clienteIP := replicas[r]
+        for intento := 0; intento < 2; intento++ {
+            if err := sincronizarReplica(job, clienteIP, shards, indice); err != nil {
+                fmt.Printf("Error enviando el shard %d a %s: %v\n", indice, clienteIP, err)
+                break
+            }
+            // Marcarlo antes de enviarlo: el resultado puede llegar antes de
+            // que el nodo termine de confirmar el job
+            job.mu.Lock()
+            job.despachados[indice] = true
+            job.mu.Unlock()
+            err := enviarJob(clienteIP, shards, indice, job, clientData, opciones)
+            if err == errSinShard {
+                // El nodo perdió su shard (por ejemplo, se reinició): resincronizar
+                continue
+            }
+            if err != nil {
+                fmt.Printf("Error enviando el job a %s: %v\n", clienteIP, err)
+                break
+            }
+            fmt.Printf("Job %s: shard %d enviado a %s\n", job.ID, indice, clienteIP)
+            return r
+        }
+    }
+    return -1
+}
+
+func manejarConexion(reader *bufio.Reader, job *Job, indice int, nodo string) {
+    tempResults := []Recommendation{}
+    curva := &curvaRecibida{}
+
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            // Un resultado sin FIN_TOP5 puede estar truncado: el shard se
+            // pide a otra réplica
+            motivo := fmt.Sprintf("error leyendo el resultado: %v", err)
+            if err == io.EOF {
+                motivo = "conexión cerrada antes de FIN_TOP5"
+            }
+            aceptarResultado(job, indice, nodo, motivo)
+            return
+        }
+
+        line = strings.TrimSpace(line)
+        if line == "FIN_TOP5" {
+            fmt.Println("Fin del Top 5 recibido.")
+            break
+        }
+        if curva.leer(line) {
+            continue
+        }
+
+        parts := strings.Split(line, ",")
+        if len(parts) != 2 {
+            fmt.Printf("Datos no válidos: %s\n", line)
+            continue
+        }
+
+        movieID := parts[0]
+        rating, err := strconv.ParseFloat(parts[1], 64)
+        if err != nil {
+            fmt.Printf("Error al parsear el rating: %v\n", err)
+            continue
+        }
+
+        tempResults = append(tempResults, Recommendation{
+            MovieID: movieID,
+            Rating:  rating,
+        })
+    }
+
+    registrarConvergencia(job, indice, nodo, curva)
+    validos, fueraDeEscala, motivo := validarPuntajes(tempResults, job.opciones)
+    if !aceptarResultado(job, indice, nodo, motivo) {
+        return
+    }
+    sumarFueraDeEscala(job, indice, nodo, fueraDeEscala)
+    actualizarTopGlobal(job, indice, nodo, validos)
+    job.resultados <- indice
+}
+
+// aceptarResultado decide si el resultado de un nodo para un shard entra en
+// el job. Con réplicas solo cuenta el primer resultado válido de cada shard;
+// si motivo no es vacío el resultado se registra como excluido y el shard se
+// pide a otra réplica.
+func aceptarResultado(job *Job, indice int, nodo string, motivo string) bool {
+    job.mu.Lock()
+    repetido := job.recibidos[indice]
+    if !repetido {
+        if motivo != "" {
+            job.reporte.Exclusiones = append(job.reporte.Exclusiones, ExclusionResultado{Shard: indice, Nodo: nodo, Motivo: motivo})
+        } else {
+            job.recibidos[indice] = true
+        }
+    }
+    job.mu.Unlock()
+    if repetido {
+        fmt.Printf("Job %s: resultado repetido del shard %d descartado\n", job.ID, indice)
+        return false
+    }
+    if motivo != "" {
+        fmt.Printf("Job %s: resultado del shard %d de %s descartado: %s\n", job.ID, indice, nodo, motivo)
+        select {
+        case job.rechazados <- indice:
+        default:
+        }
+        return false
+    }
+    return true
+}
+
+// Agregación robusta. Cada nodo entrena sobre su propio shard, así que un
+// SGD divergente o un nodo comprometido puede devolver puntajes absurdos; esos
+// resultados se descartan antes de combinar los puntajes de cada película.
+// Además de combinar puntajes, las estrategias de fusión por ranking usan solo
+// la posición de cada película en el top de cada nodo.
+
+// margenPuntaje es cuánto puede salirse una predicción de la escala de
+// ratings antes de considerarla inválida: la factorización no acota el
+// producto punto, pero un modelo sano no se aleja mucho de [1,5].
+const margenPuntaje = 1.0
+
+const (
+    // Desviación robusta a partir de la cual un nodo se considera atípico
+    umbralAtipico = 3.5
+    // Escala mínima para la desviación robusta, para que nodos casi iguales
+    // no se marquen como atípicos por diferencias insignificantes
+    escalaMinimaAtipicos = 0.25
+)
+
+// resultadoShard es el top que devolvió un nodo para un shard.
+type resultadoShard struct {
+    Nodo     string
+    Puntajes []Recommendation
+}
+
+// Voto es la aparición de una película en el top de un nodo.
+type Voto struct {
+    Puntaje  float64
+    Posicion int     // 0 para la primera película del top
+    Largo    int     // cantidad de películas en ese top
+    Peso     float64 // ratings del shard con que se entrenó el nodo
+}
+
+func puntajes(votos []Voto) []float64 {
+    valores := make([]float64, len(votos))
+    for i, voto := range votos {
+        valores[i] = voto.Puntaje
+    }
+    return valores
+}
+
+// Agregador combina los votos que distintos nodos dieron a una película en
+// el valor por el que se ordena el top global.
+type Agregador interface {
+    Nombre() string
+    Agregar(votos []Voto) float64
+}
+
+// constanteRRF amortigua el peso de las primeras posiciones en la fusión por
+// ranking recíproco; 60 es el valor habitual.
+const constanteRRF = 60
+
+var agregadores = map[string]Agregador{
+    "promedio":  agregadorPromedio{},
+    "mediana":   agregadorMediana{},
+    "recortada": mediaRecortada{fraccion: 0.2},
+    "ponderado": promedioPonderado{},
+    "borda":     conteoBorda{},
+    "rrf":       rankingReciproco{},
+    "votos":     conteoVotos{},
+}
+
+type agregadorPromedio struct{}
+
+func (agregadorPromedio) Nombre() string { return "promedio" }
+
+func (agregadorPromedio) Agregar(votos []Voto) float64 { return promedio(puntajes(votos)) }
+
+type agregadorMediana struct{}
+
+func (agregadorMediana) Nombre() string { return "mediana" }
+
+func (agregadorMediana) Agregar(votos []Voto) float64 { return mediana(puntajes(votos)) }
+
+// promedioPonderado pondera cada puntaje por el tamaño del shard del nodo, ya
+// que un modelo entrenado con más ratings es más confiable.
+type promedioPonderado struct{}
+
+func (promedioPonderado) Nombre() string { return "ponderado" }
+
+func (promedioPonderado) Agregar(votos []Voto) float64 {
+    suma, pesos := 0.0, 0.0
+    for _, voto := range votos {
+        suma += voto.Peso * voto.Puntaje
+        pesos += voto.Peso
+    }
+    if pesos == 0 {
+        return promedio(puntajes(votos))
+    }
+    return suma / pesos
+}
+
+// conteoBorda da a cada película tantos puntos como películas quedaron por
+// debajo de ella en cada top.
+type conteoBorda struct{}
+
+func (conteoBorda) Nombre() string { return "borda" }
+
+func (conteoBorda) Agregar(votos []Voto) float64 {
+    puntos := 0
+    for _, voto := range votos {
+        puntos += voto.Largo - voto.Posicion
+    }
+    return float64(puntos)
+}
+
+type rankingReciproco struct{}
+
+func (rankingReciproco) Nombre() string { return "rrf" }
+
+func (rankingReciproco) Agregar(votos []Voto) float64 {
+    suma := 0.0
+    for _, voto := range votos {
+        suma += 1 / float64(constanteRRF+voto.Posicion+1)
+    }
+    return suma
+}
+
+// conteoVotos ordena por cantidad de nodos que recomiendan la película; los
+// empates se resuelven por el puntaje promedio.
+type conteoVotos struct{}
+
+func (conteoVotos) Nombre() string { return "votos" }
+
+func (conteoVotos) Agregar(votos []Voto) float64 { return float64(len(votos)) }
+
+// mediaRecortada descarta la fracción indicada de puntajes en cada extremo
+// antes de promediar.
+type mediaRecortada struct {
+    fraccion float64
+}
+
+func (m mediaRecortada) Nombre() string {
+    return fmt.Sprintf("recortada(%g)", m.fraccion)
+}
+
+func (m mediaRecortada) Agregar(votos []Voto) float64 {
+    ordenados := puntajes(votos)
+    sort.Float64s(ordenados)
+    k := int(m.fraccion * float64(len(ordenados)))
+    return promedio(ordenados[k : len(ordenados)-k])
+}
+
+// agregadorDeJob devuelve el agregador pedido, con el recorte del job.
+func agregadorDeJob(opciones OpcionesJob) Agregador {
+    agregador, existe := agregadores[opciones.Agregacion]
+    if !existe {
+        return agregadorPromedio{}
+    }
+    if _, esRecortada := agregador.(mediaRecortada); esRecortada {
+        return mediaRecortada{fraccion: opciones.Recorte}
+    }
+    return agregador
+}
+
+func nombreAgregacion(opciones OpcionesJob) string {
+    nombre := agregadorDeJob(opciones).Nombre()
+    if detectaAtipicos(opciones) {
+        nombre += "+atipicos"
+    }
+    return nombre
+}
+
+// detectaAtipicos indica si el job compara los puntajes entre nodos. Los
+// puntajes BPR no tienen una escala común, así que no se comparan.
+func detectaAtipicos(opciones OpcionesJob) bool {
+    return opciones.DetectarAtipicos && opciones.Objetivo != objetivoBPR
+}
+
+// validarPuntajes devuelve los puntajes utilizables de un resultado, cuántos
+// descartó y el motivo por el que el resultado entero no es utilizable, o ""
+// si sus puntajes son finitos y, salvo con BPR, su mediana está en escala. El
+// producto punto no está acotado, así que un modelo sano puede predecir algo
+// más de 5 para sus mejores películas: dentro de margenPuntaje esos puntajes
+// se recortan a la escala, y más allá se descartan uno por uno en lugar de
+// descartar el resultado entero. Solo un modelo cuya mediana se sale de la
+// escala se considera divergente.
+func validarPuntajes(puntajes []Recommendation, opciones OpcionesJob) ([]Recommendation, int, string) {
+    valores := make([]float64, 0, len(puntajes))
+    for _, rec := range puntajes {
+        if math.IsNaN(rec.Rating) || math.IsInf(rec.Rating, 0) {
+            return nil, 0, fmt.Sprintf("puntaje no finito para la película %s", rec.MovieID)
+        }
+        valores = append(valores, rec.Rating)
+    }
+    if opciones.Objetivo == objetivoBPR || len(valores) == 0 {
+        return puntajes, 0, ""
+    }
+    if centro := mediana(valores); centro < ratingMinimo-margenPuntaje || centro > ratingMaximo+margenPuntaje {
+        return nil, 0, fmt.Sprintf("mediana de los puntajes %g fuera de escala", centro)
+    }
+    validos := make([]Recommendation, 0, len(puntajes))
+    for _, rec := range puntajes {
+        if rec.Rating < ratingMinimo-margenPuntaje || rec.Rating > ratingMaximo+margenPuntaje {
+            continue
+        }
+        rec.Rating = recortarRating(rec.Rating)
+        validos = append(validos, rec)
+    }
+    return validos, len(puntajes) - len(validos), ""
+}
+
+// sumarFueraDeEscala registra en el reporte los puntajes que validarPuntajes
+// descartó de un resultado aceptado.
+func sumarFueraDeEscala(job *Job, indice int, nodo string, descartados int) {
+    if descartados == 0 {
+        return
+    }
+    job.mu.Lock()
+    job.reporte.FueraDeEscala += descartados
+    job.mu.Unlock()
+    fmt.Printf("Job %s: %d puntajes del shard %d de %s descartados por estar fuera de escala\n", job.ID, descartados, indice, nodo)
+}
+
+// detectarAtipicos marca los shards cuyo puntaje mediano se aleja del de los
+// demás nodos más de umbralAtipico desviaciones absolutas medianas.
+func detectarAtipicos(porShard map[int]resultadoShard) map[int]string {
+    medianas := make(map[int]float64)
+    valores := []float64{}
+    for indice, resultado := range porShard {
+        if len(resultado.Puntajes) == 0 {
+            continue
+        }
+        puntajes := make([]float64, len(resultado.Puntajes))
+        for i, rec := range resultado.Puntajes {
+            puntajes[i] = rec.Rating
+        }
+        medianas[indice] = mediana(puntajes)
+        valores = append(valores, medianas[indice])
+    }
+    // Con menos de tres nodos no hay mayoría contra la cual comparar
+    if len(valores) < 3 {
+        return nil
+    }
+
+    centro := mediana(valores)
+    desviaciones := make([]float64, len(valores))
+    for i, valor := range valores {
+        desviaciones[i] = math.Abs(valor - centro)
+    }
+    escala := math.Max(1.4826*mediana(desviaciones), escalaMinimaAtipicos)
+
+    atipicos := make(map[int]string)
+    for indice, valor := range medianas {
+        if z := math.Abs(valor-centro) / escala; z > umbralAtipico {
+            atipicos[indice] = fmt.Sprintf("nodo atípico: mediana %.2f frente a %.2f del clúster (desviación %.1f)", valor, centro, z)
+        }
+    }
+    return atipicos
+}
+
+// agregarResultados combina los resultados aceptados del job. Debe llamarse
+// con job.mu tomado.
+func agregarResultados(job *Job) ([]Recommendation, []ExclusionResultado) {
+    var atipicos map[int]string
+    if detectaAtipicos(job.opciones) {
+        atipicos = detectarAtipicos(job.porShard)
+    }
+
+    exclusiones := []ExclusionResultado{}
+    // Los shards en orden fijo, para que los votos de cada película (y sus
+    // sumas) no dependan del orden de iteración del map
+    indices := make([]int, 0, len(job.porShard))
+    for indice := range job.porShard {
+        indices = append(indices, indice)
+    }
+    sort.Ints(indices)
+    votosMap := make(map[string][]Voto)
+    for _, indice := range indices {
+        resultado := job.porShard[indice]
+        if motivo, excluido := atipicos[indice]; excluido {
+            exclusiones = append(exclusiones, ExclusionResultado{Shard: indice, Nodo: resultado.Nodo, Motivo: motivo})
+            continue
+        }
+        peso := 0.0
+        if indice < len(job.tamShards) {
+            peso = float64(job.tamShards[indice])
+        }
+        ranking := append([]Recommendation(nil), resultado.Puntajes...)
+        sort.SliceStable(ranking, func(i, j int) bool {
+            if ranking[i].Rating != ranking[j].Rating {
+                return ranking[i].Rating > ranking[j].Rating
+            }
+            return compararIDs(ranking[i].MovieID, ranking[j].MovieID) < 0
+        })
+        for posicion, rec := range ranking {
+            votosMap[rec.MovieID] = append(votosMap[rec.MovieID], Voto{
+                Puntaje:  rec.Rating,
+                Posicion: posicion,
+                Largo:    len(ranking),
+                Peso:     peso,
+            })
+        }
+    }
+    sort.Slice(exclusiones, func(i, j int) bool { return exclusiones[i].Shard < exclusiones[j].Shard })
+
+    agregador := agregadorDeJob(job.opciones)
+    top := []Recommendation{}
+    for movieID, votos := range votosMap {
+        if len(votos) < job.opciones.SoporteMinimo {
+            continue
+        }
+        top = append(top, Recommendation{
+            MovieID: movieID,
+            Rating:  promedio(puntajes(votos)),
+            Score:   agregador.Agregar(votos),
+            Votes:   len(votos),
+        })
+    }
+
+    sort.Slice(top, func(i, j int) bool {
+        if top[i].Score != top[j].Score {
+            return top[i].Score > top[j].Score
+        }
+        if top[i].Votes != top[j].Votes {
+            return top[i].Votes > top[j].Votes
+        }
+        if top[i].Rating != top[j].Rating {
+            return top[i].Rating > top[j].Rating
+        }
+        return compararIDs(top[i].MovieID, top[j].MovieID) < 0
+    })
+    return top, exclusiones
+}
+
+func actualizarTopGlobal(job *Job, indice int, nodo string, tempResults []Recommendation) {
+    job.mu.Lock()
+    defer job.mu.Unlock()
+
+    job.porShard[indice] = resultadoShard{Nodo: nodo, Puntajes: tempResults}
+
+    newTopGlobal, _ := agregarResultados(job)
+    if len(newTopGlobal) > 15 {
+        newTopGlobal = newTopGlobal[:15]
+    }
+
+    job.topGlobal = newTopGlobal
+    fmt.Printf("Top Global del %s actualizado: %v\n", job.ID, job.topGlobal)
+}
+
+func calcularTop3Final(job *Job) []Recommendation {
+    job.mu.Lock()
+    defer job.mu.Unlock()
+
+    var topGlobal []Recommendation
+    if job.opciones.Modo == modoProcrustes {
+        modelo, alineaciones, excluidos := alinearModelos(job)
+        job.reporte.Alineacion = alineaciones
+        job.reporte.Exclusiones = append(job.reporte.Exclusiones, excluidos...)
+        job.reporte.ResultadosAceptados = len(alineaciones)
+        if modelo != nil {
+            var usuarios map[string][]float64
+            if modelo.Usuario != nil {
+                usuarios = map[string][]float64{job.UserID: modelo.Usuario}
+            }
+            guardado := guardarModeloPeliculas(job, modelo.Factores, modelo.Items, modelo.Soporte, usuarios, conteosRatings(datasetActual()), metricasProcrustes(job.reporte))
+            topGlobal = recomendarConModelo(guardado, job.UserID, job.calificadas, 3)
+            fmt.Printf("Job %s: modelo global con %d películas a partir de %d nodos\n", job.ID, len(modelo.Items), len(alineaciones))
+        }
+    } else {
+        // La detección de atípicos se decide con todos los resultados a la vista
+        var atipicos []ExclusionResultado
+        topGlobal, atipicos = agregarResultados(job)
+        job.reporte.Exclusiones = append(job.reporte.Exclusiones, atipicos...)
+        job.reporte.ResultadosAceptados = len(job.porShard) - len(atipicos)
+    }
+    if privacidad := job.reporte.Privacidad; privacidad != nil {
+        fmt.Printf("Job %s: presupuesto de privacidad ε=%.3f con δ=%g (%d pasos, q=%.4f)\n", job.ID,
+            privacidad.Epsilon, privacidad.Delta, privacidad.Pasos, privacidad.TasaMuestreo)
+    }
+    for _, exclusion := range job.reporte.Exclusiones {
+        fmt.Printf("Job %s: resultado del shard %d de %s excluido: %s\n", job.ID, exclusion.Shard, exclusion.Nodo, exclusion.Motivo)
+    }
+
+    if len(topGlobal) > 3 {
+        topGlobal = topGlobal[:3]
+    }
+    job.topGlobal = topGlobal
+
+    fmt.Println("Top 3 final:")
+    for _, rec := range topGlobal {
+        fmt.Printf("MovieID: %s, Predicted Rating: %.2f, Score: %.4g, Votes: %d\n", rec.MovieID, rec.Rating, rec.Score, rec.Votes)
+    }
+
+    return topGlobal
+}
+
+func promedio(nums []float64) float64 {
+    sum := 0.0
+    for _, num := range nums {
+        sum += num
+    }
+    return sum / float64(len(nums))
+}
+
+func mediana(nums []float64) float64 {
+    ordenados := append([]float64(nil), nums...)
+    sort.Float64s(ordenados)
+    mitad := len(ordenados) / 2
+    if len(ordenados)%2 == 0 {
+        return (ordenados[mitad-1] + ordenados[mitad]) / 2
+    }
+    return ordenados[mitad]
+}
+
+// Alineación de modelos. Cada nodo inicializa sus factores al azar, así que
+// los vectores de películas de nodos distintos viven en espacios rotados
+// arbitrariamente. En modo procrustes los nodos devuelven sus factores y el
+// coordinador rota cada modelo sobre el de referencia con Procrustes
+// ortogonal, usando las películas que comparten, antes de promediarlos.
+
+const (
+    modoTop        = "top"
+    modoProcrustes = "procrustes"
+)
+
+var modosJob = map[string]bool{
+    modoTop:        true,
+    modoProcrustes: true,
+    modoFederado:   true,
+}
+
+// minPeliculasCompartidas es la cantidad mínima de películas en común con la
+// referencia para estimar la rotación de un nodo (nunca menos que factores).
+const minPeliculasCompartidas = 10
+
+// modeloNodo son los factores que entrenó un nodo sobre su shard.
+type modeloNodo struct {
+    Nodo    string
+    Usuario []float64
+    Items   map[string][]float64
+}
+
+// ModeloGlobal es el resultado de alinear y promediar los modelos de los
+// nodos. Soporte cuenta cuántos nodos aportaron cada película.
+type ModeloGlobal struct {
+    Factores int
+    Usuario  []float64
+    Items    map[string][]float64
+    Soporte  map[string]int
+}
+
+// AlineacionNodo resume cómo se alineó el modelo de un nodo: las películas
+// compartidas con la referencia y la raíz del error cuadrático medio entre
+// ambos antes y después de rotar.
+type AlineacionNodo struct {
+    Shard        int     `json:"shard"`
+    Nodo         string  `json:"nodo"`
+    Referencia   bool    `json:"referencia"`
+    Compartidas  int     `json:"compartidas"`
+    ErrorAntes   float64 `json:"errorAntes"`
+    ErrorDespues float64 `json:"errorDespues"`
+}
+
+func manejarModelo(reader *bufio.Reader, job *Job, indice int, nodo string, factores int) {
+    modelo := modeloNodo{Nodo: nodo, Items: make(map[string][]float64)}
+    curva := &curvaRecibida{}
+    motivo := ""
+    if factores != job.opciones.Factores {
+        motivo = fmt.Sprintf("modelo con %d factores en lugar de %d", factores, job.opciones.Factores)
+    }
+
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            aceptarResultado(job, indice, nodo, fmt.Sprintf("modelo incompleto: %v", err))
+            return
+        }
+        line = strings.TrimSpace(line)
+        if line == "FIN_MODELO" {
+            break
+        }
+        if motivo != "" || curva.leer(line) {
+            continue
+        }
+
+        if strings.HasPrefix(line, "USUARIO ") {
+            modelo.Usuario, err = parsearFactores(strings.TrimPrefix(line, "USUARIO "), factores)
+            if err != nil {
+                motivo = fmt.Sprintf("factores del usuario inválidos: %v", err)
+            }
+            continue
+        }
+        movieID, valores, _ := strings.Cut(line, ",")
+        vector, err := parsearFactores(valores, factores)
+        if err != nil {
+            motivo = fmt.Sprintf("factores de la película %s inválidos: %v", movieID, err)
+            continue
+        }
+        modelo.Items[movieID] = vector
+    }
+    if motivo == "" && modelo.Usuario == nil {
+        motivo = "el modelo no incluye al usuario objetivo"
+    }
+
+    registrarConvergencia(job, indice, nodo, curva)
+    if !aceptarResultado(job, indice, nodo, motivo) {
+        return
+    }
+    job.mu.Lock()
+    job.modelos[indice] = modelo
+    job.mu.Unlock()
+    fmt.Printf("Job %s: modelo del shard %d recibido de %s (%d películas)\n", job.ID, indice, nodo, len(modelo.Items))
+    job.resultados <- indice
+}
+
+// parsearFactores lee un vector separado por comas y verifica que tenga la
+// dimensión esperada y valores finitos.
+func parsearFactores(texto string, factores int) ([]float64, error) {
+    partes := strings.Split(texto, ",")
+    if len(partes) != factores {
+        return nil, fmt.Errorf("se esperaban %d valores y llegaron %d", factores, len(partes))
+    }
+    vector := make([]float64, factores)
+    for i, parte := range partes {
+        valor, err := strconv.ParseFloat(parte, 64)
+        if err != nil {
+            return nil, err
+        }
+        if math.IsNaN(valor) || math.IsInf(valor, 0) {
+            return nil, fmt.Errorf("valor no finito")
+        }
+        vector[i] = valor
+    }
+    return vector, nil
+}
+
+// alinearModelos rota los modelos de los nodos sobre el de referencia (el que
+// tiene más películas) y los promedia. Devuelve el modelo global, el detalle
+// de cada alineación y los nodos que no pudieron alinearse. Debe llamarse con
+// job.mu tomado.
+func alinearModelos(job *Job) (*ModeloGlobal, []AlineacionNodo, []ExclusionResultado) {
+    indices := make([]int, 0, len(job.modelos))
+    for indice := range job.modelos {
+        indices = append(indices, indice)
+    }
+    if len(indices) == 0 {
+        return nil, nil, nil
+    }
+    sort.Ints(indices)
+    referencia := indices[0]
+    for _, indice := range indices {
+        if len(job.modelos[indice].Items) > len(job.modelos[referencia].Items) {
+            referencia = indice
+        }
+    }
+    factores := job.opciones.Factores
+    minimo := minPeliculasCompartidas
+    if factores > minimo {
+        minimo = factores
+    }
+
+    global := &ModeloGlobal{
+        Factores: factores,
+        Usuario:  make([]float64, factores),
+        Items:    make(map[string][]float64),
+        Soporte:  make(map[string]int),
+    }
+    alineaciones := []AlineacionNodo{}
+    exclusiones := []ExclusionResultado{}
+    base := job.modelos[referencia].Items
+    for _, indice := range indices {
+        modelo := job.modelos[indice]
+        alineacion := AlineacionNodo{Shard: indice, Nodo: modelo.Nodo, Referencia: indice == referencia}
+
+        // Películas compartidas con la referencia, en orden fijo
+        compartidas := []string{}
+        for movieID := range modelo.Items {
+            if _, existe := base[movieID]; existe {
+                compartidas = append(compartidas, movieID)
+            }
+        }
+        sort.Strings(compartidas)
+        alineacion.Compartidas = len(compartidas)
+        if len(compartidas) < minimo {
+            exclusiones = append(exclusiones, ExclusionResultado{Shard: indice, Nodo: modelo.Nodo,
+                Motivo: fmt.Sprintf("solo %d películas en común con la referencia (mínimo %d)", len(compartidas), minimo)})
+            continue
+        }
+
+        a := make([][]float64, len(compartidas))
+        b := make([][]float64, len(compartidas))
+        for i, movieID := range compartidas {
+            a[i] = modelo.Items[movieID]
+            b[i] = base[movieID]
+        }
+        rotacion := procrustes(a, b)
+        alineacion.ErrorAntes = raizErrorCuadratico(a, b)
+        alineacion.ErrorDespues = raizErrorCuadratico(multiplicar(a, rotacion), b)
+        alineaciones = append(alineaciones, alineacion)
+
+        // Los factores del usuario rotan igual que los de las películas, así
+        // que sus productos punto no cambian
+        usuario := rotarVector(modelo.Usuario, rotacion)
+        for k := range usuario {
+            global.Usuario[k] += usuario[k]
+        }
+        for movieID, vector := range modelo.Items {
+            rotado := rotarVector(vector, rotacion)
+            acumulado, existe := global.Items[movieID]
+            if !existe {
+                acumulado = make([]float64, factores)
+                global.Items[movieID] = acumulado
+            }
+            for k := range rotado {
+                acumulado[k] += rotado[k]
+            }
+            global.Soporte[movieID]++
+        }
+    }
+    if len(alineaciones) == 0 {
+        return nil, alineaciones, exclusiones
+    }
+
+    for k := range global.Usuario {
+        global.Usuario[k] /= float64(len(alineaciones))
+    }
+    for movieID, vector := range global.Items {
+        for k := range vector {
+            vector[k] /= float64(global.Soporte[movieID])
+        }
+    }
+    return global, alineaciones, exclusiones
+}
+
+// recomendarConModelo devuelve las n películas que el usuario no calificó
+// con mayor predicción en el modelo global, buscadas en el índice MIPS del
+// modelo.
+func recomendarConModelo(modelo *ModeloPeliculas, userID string, calificadas map[string]bool, n int) []Recommendation {
+    top := []Recommendation{}
+    usuario := modelo.Usuarios[userID]
+    if usuario == nil {
+        return top
+    }
+    encontradas, resultado := buscarEnModelo(modelo, usuario, n, true, func(movieID string) bool { return calificadas[movieID] },
+        OpcionesBusqueda{Sondeo: configuracionLSH.Sondeo})
+    for _, encontrada := range encontradas {
+        prediccion := modelo.Media + modelo.SesgosUsuarios[userID] + encontrada.Puntaje
+        top = append(top, Recommendation{
+            MovieID: encontrada.MovieID,
+            Rating:  recortarRating(prediccion),
+            Score:   prediccion,
+            Votes:   modelo.Soporte[encontrada.MovieID],
+        })
+    }
+    fmt.Printf("Top %d del modelo global: %d candidatos de %d películas (exacta: %t)\n", n, resultado.Candidatos, resultado.Peliculas, resultado.Exacta)
+    return top
+}
+
+// procrustes devuelve la matriz ortogonal R que minimiza ||aR - b||: con
+// aᵀb = UΣWᵀ, R = UWᵀ.
+func procrustes(a, b [][]float64) [][]float64 {
+    k := len(a[0])
+    m := make([][]float64, k)
+    for i := range m {
+        m[i] = make([]float64, k)
+    }
+    for fila := range a {
+        for i := 0; i < k; i++ {
+            for j := 0; j < k; j++ {
+                m[i][j] += a[fila][i] * b[fila][j]
+            }
+        }
+    }
+    u, w := svdJacobi(m)
+    return multiplicar(u, transponer(w))
+}
+
+// svdJacobi descompone una matriz cuadrada como m = UΣWᵀ con el método de
+// Jacobi de un lado y devuelve U y W (los valores singulares no se usan).
+func svdJacobi(m [][]float64) ([][]float64, [][]float64) {
+    n := len(m)
+    a := make([][]float64, n)
+    w := make([][]float64, n)
+    for i := range m {
+        a[i] = append([]float64(nil), m[i]...)
+        w[i] = make([]float64, n)
+        w[i][i] = 1
+    }
+
+    // Rotar pares de columnas hasta que todas sean ortogonales
+    for barrido := 0; barrido < 60; barrido++ {
+        rotaciones := 0
+        for p := 0; p < n-1; p++ {
+            for q := p + 1; q < n; q++ {
+                alfa, beta, gamma := 0.0, 0.0, 0.0
+                for i := 0; i < n; i++ {
+                    alfa += a[i][p] * a[i][p]
+                    beta += a[i][q] * a[i][q]
+                    gamma += a[i][p] * a[i][q]
+                }
+                if math.Abs(gamma) <= 1e-15*math.Sqrt(alfa*beta) || gamma == 0 {
+                    continue
+                }
+                rotaciones++
+                zeta := (beta - alfa) / (2 * gamma)
+                t := math.Copysign(1, zeta) / (math.Abs(zeta) + math.Sqrt(1+zeta*zeta))
+                c := 1 / math.Sqrt(1+t*t)
+                s := c * t
+                for i := 0; i < n; i++ {
+                    a[i][p], a[i][q] = c*a[i][p]-s*a[i][q], s*a[i][p]+c*a[i][q]
+                    w[i][p], w[i][q] = c*w[i][p]-s*w[i][q], s*w[i][p]+c*w[i][q]
+                }
+            }
+        }
+        if rotaciones == 0 {
+            break
+        }
+    }
+
+    // Las columnas de U son las de a normalizadas; las de norma nula (matriz
+    // de rango incompleto) se completan con una base ortonormal
+    u := make([][]float64, n)
+    for i := range u {
+        u[i] = make([]float64, n)
+    }
+    nulas := []int{}
+    for j := 0; j < n; j++ {
+        norma := 0.0
+        for i := 0; i < n; i++ {
+            norma += a[i][j] * a[i][j]
+        }
+        norma = math.Sqrt(norma)
+        if norma < 1e-12 {
+            nulas = append(nulas, j)
+            continue
+        }
+        for i := 0; i < n; i++ {
+            u[i][j] = a[i][j] / norma
+        }
+    }
+    for _, j := range nulas {
+        for e := 0; e < n; e++ {
+            candidato := make([]float64, n)
+            candidato[e] = 1
+            for otra := 0; otra < n; otra++ {
+                if otra == j {
+                    continue
+                }
+                proyeccion := 0.0
+                for i := 0; i < n; i++ {
+                    proyeccion += candidato[i] * u[i][otra]
+                }
+                for i := 0; i < n; i++ {
+                    candidato[i] -= proyeccion * u[i][otra]
+                }
+            }
+            norma := 0.0
+            for i := 0; i < n; i++ {
+                norma += candidato[i] * candidato[i]
+            }
+            if norma = math.Sqrt(norma); norma > 1e-6 {
+                for i := 0; i < n; i++ {
+                    u[i][j] = candidato[i] / norma
+                }
+                break
+            }
+        }
+    }
+    return u, w
+}
+
+func multiplicar(a, b [][]float64) [][]float64 {
+    resultado := make([][]float64, len(a))
+    for i := range a {
+        resultado[i] = make([]float64, len(b[0]))
+        for k := range b {
+            for j := range b[0] {
+                resultado[i][j] += a[i][k] * b[k][j]
+            }
+        }
+    }
+    return resultado
+}
+
+func transponer(m [][]float64) [][]float64 {
+    resultado := make([][]float64, len(m[0]))
+    for j := range resultado {
+        resultado[j] = make([]float64, len(m))
+        for i := range m {
+            resultado[j][i] = m[i][j]
+        }
+    }
+    return resultado
+}
+
+func rotarVector(v []float64, rotacion [][]float64) []float64 {
+    return multiplicar([][]float64{v}, rotacion)[0]
+}
+
+func raizErrorCuadratico(a, b [][]float64) float64 {
+    suma, n := 0.0, 0
+    for i := range a {
+        for j := range a[i] {
+            d := a[i][j] - b[i][j]
+            suma += d * d
+            n++
+        }
+    }
+    if n == 0 {
+        return 0
+    }
+    return math.Sqrt(suma / float64(n))
+}
+
+// Aprendizaje federado (FedAvg). Los nodos con ratings propios entrenan
+// localmente y devuelven solo los factores de sus películas; el coordinador
+// los promedia ponderando por la cantidad de ratings de cada nodo y nunca ve
+// ratings de usuarios. Al final, los nodos que conocen al usuario objetivo
+// devuelven su top con el modelo global y se agregan como en el modo top.
+
+const modoFederado = "federado"
+
+// RondaFederada resume una ronda de FedAvg. Cambio es la raíz del cambio
+// cuadrático medio de los factores globales respecto de la ronda anterior (en
+// la primera ronda, respecto de cero).
+type RondaFederada struct {
+    Ronda         int      `json:"ronda"`
+    Participantes int      `json:"participantes"`
+    Ratings       int      `json:"ratings"`
+    Peliculas     int      `json:"peliculas"`
+    Cambio        float64  `json:"cambio"`
+    // RMSE de la última iteración local, ponderado por los ratings de cada
+    // nodo
+    RMSEEntrenamiento float64 `json:"rmseEntrenamiento"`
+    RMSEValidacion    float64 `json:"rmseValidacion"`
+    DuracionMs        int64   `json:"duracionMs"`
+    Fallidos      []string `json:"fallidos,omitempty"`
+}
+
+// actualizacionFederada son los factores locales que devolvió un nodo.
+type actualizacionFederada struct {
+    Ratings int
+    Items   map[string][]float64
+    Curva   *curvaRecibida
+    // Cantidad y suma de los ratings locales de cada película (sin DP)
+    Conteos map[string]ConteoPelicula
+}
+
+// nodosFederados devuelve, ordenados, los nodos que informaron ratings locales.
+func nodosFederados() []string {
+    muNodos.Lock()
+    defer muNodos.Unlock()
+    participantes := []string{}
+    for _, addr := range addrs {
+        if info := nodos[addr]; info != nil && info.RatingsLocales > 0 {
+            participantes = append(participantes, addr)
+        }
+    }
+    return participantes
+}
+
+func entrenarFederado(userID string, opciones OpcionesJob) ([]Recommendation, *ReporteJob, error) {
+    participantes := nodosFederados()
+    if len(participantes) == 0 {
+        return nil, nil, fmt.Errorf("no worker node has local ratings")
+    }
+    job := nuevoJob(userID, opciones)
+    defer terminarJob(job)
+    menorLocal := -1
+    muNodos.Lock()
+    for _, clienteIP := range participantes {
+        if locales := nodos[clienteIP].RatingsLocales; menorLocal < 0 || locales < menorLocal {
+            menorLocal = locales
+        }
+    }
+    muNodos.Unlock()
+    job.reporte.Privacidad = reportePrivacidad(opciones, menorLocal, opciones.Rondas)
+
+    global := make(map[string][]float64)
+    var conteos map[string]ConteoPelicula
+    for ronda := 1; ronda <= opciones.Rondas; ronda++ {
+        inicio := time.Now()
+        actualizaciones := make([]*actualizacionFederada, len(participantes))
+        errores := make([]error, len(participantes))
+        var wg sync.WaitGroup
+        for i, clienteIP := range participantes {
+            wg.Add(1)
+            go func(i int, clienteIP string) {
+                defer wg.Done()
+                actualizaciones[i], errores[i] = rondaFederada(clienteIP, job, ronda, global, opciones)
+            }(i, clienteIP)
+        }
+        wg.Wait()
+
+        // FedAvg: cada película promedia los factores de los nodos que la
+        // tienen, ponderados por la cantidad de ratings del nodo
+        resumen := RondaFederada{Ronda: ronda}
+        conteos = make(map[string]ConteoPelicula)
+        pesoRMSE := 0.0
+        sumas := make(map[string][]float64)
+        pesos := make(map[string]float64)
+        for i, actualizacion := range actualizaciones {
+            if errores[i] != nil {
+                resumen.Fallidos = append(resumen.Fallidos, fmt.Sprintf("%s: %v", participantes[i], errores[i]))
+                continue
+            }
+            resumen.Participantes++
+            resumen.Ratings += actualizacion.Ratings
+            for movieID, conteo := range actualizacion.Conteos {
+                total := conteos[movieID]
+                total.N += conteo.N
+                total.Suma += conteo.Suma
+                conteos[movieID] = total
+            }
+            peso := float64(actualizacion.Ratings)
+            if ultimo, existe := actualizacion.Curva.ultimo(); existe && ultimo.Entrenamiento >= 0 && ultimo.Validacion >= 0 {
+                resumen.RMSEEntrenamiento += peso * ultimo.Entrenamiento
+                resumen.RMSEValidacion += peso * ultimo.Validacion
+                pesoRMSE += peso
+            }
+            for movieID, vector := range actualizacion.Items {
+                suma, existe := sumas[movieID]
+                if !existe {
+                    suma = make([]float64, opciones.Factores)
+                    sumas[movieID] = suma
+                }
+                for k := range vector {
+                    suma[k] += peso * vector[k]
+                }
+                pesos[movieID] += peso
+            }
+        }
+        if resumen.Participantes == 0 {
+            return nil, nil, fmt.Errorf("no worker node completed federated round %d", ronda)
+        }
+
+        nuevo := make(map[string][]float64, len(sumas))
+        for movieID, suma := range sumas {
+            for k := range suma {
+                suma[k] /= pesos[movieID]
+            }
+            nuevo[movieID] = suma
+        }
+        // Los nodos envían solo las películas que entrenaron; las demás
+        // conservan los factores de la ronda anterior
+        for movieID, vector := range global {
+            if _, existe := nuevo[movieID]; !existe {
+                nuevo[movieID] = vector
+            }
+        }
+        resumen.Peliculas = len(nuevo)
+        if pesoRMSE > 0 {
+            resumen.RMSEEntrenamiento /= pesoRMSE
+            resumen.RMSEValidacion /= pesoRMSE
+        }
+        resumen.Cambio = cambioModelo(global, nuevo)
+        resumen.DuracionMs = time.Since(inicio).Milliseconds()
+        global = nuevo
+
+        fmt.Printf("Job %s: ronda federada %d/%d con %d nodos, %d películas, cambio %.4f, RMSE %.4f (validación %.4f)\n", job.ID, ronda, opciones.Rondas,
+            resumen.Participantes, resumen.Peliculas, resumen.Cambio, resumen.RMSEEntrenamiento, resumen.RMSEValidacion)
+        job.mu.Lock()
+        job.reporte.Rondas = append(job.reporte.Rondas, resumen)
+        job.mu.Unlock()
+    }
+
+    job.mu.Lock()
+    metricas := metricasFederadas(job.reporte)
+    job.mu.Unlock()
+    guardarModeloPeliculas(job, opciones.Factores, global, nil, nil, conteos, metricas)
+
+    // Pedir a cada nodo el top del usuario con el modelo final
+    var wg sync.WaitGroup
+    for i, clienteIP := range participantes {
+        wg.Add(1)
+        go func(i int, clienteIP string) {
+            defer wg.Done()
+            top, err := topFederado(clienteIP, job, global, opciones)
+            if err != nil {
+                fmt.Printf("Job %s: %s no devolvió un top: %v\n", job.ID, clienteIP, err)
+                return
+            }
+            if top == nil {
+                return
+            }
+            top, fueraDeEscala, motivo := validarPuntajes(top, opciones)
+            if motivo != "" {
+                job.mu.Lock()
+                job.reporte.Exclusiones = append(job.reporte.Exclusiones, ExclusionResultado{Shard: i, Nodo: clienteIP, Motivo: motivo})
+                job.mu.Unlock()
+                return
+            }
+            sumarFueraDeEscala(job, i, clienteIP, fueraDeEscala)
+            job.mu.Lock()
+            job.porShard[i] = resultadoShard{Nodo: clienteIP, Puntajes: top}
+            job.mu.Unlock()
+        }(i, clienteIP)
+    }
+    wg.Wait()
+
+    job.mu.Lock()
+    conocido := len(job.porShard) > 0
+    job.mu.Unlock()
+    if !conocido {
+        return nil, nil, fmt.Errorf("No data found for user %s", userID)
+    }
+
+    finalTop3 := calcularTop3Final(job)
+    job.mu.Lock()
+    reporte := job.reporte
+    job.mu.Unlock()
+    return finalTop3, &reporte, nil
+}
+
+// enviarRondaFederada abre la conexión con el nodo y envía la cabecera, los
+// parámetros y el modelo global.
+func enviarRondaFederada(clienteIP string, job *Job, ronda string, global map[string][]float64, opciones OpcionesJob) (net.Conn, *bufio.Reader, error) {
+    conn, err := seguridad.Conectar(net.JoinHostPort(clienteIP, strconv.Itoa(portHP)))
+    if err != nil {
+        return nil, nil, err
+    }
+    conn.SetDeadline(time.Now().Add(timeoutReplica))
+
+    writer := bufio.NewWriterSize(conn, tamBufferSubida)
+    fmt.Fprintf(writer, "FEDERADO %s %s\n", job.ID, ronda)
+    escribirParamsEntrenamiento(writer, opciones)
+    fmt.Fprintf(writer, "PARAM usuario=%s\n", job.UserID)
+    for movieID, vector := range global {
+        partes := make([]string, len(vector))
+        for k, valor := range vector {
+            partes[k] = strconv.FormatFloat(valor, 'g', 8, 64)
+        }
+        fmt.Fprintf(writer, "%s,%s\n", movieID, strings.Join(partes, ","))
+    }
+    fmt.Fprintln(writer, "FIN_MODELO")
+    if err := writer.Flush(); err != nil {
+        conn.Close()
+        return nil, nil, err
+    }
+    return conn, bufio.NewReader(conn), nil
+}
+
+func rondaFederada(clienteIP string, job *Job, ronda int, global map[string][]float64, opciones OpcionesJob) (*actualizacionFederada, error) {
+    conn, reader, err := enviarRondaFederada(clienteIP, job, strconv.Itoa(ronda), global, opciones)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    cabecera, err := reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    campos := strings.Fields(cabecera)
+    if len(campos) != 2 || campos[0] != "ACTUALIZACION" {
+        return nil, fmt.Errorf("respuesta inesperada: %s", strings.TrimSpace(cabecera))
+    }
+    actualizacion := &actualizacionFederada{Items: make(map[string][]float64), Curva: &curvaRecibida{}}
+    if actualizacion.Ratings, err = strconv.Atoi(campos[1]); err != nil || actualizacion.Ratings <= 0 {
+        return nil, fmt.Errorf("cantidad de ratings no válida: %s", campos[1])
+    }
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimSpace(line)
+        if line == "FIN_MODELO" {
+            break
+        }
+        if actualizacion.Curva.leer(line) {
+            continue
+        }
+        if conteo, existe := strings.CutPrefix(line, "CONTEO "); existe {
+            campos := strings.Split(conteo, ",")
+            if len(campos) != 3 {
+                return nil, fmt.Errorf("conteo mal formado: %s", line)
+            }
+            n, errN := strconv.Atoi(campos[1])
+            suma, errSuma := strconv.ParseFloat(campos[2], 64)
+            if errN != nil || errSuma != nil || n <= 0 || suma < ratingMinimo*float64(n) || suma > ratingMaximo*float64(n) {
+                return nil, fmt.Errorf("conteo no válido: %s", line)
+            }
+            if actualizacion.Conteos == nil {
+                actualizacion.Conteos = make(map[string]ConteoPelicula)
+            }
+            actualizacion.Conteos[campos[0]] = ConteoPelicula{N: n, Suma: suma}
+            continue
+        }
+        movieID, valores, _ := strings.Cut(line, ",")
+        vector, err := parsearFactores(valores, opciones.Factores)
+        if err != nil {
+            return nil, fmt.Errorf("factores de la película %s inválidos: %v", movieID, err)
+        }
+        actualizacion.Items[movieID] = vector
+    }
+    return actualizacion, nil
+}
+
+// topFederado pide al nodo el top del usuario objetivo con el modelo final.
+// Devuelve nil sin error si el usuario no es local del nodo.
+func topFederado(clienteIP string, job *Job, global map[string][]float64, opciones OpcionesJob) ([]Recommendation, error) {
+    conn, reader, err := enviarRondaFederada(clienteIP, job, "final", global, opciones)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    top := []Recommendation{}
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimSpace(line)
+        switch line {
+        case "SIN_USUARIO", "SIN_DATOS":
+            return nil, nil
+        case "FIN_TOP5":
+            return top, nil
+        }
+        movieID, valor, _ := strings.Cut(line, ",")
+        rating, err := strconv.ParseFloat(valor, 64)
+        if err != nil {
+            return nil, fmt.Errorf("puntaje no válido: %s", line)
+        }
+        top = append(top, Recommendation{MovieID: movieID, Rating: rating})
+    }
+}
+
+// escribirParamsEntrenamiento envía los parámetros del SGD de un job o ronda.
+func escribirParamsEntrenamiento(w io.Writer, opciones OpcionesJob) {
+    fmt.Fprintf(w, "PARAM seed=%d\n", opciones.Seed)
+    fmt.Fprintf(w, "PARAM factores=%d\n", opciones.Factores)
+    fmt.Fprintf(w, "PARAM learningRate=%g\n", opciones.LearningRate)
+    fmt.Fprintf(w, "PARAM iteraciones=%d\n", opciones.Iteraciones)
+    fmt.Fprintf(w, "PARAM hilos=%d\n", opciones.Hilos)
+    if opciones.Hogwild {
+        fmt.Fprintln(w, "PARAM hogwild=1")
+    }
+    fmt.Fprintf(w, "PARAM validacion=%g\n", opciones.Validacion)
+    fmt.Fprintf(w, "PARAM tolerancia=%g\n", opciones.Tolerancia)
+    fmt.Fprintf(w, "PARAM paciencia=%d\n", opciones.Paciencia)
+    if opciones.Objetivo == objetivoBPR {
+        fmt.Fprintf(w, "PARAM objetivo=%s\n", opciones.Objetivo)
+        fmt.Fprintf(w, "PARAM positivo=%g\n", opciones.UmbralPositivo)
+    }
+    fmt.Fprintf(w, "PARAM optimizador=%s\n", opciones.Optimizador)
+    fmt.Fprintf(w, "PARAM programa=%s\n", opciones.Programa)
+    fmt.Fprintf(w, "PARAM decaimiento=%g\n", opciones.Decaimiento)
+    fmt.Fprintf(w, "PARAM pasoDecaimiento=%d\n", opciones.PasoDecaimiento)
+    fmt.Fprintf(w, "PARAM calentamiento=%d\n", opciones.Calentamiento)
+    if opciones.ClipGradiente > 0 {
+        fmt.Fprintf(w, "PARAM clipGradiente=%g\n", opciones.ClipGradiente)
+    }
+    if opciones.Algoritmo == algoritmoSVDpp {
+        fmt.Fprintf(w, "PARAM algoritmo=%s\n", opciones.Algoritmo)
+    }
+    if !opciones.Privado {
+        return
+    }
+    fmt.Fprintln(w, "PARAM dp=1")
+    fmt.Fprintf(w, "PARAM clip=%g\n", opciones.Clip)
+    fmt.Fprintf(w, "PARAM ruido=%g\n", opciones.Ruido)
+    fmt.Fprintf(w, "PARAM lote=%d\n", opciones.Lote)
+}
+
+func cambioModelo(anterior, nuevo map[string][]float64) float64 {
+    suma, n := 0.0, 0
+    for movieID, vector := range nuevo {
+        previo, existe := anterior[movieID]
+        for k := range vector {
+            d := vector[k]
+            if existe {
+                d -= previo[k]
+            }
+            suma += d * d
+            n++
+        }
+    }
+    if n == 0 {
+        return 0
+    }
+    return math.Sqrt(suma / float64(n))
+}
+
+// Contabilidad de privacidad. Los nodos entrenan con DP-SGD (mecanismo
+// gaussiano submuestreado); el coordinador conoce todos sus parámetros y
+// calcula el presupuesto (ε, δ) del job con la contabilidad de Rényi.
+
+// ReportePrivacidad es el presupuesto gastado por un job con DP-SGD. Como
+// cada rating está en un solo shard, vale el del shard más pequeño (el de
+// mayor tasa de muestreo). Los ratings del usuario objetivo se envían a todos
+// los nodos y no quedan cubiertos por este presupuesto.
+type ReportePrivacidad struct {
+    Clip         float64 `json:"clip"`
+    Ruido        float64 `json:"ruido"`
+    Lote         int     `json:"lote"`
+    TasaMuestreo float64 `json:"tasaMuestreo"`
+    Pasos        int     `json:"pasos"`
+    Delta        float64 `json:"delta"`
+    Epsilon      float64 `json:"epsilon"`
+    OrdenRenyi   int     `json:"ordenRenyi"`
+}
+
+// ordenesRenyi son los órdenes en los que se evalúa la contabilidad.
+var ordenesRenyi = func() []int {
+    ordenes := []int{}
+    for alfa := 2; alfa <= 64; alfa++ {
+        ordenes = append(ordenes, alfa)
+    }
+    return append(ordenes, 96, 128, 256, 512)
+}()
+
+// reportePrivacidad calcula el presupuesto de entrenar rondas veces, cada una
+// con opciones.Iteraciones iteraciones, sobre ratings ejemplos.
+func reportePrivacidad(opciones OpcionesJob, ratings int, rondas int) *ReportePrivacidad {
+    if !opciones.Privado || ratings <= 0 {
+        return nil
+    }
+    reporte := &ReportePrivacidad{
+        Clip:         opciones.Clip,
+        Ruido:        opciones.Ruido,
+        Lote:         opciones.Lote,
+        TasaMuestreo: math.Min(1, float64(opciones.Lote)/float64(ratings)),
+        Pasos:        rondas * opciones.Iteraciones * ((ratings + opciones.Lote - 1) / opciones.Lote),
+        Delta:        opciones.Delta,
+    }
+    reporte.Epsilon, reporte.OrdenRenyi = epsilonRDP(reporte.TasaMuestreo, opciones.Ruido, reporte.Pasos, opciones.Delta)
+    return reporte
+}
+
+// epsilonRDP devuelve el ε de (ε, δ)-DP tras pasos aplicaciones del mecanismo
+// gaussiano submuestreado con tasa q y multiplicador de ruido sigma, y el
+// orden de Rényi que lo alcanza. Para órdenes enteros α (Mironov et al.,
+// 2019): ε_α = log(Σ_k C(α,k) (1-q)^(α-k) q^k exp((k²-k)/(2σ²))) / (α-1).
+func epsilonRDP(q, sigma float64, pasos int, delta float64) (float64, int) {
+    if sigma <= 0 {
+        return math.Inf(1), 0
+    }
+    mejor, orden := math.Inf(1), 0
+    for _, alfa := range ordenesRenyi {
+        var logA float64
+        if q >= 1 {
+            logA = float64(alfa*(alfa-1)) / (2 * sigma * sigma)
+        } else {
+            terminos := make([]float64, alfa+1)
+            for k := 0; k <= alfa; k++ {
+                terminos[k] = logCombinatorio(alfa, k) + float64(alfa-k)*math.Log1p(-q) + float64(k)*math.Log(q) +
+                    float64(k*k-k)/(2*sigma*sigma)
+            }
+            logA = logSumaExp(terminos)
+        }
+        epsilon := float64(pasos)*logA/float64(alfa-1) + math.Log(1/delta)/float64(alfa-1)
+        if epsilon < mejor {
+            mejor, orden = epsilon, alfa
+        }
+    }
+    return mejor, orden
+}
+
+func logCombinatorio(n, k int) float64 {
+    a, _ := math.Lgamma(float64(n + 1))
+    b, _ := math.Lgamma(float64(k + 1))
+    c, _ := math.Lgamma(float64(n - k + 1))
+    return a - b - c
+}
+
+func logSumaExp(valores []float64) float64 {
+    maximo := math.Inf(-1)
+    for _, valor := range valores {
+        maximo = math.Max(maximo, valor)
+    }
+    suma := 0.0
+    for _, valor := range valores {
+        suma += math.Exp(valor - maximo)
+    }
+    return maximo + math.Log(suma)
+}
+
+// Seguimiento de la convergencia. Los nodos miden la pérdida en cada
+// iteración, pueden detenerse antes de completarlas y envían la curva antes
+// de su resultado como líneas "PERDIDA <iter> <entr> <valid>" y
+// "PARADA <motivo>". Con DP-SGD solo envían "PARADA iteraciones".
+
+// PuntoPerdida es la raíz del error cuadrático medio de un nodo tras una
+// iteración. Un valor no finito (el SGD divergió) se informa como -1.
+type PuntoPerdida struct {
+    Iteracion     int     `json:"iteracion"`
+    Entrenamiento float64 `json:"entrenamiento"`
+    Validacion    float64 `json:"validacion"`
+}
+
+// ConvergenciaShard es la curva de pérdida del nodo que procesó un shard y
+// por qué se detuvo: "iteraciones", "convergencia" o "divergencia". Tras
+// divergir, el nodo vuelve a los factores de la iteración Restaurada.
+type ConvergenciaShard struct {
+    Shard      int            `json:"shard"`
+    Nodo       string         `json:"nodo"`
+    Motivo     string         `json:"motivo"`
+    Restaurada *int           `json:"restaurada,omitempty"`
+    Curva      []PuntoPerdida `json:"curva"`
+}
+
+// curvaRecibida acumula las líneas de pérdida de la respuesta de un nodo.
+type curvaRecibida struct {
+    Puntos     []PuntoPerdida
+    Motivo     string
+    Restaurada *int
+}
+
+// leer interpreta la línea si es de pérdida o de parada y devuelve si la
+// consumió.
+func (c *curvaRecibida) leer(line string) bool {
+    if resto, esParada := strings.CutPrefix(line, "PARADA "); esParada {
+        campos := strings.Fields(resto)
+        if len(campos) > 0 {
+            c.Motivo = campos[0]
+        }
+        if len(campos) > 1 {
+            if iteracion, err := strconv.Atoi(campos[1]); err == nil {
+                c.Restaurada = &iteracion
+            }
+        }
+        return true
+    }
+    resto, esPerdida := strings.CutPrefix(line, "PERDIDA ")
+    if !esPerdida {
+        return false
+    }
+    campos := strings.Fields(resto)
+    if len(campos) != 3 {
+        fmt.Printf("Línea de pérdida no válida: %s\n", line)
+        return true
+    }
+    iteracion, err := strconv.Atoi(campos[0])
+    if err != nil {
+        fmt.Printf("Línea de pérdida no válida: %s\n", line)
+        return true
+    }
+    c.Puntos = append(c.Puntos, PuntoPerdida{
+        Iteracion:     iteracion,
+        Entrenamiento: perdidaFinita(campos[1]),
+        Validacion:    perdidaFinita(campos[2]),
+    })
+    return true
+}
+
+func (c *curvaRecibida) ultimo() (PuntoPerdida, bool) {
+    if len(c.Puntos) == 0 {
+        return PuntoPerdida{}, false
+    }
+    return c.Puntos[len(c.Puntos)-1], true
+}
+
+// perdidaFinita convierte la pérdida y reemplaza los valores no finitos o
+// ilegibles por -1, que JSON sí puede representar.
+func perdidaFinita(texto string) float64 {
+    valor, err := strconv.ParseFloat(texto, 64)
+    if err != nil || math.IsNaN(valor) || math.IsInf(valor, 0) {
+        return -1
+    }
+    return valor
+}
+
+// registrarConvergencia agrega la curva de un nodo al reporte del job y la
+// resume en el log. Los nodos anteriores a este protocolo no envían curva.
+func registrarConvergencia(job *Job, indice int, nodo string, curva *curvaRecibida) {
+    ultimo, existe := curva.ultimo()
+    if !existe {
+        return
+    }
+    fmt.Printf("Job %s: shard %d de %s terminó en la iteración %d por %s (RMSE %.4f, validación %.4f)\n",
+        job.ID, indice, nodo, ultimo.Iteracion, curva.Motivo, ultimo.Entrenamiento, ultimo.Validacion)
+    if curva.Restaurada != nil {
+        fmt.Printf("Job %s: el nodo %s restauró los factores de la iteración %d\n", job.ID, nodo, *curva.Restaurada)
+    }
+    job.mu.Lock()
+    job.reporte.Convergencia = append(job.reporte.Convergencia, ConvergenciaShard{
+        Shard:      indice,
+        Nodo:       nodo,
+        Motivo:     curva.Motivo,
+        Restaurada: curva.Restaurada,
+        Curva:      curva.Puntos,
+    })
+    job.mu.Unlock()
+}
+
+// Películas similares. Los jobs en modo procrustes y federado terminan con
+// factores globales de las películas en el coordinador; el modelo activo del
+// registro responde /movies/{id}/similar con las películas más cercanas en el
+// espacio latente, por similitud coseno. Los jobs en modo top, el modo por
+// defecto, no dejan factores: si todavía no hay modelo, la primera consulta
+// que lo necesita entrena uno con un job procrustes.
+
+// ModeloPeliculas son los factores de las películas de un job terminado.
+type ModeloPeliculas struct {
+    // Versión en el registro de modelos
+    Version  string
+    JobID    string
+    Modo     string
+    Factores int
+    Items    map[string][]float64
+    // Nodos que aportaron cada película (solo en procrustes)
+    Soporte map[string]int
+    // Vectores de los usuarios que el modelo conoce: en procrustes, el del
+    // usuario del job
+    Usuarios map[string][]float64
+    // Predictor base: la media y los sesgos de las películas salen de los
+    // ratings con que se entrenó (sesgosBase) y los usuarios se pliegan sobre
+    // r - μ - b_i, así que la predicción es Media + b_u + b_i + pᵀq. Sin
+    // conteos de ratings (BPR o federado con DP) quedan en cero
+    Media          float64
+    SesgosItems    map[string]float64
+    SesgosUsuarios map[string]float64
+    // Hiperparámetros del job, métricas del entrenamiento y huella del
+    // dataset con que se entrenó
+    Parametros map[string]string
+    Metricas   map[string]float64
+    Huella     string
+    Creado     time.Time
+    // Índices aproximados; nil con menos de configuracionLSH.Minimo películas
+    indiceCoseno   *indiceLSH
+    indiceProducto *indiceLSH
+    // Vectores de la búsqueda por producto interno en un modelo con sesgos
+    productos map[string][]float64
+}
+
+var (
+    modeloPeliculas   *ModeloPeliculas
+    muModeloPeliculas sync.RWMutex
+)
+
+const (
+    similaresPorDefecto = 10
+    maximoSimilares     = 100
+)
+
+// guardarModeloPeliculas registra el modelo de un entrenamiento global como
+// una nueva versión y lo publica para las consultas de similares y de
+// usuarios; el de cualquier otro job queda en modelosDeJobs, fuera del
+// registro. Devuelve el modelo ya indexado, que el job usa para su propio top.
+func guardarModeloPeliculas(job *Job, factores int, items map[string][]float64, soporte map[string]int, usuarios map[string][]float64, conteos map[string]ConteoPelicula, metricas map[string]float64) *ModeloPeliculas {
+    muDataset.RLock()
+    huella := huellaDataset
+    muDataset.RUnlock()
+    modelo := &ModeloPeliculas{
+        JobID:      job.ID,
+        Modo:       job.opciones.Modo,
+        Factores:   factores,
+        Items:      items,
+        Soporte:    soporte,
+        Usuarios:   usuarios,
+        Parametros: parametrosModelo(job.opciones),
+        Metricas:   metricas,
+        Huella:     huella,
+        Creado:     time.Now(),
+    }
+    if len(conteos) > 0 && job.opciones.Objetivo != objetivoBPR {
+        modelo.Media, modelo.SesgosItems = sesgosBase(conteos, items)
+        // Los usuarios guardados se vuelven a plegar sobre r - μ - b_i para
+        // que su vector y su sesgo correspondan a la predicción con sesgos
+        for userID := range usuarios {
+            vector, resumen, err := plegarUsuario(modelo, ratingsConPendientes(userID))
+            if err != nil {
+                delete(usuarios, userID)
+                continue
+            }
+            usuarios[userID] = vector
+            if modelo.SesgosUsuarios == nil {
+                modelo.SesgosUsuarios = make(map[string]float64)
+            }
+            modelo.SesgosUsuarios[userID] = resumen.Sesgo
+        }
+    }
+    indexarModelo(modelo)
+    if !job.opciones.Activar {
+        guardarModeloDeJob(modelo)
+        return modelo
+    }
+    version, err := registrarModelo(modelo)
+    if err != nil {
+        fmt.Printf("Job %s: el modelo %s queda solo en memoria: %v\n", job.ID, version, err)
+    }
+    if !activarNuevosModelos {
+        fmt.Printf("Job %s: modelo registrado como %s sin activarlo\n", job.ID, version)
+        return modelo
+    }
+    if err := activarModelo(modelo); err != nil {
+        fmt.Printf("Job %s: no se pudo guardar la versión activa: %v\n", job.ID, err)
+    }
+    fmt.Printf("Job %s: modelo %s de %d películas activo para consultas de similares (índice LSH: %t)\n", job.ID, modelo.Version, len(items), modelo.indiceCoseno != nil)
+    return modelo
+}
+
+// maximoModelosDeJobs es cuántos modelos de jobs que no son entrenamientos
+// globales se conservan para /predict?source=job.
+const maximoModelosDeJobs = 20
+
+var (
+    // Modelos de los jobs de /recommend y /predict?source=job, del más viejo
+    // al más nuevo
+    modelosDeJobs   []*ModeloPeliculas
+    muModelosDeJobs sync.Mutex
+)
+
+// guardarModeloDeJob conserva el modelo de un job que no se registra,
+// descartando el más viejo por encima de maximoModelosDeJobs.
+func guardarModeloDeJob(modelo *ModeloPeliculas) {
+    muModelosDeJobs.Lock()
+    defer muModelosDeJobs.Unlock()
+    modelosDeJobs = append(modelosDeJobs, modelo)
+    if len(modelosDeJobs) > maximoModelosDeJobs {
+        modelosDeJobs = modelosDeJobs[len(modelosDeJobs)-maximoModelosDeJobs:]
+    }
+}
+
+// indexarModelo construye los índices del modelo si tiene suficientes
+// películas y todavía no los tiene.
+func indexarModelo(modelo *ModeloPeliculas) {
+    if modelo.indiceCoseno != nil || len(modelo.Items) < configuracionLSH.Minimo {
+        return
+    }
+    seed, _ := strconv.ParseInt(modelo.Parametros["seed"], 10, 64)
+    modelo.indiceCoseno = nuevoIndiceLSH(modelo.Items, modelo.Factores, false, configuracionLSH, seed)
+    if modelo.tieneSesgos() {
+        modelo.productos = modelo.itemsProducto()
+        modelo.indiceProducto = nuevoIndiceLSH(modelo.productos, modelo.Factores+1, true, configuracionLSH, seed)
+    } else {
+        modelo.indiceProducto = nuevoIndiceLSH(modelo.Items, modelo.Factores, true, configuracionLSH, seed)
+    }
+}
+
+// tieneSesgos indica si el modelo predice con media y sesgos además de los
+// factores.
+func (modelo *ModeloPeliculas) tieneSesgos() bool {
+    return modelo.Media != 0 || len(modelo.SesgosItems) > 0 || len(modelo.SesgosUsuarios) > 0
+}
+
+// itemsProducto son los vectores [q_i, b_i] de la búsqueda por producto
+// interno en un modelo con sesgos: con la consulta [p_u, 1] el puntaje es
+// b_i + pᵀq_i, que ordena las películas como la predicción del usuario.
+func (modelo *ModeloPeliculas) itemsProducto() map[string][]float64 {
+    if modelo.productos != nil {
+        return modelo.productos
+    }
+    productos := make(map[string][]float64, len(modelo.Items))
+    for movieID, q := range modelo.Items {
+        productos[movieID] = append(append(make([]float64, 0, len(q)+1), q...), modelo.SesgosItems[movieID])
+    }
+    return productos
+}
+
+// ConteoPelicula es la cantidad y la suma de los ratings de una película.
+type ConteoPelicula struct {
+    N    int
+    Suma float64
+}
+
+// regularizacionSesgosBase encoge el sesgo de las películas con pocos ratings
+// hacia la media: b_i = Σ(r - μ) / (n_i + λ).
+const regularizacionSesgosBase = 25.0
+
+// sesgosBase calcula la media global y el sesgo de cada película del modelo
+// a partir de los conteos de sus ratings.
+func sesgosBase(conteos map[string]ConteoPelicula, items map[string][]float64) (float64, map[string]float64) {
+    total, suma := 0, 0.0
+    for _, conteo := range conteos {
+        total += conteo.N
+        suma += conteo.Suma
+    }
+    if total == 0 {
+        return 0, nil
+    }
+    media := suma / float64(total)
+    sesgos := make(map[string]float64, len(items))
+    for movieID := range items {
+        if conteo := conteos[movieID]; conteo.N > 0 {
+            sesgos[movieID] = (conteo.Suma - media*float64(conteo.N)) / (float64(conteo.N) + regularizacionSesgosBase)
+        }
+    }
+    return media, sesgos
+}
+
+// conteosRatings cuenta y suma los ratings de cada película.
+func conteosRatings(ratings map[string][]Rating) map[string]ConteoPelicula {
+    conteos := make(map[string]ConteoPelicula)
+    for _, ratingsUsuario := range ratings {
+        for _, rating := range ratingsUsuario {
+            conteo := conteos[rating.MovieID]
+            conteo.N++
+            conteo.Suma += rating.Rating
+            conteos[rating.MovieID] = conteo
+        }
+    }
+    return conteos
+}
+
+// publicarModelo construye los índices del modelo y lo deja activo. Los
+// índices se construyen antes de publicarlo para que las consultas no
+// esperen.
+func publicarModelo(modelo *ModeloPeliculas) {
+    indexarModelo(modelo)
+    muModeloPeliculas.Lock()
+    modeloPeliculas = modelo
+    muModeloPeliculas.Unlock()
+}
+
+// Entrenamiento del modelo inicial, que se lanza en segundo plano cuando se
+// consulta sin modelo activo
+var (
+    entrenandoInicial bool
+    errorInicial      error
+    muModeloInicial   sync.Mutex
+)
+
+// esperaModeloInicial son los segundos que se sugieren en Retry-After
+// mientras se entrena el modelo inicial.
+const esperaModeloInicial = 10
+
+var errEntrenandoModelo = errors.New("no active model yet: training a procrustes model from the coordinator's dataset, retry in a few seconds")
+
+// modeloParaConsultas devuelve el modelo activo y, si todavía no hay ninguno
+// y el coordinador tiene el dataset, lanza su entrenamiento y devuelve
+// errEntrenandoModelo. Las consultas que llegan mientras tanto no lanzan
+// otro.
+func modeloParaConsultas() (*ModeloPeliculas, error) {
+    muModeloPeliculas.RLock()
+    modelo := modeloPeliculas
+    muModeloPeliculas.RUnlock()
+    if modelo != nil {
+        return modelo, nil
+    }
+    if len(datasetActual()) == 0 {
+        return nil, errSinModelo
+    }
+
+    muModeloInicial.Lock()
+    defer muModeloInicial.Unlock()
+    anterior := errorInicial
+    if !entrenandoInicial {
+        entrenandoInicial = true
+        go entrenarModeloInicial()
+    }
+    if anterior != nil {
+        return nil, fmt.Errorf("%w (the previous attempt failed: %v)", errEntrenandoModelo, anterior)
+    }
+    return nil, errEntrenandoModelo
+}
+
+func entrenarModeloInicial() {
+    fmt.Println("No hay modelo activo: se entrena uno en segundo plano para las consultas")
+    reporte, err := entrenarModeloGlobal()
+    if err == nil {
+        muModeloPeliculas.RLock()
+        activo := modeloPeliculas != nil
+        muModeloPeliculas.RUnlock()
+        if !activo {
+            err = fmt.Errorf("job %s did not activate a model", reporte.ID)
+        }
+    }
+    if err != nil {
+        fmt.Printf("No se pudo entrenar el modelo inicial: %v\n", err)
+    }
+    muModeloInicial.Lock()
+    entrenandoInicial = false
+    errorInicial = err
+    muModeloInicial.Unlock()
+}
+
+// avisarReintento agrega Retry-After a la respuesta si el modelo se está
+// entrenando. Debe llamarse antes de escribir el estado.
+func avisarReintento(w http.ResponseWriter, err error) {
+    if errors.Is(err, errEntrenandoModelo) {
+        w.Header().Set("Retry-After", strconv.Itoa(esperaModeloInicial))
+    }
+}
+
+// PeliculaSimilar es una película cercana a la consultada.
+type PeliculaSimilar struct {
+    MovieID   string  `json:"movieId"`
+    Titulo    string  `json:"titulo,omitempty"`
+    Anio      string  `json:"anio,omitempty"`
+    Similitud float64 `json:"similitud"`
+    Soporte   int     `json:"soporte,omitempty"`
+}
+
+func normaVector(vector []float64) float64 {
+    suma := 0.0
+    for _, valor := range vector {
+        suma += valor * valor
+    }
+    return math.Sqrt(suma)
+}
+
+// peliculasSimilares devuelve las n películas con mayor similitud coseno a
+// movieID, sin incluirla.
+func peliculasSimilares(modelo *ModeloPeliculas, movieID string, n int, opciones OpcionesBusqueda) ([]PeliculaSimilar, ResultadoBusqueda) {
+    encontradas, resultado := buscarEnModelo(modelo, modelo.Items[movieID], n, false, func(otra string) bool { return otra == movieID }, opciones)
+    similares := make([]PeliculaSimilar, len(encontradas))
+    for i, encontrada := range encontradas {
+        similares[i] = PeliculaSimilar{
+            MovieID:   encontrada.MovieID,
+            Similitud: encontrada.Puntaje,
+            Soporte:   modelo.Soporte[encontrada.MovieID],
+        }
+        if pelicula, existe := catalogo[encontrada.MovieID]; existe {
+            similares[i].Titulo = pelicula.Titulo
+            similares[i].Anio = pelicula.Anio
+        }
+    }
+    return similares, resultado
+}
+
+// similaresHandler atiende /movies/{id}/similar?n=.
+func similaresHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    responderError := func(estado int, mensaje string) {
+        w.WriteHeader(estado)
+        json.NewEncoder(w).Encode(map[string]string{"error": mensaje})
+    }
+
+    movieID := r.PathValue("id")
+    n := similaresPorDefecto
+    if valor := r.URL.Query().Get("n"); valor != "" {
+        var err error
+        if n, err = strconv.Atoi(valor); err != nil || n <= 0 || n > maximoSimilares {
+            responderError(http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maximoSimilares))
+            return
+        }
+    }
+    busqueda, err := opcionesBusquedaDe(r)
+    if err != nil {
+        responderError(http.StatusBadRequest, err.Error())
+        return
+    }
+
+    modelo, err := modeloParaConsultas()
+    if err != nil {
+        avisarReintento(w, err)
+        responderError(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    if _, existe := modelo.Items[movieID]; !existe {
+        responderError(http.StatusNotFound, fmt.Sprintf("movie %q is not in the stored model", movieID))
+        return
+    }
+
+    pelicula, existe := catalogo[movieID]
+    if !existe {
+        pelicula = Pelicula{MovieID: movieID}
+    }
+    similares, resultado := peliculasSimilares(modelo, movieID, n, busqueda)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "movie":    pelicula,
+        "similar":  similares,
+        "busqueda": resultado,
+        "model": map[string]interface{}{
+            "version":   modelo.Version,
+            "job":       modelo.JobID,
+            "modo":      modelo.Modo,
+            "factores":  modelo.Factores,
+            "peliculas": len(modelo.Items),
+            "creado":    modelo.Creado,
+        },
+    })
+}
+
+// Índice aproximado de vecinos para el modelo guardado. Recorrer y ordenar
+// todas las películas por consulta no escala al servir a muchos usuarios,
+// así que al guardar un modelo se construyen dos índices LSH de hiperplanos
+// aleatorios: uno por coseno, con las películas normalizadas, y otro por
+// producto interno máximo (MIPS) con la transformación de Neyshabur y
+// Srebro: cada película x pasa a [x/M, √(1-‖x/M‖²)], con M la mayor norma,
+// y la consulta q a [q/‖q‖, 0], así que el coseno entre ambas ordena igual
+// que qᵀx. Cada tabla agrupa las películas por el signo de sus proyecciones
+// sobre BitsLSH hiperplanos; una consulta revisa su cubeta en cada tabla y,
+// según el sondeo, las que difieren en uno o dos bits, y ordena exactamente
+// solo esos candidatos. Con pocas películas, si se pide o si los candidatos
+// no alcanzan, se recorre el modelo completo.
+
+// ConfiguracionLSH son los parámetros de los índices.
+type ConfiguracionLSH struct {
+    Tablas int
+    Bits   int
+    // Sondeo por defecto: distancia de Hamming máxima de las cubetas
+    // revisadas (0, 1 o 2); más sondeo da más recall y más latencia
+    Sondeo int
+    // Cantidad de películas desde la que se construyen los índices
+    Minimo int
+}
+
+var configuracionLSH = ConfiguracionLSH{Tablas: 8, Bits: 10, Sondeo: 1, Minimo: 1000}
+
+const maximoSondeo = 2
+
+// leerConfiguracionLSH toma LSH_TABLAS, LSH_BITS, LSH_SONDEO y LSH_MINIMO.
+func leerConfiguracionLSH() error {
+    parametros := []struct {
+        env      string
+        destino  *int
+        min, max int
+    }{
+        {"LSH_TABLAS", &configuracionLSH.Tablas, 1, 64},
+        {"LSH_BITS", &configuracionLSH.Bits, 1, 62},
+        {"LSH_SONDEO", &configuracionLSH.Sondeo, 0, maximoSondeo},
+        {"LSH_MINIMO", &configuracionLSH.Minimo, 0, math.MaxInt32},
+    }
+    for _, parametro := range parametros {
+        valor, err := strconv.Atoi(leerEnv(parametro.env, strconv.Itoa(*parametro.destino)))
+        if err != nil || valor < parametro.min || valor > parametro.max {
+            return fmt.Errorf("%s debe estar entre %d y %d", parametro.env, parametro.min, parametro.max)
+        }
+        *parametro.destino = valor
+    }
+    return nil
+}
+
+// indiceLSH agrupa las películas de un modelo en Tablas tablas de cubetas.
+type indiceLSH struct {
+    producto bool
+    bits     int
+    planos   [][][]float64
+    tablas   []map[uint64][]string
+}
+
+// transformarPeliculas devuelve los vectores de k+1 dimensiones que se
+// indexan: normalizados para coseno o con la transformación MIPS.
+func transformarPeliculas(items map[string][]float64, producto bool) map[string][]float64 {
+    maxima := 0.0
+    for _, vector := range items {
+        maxima = math.Max(maxima, normaVector(vector))
+    }
+    transformados := make(map[string][]float64, len(items))
+    for movieID, vector := range items {
+        norma := normaVector(vector)
+        escala := maxima
+        if !producto {
+            escala = norma
+        }
+        transformado := make([]float64, len(vector)+1)
+        if escala > 0 {
+            for k, valor := range vector {
+                transformado[k] = valor / escala
+            }
+        }
+        if producto && maxima > 0 {
+            relativa := norma / maxima
+            transformado[len(vector)] = math.Sqrt(math.Max(0, 1-relativa*relativa))
+        }
+        transformados[movieID] = transformado
+    }
+    return transformados
+}
+
+// nuevoIndiceLSH construye el índice con hiperplanos gaussianos que dependen
+// solo de la semilla, para que el mismo modelo dé el mismo índice.
+func nuevoIndiceLSH(items map[string][]float64, factores int, producto bool, configuracion ConfiguracionLSH, seed int64) *indiceLSH {
+    generador := rand.New(rand.NewSource(seed))
+    indice := &indiceLSH{producto: producto, bits: configuracion.Bits}
+    for t := 0; t < configuracion.Tablas; t++ {
+        planos := make([][]float64, configuracion.Bits)
+        for b := range planos {
+            planos[b] = make([]float64, factores+1)
+            for k := range planos[b] {
+                planos[b][k] = generador.NormFloat64()
+            }
+        }
+        indice.planos = append(indice.planos, planos)
+        indice.tablas = append(indice.tablas, make(map[uint64][]string))
+    }
+
+    transformados := transformarPeliculas(items, producto)
+    ids := make([]string, 0, len(transformados))
+    for movieID := range transformados {
+        ids = append(ids, movieID)
+    }
+    sort.Slice(ids, func(i, j int) bool { return compararIDs(ids[i], ids[j]) < 0 })
+    for t := range indice.tablas {
+        for _, movieID := range ids {
+            firma := indice.firma(t, transformados[movieID])
+            indice.tablas[t][firma] = append(indice.tablas[t][firma], movieID)
+        }
+    }
+    return indice
+}
+
+// firma es el patrón de signos de x sobre los hiperplanos de la tabla t.
+func (indice *indiceLSH) firma(t int, x []float64) uint64 {
+    var firma uint64
+    for b, plano := range indice.planos[t] {
+        producto := 0.0
+        for k := range plano {
+            producto += plano[k] * x[k]
+        }
+        if producto >= 0 {
+            firma |= 1 << uint(b)
+        }
+    }
+    return firma
+}
+
+// candidatos reúne las películas de las cubetas a distancia de Hamming
+// hasta sondeo de la consulta en cada tabla.
+func (indice *indiceLSH) candidatos(consulta []float64, sondeo int) map[string]bool {
+    norma := normaVector(consulta)
+    transformada := make([]float64, len(consulta)+1)
+    if norma > 0 {
+        for k, valor := range consulta {
+            transformada[k] = valor / norma
+        }
+    }
+    vistos := make(map[string]bool)
+    revisar := func(tabla map[uint64][]string, firma uint64) {
+        for _, movieID := range tabla[firma] {
+            vistos[movieID] = true
+        }
+    }
+    for t, tabla := range indice.tablas {
+        firma := indice.firma(t, transformada)
+        revisar(tabla, firma)
+        for i := 0; sondeo >= 1 && i < indice.bits; i++ {
+            revisar(tabla, firma^(1<<uint(i)))
+            for j := i + 1; sondeo >= 2 && j < indice.bits; j++ {
+                revisar(tabla, firma^(1<<uint(i))^(1<<uint(j)))
+            }
+        }
+    }
+    return vistos
+}
+
+// OpcionesBusqueda ajustan una consulta al modelo: Exacta recorre todas las
+// películas y Sondeo fija el compromiso entre recall y latencia.
+type OpcionesBusqueda struct {
+    Exacta bool
+    Sondeo int
+}
+
+// ResultadoBusqueda informa cómo se resolvió una consulta.
+type ResultadoBusqueda struct {
+    Exacta     bool `json:"exacta"`
+    Sondeo     int  `json:"sondeo"`
+    Candidatos int  `json:"candidatos"`
+    Peliculas  int  `json:"peliculas"`
+}
+
+// opcionesBusquedaDe lee exact y probes de la consulta HTTP.
+func opcionesBusquedaDe(r *http.Request) (OpcionesBusqueda, error) {
+    opciones := OpcionesBusqueda{Sondeo: configuracionLSH.Sondeo}
+    query := r.URL.Query()
+    if exacta := query.Get("exact"); exacta != "" {
+        valor, err := strconv.ParseBool(exacta)
+        if err != nil {
+            return opciones, fmt.Errorf("invalid exact %q", exacta)
+        }
+        opciones.Exacta = valor
+    }
+    if sondeo := query.Get("probes"); sondeo != "" {
+        valor, err := strconv.Atoi(sondeo)
+        if err != nil || valor < 0 || valor > maximoSondeo {
+            return opciones, fmt.Errorf("probes must be between 0 and %d", maximoSondeo)
+        }
+        opciones.Sondeo = valor
+    }
+    return opciones, nil
+}
+
+// PuntajePelicula es una película encontrada y su puntaje en la búsqueda.
+type PuntajePelicula struct {
+    MovieID string
+    Puntaje float64
+}
+
+// buscarEnModelo devuelve las n películas con mayor producto interno (o
+// coseno si producto es falso) con la consulta, salvo las excluidas. En un
+// modelo con sesgos el producto interno incluye b_i. Usa el índice si existe
+// y no se pide una búsqueda exacta, y recurre a recorrer todo el modelo si
+// los candidatos no alcanzan para n.
+func buscarEnModelo(modelo *ModeloPeliculas, consulta []float64, n int, producto bool, excluir func(string) bool, opciones OpcionesBusqueda) ([]PuntajePelicula, ResultadoBusqueda) {
+    resultado := ResultadoBusqueda{Exacta: true, Sondeo: opciones.Sondeo, Peliculas: len(modelo.Items)}
+    indice, items := modelo.indiceCoseno, modelo.Items
+    if producto {
+        indice = modelo.indiceProducto
+        if modelo.tieneSesgos() {
+            items = modelo.itemsProducto()
+            consulta = append(append(make([]float64, 0, len(consulta)+1), consulta...), 1)
+        }
+    }
+    var candidatos map[string]bool
+    if indice != nil && !opciones.Exacta {
+        candidatos = indice.candidatos(consulta, opciones.Sondeo)
+        utiles := 0
+        for movieID := range candidatos {
+            if !excluir(movieID) {
+                utiles++
+            }
+        }
+        if utiles >= n {
+            resultado.Exacta = false
+        } else {
+            candidatos = nil
+        }
+    }
+
+    normaConsulta := normaVector(consulta)
+    puntajes := make([]PuntajePelicula, 0)
+    puntuar := func(movieID string) {
+        vector := items[movieID]
+        if excluir(movieID) || vector == nil {
+            return
+        }
+        puntaje := 0.0
+        for k := range vector {
+            puntaje += consulta[k] * vector[k]
+        }
+        if !producto {
+            norma := normaVector(vector)
+            if norma == 0 || normaConsulta == 0 {
+                return
+            }
+            puntaje /= norma * normaConsulta
+        }
+        puntajes = append(puntajes, PuntajePelicula{MovieID: movieID, Puntaje: puntaje})
+    }
+    if candidatos != nil {
+        for movieID := range candidatos {
+            puntuar(movieID)
+        }
+    } else {
+        for movieID := range items {
+            puntuar(movieID)
+        }
+    }
+    resultado.Candidatos = len(puntajes)
+
+    sort.Slice(puntajes, func(i, j int) bool {
+        if puntajes[i].Puntaje != puntajes[j].Puntaje {
+            return puntajes[i].Puntaje > puntajes[j].Puntaje
+        }
+        return compararIDs(puntajes[i].MovieID, puntajes[j].MovieID) < 0
+    })
+    if len(puntajes) > n {
+        puntajes = puntajes[:n]
+    }
+    return puntajes, resultado
+}
+
+// Plegado de usuarios (fold-in). Cuando un usuario agrega ratings no hace
+// falta repetir el job distribuido: con los factores de las películas del
+// modelo guardado fijos, su vector es la solución de mínimos cuadrados con
+// regularización, p = (QᵀQ + λI)⁻¹ Qᵀr sobre las películas que calificó, y
+// sus recomendaciones salen al instante del índice MIPS. Los ratings nuevos
+// quedan pendientes hasta el reentrenamiento periódico, que los incorpora al
+// dataset (con lo que cambia su huella y se rehacen los shards) y lanza un
+// job en modo procrustes para renovar el modelo.
+
+var (
+    // Ratings agregados desde el último reentrenamiento: usuario -> película
+    ratingsPendientes = make(map[string]map[string]float64)
+    muPendientes      sync.Mutex
+    // dataset y huellaDataset se reemplazan enteros al reentrenar
+    muDataset sync.RWMutex
+    // Ratings incorporados al dataset desde que se cargó
+    ratingsIncorporados int
+)
+
+// regularizacionPlegado es λ en la solución del vector del usuario y
+// regularizacionSesgoPlegado la de su sesgo, que por omisión no se regulariza.
+var (
+    regularizacionPlegado      = 0.1
+    regularizacionSesgoPlegado = 0.0
+)
+
+// usuarioPlegado es el vector y el sesgo de un usuario plegado.
+type usuarioPlegado struct {
+    vector  []float64
+    resumen PlegadoUsuario
+}
+
+// plegados guarda los usuarios ya plegados en un modelo para no resolver el
+// sistema en cada consulta. Se vacía al cambiar el modelo, y los ratings
+// nuevos de un usuario descartan su entrada y suben la generación para que un
+// plegado en curso con los ratings anteriores no se guarde.
+var (
+    plegados struct {
+        modelo     *ModeloPeliculas
+        usuarios   map[string]usuarioPlegado
+        generacion int
+    }
+    muPlegados sync.Mutex
+)
+
+func datasetActual() map[string][]Rating {
+    muDataset.RLock()
+    defer muDataset.RUnlock()
+    return dataset
+}
+
+// ratingsConPendientes son los ratings del usuario en el dataset con los
+// pendientes encima.
+func ratingsConPendientes(userID string) []Rating {
+    muPendientes.Lock()
+    pendientes := ratingsPendientes[userID]
+    muPendientes.Unlock()
+    return superponerRatings(datasetActual()[userID], pendientes, userID)
+}
+
+// superponerRatings agrega los pendientes a base: un rating pendiente
+// reemplaza al de la misma película.
+func superponerRatings(base []Rating, pendientes map[string]float64, userID string) []Rating {
+    if len(pendientes) == 0 {
+        return base
+    }
+    ratings := make([]Rating, 0, len(base)+len(pendientes))
+    for _, rating := range base {
+        if _, reemplazado := pendientes[rating.MovieID]; !reemplazado {
+            ratings = append(ratings, rating)
+        }
+    }
+    peliculas := make([]string, 0, len(pendientes))
+    for movieID := range pendientes {
+        peliculas = append(peliculas, movieID)
+    }
+    sort.Slice(peliculas, func(i, j int) bool { return compararIDs(peliculas[i], peliculas[j]) < 0 })
+    for _, movieID := range peliculas {
+        ratings = append(ratings, Rating{UserID: userID, MovieID: movieID, Rating: pendientes[movieID]})
+    }
+    return ratings
+}
+
+// resolverCholesky resuelve a x = b con a simétrica definida positiva.
+func resolverCholesky(a [][]float64, b []float64) ([]float64, error) {
+    n := len(b)
+    l := make([][]float64, n)
+    for i := range l {
+        l[i] = make([]float64, n)
+        for j := 0; j <= i; j++ {
+            suma := a[i][j]
+            for k := 0; k < j; k++ {
+                suma -= l[i][k] * l[j][k]
+            }
+            if i == j {
+                if suma <= 0 {
+                    return nil, fmt.Errorf("la matriz no es definida positiva")
+                }
+                l[i][i] = math.Sqrt(suma)
+            } else {
+                l[i][j] = suma / l[j][j]
+            }
+        }
+    }
+    // l y = b, luego lᵀ x = y
+    y := make([]float64, n)
+    for i := 0; i < n; i++ {
+        suma := b[i]
+        for k := 0; k < i; k++ {
+            suma -= l[i][k] * y[k]
+        }
+        y[i] = suma / l[i][i]
+    }
+    x := make([]float64, n)
+    for i := n - 1; i >= 0; i-- {
+        suma := y[i]
+        for k := i + 1; k < n; k++ {
+            suma -= l[k][i] * x[k]
+        }
+        x[i] = suma / l[i][i]
+    }
+    return x, nil
+}
+
+// PlegadoUsuario resume cómo se calculó el vector de un usuario.
+type PlegadoUsuario struct {
+    Ratings    int     `json:"ratings"`
+    EnModelo   int     `json:"enModelo"`
+    Pendientes int     `json:"pendientes"`
+    // Sesgo del usuario: cuánto califica por encima o por debajo de lo que
+    // explican los factores
+    Sesgo float64 `json:"sesgo"`
+    RMSE  float64 `json:"rmse"`
+}
+
+// plegarUsuario calcula el vector del usuario contra las películas fijas del
+// modelo; las películas que el modelo no conoce no aportan. Se ajusta
+// r - μ - b_i y el sesgo del usuario es una coordenada más de la solución,
+// con su propia regularización, para que la de los factores no acerque a
+// cero los ratings de un usuario con pocas calificaciones.
+func plegarUsuario(modelo *ModeloPeliculas, ratings []Rating) ([]float64, PlegadoUsuario, error) {
+    k := modelo.Factores
+    dimension := k + 1
+    resumen := PlegadoUsuario{Ratings: len(ratings)}
+    a := make([][]float64, dimension)
+    for i := range a {
+        a[i] = make([]float64, dimension)
+        a[i][i] = regularizacionPlegado
+    }
+    a[k][k] = regularizacionSesgoPlegado
+    b := make([]float64, dimension)
+    x := make([]float64, dimension)
+    for _, rating := range ratings {
+        q, existe := modelo.Items[rating.MovieID]
+        if !existe {
+            continue
+        }
+        resumen.EnModelo++
+        copy(x, q)
+        x[k] = 1
+        objetivo := rating.Rating - modelo.Media - modelo.SesgosItems[rating.MovieID]
+        for i := 0; i < dimension; i++ {
+            b[i] += x[i] * objetivo
+            for j := 0; j < dimension; j++ {
+                a[i][j] += x[i] * x[j]
+            }
+        }
+    }
+    if resumen.EnModelo == 0 {
+        return nil, resumen, fmt.Errorf("none of the user's %d ratings are for movies in the stored model", len(ratings))
+    }
+    solucion, err := resolverCholesky(a, b)
+    if err != nil {
+        return nil, resumen, err
+    }
+    usuario := solucion[:k]
+    resumen.Sesgo = solucion[k]
+    suma := 0.0
+    for _, rating := range ratings {
+        if q, existe := modelo.Items[rating.MovieID]; existe {
+            d := rating.Rating - modelo.Media - resumen.Sesgo - modelo.SesgosItems[rating.MovieID] - predecirProducto(usuario, q)
+            suma += d * d
+        }
+    }
+    resumen.RMSE = math.Sqrt(suma / float64(resumen.EnModelo))
+    return usuario, resumen, nil
+}
+
+// plegarEnModelo devuelve los ratings del usuario y su vector y sesgo en el
+// modelo, plegándolo solo si no está guardado en plegados.
+func plegarEnModelo(modelo *ModeloPeliculas, userID string) ([]float64, PlegadoUsuario, []Rating, error) {
+    muPlegados.Lock()
+    if plegados.modelo != modelo {
+        plegados.modelo, plegados.usuarios = modelo, make(map[string]usuarioPlegado)
+    }
+    guardado, existe := plegados.usuarios[userID]
+    generacion := plegados.generacion
+    muPlegados.Unlock()
+
+    ratings := ratingsConPendientes(userID)
+    if len(ratings) == 0 {
+        return nil, PlegadoUsuario{}, nil, fmt.Errorf("No data found for user %s", userID)
+    }
+    if !existe {
+        vector, resumen, err := plegarUsuario(modelo, ratings)
+        if err != nil {
+            return nil, resumen, nil, err
+        }
+        guardado = usuarioPlegado{vector: vector, resumen: resumen}
+        muPlegados.Lock()
+        if plegados.modelo == modelo && plegados.generacion == generacion {
+            plegados.usuarios[userID] = guardado
+        }
+        muPlegados.Unlock()
+    }
+    resumen := guardado.resumen
+    muPendientes.Lock()
+    resumen.Pendientes = len(ratingsPendientes[userID])
+    muPendientes.Unlock()
+    return guardado.vector, resumen, ratings, nil
+}
+
+// olvidarPlegado descarta el plegado del usuario tras recibir ratings nuevos.
+func olvidarPlegado(userID string) {
+    muPlegados.Lock()
+    delete(plegados.usuarios, userID)
+    plegados.generacion++
+    muPlegados.Unlock()
+}
+
+// recortarRating lleva una predicción al rango de los ratings.
+func recortarRating(prediccion float64) float64 {
+    return math.Max(ratingMinimo, math.Min(ratingMaximo, prediccion))
+}
+
+func predecirProducto(usuario, pelicula []float64) float64 {
+    prediccion := 0.0
+    for k := range usuario {
+        prediccion += usuario[k] * pelicula[k]
+    }
+    return prediccion
+}
+
+// recomendarPlegado pliega al usuario en el modelo guardado y devuelve sus n
+// mejores películas no calificadas.
+func recomendarPlegado(userID string, n int, busqueda OpcionesBusqueda) ([]Recommendation, map[string]interface{}, error) {
+    modelo, err := modeloParaConsultas()
+    if err != nil {
+        return nil, nil, err
+    }
+    usuario, resumen, ratings, err := plegarEnModelo(modelo, userID)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    calificadas := make(map[string]bool, len(ratings))
+    for _, rating := range ratings {
+        calificadas[rating.MovieID] = true
+    }
+    encontradas, resultado := buscarEnModelo(modelo, usuario, n, true, func(movieID string) bool { return calificadas[movieID] }, busqueda)
+    recomendaciones := make([]Recommendation, len(encontradas))
+    for i, encontrada := range encontradas {
+        // La media y el sesgo del usuario no cambian el orden, pero sí el
+        // rating estimado
+        prediccion := modelo.Media + resumen.Sesgo + encontrada.Puntaje
+        recomendaciones[i] = Recommendation{
+            MovieID: encontrada.MovieID,
+            Rating:  recortarRating(prediccion),
+            Score:   prediccion,
+            Votes:   modelo.Soporte[encontrada.MovieID],
+        }
+    }
+    return recomendaciones, map[string]interface{}{
+        "modelo":   modelo.JobID,
+        "version":  modelo.Version,
+        "plegado":  resumen,
+        "busqueda": resultado,
+    }, nil
+}
+
+var errSinModelo = errors.New("no active model yet: load a dataset so the coordinator trains a procrustes model, run a job with mode=federado, or activate a version with POST /models/{version}/activate")
+
+// sinModeloActivo indica si err se debe a que todavía no hay modelo activo.
+func sinModeloActivo(err error) bool {
+    return errors.Is(err, errSinModelo) || errors.Is(err, errEntrenandoModelo)
+}
+
+// CalificacionNueva es un rating enviado a /users/{id}/ratings.
+type CalificacionNueva struct {
+    MovieID string  `json:"movieId"`
+    Rating  float64 `json:"rating"`
+}
+
+// usuarioHandler atiende /users/{id}/ratings (POST, agrega ratings) y
+// /users/{id}/recommendations (GET); ambos responden con las
+// recomendaciones del usuario plegado en el modelo guardado.
+func usuarioHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    responderError := func(estado int, mensaje string) {
+        w.WriteHeader(estado)
+        json.NewEncoder(w).Encode(map[string]string{"error": mensaje})
+    }
+
+    userID := r.PathValue("id")
+    n := similaresPorDefecto
+    if valor := r.URL.Query().Get("n"); valor != "" {
+        var err error
+        if n, err = strconv.Atoi(valor); err != nil || n <= 0 || n > maximoSimilares {
+            responderError(http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maximoSimilares))
+            return
+        }
+    }
+    busqueda, err := opcionesBusquedaDe(r)
+    if err != nil {
+        responderError(http.StatusBadRequest, err.Error())
+        return
+    }
+
+    respuesta := map[string]interface{}{"userId": userID}
+    if strings.HasSuffix(r.URL.Path, "/ratings") {
+        if r.Method != http.MethodPost {
+            responderError(http.StatusMethodNotAllowed, "use POST to add ratings")
+            return
+        }
+        var cuerpo struct {
+            Ratings []CalificacionNueva `json:"ratings"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&cuerpo); err != nil || len(cuerpo.Ratings) == 0 {
+            responderError(http.StatusBadRequest, `expected {"ratings":[{"movieId":"...","rating":4}]}`)
+            return
+        }
+        for _, calificacion := range cuerpo.Ratings {
+            if math.IsNaN(calificacion.Rating) || calificacion.Rating < ratingMinimo || calificacion.Rating > ratingMaximo {
+                responderError(http.StatusBadRequest, fmt.Sprintf("rating for movie %q must be between %g and %g", calificacion.MovieID, ratingMinimo, ratingMaximo))
+                return
+            }
+            if _, existe := catalogo[calificacion.MovieID]; catalogo != nil && !existe {
+                responderError(http.StatusBadRequest, fmt.Sprintf("unknown movie %q", calificacion.MovieID))
+                return
+            }
+        }
+        muPendientes.Lock()
+        if ratingsPendientes[userID] == nil {
+            ratingsPendientes[userID] = make(map[string]float64)
+        }
+        for _, calificacion := range cuerpo.Ratings {
+            ratingsPendientes[userID][calificacion.MovieID] = calificacion.Rating
+        }
+        muPendientes.Unlock()
+        olvidarPlegado(userID)
+        respuesta["aceptados"] = len(cuerpo.Ratings)
+    } else if r.Method != http.MethodGet {
+        responderError(http.StatusMethodNotAllowed, "use GET for recommendations")
+        return
+    }
+
+    recomendaciones, detalle, err := recomendarPlegado(userID, n, busqueda)
+    switch {
+    case sinModeloActivo(err) && respuesta["aceptados"] != nil:
+        // Los ratings quedan guardados aunque todavía no haya modelo
+        respuesta["error"] = err.Error()
+    case sinModeloActivo(err):
+        avisarReintento(w, err)
+        responderError(http.StatusServiceUnavailable, err.Error())
+        return
+    case err != nil:
+        responderError(http.StatusNotFound, err.Error())
+        return
+    default:
+        respuesta["recommendations"] = recomendaciones
+        for clave, valor := range detalle {
+            respuesta[clave] = valor
+        }
+    }
+    json.NewEncoder(w).Encode(respuesta)
+}
+
+// incorporarPendientes pasa los ratings pendientes al dataset, que se
+// reemplaza por una copia para no alterar el que usan los jobs en curso, y
+// recalcula su huella. Si hay menos de minimo no hace nada. Devuelve cuántos
+// ratings incorporó.
+func incorporarPendientes(minimo int) int {
+    muPendientes.Lock()
+    total := 0
+    for _, pendientes := range ratingsPendientes {
+        total += len(pendientes)
+    }
+    if total == 0 || total < minimo {
+        muPendientes.Unlock()
+        return 0
+    }
+    pendientes := ratingsPendientes
+    ratingsPendientes = make(map[string]map[string]float64)
+    muPendientes.Unlock()
+
+    // Solo el reentrenamiento reemplaza el dataset, así que no cambia entre
+    // la lectura y el reemplazo
+    anterior := datasetActual()
+    actualizado := make(map[string][]Rating, len(anterior)+len(pendientes))
+    for userID, ratings := range anterior {
+        actualizado[userID] = ratings
+    }
+    for userID, ratingsUsuario := range pendientes {
+        actualizado[userID] = superponerRatings(anterior[userID], ratingsUsuario, userID)
+    }
+    huella := calcularHuella(actualizado)
+    muDataset.Lock()
+    dataset = actualizado
+    huellaDataset = huella
+    ratingsIncorporados += total
+    muDataset.Unlock()
+    return total
+}
+
+// usuarioReferencia es el usuario con más ratings, objetivo de los jobs de
+// reentrenamiento: el modelo global no depende de él, pero el job necesita
+// uno.
+func usuarioReferencia() string {
+    actual := datasetActual()
+    elegido := ""
+    for userID, ratings := range actual {
+        if elegido == "" || len(ratings) > len(actual[elegido]) || (len(ratings) == len(actual[elegido]) && compararIDs(userID, elegido) < 0) {
+            elegido = userID
+        }
+    }
+    return elegido
+}
+
+// reentrenar incorpora los pendientes y, si hubo alguno, renueva el modelo
+// guardado con un job en modo procrustes con las opciones por defecto.
+func reentrenar(minimo int) {
+    incorporados := incorporarPendientes(minimo)
+    if incorporados == 0 {
+        return
+    }
+    fmt.Printf("Reentrenamiento: %d ratings nuevos incorporados al dataset\n", incorporados)
+    if reporte, err := entrenarModeloGlobal(); err != nil {
+        fmt.Printf("Reentrenamiento: el job falló: %v\n", err)
+    } else {
+        fmt.Printf("Reentrenamiento: modelo renovado por el %s\n", reporte.ID)
+    }
+}
+
+// entrenarModeloGlobal corre un job en modo procrustes con las opciones por
+// defecto para renovar el modelo guardado.
+func entrenarModeloGlobal() (*ReporteJob, error) {
+    solicitud, _ := http.NewRequest(http.MethodGet, "/recommend?mode="+modoProcrustes+"&algorithm="+algoritmoFactorizacion, nil)
+    opciones, err := parsearOpcionesJob(solicitud)
+    if err != nil {
+        return nil, fmt.Errorf("opciones por defecto no válidas: %v", err)
+    }
+    opciones.Activar = true
+    _, reporte, err := generateRecommendations(usuarioReferencia(), opciones)
+    return reporte, err
+}
+
+// reentrenarPeriodicamente reentrena cada intervalo si hay al menos minimo
+// ratings pendientes.
+func reentrenarPeriodicamente(intervalo time.Duration, minimo int) {
+    for range time.Tick(intervalo) {
+        reentrenar(minimo)
+    }
+}
+
+// Registro de modelos. Cada modelo de un entrenamiento global (federado, de
+// reentrenamiento o el que se entrena para las consultas) queda como una
+// versión (v1, v2, ...) y, con MODELOS_DIR, se guarda en un archivo de texto
+// con una cabecera de formato, los hiperparámetros del job, métricas del
+// entrenamiento, la huella del dataset, los diccionarios de IDs de películas
+// y usuarios y, por índice, sus sesgos y factores. El historial de
+// activaciones se guarda en el archivo "activo", una versión por línea con
+// la activa al final: al reiniciar, el coordinador vuelve a servir ese
+// modelo, y /models/rollback activa la anterior. Sin MODELOS_DIR el registro
+// vive solo en memoria.
+
+// formatoModelo es la versión del formato de los archivos de modelo.
+const formatoModelo = 1
+
+// maximoHistorial es cuántas activaciones se recuerdan para volver atrás.
+const maximoHistorial = 100
+
+var (
+    directorioModelos string
+    // Versiones que se conservan (0 no borra ninguna) y si los modelos de los
+    // entrenamientos globales se activan al terminar su job
+    maximoModelos        = 20
+    activarNuevosModelos = true
+)
+
+// VersionModelo describe una versión del registro.
+type VersionModelo struct {
+    Version    string             `json:"version"`
+    JobID      string             `json:"job"`
+    Modo       string             `json:"modo"`
+    Factores   int                `json:"factores"`
+    Peliculas  int                `json:"peliculas"`
+    Usuarios   int                `json:"usuarios"`
+    Sesgos     bool               `json:"sesgos"`
+    Parametros map[string]string  `json:"parametros"`
+    Metricas   map[string]float64 `json:"metricas"`
+    Huella     string             `json:"huella"`
+    Creado     time.Time          `json:"creado"`
+    // Calculados al responder
+    Activa        bool `json:"activa"`
+    DatasetActual bool `json:"datasetActual"`
+    // El modelo completo cuando no hay archivo del que leerlo
+    modelo *ModeloPeliculas
+}
+
+var (
+    // Versiones en orden de creación y versiones activadas, la activa al final
+    registroModelos  []*VersionModelo
+    historialModelos []string
+    siguienteModelo  = 1
+    muRegistro       sync.Mutex
+)
+
+// leerConfiguracionModelos toma MODELOS_DIR, MODELOS_MAXIMO y MODELOS_ACTIVAR.
+func leerConfiguracionModelos() error {
+    directorioModelos = leerEnv("MODELOS_DIR", "")
+    var err error
+    if maximoModelos, err = strconv.Atoi(leerEnv("MODELOS_MAXIMO", strconv.Itoa(maximoModelos))); err != nil || maximoModelos < 0 {
+        return fmt.Errorf("MODELOS_MAXIMO debe ser un entero no negativo")
+    }
+    if activarNuevosModelos, err = strconv.ParseBool(leerEnv("MODELOS_ACTIVAR", "true")); err != nil {
+        return fmt.Errorf("MODELOS_ACTIVAR debe ser true o false")
+    }
+    return nil
+}
+
+func parametrosModelo(opciones OpcionesJob) map[string]string {
+    var buffer bytes.Buffer
+    escribirParamsEntrenamiento(&buffer, opciones)
+    parametros := map[string]string{
+        "modo":      opciones.Modo,
+        "particion": opciones.Particion,
+        "algoritmo": opciones.Algoritmo,
+    }
+    if opciones.Modo == modoFederado {
+        parametros["rondas"] = strconv.Itoa(opciones.Rondas)
+    }
+    for _, linea := range strings.Split(buffer.String(), "\n") {
+        if clave, valor, ok := strings.Cut(strings.TrimPrefix(linea, "PARAM "), "="); ok {
+            parametros[clave] = valor
+        }
+    }
+    return parametros
+}
+
+// metricasProcrustes promedia el último punto de las curvas de los shards y
+// el error de alineación de los nodos alineados a la referencia.
+func metricasProcrustes(reporte ReporteJob) map[string]float64 {
+    metricas := map[string]float64{"nodos": float64(len(reporte.Alineacion))}
+    entrenamiento, validacion, curvas := 0.0, 0.0, 0
+    for _, convergencia := range reporte.Convergencia {
+        if len(convergencia.Curva) == 0 {
+            continue
+        }
+        ultimo := convergencia.Curva[len(convergencia.Curva)-1]
+        entrenamiento += ultimo.Entrenamiento
+        validacion += ultimo.Validacion
+        curvas++
+    }
+    if curvas > 0 {
+        metricas["rmseEntrenamiento"] = entrenamiento / float64(curvas)
+        metricas["rmseValidacion"] = validacion / float64(curvas)
+    }
+    alineacion, alineados := 0.0, 0
+    for _, nodo := range reporte.Alineacion {
+        if !nodo.Referencia {
+            alineacion += nodo.ErrorDespues
+            alineados++
+        }
+    }
+    if alineados > 0 {
+        metricas["errorAlineacion"] = alineacion / float64(alineados)
+    }
+    return metricas
+}
+
+// metricasFederadas toma las de la última ronda.
+func metricasFederadas(reporte ReporteJob) map[string]float64 {
+    metricas := map[string]float64{"rondas": float64(len(reporte.Rondas))}
+    if len(reporte.Rondas) > 0 {
+        ultima := reporte.Rondas[len(reporte.Rondas)-1]
+        metricas["nodos"] = float64(ultima.Participantes)
+        metricas["rmseEntrenamiento"] = ultima.RMSEEntrenamiento
+        metricas["rmseValidacion"] = ultima.RMSEValidacion
+        metricas["cambio"] = ultima.Cambio
+    }
+    return metricas
+}
+
+func describirModelo(modelo *ModeloPeliculas) *VersionModelo {
+    return &VersionModelo{
+        Version:    modelo.Version,
+        JobID:      modelo.JobID,
+        Modo:       modelo.Modo,
+        Factores:   modelo.Factores,
+        Peliculas:  len(modelo.Items),
+        Usuarios:   len(modelo.Usuarios),
+        Sesgos:     modelo.tieneSesgos(),
+        Parametros: modelo.Parametros,
+        Metricas:   modelo.Metricas,
+        Huella:     modelo.Huella,
+        Creado:     modelo.Creado,
+    }
+}
+
+func rutaModelo(version string) string {
+    return filepath.Join(directorioModelos, "modelo-"+version+".txt")
+}
+
+func numeroVersion(version string) int {
+    numero, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+    if err != nil || !strings.HasPrefix(version, "v") {
+        return 0
+    }
+    return numero
+}
+
+// escribirAtomico escribe el archivo en uno temporal y lo renombra, para
+// que un corte no deje un archivo a medias.
+func escribirAtomico(ruta string, escribir func(*bufio.Writer)) error {
+    if err := os.MkdirAll(filepath.Dir(ruta), 0755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(ruta), "modelo-*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    writer := bufio.NewWriter(tmp)
+    escribir(writer)
+    if err := writer.Flush(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), ruta)
+}
+
+func formatearNumero(valor float64) string {
+    return strconv.FormatFloat(valor, 'g', -1, 64)
+}
+
+// escribirFilaModelo escribe "índice,columnas...,factores..." con todos los
+// dígitos necesarios para leer los mismos valores.
+func escribirFilaModelo(w *bufio.Writer, indice int, columnas []float64, vector []float64) {
+    w.WriteString(strconv.Itoa(indice))
+    for _, valor := range columnas {
+        w.WriteByte(',')
+        w.WriteString(formatearNumero(valor))
+    }
+    for _, valor := range vector {
+        w.WriteByte(',')
+        w.WriteString(formatearNumero(valor))
+    }
+    w.WriteByte('\n')
+}
+
+// escribirModelo guarda el modelo en el formato del registro:
+//
+//	MODELO 1
+//	VERSION v3 / JOB / MODO / CREADO / HUELLA
+//	PARAM clave=valor ...
+//	METRICA clave=valor ...
+//	MEDIA μ
+//	FACTORES k
+//	PELICULAS n, y n líneas "índice movieId"
+//	USUARIOS m, y m líneas "índice userId"
+//	FACTORES_PELICULAS, y n líneas "índice,b_i,soporte,q..."
+//	FACTORES_USUARIOS, y m líneas "índice,b_u,p..."
+//	FIN
+func escribirModelo(modelo *ModeloPeliculas, ruta string) error {
+    peliculas := make([]string, 0, len(modelo.Items))
+    for movieID := range modelo.Items {
+        peliculas = append(peliculas, movieID)
+    }
+    sort.Strings(peliculas)
+    usuarios := make([]string, 0, len(modelo.Usuarios))
+    for userID := range modelo.Usuarios {
+        usuarios = append(usuarios, userID)
+    }
+    sort.Strings(usuarios)
+
+    return escribirAtomico(ruta, func(w *bufio.Writer) {
+        fmt.Fprintf(w, "MODELO %d\n", formatoModelo)
+        fmt.Fprintf(w, "VERSION %s\n", modelo.Version)
+        fmt.Fprintf(w, "JOB %s\n", modelo.JobID)
+        fmt.Fprintf(w, "MODO %s\n", modelo.Modo)
+        fmt.Fprintf(w, "CREADO %s\n", modelo.Creado.Format(time.RFC3339Nano))
+        fmt.Fprintf(w, "HUELLA %s\n", modelo.Huella)
+        for _, clave := range clavesOrdenadas(modelo.Parametros) {
+            fmt.Fprintf(w, "PARAM %s=%s\n", clave, modelo.Parametros[clave])
+        }
+        metricas := make([]string, 0, len(modelo.Metricas))
+        for clave := range modelo.Metricas {
+            metricas = append(metricas, clave)
+        }
+        sort.Strings(metricas)
+        for _, clave := range metricas {
+            fmt.Fprintf(w, "METRICA %s=%s\n", clave, formatearNumero(modelo.Metricas[clave]))
+        }
+        fmt.Fprintf(w, "MEDIA %s\n", formatearNumero(modelo.Media))
+        fmt.Fprintf(w, "FACTORES %d\n", modelo.Factores)
+        fmt.Fprintf(w, "PELICULAS %d\n", len(peliculas))
+        for i, movieID := range peliculas {
+            fmt.Fprintf(w, "%d %s\n", i, movieID)
+        }
+        fmt.Fprintf(w, "USUARIOS %d\n", len(usuarios))
+        for i, userID := range usuarios {
+            fmt.Fprintf(w, "%d %s\n", i, userID)
+        }
+        fmt.Fprintln(w, "FACTORES_PELICULAS")
+        for i, movieID := range peliculas {
+            escribirFilaModelo(w, i, []float64{modelo.SesgosItems[movieID], float64(modelo.Soporte[movieID])}, modelo.Items[movieID])
+        }
+        fmt.Fprintln(w, "FACTORES_USUARIOS")
+        for i, userID := range usuarios {
+            escribirFilaModelo(w, i, []float64{modelo.SesgosUsuarios[userID]}, modelo.Usuarios[userID])
+        }
+        fmt.Fprintln(w, "FIN")
+    })
+}
+
+func clavesOrdenadas(mapa map[string]string) []string {
+    claves := make([]string, 0, len(mapa))
+    for clave := range mapa {
+        claves = append(claves, clave)
+    }
+    sort.Strings(claves)
+    return claves
+}
+
+// leerFilaModelo separa una fila de factores en el ID de su índice, sus
+// columnas fijas y el vector de factores.
+func leerFilaModelo(linea string, ids []string, columnas, factores int) (string, []float64, []float64, error) {
+    campos := strings.Split(linea, ",")
+    if len(campos) != 1+columnas+factores {
+        return "", nil, nil, fmt.Errorf("fila con %d campos, se esperaban %d", len(campos), 1+columnas+factores)
+    }
+    indice, err := strconv.Atoi(campos[0])
+    if err != nil || indice < 0 || indice >= len(ids) {
+        return "", nil, nil, fmt.Errorf("índice %q fuera del diccionario", campos[0])
+    }
+    valores := make([]float64, len(campos)-1)
+    for i, campo := range campos[1:] {
+        if valores[i], err = strconv.ParseFloat(campo, 64); err != nil {
+            return "", nil, nil, err
+        }
+    }
+    return ids[indice], valores[:columnas], valores[columnas:], nil
+}
+
+// leerModelo lee un archivo escrito por escribirModelo.
+func leerModelo(ruta string) (*ModeloPeliculas, error) {
+    file, err := os.Open(ruta)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    var formato int
+    if !scanner.Scan() {
+        return nil, fmt.Errorf("archivo vacío")
+    }
+    if _, err := fmt.Sscanf(scanner.Text(), "MODELO %d", &formato); err != nil {
+        return nil, fmt.Errorf("cabecera de formato ausente")
+    }
+    if formato != formatoModelo {
+        return nil, fmt.Errorf("formato %d no soportado (se lee el %d)", formato, formatoModelo)
+    }
+
+    modelo := &ModeloPeliculas{
+        Items:      make(map[string][]float64),
+        Parametros: make(map[string]string),
+        Metricas:   make(map[string]float64),
+    }
+    var peliculas, usuarios []string
+    leerDiccionario := func(valor string) ([]string, error) {
+        n, err := strconv.Atoi(valor)
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("tamaño de diccionario %q no válido", valor)
+        }
+        ids := make([]string, n)
+        for i := range ids {
+            if !scanner.Scan() {
+                return nil, fmt.Errorf("diccionario truncado")
+            }
+            indice, id, _ := strings.Cut(scanner.Text(), " ")
+            if indice != strconv.Itoa(i) || id == "" {
+                return nil, fmt.Errorf("entrada %q fuera de orden en el diccionario", scanner.Text())
+            }
+            ids[i] = id
+        }
+        return ids, nil
+    }
+
+    seccion, completo := "", false
+    for scanner.Scan() && !completo {
+        linea := scanner.Text()
+        switch {
+        case linea == "FIN":
+            completo = true
+            continue
+        case linea == "FACTORES_PELICULAS" || linea == "FACTORES_USUARIOS":
+            seccion = linea
+            continue
+        case seccion == "FACTORES_PELICULAS":
+            movieID, columnas, vector, err := leerFilaModelo(linea, peliculas, 2, modelo.Factores)
+            if err != nil {
+                return nil, err
+            }
+            modelo.Items[movieID] = vector
+            if columnas[0] != 0 {
+                if modelo.SesgosItems == nil {
+                    modelo.SesgosItems = make(map[string]float64)
+                }
+                modelo.SesgosItems[movieID] = columnas[0]
+            }
+            if columnas[1] != 0 {
+                if modelo.Soporte == nil {
+                    modelo.Soporte = make(map[string]int)
+                }
+                modelo.Soporte[movieID] = int(columnas[1])
+            }
+            continue
+        case seccion == "FACTORES_USUARIOS":
+            userID, columnas, vector, err := leerFilaModelo(linea, usuarios, 1, modelo.Factores)
+            if err != nil {
+                return nil, err
+            }
+            if modelo.Usuarios == nil {
+                modelo.Usuarios = make(map[string][]float64)
+            }
+            modelo.Usuarios[userID] = vector
+            if columnas[0] != 0 {
+                if modelo.SesgosUsuarios == nil {
+                    modelo.SesgosUsuarios = make(map[string]float64)
+                }
+                modelo.SesgosUsuarios[userID] = columnas[0]
+            }
+            continue
+        }
+
+        clave, valor, _ := strings.Cut(linea, " ")
+        switch clave {
+        case "VERSION":
+            modelo.Version = valor
+        case "JOB":
+            modelo.JobID = valor
+        case "MODO":
+            modelo.Modo = valor
+        case "HUELLA":
+            modelo.Huella = valor
+        case "CREADO":
+            modelo.Creado, err = time.Parse(time.RFC3339Nano, valor)
+        case "PARAM":
+            nombre, dato, _ := strings.Cut(valor, "=")
+            modelo.Parametros[nombre] = dato
+        case "METRICA":
+            nombre, dato, _ := strings.Cut(valor, "=")
+            modelo.Metricas[nombre], err = strconv.ParseFloat(dato, 64)
+        case "MEDIA":
+            modelo.Media, err = strconv.ParseFloat(valor, 64)
+        case "FACTORES":
+            if modelo.Factores, err = strconv.Atoi(valor); err == nil && modelo.Factores <= 0 {
+                err = fmt.Errorf("cantidad de factores %d no válida", modelo.Factores)
+            }
+        case "PELICULAS":
+            peliculas, err = leerDiccionario(valor)
+        case "USUARIOS":
+            usuarios, err = leerDiccionario(valor)
+        default:
+            // Las claves desconocidas se ignoran para poder agregar metadatos
+            // sin cambiar el formato
+        }
+        if err != nil {
+            return nil, fmt.Errorf("línea %q: %v", linea, err)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if !completo {
+        return nil, fmt.Errorf("archivo truncado: falta FIN")
+    }
+    if len(modelo.Items) != len(peliculas) || len(modelo.Usuarios) != len(usuarios) {
+        return nil, fmt.Errorf("hay %d de %d películas y %d de %d usuarios con factores", len(modelo.Items), len(peliculas), len(modelo.Usuarios), len(usuarios))
+    }
+    return modelo, nil
+}
+
+// registrarModelo asigna la siguiente versión al modelo y lo guarda. Si no
+// se puede escribir el archivo, la versión se conserva en memoria.
+func registrarModelo(modelo *ModeloPeliculas) (string, error) {
+    muRegistro.Lock()
+    defer muRegistro.Unlock()
+
+    modelo.Version = fmt.Sprintf("v%d", siguienteModelo)
+    siguienteModelo++
+    version := describirModelo(modelo)
+    var err error
+    if directorioModelos == "" {
+        version.modelo = modelo
+    } else if err = escribirModelo(modelo, rutaModelo(modelo.Version)); err != nil {
+        version.modelo = modelo
+    }
+    registroModelos = append(registroModelos, version)
+    podarRegistro()
+    return modelo.Version, err
+}
+
+// podarRegistro borra las versiones más antiguas por encima de
+// maximoModelos, salvo las del historial de activaciones, que hacen falta
+// para volver atrás. Se llama con muRegistro tomado.
+func podarRegistro() {
+    enHistorial := make(map[string]bool, len(historialModelos))
+    for _, version := range historialModelos {
+        enHistorial[version] = true
+    }
+    for maximoModelos > 0 && len(registroModelos) > maximoModelos {
+        i := 0
+        for i < len(registroModelos) && enHistorial[registroModelos[i].Version] {
+            i++
+        }
+        if i == len(registroModelos) {
+            return
+        }
+        borrada := registroModelos[i]
+        registroModelos = append(registroModelos[:i], registroModelos[i+1:]...)
+        if directorioModelos != "" && borrada.modelo == nil {
+            if err := os.Remove(rutaModelo(borrada.Version)); err != nil {
+                fmt.Printf("No se pudo borrar el modelo %s: %v\n", borrada.Version, err)
+            }
+        }
+        fmt.Printf("Modelo %s (%s) retirado del registro\n", borrada.Version, borrada.JobID)
+    }
+}
 
-        parts := strings.Split(line, ",")
-        if len(parts) != 2 {
-            fmt.Printf("Datos no válidos: %s\n", line)
+// versionActiva se llama con muRegistro tomado.
+func versionActiva() string {
+    if len(historialModelos) == 0 {
+        return ""
+    }
+    return historialModelos[len(historialModelos)-1]
+}
+
+func buscarVersion(version string) *VersionModelo {
+    for _, registrada := range registroModelos {
+        if registrada.Version == version {
+            return registrada
+        }
+    }
+    return nil
+}
+
+func cargarVersion(version *VersionModelo) (*ModeloPeliculas, error) {
+    if version.modelo != nil {
+        return version.modelo, nil
+    }
+    modelo, err := leerModelo(rutaModelo(version.Version))
+    if err != nil {
+        return nil, err
+    }
+    if modelo.Version != version.Version {
+        return nil, fmt.Errorf("el archivo contiene la versión %s", modelo.Version)
+    }
+    return modelo, nil
+}
+
+// guardarHistorial se llama con muRegistro tomado.
+func guardarHistorial() error {
+    if directorioModelos == "" {
+        return nil
+    }
+    return escribirAtomico(filepath.Join(directorioModelos, "activo"), func(w *bufio.Writer) {
+        for _, version := range historialModelos {
+            fmt.Fprintln(w, version)
+        }
+    })
+}
+
+// activarModelo publica un modelo ya registrado y lo anota como activo.
+func activarModelo(modelo *ModeloPeliculas) error {
+    muRegistro.Lock()
+    defer muRegistro.Unlock()
+
+    publicarModelo(modelo)
+    if versionActiva() != modelo.Version {
+        historialModelos = append(historialModelos, modelo.Version)
+        if len(historialModelos) > maximoHistorial {
+            historialModelos = historialModelos[len(historialModelos)-maximoHistorial:]
+        }
+    }
+    return guardarHistorial()
+}
+
+var errVersionDesconocida = errors.New("unknown model version")
+
+// activarVersion carga una versión del registro y la activa.
+func activarVersion(nombre string) (*VersionModelo, error) {
+    muRegistro.Lock()
+    version := buscarVersion(nombre)
+    muRegistro.Unlock()
+    if version == nil {
+        return nil, errVersionDesconocida
+    }
+    modelo, err := cargarVersion(version)
+    if err != nil {
+        return nil, fmt.Errorf("model %s could not be loaded: %v", nombre, err)
+    }
+    if err := activarModelo(modelo); err != nil {
+        fmt.Printf("No se pudo guardar la versión activa: %v\n", err)
+    }
+    fmt.Printf("Modelo %s (%s) activado\n", version.Version, version.JobID)
+    return version, nil
+}
+
+// retrocederModelo activa la versión que estaba activa antes de la actual,
+// saltando las que ya no están en el registro o no se pueden leer.
+func retrocederModelo() (*VersionModelo, error) {
+    muRegistro.Lock()
+    defer muRegistro.Unlock()
+
+    // El historial solo cambia si se encuentra una versión utilizable
+    historial := historialModelos
+    for len(historial) > 1 {
+        historial = historial[:len(historial)-1]
+        version := buscarVersion(historial[len(historial)-1])
+        if version == nil {
+            continue
+        }
+        modelo, err := cargarVersion(version)
+        if err != nil {
+            fmt.Printf("Modelo %s no utilizable para volver atrás: %v\n", version.Version, err)
             continue
         }
+        publicarModelo(modelo)
+        historialModelos = historial
+        if err := guardarHistorial(); err != nil {
+            fmt.Printf("No se pudo guardar la versión activa: %v\n", err)
+        }
+        fmt.Printf("Modelo %s (%s) activado al volver atrás\n", version.Version, version.JobID)
+        return version, nil
+    }
+    return nil, errors.New("there is no previous model version to roll back to")
+}
 
-        movieID := parts[0]
-        rating, err := strconv.ParseFloat(parts[1], 64)
+// cargarRegistroModelos lee las versiones guardadas en MODELOS_DIR y vuelve
+// a activar la que estaba activa.
+func cargarRegistroModelos() {
+    if directorioModelos == "" {
+        return
+    }
+    archivos, _ := filepath.Glob(filepath.Join(directorioModelos, "modelo-v*.txt"))
+    var activo *ModeloPeliculas
+    historial := leerHistorial()
+    muRegistro.Lock()
+    for _, archivo := range archivos {
+        modelo, err := leerModelo(archivo)
+        if err == nil && rutaModelo(modelo.Version) != archivo {
+            err = fmt.Errorf("contiene la versión %s", modelo.Version)
+        }
         if err != nil {
-            fmt.Printf("Error al parsear el rating: %v\n", err)
+            fmt.Printf("Modelo %s no utilizable: %v\n", archivo, err)
             continue
         }
+        registroModelos = append(registroModelos, describirModelo(modelo))
+        if numero := numeroVersion(modelo.Version); numero >= siguienteModelo {
+            siguienteModelo = numero + 1
+        }
+        if len(historial) > 0 && modelo.Version == historial[len(historial)-1] {
+            activo = modelo
+        }
+    }
+    sort.Slice(registroModelos, func(i, j int) bool {
+        return numeroVersion(registroModelos[i].Version) < numeroVersion(registroModelos[j].Version)
+    })
+    historialModelos = historial
+    muRegistro.Unlock()
 
-        tempResults = append(tempResults, Recommendation{
-            MovieID: movieID,
-            Rating:  rating,
-        })
+    fmt.Printf("Registro de modelos: %d versiones en %s\n", len(registroModelos), directorioModelos)
+    if activo != nil {
+        publicarModelo(activo)
+        fmt.Printf("Modelo %s (%s) activo de nuevo, con %d películas\n", activo.Version, activo.JobID, len(activo.Items))
     }
+}
 
-    actualizarTopGlobal(tempResults)
+func leerHistorial() []string {
+    file, err := os.Open(filepath.Join(directorioModelos, "activo"))
+    if err != nil {
+        return nil
+    }
+    defer file.Close()
+    var historial []string
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        if version := strings.TrimSpace(scanner.Text()); version != "" {
+            historial = append(historial, version)
+        }
+    }
+    return historial
 }
 
-func actualizarTopGlobal(tempResults []Recommendation) {
-    muTopGlobal.Lock()
-    defer muTopGlobal.Unlock()
+// versionesModelos copia el registro, de la más nueva a la más antigua,
+// marcando la activa y las entrenadas con el dataset actual.
+func versionesModelos() ([]VersionModelo, string) {
+    muDataset.RLock()
+    huella := huellaDataset
+    muDataset.RUnlock()
+    muRegistro.Lock()
+    defer muRegistro.Unlock()
 
-    ratingMap := make(map[string][]float64)
+    activa := versionActiva()
+    versiones := make([]VersionModelo, len(registroModelos))
+    for i, registrada := range registroModelos {
+        version := *registrada
+        version.Activa = version.Version == activa
+        version.DatasetActual = version.Huella == huella
+        versiones[len(versiones)-1-i] = version
+    }
+    return versiones, activa
+}
 
-    for _, rec := range topGlobal {
-        ratingMap[rec.MovieID] = append(ratingMap[rec.MovieID], rec.Rating)
+// modelosHandler atiende GET /models, GET /models/{version},
+// POST /models/{version}/activate y POST /models/rollback.
+func modelosHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    responderError := func(estado int, mensaje string) {
+        w.WriteHeader(estado)
+        json.NewEncoder(w).Encode(map[string]string{"error": mensaje})
     }
 
-    for _, rec := range tempResults {
-        ratingMap[rec.MovieID] = append(ratingMap[rec.MovieID], rec.Rating)
+    var version *VersionModelo
+    var err error
+    switch {
+    case r.URL.Path == "/models/rollback" || strings.HasSuffix(r.URL.Path, "/activate"):
+        if r.Method != http.MethodPost {
+            responderError(http.StatusMethodNotAllowed, "use POST to change the active model")
+            return
+        }
+        if r.URL.Path == "/models/rollback" {
+            version, err = retrocederModelo()
+        } else {
+            version, err = activarVersion(r.PathValue("version"))
+        }
+        switch {
+        case err == errVersionDesconocida:
+            responderError(http.StatusNotFound, fmt.Sprintf("unknown model version %q", r.PathValue("version")))
+            return
+        case err != nil:
+            responderError(http.StatusConflict, err.Error())
+            return
+        }
+    case r.Method != http.MethodGet:
+        responderError(http.StatusMethodNotAllowed, "use GET to list models")
+        return
     }
 
-    newTopGlobal := []Recommendation{}
-    for movieID, ratings := range ratingMap {
-        newTopGlobal = append(newTopGlobal, Recommendation{
-            MovieID: movieID,
-            Rating:  promedio(ratings),
-        })
+    versiones, activa := versionesModelos()
+    if nombre := r.PathValue("version"); version == nil && nombre != "" {
+        for _, registrada := range versiones {
+            if registrada.Version == nombre {
+                json.NewEncoder(w).Encode(registrada)
+                return
+            }
+        }
+        responderError(http.StatusNotFound, fmt.Sprintf("unknown model version %q", nombre))
+        return
+    }
+    respuesta := map[string]interface{}{
+        "activa":     activa,
+        "versiones":  versiones,
+        "persistido": directorioModelos != "",
+    }
+    if version != nil {
+        for _, registrada := range versiones {
+            if registrada.Version == version.Version {
+                respuesta["activada"] = registrada
+            }
+        }
     }
+    json.NewEncoder(w).Encode(respuesta)
+}
 
-    sort.Slice(newTopGlobal, func(i, j int) bool {
-        return newTopGlobal[i].Rating > newTopGlobal[j].Rating
-    })
+// Predicción de ratings. /predict?userId=&movieIds= estima cuánto le
+// gustaría cada película al usuario: μ + b_u + b_i + pᵀq, recortado al rango
+// de los ratings, y devuelve cada término. El vector y el sesgo del usuario
+// son los que guardó el modelo si lo conoce, y si no, los del plegado de sus
+// ratings. En un modelo sin sesgos μ y b_i valen cero. Por defecto se usa el
+// modelo activo; con source=job se lanza antes un job (procrustes salvo que
+// se pida mode=federado, con las demás opciones de /recommend) y se predice
+// con el modelo que registró, sin activarlo.
 
-    if len(newTopGlobal) > 15 {
-        newTopGlobal = newTopGlobal[:15]
+const maximoPredicciones = 100
+
+// Prediccion es el rating estimado de un par usuario–película y sus términos.
+type Prediccion struct {
+    MovieID       string  `json:"movieId"`
+    Titulo        string  `json:"titulo,omitempty"`
+    Anio          string  `json:"anio,omitempty"`
+    Rating        float64 `json:"rating"`
+    SinRecortar   float64 `json:"sinRecortar"`
+    Recortada     bool    `json:"recortada"`
+    Media         float64 `json:"media"`
+    SesgoUsuario  float64 `json:"sesgoUsuario"`
+    SesgoPelicula float64 `json:"sesgoPelicula"`
+    Interaccion   float64 `json:"interaccion"`
+    // Rating que el usuario ya le dio, si la calificó
+    Calificada *float64 `json:"calificada,omitempty"`
+}
+
+// UsuarioPrediccion indica de dónde salió el vector del usuario: "modelo" o
+// "plegado".
+type UsuarioPrediccion struct {
+    Origen  string          `json:"origen"`
+    Sesgo   float64         `json:"sesgo"`
+    Plegado *PlegadoUsuario `json:"plegado,omitempty"`
+}
+
+// predecirRatings devuelve las predicciones de las películas que el modelo
+// conoce y la lista de las que no.
+func predecirRatings(modelo *ModeloPeliculas, userID string, movieIDs []string) ([]Prediccion, []string, UsuarioPrediccion, error) {
+    if modelo.Parametros["objetivo"] == objetivoBPR {
+        return nil, nil, UsuarioPrediccion{}, fmt.Errorf("model %s was trained with objective=%s and ranks movies instead of predicting ratings", modelo.Version, objetivoBPR)
+    }
+    ratings := ratingsConPendientes(userID)
+    usuario, origen := modelo.Usuarios[userID], UsuarioPrediccion{Origen: "modelo", Sesgo: modelo.SesgosUsuarios[userID]}
+    if usuario == nil {
+        var resumen PlegadoUsuario
+        var err error
+        if usuario, resumen, ratings, err = plegarEnModelo(modelo, userID); err != nil {
+            return nil, nil, origen, err
+        }
+        origen = UsuarioPrediccion{Origen: "plegado", Sesgo: resumen.Sesgo, Plegado: &resumen}
+    }
+    calificadas := make(map[string]float64, len(ratings))
+    for _, rating := range ratings {
+        calificadas[rating.MovieID] = rating.Rating
     }
 
-    topGlobal = newTopGlobal
-    fmt.Println("Top Global actualizado:", topGlobal)
+    predicciones := []Prediccion{}
+    desconocidas := []string{}
+    for _, movieID := range movieIDs {
+        q, existe := modelo.Items[movieID]
+        if !existe {
+            desconocidas = append(desconocidas, movieID)
+            continue
+        }
+        prediccion := Prediccion{
+            MovieID:       movieID,
+            Media:         modelo.Media,
+            SesgoUsuario:  origen.Sesgo,
+            SesgoPelicula: modelo.SesgosItems[movieID],
+            Interaccion:   predecirProducto(usuario, q),
+        }
+        prediccion.SinRecortar = prediccion.Media + prediccion.SesgoUsuario + prediccion.SesgoPelicula + prediccion.Interaccion
+        prediccion.Rating = recortarRating(prediccion.SinRecortar)
+        prediccion.Recortada = prediccion.Rating != prediccion.SinRecortar
+        if rating, existe := calificadas[movieID]; existe {
+            prediccion.Calificada = &rating
+        }
+        if pelicula, existe := catalogo[movieID]; existe {
+            prediccion.Titulo = pelicula.Titulo
+            prediccion.Anio = pelicula.Anio
+        }
+        predicciones = append(predicciones, prediccion)
+    }
+    return predicciones, desconocidas, origen, nil
 }
 
-func calcularTop3Final() []Recommendation {
-    muTopGlobal.Lock()
-    defer muTopGlobal.Unlock()
+// modeloDelJob devuelve el modelo que dejó el job: el que conservó fuera del
+// registro o la versión que registró, esté activa o no.
+func modeloDelJob(jobID string) (*ModeloPeliculas, error) {
+    muModelosDeJobs.Lock()
+    for _, modelo := range modelosDeJobs {
+        if modelo.JobID == jobID {
+            muModelosDeJobs.Unlock()
+            return modelo, nil
+        }
+    }
+    muModelosDeJobs.Unlock()
+    muRegistro.Lock()
+    var version *VersionModelo
+    for _, registrada := range registroModelos {
+        if registrada.JobID == jobID {
+            version = registrada
+        }
+    }
+    muRegistro.Unlock()
+    if version == nil {
+        return nil, fmt.Errorf("job %s finished without a global model", jobID)
+    }
+    return cargarVersion(version)
+}
 
-    if len(topGlobal) > 3 {
-        topGlobal = topGlobal[:3]
+// predecirHandler atiende /predict?userId=&movieIds=1,2,3[&source=job].
+func predecirHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    responderError := func(estado int, mensaje string) {
+        w.WriteHeader(estado)
+        json.NewEncoder(w).Encode(map[string]string{"error": mensaje})
+    }
+
+    consulta := r.URL.Query()
+    userID := consulta.Get("userId")
+    if userID == "" {
+        responderError(http.StatusBadRequest, "userId parameter is required")
+        return
+    }
+    var movieIDs []string
+    repetidas := make(map[string]bool)
+    for _, movieID := range strings.Split(consulta.Get("movieIds"), ",") {
+        if movieID = strings.TrimSpace(movieID); movieID != "" && !repetidas[movieID] {
+            repetidas[movieID] = true
+            movieIDs = append(movieIDs, movieID)
+        }
+    }
+    if len(movieIDs) == 0 || len(movieIDs) > maximoPredicciones {
+        responderError(http.StatusBadRequest, fmt.Sprintf("movieIds must list between 1 and %d comma-separated movie IDs", maximoPredicciones))
+        return
+    }
+
+    respuesta := map[string]interface{}{"userId": userID}
+    var modelo *ModeloPeliculas
+    switch fuente := consulta.Get("source"); fuente {
+    case "", "model":
+        var err error
+        if modelo, err = modeloParaConsultas(); err != nil {
+            avisarReintento(w, err)
+            responderError(http.StatusServiceUnavailable, err.Error()+", or use source=job")
+            return
+        }
+    case "job":
+        if consulta.Get("mode") == "" {
+            consulta.Set("mode", modoProcrustes)
+        }
+        solicitud := r.Clone(r.Context())
+        solicitud.URL.RawQuery = consulta.Encode()
+        opciones, err := parsearOpcionesJob(solicitud)
+        if err == nil && opciones.Modo != modoProcrustes && opciones.Modo != modoFederado {
+            err = fmt.Errorf("source=job needs mode=%s or mode=%s, which leave a global model", modoProcrustes, modoFederado)
+        }
+        if err == nil && opciones.Objetivo == objetivoBPR {
+            err = fmt.Errorf("source=job cannot use objective=%s: it ranks movies instead of predicting ratings", objetivoBPR)
+        }
+        if err != nil {
+            responderError(http.StatusBadRequest, err.Error())
+            return
+        }
+        // Un GET no cambia el modelo que sirven las demás consultas
+        opciones.Activar = false
+        _, reporte, err := generateRecommendations(userID, opciones)
+        if err != nil {
+            responderError(http.StatusInternalServerError, err.Error())
+            return
+        }
+        if modelo, err = modeloDelJob(reporte.ID); err != nil {
+            responderError(http.StatusInternalServerError, err.Error())
+            return
+        }
+        respuesta["job"] = reporte
+    default:
+        responderError(http.StatusBadRequest, fmt.Sprintf("unknown source %q: use model or job", fuente))
+        return
+    }
+
+    predicciones, desconocidas, usuario, err := predecirRatings(modelo, userID, movieIDs)
+    switch {
+    case err != nil && modelo.Parametros["objetivo"] == objetivoBPR:
+        responderError(http.StatusConflict, err.Error())
+        return
+    case err != nil:
+        responderError(http.StatusNotFound, err.Error())
+        return
+    }
+    respuesta["predictions"] = predicciones
+    respuesta["desconocidas"] = desconocidas
+    respuesta["usuario"] = usuario
+    respuesta["rango"] = []float64{ratingMinimo, ratingMaximo}
+    respuesta["model"] = map[string]interface{}{
+        "version":  modelo.Version,
+        "job":      modelo.JobID,
+        "modo":     modelo.Modo,
+        "factores": modelo.Factores,
+        "sesgos":   modelo.tieneSesgos(),
+        "creado":   modelo.Creado,
+    }
+    json.NewEncoder(w).Encode(respuesta)
+}
+
+// Vecinos más cercanos. Con algorithm=knn-items o knn-usuarios los nodos no
+// factorizan: la partición por rango les da columnas completas y cada uno
+// puntúa las películas de su rango. En knn-items el coordinador envía con el
+// job las columnas de las películas del usuario (líneas REF), salvo las que
+// el nodo ya tiene, y los nodos calculan las similitudes entre películas. En
+// knn-usuarios cada nodo devuelve estadísticas de co-ratings con el usuario
+// en su rango (ESTADISTICAS); como son sumas, el coordinador las combina,
+// calcula las similitudes entre usuarios, elige los vecinos y se los envía a
+// cada shard (VECINOS) para que devuelva su top.
+
+// candidatosPorVecino es cuántos vecinos por cada uno pedido se envían a los
+// nodos: cada película usa los k más similares que la calificaron.
+const candidatosPorVecino = 10
+
+// estadisticasShard son las estadísticas que devolvió un nodo para su rango.
+type estadisticasShard struct {
+    Nodo     string
+    Usuarios map[string]similitud.Estadisticas
+}
+
+// VecinoUsuario es un usuario similar al objetivo en knn-usuarios.
+type VecinoUsuario struct {
+    UserID    string  `json:"userId"`
+    Similitud float64 `json:"similitud"`
+    CoRatings int     `json:"coRatings"`
+}
+
+// ReporteKNN resume un job de vecinos más cercanos: los ratings de
+// referencia enviados (knn-items) o los usuarios comparados y los vecinos
+// más similares (knn-usuarios).
+type ReporteKNN struct {
+    Algoritmo      string          `json:"algoritmo"`
+    Similitud      string          `json:"similitud"`
+    Vecinos        int             `json:"vecinos"`
+    Encogimiento   float64         `json:"encogimiento"`
+    Referencias    int             `json:"referencias,omitempty"`
+    Comparados     int             `json:"comparados,omitempty"`
+    MejoresVecinos []VecinoUsuario `json:"mejoresVecinos,omitempty"`
+}
+
+// vecinosReportados es cuántos vecinos se incluyen en el reporte.
+const vecinosReportados = 10
+
+func mediaRatings(ratings []Rating) float64 {
+    if len(ratings) == 0 {
+        return 0
+    }
+    suma := 0.0
+    for _, rating := range ratings {
+        suma += rating.Rating
+    }
+    return suma / float64(len(ratings))
+}
+
+func escribirParamsKNN(w io.Writer, opciones OpcionesJob) {
+    fmt.Fprintf(w, "PARAM algoritmo=%s\n", opciones.Algoritmo)
+    fmt.Fprintf(w, "PARAM similitud=%s\n", opciones.Similitud)
+    fmt.Fprintf(w, "PARAM vecinos=%d\n", opciones.Vecinos)
+    fmt.Fprintf(w, "PARAM encogimiento=%g\n", opciones.Encogimiento)
+}
 
-        seenMovies := make(map[string][]float64)
-        for _, rec := range topGlobal {
-            seenMovies[rec.MovieID] = append(seenMovies[rec.MovieID], rec.Rating)
+// prepararReferencias junta, por shard de origen, los ratings de otros
+// usuarios a las películas que calificó el objetivo, la media de cada una de
+// esas columnas completas y, con coseno ajustado, la media de cada uno de
+// esos usuarios en todo el dataset. Un nodo solo usa las referencias de los
+// usuarios que también están en su shard (sin co-ratings no hay similitud),
+// así que se anotan los de cada shard.
+func prepararReferencias(job *Job, clientData ClientData, shards *ShardSet) {
+    job.referencias = make(map[int][]Rating)
+    usuarios := make(map[string]bool)
+    sumas := make(map[string][2]float64)
+    total := 0
+    for indice, shard := range shards.Shards {
+        for _, rating := range shard {
+            if job.calificadas[rating.MovieID] && rating.UserID != clientData.UserID {
+                job.referencias[indice] = append(job.referencias[indice], rating)
+                usuarios[rating.UserID] = true
+                suma := sumas[rating.MovieID]
+                sumas[rating.MovieID] = [2]float64{suma[0] + rating.Rating, suma[1] + 1}
+                total++
+            }
+        }
+    }
+    for _, rating := range clientData.Data {
+        suma := sumas[rating.MovieID]
+        sumas[rating.MovieID] = [2]float64{suma[0] + rating.Rating, suma[1] + 1}
+    }
+    job.mediasColumnas = make(map[string]float64, len(sumas))
+    for movieID, suma := range sumas {
+        job.mediasColumnas[movieID] = suma[0] / suma[1]
+    }
+    job.coUsuarios = make([]map[string]bool, len(shards.Shards))
+    for indice, shard := range shards.Shards {
+        job.coUsuarios[indice] = make(map[string]bool)
+        for _, rating := range shard {
+            if usuarios[rating.UserID] {
+                job.coUsuarios[indice][rating.UserID] = true
+            }
+        }
+    }
+    if job.opciones.Similitud == similitud.CosenoAjustado {
+        job.medias = make(map[string]float64)
+        for _, ratings := range job.referencias {
+            for _, rating := range ratings {
+                if _, existe := job.medias[rating.UserID]; !existe {
+                    job.medias[rating.UserID] = mediaRatings(ratingsConPendientes(rating.UserID))
+                }
+            }
         }
+    }
+    job.reporte.KNN.Referencias = total
+    fmt.Printf("Job %s: %d ratings de referencia para knn-items\n", job.ID, total)
+}
 
-        for i, rec := range topGlobal {
-            if len(seenMovies[rec.MovieID]) > 1 {
-                topGlobal[i].Rating = promedio(seenMovies[rec.MovieID])
+// escribirReferencias envía al nodo del shard indice los ratings de las
+// columnas de referencia que no están en su shard, solo de los usuarios que
+// tiene, y la media de cada columna completa.
+func escribirReferencias(w io.Writer, job *Job, indice int) {
+    usuarios := make(map[string]bool)
+    for origen, ratings := range job.referencias {
+        if origen == indice {
+            continue
+        }
+        for _, rating := range ratings {
+            if !job.coUsuarios[indice][rating.UserID] {
+                continue
             }
+            fmt.Fprintf(w, "REF %s,%s,%.2f\n", rating.UserID, rating.MovieID, rating.Rating)
+            usuarios[rating.UserID] = true
         }
     }
+    for movieID, media := range job.mediasColumnas {
+        fmt.Fprintf(w, "COLUMNA %s,%g\n", movieID, media)
+    }
+    if job.medias == nil {
+        return
+    }
+    // El nodo necesita también las medias de los usuarios de sus columnas
+    for _, rating := range job.referencias[indice] {
+        usuarios[rating.UserID] = true
+    }
+    for userID := range usuarios {
+        fmt.Fprintf(w, "MEDIA %s,%g\n", userID, job.medias[userID])
+    }
+}
 
-    fmt.Println("Top 3 final:")
-    for _, rec := range topGlobal {
-        fmt.Printf("MovieID: %s, Predicted Rating: %.2f\n", rec.MovieID, rec.Rating)
+// manejarEstadisticas recibe las estadísticas de co-ratings de un shard en
+// la primera ronda de knn-usuarios: "userID,n,sx,sy,sxx,syy,sxy" hasta
+// "FIN_ESTADISTICAS".
+func manejarEstadisticas(reader *bufio.Reader, job *Job, indice int, nodo string) {
+    recibidas := estadisticasShard{Nodo: nodo, Usuarios: make(map[string]similitud.Estadisticas)}
+    motivo := ""
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            aceptarResultado(job, indice, nodo, fmt.Sprintf("estadísticas incompletas: %v", err))
+            return
+        }
+        line = strings.TrimSpace(line)
+        if line == "FIN_ESTADISTICAS" {
+            break
+        }
+        if motivo != "" {
+            continue
+        }
+        campos := strings.Split(line, ",")
+        if len(campos) != 7 {
+            motivo = fmt.Sprintf("línea de estadísticas no válida: %q", line)
+            continue
+        }
+        n, err := strconv.Atoi(campos[1])
+        if err != nil || n <= 0 {
+            motivo = fmt.Sprintf("cantidad de co-ratings no válida: %q", campos[1])
+            continue
+        }
+        sumas := make([]float64, 5)
+        for i := range sumas {
+            sumas[i], err = strconv.ParseFloat(campos[2+i], 64)
+            if err != nil || math.IsNaN(sumas[i]) || math.IsInf(sumas[i], 0) {
+                motivo = fmt.Sprintf("suma no válida para el usuario %s", campos[0])
+                break
+            }
+        }
+        recibidas.Usuarios[campos[0]] = similitud.Estadisticas{N: n, Sx: sumas[0], Sy: sumas[1], Sxx: sumas[2], Syy: sumas[3], Sxy: sumas[4]}
     }
 
-    return topGlobal
+    if !aceptarResultado(job, indice, nodo, motivo) {
+        return
+    }
+    job.mu.Lock()
+    job.estadisticas[indice] = recibidas
+    job.mu.Unlock()
+    fmt.Printf("Job %s: estadísticas del shard %d recibidas de %s (%d usuarios)\n", job.ID, indice, nodo, len(recibidas.Usuarios))
+    job.resultados <- indice
 }
 
-func promedio(nums []float64) float64 {
-    sum := 0.0
-    for _, num := range nums {
-        sum += num
+// elegirVecinos combina las estadísticas de todos los shards y ordena a los
+// usuarios con similitud positiva de mayor a menor.
+func elegirVecinos(job *Job) ([]VecinoUsuario, int) {
+    job.mu.Lock()
+    combinadas := make(map[string]*similitud.Estadisticas)
+    for _, recibidas := range job.estadisticas {
+        for userID, e := range recibidas.Usuarios {
+            if combinadas[userID] == nil {
+                combinadas[userID] = &similitud.Estadisticas{}
+            }
+            combinadas[userID].Combinar(e)
+        }
+    }
+    job.mu.Unlock()
+
+    vecinos := make([]VecinoUsuario, 0)
+    for userID, e := range combinadas {
+        if sim := e.Similitud(job.opciones.Similitud, job.opciones.Encogimiento); sim > 0 {
+            vecinos = append(vecinos, VecinoUsuario{UserID: userID, Similitud: sim, CoRatings: e.N})
+        }
+    }
+    sort.Slice(vecinos, func(i, j int) bool {
+        if vecinos[i].Similitud != vecinos[j].Similitud {
+            return vecinos[i].Similitud > vecinos[j].Similitud
+        }
+        return compararIDs(vecinos[i].UserID, vecinos[j].UserID) < 0
+    })
+    if maximo := job.opciones.Vecinos * candidatosPorVecino; len(vecinos) > maximo {
+        vecinos = vecinos[:maximo]
+    }
+    return vecinos, len(combinadas)
+}
+
+// puntuarConVecinos es la segunda ronda de knn-usuarios: envía los vecinos
+// elegidos a una réplica de cada shard, empezando por la que respondió las
+// estadísticas, y agrega los tops que devuelven.
+func puntuarConVecinos(job *Job, clientData ClientData, shards *ShardSet) {
+    vecinos, comparados := elegirVecinos(job)
+    job.mu.Lock()
+    job.reporte.KNN.Comparados = comparados
+    job.reporte.KNN.MejoresVecinos = vecinos
+    if len(vecinos) > vecinosReportados {
+        job.reporte.KNN.MejoresVecinos = vecinos[:vecinosReportados]
+    }
+    preferidos := make(map[int]string)
+    for indice, recibidas := range job.estadisticas {
+        preferidos[indice] = recibidas.Nodo
+    }
+    job.mu.Unlock()
+    fmt.Printf("Job %s: %d vecinos con similitud positiva entre %d usuarios\n", job.ID, len(vecinos), comparados)
+    if len(vecinos) == 0 {
+        return
+    }
+
+    mediaObjetivo := mediaRatings(clientData.Data)
+    var wg sync.WaitGroup
+    for indice := range shards.Shards {
+        replicas := shards.Replicas[indice]
+        if preferido, existe := preferidos[indice]; existe {
+            ordenadas := []string{preferido}
+            for _, replica := range replicas {
+                if replica != preferido {
+                    ordenadas = append(ordenadas, replica)
+                }
+            }
+            replicas = ordenadas
+        }
+        wg.Add(1)
+        go func(indice int, replicas []string) {
+            defer wg.Done()
+            for _, clienteIP := range replicas {
+                puntajes, err := pedirTopVecinos(clienteIP, shards, indice, job, clientData, vecinos, mediaObjetivo)
+                if err != nil {
+                    fmt.Printf("Job %s: la réplica %s no puntuó el shard %d con vecinos: %v\n", job.ID, clienteIP, indice, err)
+                    continue
+                }
+                puntajes, fueraDeEscala, motivo := validarPuntajes(puntajes, job.opciones)
+                if motivo != "" {
+                    job.mu.Lock()
+                    job.reporte.Exclusiones = append(job.reporte.Exclusiones, ExclusionResultado{Shard: indice, Nodo: clienteIP, Motivo: motivo})
+                    job.mu.Unlock()
+                    continue
+                }
+                sumarFueraDeEscala(job, indice, clienteIP, fueraDeEscala)
+                actualizarTopGlobal(job, indice, clienteIP, puntajes)
+                return
+            }
+            fmt.Printf("Job %s: ninguna réplica puntuó el shard %d con vecinos\n", job.ID, indice)
+        }(indice, replicas)
+    }
+    wg.Wait()
+}
+
+// pedirTopVecinos envía "VECINOS <version> <job> <shard>", el usuario, los
+// parámetros, una línea "VECINO userID,similitud,media" por vecino, los
+// ratings del objetivo y "FIN_VECINOS", y lee el top que responde el nodo.
+func pedirTopVecinos(clienteIP string, shards *ShardSet, indice int, job *Job, clientData ClientData, vecinos []VecinoUsuario, mediaObjetivo float64) ([]Recommendation, error) {
+    remoteDir := net.JoinHostPort(clienteIP, strconv.Itoa(portHP))
+    conn, err := seguridad.Conectar(remoteDir)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(timeoutConexion))
+    writer := bufio.NewWriter(conn)
+    fmt.Fprintf(writer, "VECINOS %s %s %d\n", shards.Version, job.ID, indice)
+    fmt.Fprintf(writer, "UserID: %s\n", clientData.UserID)
+    escribirParamsKNN(writer, job.opciones)
+    fmt.Fprintf(writer, "PARAM media=%g\n", mediaObjetivo)
+    for _, vecino := range vecinos {
+        fmt.Fprintf(writer, "VECINO %s,%g,%g\n", vecino.UserID, vecino.Similitud, mediaRatings(ratingsConPendientes(vecino.UserID)))
+    }
+    for _, rating := range ratingsFueraDelShard(clientData.Data, shards.Shards[indice]) {
+        fmt.Fprintf(writer, "%s,%s,%.2f\n", rating.UserID, rating.MovieID, rating.Rating)
+    }
+    fmt.Fprintln(writer, "FIN_VECINOS")
+    if err := writer.Flush(); err != nil {
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    puntajes := []Recommendation{}
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, "SIN_SHARD") {
+            olvidarReplica(clienteIP, indice, shards.Version)
+            return nil, errSinShard
+        }
+        if line == "FIN_TOP5" {
+            return puntajes, nil
+        }
+        movieID, valor, _ := strings.Cut(line, ",")
+        rating, err := strconv.ParseFloat(valor, 64)
+        if err != nil {
+            return nil, fmt.Errorf("puntaje no válido: %q", line)
+        }
+        puntajes = append(puntajes, Recommendation{MovieID: movieID, Rating: rating})
     }
-    return sum / float64(len(nums))
 }
@@ -0,0 +1,1150 @@
+// codeServer_test.go
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func escribirCSV(t *testing.T, contenido string) string {
+    t.Helper()
+    ruta := filepath.Join(t.TempDir(), "ratings.csv")
+    if err := os.WriteFile(ruta, []byte(contenido), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return ruta
+}
+
+func TestLoadDatasetModoEstricto(t *testing.T) {
+    catalogo := map[string]Pelicula{"1": {MovieID: "1"}, "2": {MovieID: "2"}}
+    casos := []struct {
+        nombre     string
+        csv        string
+        estricto   bool
+        aceptadas  int
+        problemas  int
+        duplicados int
+    }{
+        {"duplicado resuelto por la política", "movieId,userId,rating\n1,a,4\n1,a,5\n2,a,3\n", true, 2, 0, 1},
+        {"película fuera del catálogo rechazada", "movieId,userId,rating\n1,a,4\n9,a,5\n", true, 1, 1, 0},
+        {"película fuera del catálogo aceptada sin modo estricto", "movieId,userId,rating\n1,a,4\n9,a,5\n", false, 2, 1, 0},
+        {"fila malformada", "movieId,userId,rating\n1,a\n2,b,3\n", true, 1, 1, 0},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            _, _, reporte, err := loadDataset(escribirCSV(t, caso.csv), 0, catalogo, "primero", false, caso.estricto)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if reporte.FilasAceptadas != caso.aceptadas || reporte.Problemas() != caso.problemas || reporte.Duplicados != caso.duplicados {
+                t.Errorf("aceptadas=%d problemas=%d duplicados=%d, se esperaba %d, %d y %d",
+                    reporte.FilasAceptadas, reporte.Problemas(), reporte.Duplicados, caso.aceptadas, caso.problemas, caso.duplicados)
+            }
+        })
+    }
+}
+
+func TestLoadDatasetEventosImplicitos(t *testing.T) {
+    csv := "movieId,userId,rating\n1,a,2\n2,a\n2,a,\n1,a\n3,b\n"
+    casos := []struct {
+        nombre    string
+        implicito bool
+        ratings   map[string]int
+        eventos   map[string]int
+    }{
+        // El evento repetido cuenta una vez y el de la película calificada no cuenta
+        {"con eventos", true, map[string]int{"a": 1}, map[string]int{"a": 1, "b": 1}},
+        {"sin eventos", false, map[string]int{"a": 1}, map[string]int{}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            ratings, eventos, reporte, err := loadDataset(escribirCSV(t, csv), 0, nil, "primero", caso.implicito, false)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, par := range []struct {
+                obtenidos map[string][]Rating
+                esperados map[string]int
+            }{{ratings, caso.ratings}, {eventos, caso.eventos}} {
+                if len(par.obtenidos) != len(par.esperados) {
+                    t.Fatalf("se obtuvieron %v, se esperaban %v por usuario", par.obtenidos, par.esperados)
+                }
+                for usuario, cantidad := range par.esperados {
+                    if len(par.obtenidos[usuario]) != cantidad {
+                        t.Errorf("usuario %s: %v, se esperaban %d", usuario, par.obtenidos[usuario], cantidad)
+                    }
+                }
+            }
+            if reporte.FilasAceptadas != 1 || reporte.Usuarios != 1 {
+                t.Errorf("aceptadas=%d usuarios=%d, los eventos no deben contar como ratings", reporte.FilasAceptadas, reporte.Usuarios)
+            }
+            // La huella solo depende de los ratings
+            if huella := calcularHuella(ratings); huella != calcularHuella(map[string][]Rating{"a": {{"a", "1", 2}}}) {
+                t.Errorf("la huella %s incluye los eventos", huella)
+            }
+        })
+    }
+}
+
+func TestRatingsFueraDelShard(t *testing.T) {
+    objetivo := []Rating{{"u", "1", 4}, {"u", "2", 3}, {"u", "3", 5}}
+    casos := []struct {
+        nombre    string
+        shard     []Rating
+        faltantes []string
+    }{
+        {"shard sin el objetivo", []Rating{{"v", "1", 4}}, []string{"1", "2", "3"}},
+        {"ratings ya presentes", []Rating{{"u", "1", 4}, {"u", "3", 5}, {"v", "2", 3}}, []string{"2"}},
+        {"rating corregido", []Rating{{"u", "1", 2}, {"u", "2", 3}, {"u", "3", 5}}, []string{"1"}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            faltantes := ratingsFueraDelShard(objetivo, caso.shard)
+            if len(faltantes) != len(caso.faltantes) {
+                t.Fatalf("se obtuvieron %v, se esperaban las películas %v", faltantes, caso.faltantes)
+            }
+            for i, rating := range faltantes {
+                if rating.MovieID != caso.faltantes[i] {
+                    t.Errorf("faltante %d: %s, se esperaba %s", i, rating.MovieID, caso.faltantes[i])
+                }
+            }
+        })
+    }
+}
+
+func TestUbicarReplicas(t *testing.T) {
+    anteriores := addrs
+    defer func() { addrs = anteriores }()
+    addrs = []string{"a", "b", "c", "d"}
+
+    casos := []struct {
+        nombre      string
+        pesos       []float64
+        replicacion int
+        // Réplicas extra que se espera que guarde cada nodo
+        extras map[string]int
+    }{
+        {"pesos iguales", []float64{0.25, 0.25, 0.25, 0.25}, 2, map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}},
+        {"un nodo con la mitad de la capacidad", []float64{0.5, 0.2, 0.15, 0.15}, 2, map[string]int{"a": 3, "b": 1, "c": 0, "d": 0}},
+        {"sin replicación", []float64{0.4, 0.3, 0.2, 0.1}, 1, map[string]int{}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            replicas := ubicarReplicas(caso.pesos, caso.replicacion)
+            extras := make(map[string]int)
+            for i, nodos := range replicas {
+                if len(nodos) != caso.replicacion || nodos[0] != addrs[i] {
+                    t.Fatalf("shard %d: réplicas %v", i, nodos)
+                }
+                vistos := make(map[string]bool)
+                for _, nodo := range nodos {
+                    if vistos[nodo] {
+                        t.Fatalf("shard %d: el nodo %s aparece dos veces", i, nodo)
+                    }
+                    vistos[nodo] = true
+                }
+                for _, nodo := range nodos[1:] {
+                    extras[nodo]++
+                }
+            }
+            for _, nodo := range addrs {
+                if extras[nodo] != caso.extras[nodo] {
+                    t.Errorf("réplicas extra por nodo %v, se esperaba %v", extras, caso.extras)
+                    break
+                }
+            }
+        })
+    }
+}
+
+func TestPesosNodos(t *testing.T) {
+    anteriores, anterioresNodos := addrs, nodos
+    defer func() { addrs, nodos = anteriores, anterioresNodos }()
+    addrs = []string{"a", "b", "c"}
+
+    const gib = 1 << 30
+    capacidad := func(cpus float64, memoria int64) *InfoNodo {
+        return &InfoNodo{CPUs: cpus, Memoria: memoria}
+    }
+    // Los pesos esperados se normalizan antes de comparar
+    casos := []struct {
+        nombre string
+        nodos  map[string]*InfoNodo
+        pesos  []float64
+    }{
+        {"sin registros", map[string]*InfoNodo{}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+        {"proporcional a CPU y memoria", map[string]*InfoNodo{"a": capacidad(1, gib), "b": capacidad(2, 2*gib), "c": capacidad(4, 4*gib)},
+            []float64{1.0 / 7, 2.0 / 7, 4.0 / 7}},
+        // Con las CPUs repartidas por igual manda la memoria: c tiene 3/4
+        // de la memoria pero solo 1/3 de las CPUs
+        {"el recurso más escaso", map[string]*InfoNodo{"a": capacidad(2, gib), "b": capacidad(2, gib), "c": capacidad(2, 6*gib)},
+            []float64{1.0 / 8, 1.0 / 8, 1.0 / 3}},
+        // El nodo sin registrar recibe el promedio de los registrados
+        {"nodo sin registrar", map[string]*InfoNodo{"a": capacidad(1, gib), "b": capacidad(3, 3*gib)}, []float64{0.25, 0.75, 0.5}},
+        // Capacidades nulas, infinitas o no numéricas cuentan como sin
+        // registrar
+        {"capacidades nulas", map[string]*InfoNodo{"a": capacidad(1, gib), "b": capacidad(3, 3*gib), "c": capacidad(0, 8*gib)}, []float64{0.25, 0.75, 0.5}},
+        {"capacidades infinitas", map[string]*InfoNodo{"a": capacidad(1, gib), "b": capacidad(3, 3*gib), "c": capacidad(math.Inf(1), 8*gib)}, []float64{0.25, 0.75, 0.5}},
+        {"capacidades no numéricas", map[string]*InfoNodo{"a": capacidad(1, gib), "b": capacidad(3, 3*gib), "c": capacidad(math.NaN(), 8*gib)}, []float64{0.25, 0.75, 0.5}},
+        // Un nodo con valores absurdos cuenta como desproporcionMaxima veces
+        // la mediana, y uno diminuto como su fracción
+        {"capacidades absurdas", map[string]*InfoNodo{"a": capacidad(2, 4*gib), "b": capacidad(2, 4*gib), "c": capacidad(1e9, 1<<60)},
+            []float64{0.1, 0.1, 0.8}},
+        {"capacidades diminutas", map[string]*InfoNodo{"a": capacidad(8, 8*gib), "b": capacidad(8, 8*gib), "c": capacidad(0.001, 1)},
+            []float64{8.0 / 17, 8.0 / 17, 1.0 / 17}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            nodos = caso.nodos
+            pesos := pesosNodos()
+            suma := 0.0
+            for _, peso := range pesos {
+                suma += peso
+            }
+            if math.Abs(suma-1) > 1e-12 {
+                t.Errorf("los pesos %v suman %g", pesos, suma)
+            }
+            normalizados := make([]float64, len(caso.pesos))
+            total := 0.0
+            for _, peso := range caso.pesos {
+                total += peso
+            }
+            for i, peso := range caso.pesos {
+                normalizados[i] = peso / total
+            }
+            for i := range pesos {
+                if math.Abs(pesos[i]-normalizados[i]) > 1e-12 {
+                    t.Fatalf("pesos %v, se esperaba %v", pesos, normalizados)
+                }
+            }
+        })
+    }
+
+    // El tamaño de los shards sigue a los pesos
+    nodos = map[string]*InfoNodo{"a": capacidad(1, gib), "b": capacidad(2, 2*gib), "c": capacidad(4, 4*gib)}
+    ratings := make(map[string][]Rating)
+    for u := 0; u < 700; u++ {
+        userID := strconv.Itoa(u + 1)
+        for m := 0; m < 10; m++ {
+            ratings[userID] = append(ratings[userID], Rating{UserID: userID, MovieID: strconv.Itoa(m + 1), Rating: 3})
+        }
+    }
+    shards := splitDataset(ratings, pesosNodos(), particionRoundRobin{}, 1)
+    for i, esperado := range []int{1000, 2000, 4000} {
+        if len(shards[i]) != esperado {
+            t.Errorf("shard %d con %d ratings, se esperaban %d", i, len(shards[i]), esperado)
+        }
+    }
+}
+
+func TestAgregadores(t *testing.T) {
+    // Tres nodos sanos y uno que devuelve un puntaje absurdo
+    votos := []Voto{
+        {Puntaje: 4, Posicion: 0, Largo: 5, Peso: 100},
+        {Puntaje: 4.2, Posicion: 1, Largo: 5, Peso: 100},
+        {Puntaje: 3.8, Posicion: 2, Largo: 5, Peso: 200},
+        {Puntaje: 40, Posicion: 4, Largo: 5, Peso: 100},
+    }
+    casos := []struct {
+        agregador Agregador
+        esperado  float64
+    }{
+        {agregadorPromedio{}, 13},
+        {agregadorMediana{}, 4.1},
+        {promedioPonderado{}, (400 + 420 + 760 + 4000) / 500.0},
+        {mediaRecortada{fraccion: 0.25}, 4.1},
+        {conteoBorda{}, 5 + 4 + 3 + 1},
+        {rankingReciproco{}, 1.0/61 + 1.0/62 + 1.0/63 + 1.0/65},
+        {conteoVotos{}, 4},
+    }
+    for _, caso := range casos {
+        t.Run(caso.agregador.Nombre(), func(t *testing.T) {
+            if obtenido := caso.agregador.Agregar(votos); math.Abs(obtenido-caso.esperado) > 1e-9 {
+                t.Errorf("se obtuvo %g, se esperaba %g", obtenido, caso.esperado)
+            }
+        })
+    }
+}
+
+func TestValidarPuntajes(t *testing.T) {
+    rmse := OpcionesJob{Objetivo: objetivoRMSE}
+    casos := []struct {
+        nombre      string
+        puntajes    []float64
+        opciones    OpcionesJob
+        rechazado   bool
+        validos     []float64
+        descartados int
+    }{
+        {"puntajes en escala", []float64{4.5, 4, 3.2}, rmse, false, []float64{4.5, 4, 3.2}, 0},
+        {"mejores películas algo por encima de 5", []float64{5.8, 5.4, 4.9, 4.1, 3.9}, rmse, false, []float64{5, 5, 4.9, 4.1, 3.9}, 0},
+        {"puntajes sueltos fuera del margen", []float64{6.8, 5.4, 4.9, -0.5, 3.9}, rmse, false, []float64{5, 4.9, 3.9}, 2},
+        {"modelo divergente", []float64{900, 850, 4}, rmse, true, nil, 0},
+        {"puntaje no finito", []float64{4, math.NaN()}, rmse, true, nil, 0},
+        {"BPR sin escala", []float64{12, -3}, OpcionesJob{Objetivo: objetivoBPR}, false, []float64{12, -3}, 0},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            puntajes := make([]Recommendation, len(caso.puntajes))
+            for i, valor := range caso.puntajes {
+                puntajes[i] = Recommendation{MovieID: strconv.Itoa(i), Rating: valor}
+            }
+            validos, descartados, motivo := validarPuntajes(puntajes, caso.opciones)
+            if (motivo != "") != caso.rechazado {
+                t.Fatalf("motivo %q, se esperaba rechazado=%v", motivo, caso.rechazado)
+            }
+            if len(validos) != len(caso.validos) || descartados != caso.descartados {
+                t.Fatalf("%d puntajes válidos y %d descartados, se esperaba %d y %d", len(validos), descartados, len(caso.validos), caso.descartados)
+            }
+            for i, valor := range caso.validos {
+                if validos[i].Rating != valor {
+                    t.Errorf("puntaje %d: %g, se esperaba %g", i, validos[i].Rating, valor)
+                }
+            }
+        })
+    }
+}
+
+func TestEpsilonRDP(t *testing.T) {
+    casos := []struct {
+        nombre   string
+        q, sigma float64
+        pasos    int
+        epsilon  float64
+        orden    int
+    }{
+        // Sin submuestreo: mín_α α/(2σ²) + log(1/δ)/(α-1)
+        {"mecanismo gaussiano", 1, 1, 1, 3 + math.Log(1e5)/5, 6},
+        // Ejemplo de MNIST de TensorFlow Privacy: 60 épocas con lotes de 256
+        {"MNIST, 60 épocas", 256.0 / 60000, 1.1, 60 * 235, 3.01, 9},
+        {"sin ruido", 0.01, 0, 100, math.Inf(1), 0},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            epsilon, orden := epsilonRDP(caso.q, caso.sigma, caso.pasos, 1e-5)
+            cerca := epsilon == caso.epsilon || math.Abs(epsilon-caso.epsilon) < 0.01
+            if !cerca || orden != caso.orden {
+                t.Errorf("ε=%g con orden %d, se esperaba %g con orden %d", epsilon, orden, caso.epsilon, caso.orden)
+            }
+        })
+    }
+}
+
+func TestReportePrivacidad(t *testing.T) {
+    privado := OpcionesJob{Privado: true, Clip: 1, Ruido: 1.1, Lote: 64, Delta: 1e-5, Iteraciones: 10}
+    casos := []struct {
+        nombre   string
+        opciones OpcionesJob
+        ratings  int
+        rondas   int
+        // 0 pasos si el job no gasta presupuesto
+        pasos int
+        tasa  float64
+    }{
+        {"job sin privacidad", OpcionesJob{Iteraciones: 10}, 1000, 1, 0, 0},
+        {"shard vacío", privado, 0, 1, 0, 0},
+        {"una ronda", privado, 1000, 1, 10 * 16, 0.064},
+        {"federado", privado, 1000, 5, 5 * 10 * 16, 0.064},
+        {"lote mayor que el shard", privado, 40, 1, 10, 1},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            reporte := reportePrivacidad(caso.opciones, caso.ratings, caso.rondas)
+            if caso.pasos == 0 {
+                if reporte != nil {
+                    t.Fatalf("se obtuvo %+v, se esperaba nil", *reporte)
+                }
+                return
+            }
+            if reporte == nil {
+                t.Fatal("no hay reporte")
+            }
+            if reporte.Pasos != caso.pasos || math.Abs(reporte.TasaMuestreo-caso.tasa) > 1e-12 {
+                t.Errorf("pasos=%d tasa=%g, se esperaba %d y %g", reporte.Pasos, reporte.TasaMuestreo, caso.pasos, caso.tasa)
+            }
+            epsilon, _ := epsilonRDP(caso.tasa, caso.opciones.Ruido, caso.pasos, caso.opciones.Delta)
+            if reporte.Epsilon != epsilon {
+                t.Errorf("ε=%g, se esperaba %g", reporte.Epsilon, epsilon)
+            }
+        })
+    }
+}
+
+func TestParticionadores(t *testing.T) {
+    // 3000 ratings de 200 usuarios sobre 150 películas
+    generador := rand.New(rand.NewSource(3))
+    ratings := make([]Rating, 0, 3000)
+    vistos := make(map[[2]int]bool)
+    for len(ratings) < 3000 {
+        u, m := generador.Intn(200), generador.Intn(150)
+        if !vistos[[2]int{u, m}] {
+            vistos[[2]int{u, m}] = true
+            ratings = append(ratings, Rating{strconv.Itoa(u), strconv.Itoa(m), float64(1 + generador.Intn(5))})
+        }
+    }
+
+    casos := []struct {
+        particion string
+        pesos     []float64
+        // Tolerancia de cada fracción respecto de su peso
+        tolerancia float64
+        // Clave que no se reparte entre particiones: "usuario", "pelicula" o ""
+        clave string
+    }{
+        {"roundrobin", []float64{0.25, 0.25, 0.25, 0.25}, 0.001, ""},
+        {"roundrobin", []float64{0.5, 0.3, 0.2}, 0.001, ""},
+        {"hash-usuario", []float64{0.25, 0.25, 0.25, 0.25}, 0.06, "usuario"},
+        {"hash-item", []float64{0.5, 0.3, 0.2}, 0.08, "pelicula"},
+        {"rango", []float64{0.5, 0.3, 0.2}, 0.02, "pelicula"},
+    }
+    for _, caso := range casos {
+        t.Run(fmt.Sprintf("%s %v", caso.particion, caso.pesos), func(t *testing.T) {
+            particionador := particionadores[caso.particion]
+            particiones := particionador.Particionar(ratings, caso.pesos, 7)
+            if len(particiones) != len(caso.pesos) {
+                t.Fatalf("%d particiones, se esperaban %d", len(particiones), len(caso.pesos))
+            }
+
+            duenos := make(map[string]int)
+            total := 0
+            for i, particion := range particiones {
+                total += len(particion)
+                if fraccion := float64(len(particion)) / float64(len(ratings)); math.Abs(fraccion-caso.pesos[i]) > caso.tolerancia {
+                    t.Errorf("partición %d: fracción %.3f, peso %.3f", i, fraccion, caso.pesos[i])
+                }
+                for _, rating := range particion {
+                    clave := rating.UserID
+                    if caso.clave == "pelicula" {
+                        clave = rating.MovieID
+                    }
+                    if dueno, existe := duenos[clave]; caso.clave != "" && existe && dueno != i {
+                        t.Fatalf("%s %s repartido entre las particiones %d y %d", caso.clave, clave, dueno, i)
+                    }
+                    duenos[clave] = i
+                }
+            }
+            if total != len(ratings) {
+                t.Fatalf("%d ratings repartidos, se esperaban %d", total, len(ratings))
+            }
+
+            // Con la misma semilla el reparto se repite
+            repetidas := particionador.Particionar(ratings, caso.pesos, 7)
+            for i := range particiones {
+                if len(repetidas[i]) != len(particiones[i]) || len(particiones[i]) > 0 && repetidas[i][0] != particiones[i][0] {
+                    t.Fatalf("la partición %d cambió con la misma semilla", i)
+                }
+            }
+        })
+    }
+}
+
+// ortogonalAleatoria ortonormaliza las columnas de una matriz gaussiana con
+// Gram-Schmidt.
+func ortogonalAleatoria(r *rand.Rand, k int) [][]float64 {
+    q := matrizAleatoria(r, k, k)
+    for j := 0; j < k; j++ {
+        for otra := 0; otra < j; otra++ {
+            proyeccion := 0.0
+            for i := 0; i < k; i++ {
+                proyeccion += q[i][j] * q[i][otra]
+            }
+            for i := 0; i < k; i++ {
+                q[i][j] -= proyeccion * q[i][otra]
+            }
+        }
+        norma := 0.0
+        for i := 0; i < k; i++ {
+            norma += q[i][j] * q[i][j]
+        }
+        for i := 0; i < k; i++ {
+            q[i][j] /= math.Sqrt(norma)
+        }
+    }
+    return q
+}
+
+func matrizAleatoria(r *rand.Rand, filas, columnas int) [][]float64 {
+    m := make([][]float64, filas)
+    for i := range m {
+        m[i] = make([]float64, columnas)
+        for j := range m[i] {
+            m[i][j] = r.NormFloat64()
+        }
+    }
+    return m
+}
+
+// distanciaMaxima es el mayor |a_ij - b_ij|.
+func distanciaMaxima(a, b [][]float64) float64 {
+    maxima := 0.0
+    for i := range a {
+        for j := range a[i] {
+            maxima = math.Max(maxima, math.Abs(a[i][j]-b[i][j]))
+        }
+    }
+    return maxima
+}
+
+func identidad(k int) [][]float64 {
+    m := make([][]float64, k)
+    for i := range m {
+        m[i] = make([]float64, k)
+        m[i][i] = 1
+    }
+    return m
+}
+
+func TestSvdJacobi(t *testing.T) {
+    r := rand.New(rand.NewSource(7))
+    casos := []struct {
+        nombre string
+        m      [][]float64
+    }{
+        {"rango completo", matrizAleatoria(r, 5, 5)},
+        {"rango 2 de 4", multiplicar(matrizAleatoria(r, 4, 2), matrizAleatoria(r, 2, 4))},
+        {"matriz nula", [][]float64{make([]float64, 3), make([]float64, 3), make([]float64, 3)}},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            n := len(caso.m)
+            u, w := svdJacobi(caso.m)
+            // U y W son ortogonales y UᵀmW es diagonal con valores no negativos
+            if d := distanciaMaxima(multiplicar(transponer(u), u), identidad(n)); d > 1e-9 {
+                t.Errorf("UᵀU se aleja %g de la identidad", d)
+            }
+            if d := distanciaMaxima(multiplicar(transponer(w), w), identidad(n)); d > 1e-9 {
+                t.Errorf("WᵀW se aleja %g de la identidad", d)
+            }
+            sigma := multiplicar(multiplicar(transponer(u), caso.m), w)
+            for i := range sigma {
+                for j := range sigma[i] {
+                    if (i != j && math.Abs(sigma[i][j]) > 1e-9) || (i == j && sigma[i][j] < -1e-9) {
+                        t.Fatalf("UᵀmW no es diagonal no negativa: %v", sigma)
+                    }
+                }
+            }
+        })
+    }
+}
+
+func TestProcrustesRecuperaRotacion(t *testing.T) {
+    r := rand.New(rand.NewSource(42))
+    for _, k := range []int{2, 3, 8} {
+        t.Run(fmt.Sprintf("k=%d", k), func(t *testing.T) {
+            // b es a rotada por Q más un ruido pequeño: procrustes devuelve Q
+            q := ortogonalAleatoria(r, k)
+            a := matrizAleatoria(r, 50, k)
+            b := multiplicar(a, q)
+            for i := range b {
+                for j := range b[i] {
+                    b[i][j] += 1e-6 * r.NormFloat64()
+                }
+            }
+            rotacion := procrustes(a, b)
+            if d := distanciaMaxima(rotacion, q); d > 1e-5 {
+                t.Errorf("la rotación se aleja %g de Q", d)
+            }
+            if e := raizErrorCuadratico(multiplicar(a, rotacion), b); e > 1e-5 {
+                t.Errorf("error después de alinear %g", e)
+            }
+        })
+    }
+}
+
+func TestProcrustesRangoIncompleto(t *testing.T) {
+    // Las películas compartidas solo ocupan 2 de las 4 dimensiones: la rotación
+    // no es única, pero debe ser ortogonal y alinear las compartidas
+    r := rand.New(rand.NewSource(3))
+    k := 4
+    q := ortogonalAleatoria(r, k)
+    a := multiplicar(matrizAleatoria(r, 30, 2), matrizAleatoria(r, 2, k))
+    b := multiplicar(a, q)
+    rotacion := procrustes(a, b)
+    for i := range rotacion {
+        for j := range rotacion[i] {
+            if math.IsNaN(rotacion[i][j]) {
+                t.Fatalf("rotación con NaN: %v", rotacion)
+            }
+        }
+    }
+    if d := distanciaMaxima(multiplicar(transponer(rotacion), rotacion), identidad(k)); d > 1e-9 {
+        t.Errorf("RᵀR se aleja %g de la identidad", d)
+    }
+    if e := raizErrorCuadratico(multiplicar(a, rotacion), b); e > 1e-9 {
+        t.Errorf("error después de alinear %g", e)
+    }
+}
+
+func TestAlinearModelos(t *testing.T) {
+    // El nodo 1 aprendió el mismo modelo que el 0 pero rotado: al alinearlo
+    // el promedio reproduce el modelo de referencia y las predicciones
+    r := rand.New(rand.NewSource(11))
+    k := 3
+    q := ortogonalAleatoria(r, k)
+    items := make(map[string][]float64)
+    rotados := make(map[string][]float64)
+    for i := 0; i < 20; i++ {
+        vector := matrizAleatoria(r, 1, k)[0]
+        items[strconv.Itoa(i)] = vector
+        rotados[strconv.Itoa(i)] = multiplicar([][]float64{vector}, q)[0]
+    }
+    usuario := []float64{0.5, -1, 2}
+    job := nuevoJob("u", OpcionesJob{Factores: k})
+    defer terminarJob(job)
+    job.modelos[0] = modeloNodo{Nodo: "a", Usuario: usuario, Items: items}
+    job.modelos[1] = modeloNodo{Nodo: "b", Usuario: multiplicar([][]float64{usuario}, q)[0], Items: rotados}
+
+    global, alineaciones, exclusiones := alinearModelos(job)
+    if global == nil || len(alineaciones) != 2 || len(exclusiones) != 0 {
+        t.Fatalf("alineaciones %+v y exclusiones %+v, se esperaban dos alineados", alineaciones, exclusiones)
+    }
+    if alineaciones[1].ErrorAntes < 0.1 || alineaciones[1].ErrorDespues > 1e-9 {
+        t.Errorf("error antes %g y después %g, se esperaba alinear el modelo rotado", alineaciones[1].ErrorAntes, alineaciones[1].ErrorDespues)
+    }
+    for movieID, vector := range items {
+        if d := distanciaMaxima([][]float64{global.Items[movieID]}, [][]float64{vector}); d > 1e-9 {
+            t.Errorf("película %s se aleja %g de la referencia", movieID, d)
+        }
+        if global.Soporte[movieID] != 2 {
+            t.Errorf("soporte de %s %d, se esperaba 2", movieID, global.Soporte[movieID])
+        }
+    }
+    if d := distanciaMaxima([][]float64{global.Usuario}, [][]float64{usuario}); d > 1e-9 {
+        t.Errorf("el usuario se aleja %g del de referencia", d)
+    }
+}
+
+func TestPlegarUsuario(t *testing.T) {
+    // Con λ casi nula el plegado recupera el vector y el sesgo con que se
+    // generaron los ratings: r = 3 + (1, 2)·q
+    anterior := regularizacionPlegado
+    regularizacionPlegado = 1e-9
+    defer func() { regularizacionPlegado = anterior }()
+    modelo := &ModeloPeliculas{
+        Factores: 2,
+        Items: map[string][]float64{
+            "1": {1, 0},
+            "2": {0, 1},
+            "3": {1, 1},
+            "4": {0, 0},
+        },
+    }
+    generados := []Rating{{"a", "1", 4}, {"a", "2", 5}, {"a", "3", 6}, {"a", "4", 3}}
+
+    casos := []struct {
+        nombre   string
+        ratings  []Rating
+        enModelo int
+        usuario  []float64
+        sesgo    float64
+        error    bool
+    }{
+        {"recupera vector y sesgo", generados, 4, []float64{1, 2}, 3, false},
+        {"las películas fuera del modelo no aportan", append([]Rating{{"a", "9", 1}}, generados...), 4, []float64{1, 2}, 3, false},
+        {"un solo rating queda en el sesgo", []Rating{{"a", "4", 4}}, 1, []float64{0, 0}, 4, false},
+        {"ninguna película del modelo", []Rating{{"a", "9", 1}}, 0, nil, 0, true},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            usuario, resumen, err := plegarUsuario(modelo, caso.ratings)
+            if (err != nil) != caso.error {
+                t.Fatalf("error %v, se esperaba error: %t", err, caso.error)
+            }
+            if resumen.Ratings != len(caso.ratings) || resumen.EnModelo != caso.enModelo {
+                t.Errorf("ratings=%d enModelo=%d, se esperaba %d y %d", resumen.Ratings, resumen.EnModelo, len(caso.ratings), caso.enModelo)
+            }
+            if caso.error {
+                return
+            }
+            for k := range caso.usuario {
+                if math.Abs(usuario[k]-caso.usuario[k]) > 1e-6 {
+                    t.Errorf("usuario %v, se esperaba %v", usuario, caso.usuario)
+                    break
+                }
+            }
+            if math.Abs(resumen.Sesgo-caso.sesgo) > 1e-6 || resumen.RMSE > 1e-6 {
+                t.Errorf("sesgo %.6f con RMSE %.6f, se esperaba %.6f y 0", resumen.Sesgo, resumen.RMSE, caso.sesgo)
+            }
+        })
+    }
+}
+
+func TestPlegarUsuarioSesgos(t *testing.T) {
+    // La λ de los factores no encoge el sesgo del usuario, que se ajusta sobre
+    // r - μ - b_i: con un rating de 4 en una película de b_i = 0.5 y μ = 3
+    // el sesgo es 0.5, o 0.25 si se regulariza con λ = 1
+    anterior, anteriorSesgo := regularizacionPlegado, regularizacionSesgoPlegado
+    defer func() { regularizacionPlegado, regularizacionSesgoPlegado = anterior, anteriorSesgo }()
+    modelo := &ModeloPeliculas{
+        Factores:    1,
+        Items:       map[string][]float64{"1": {0}},
+        Media:       3,
+        SesgosItems: map[string]float64{"1": 0.5},
+    }
+    casos := []struct {
+        nombre      string
+        lambdaSesgo float64
+        sesgo       float64
+    }{
+        {"sesgo sin regularizar", 0, 0.5},
+        {"sesgo regularizado", 1, 0.25},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            regularizacionPlegado, regularizacionSesgoPlegado = 10, caso.lambdaSesgo
+            _, resumen, err := plegarUsuario(modelo, []Rating{{"a", "1", 4}})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if math.Abs(resumen.Sesgo-caso.sesgo) > 1e-9 {
+                t.Errorf("sesgo %g, se esperaba %g", resumen.Sesgo, caso.sesgo)
+            }
+        })
+    }
+}
+
+func TestPlegarEnModeloGuardaElUsuario(t *testing.T) {
+    anteriorDataset := dataset
+    defer func() { dataset = anteriorDataset }()
+    modelo := &ModeloPeliculas{Factores: 1, Items: map[string][]float64{"1": {1}, "2": {0}}}
+    dataset = map[string][]Rating{"a": {{"a", "1", 5}, {"a", "2", 3}}}
+
+    _, primero, _, err := plegarEnModelo(modelo, "a")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Sin ratings nuevos por /users/{id}/ratings se reutiliza el plegado
+    dataset = map[string][]Rating{"a": {{"a", "1", 1}, {"a", "2", 1}}}
+    if _, segundo, _, _ := plegarEnModelo(modelo, "a"); segundo.Sesgo != primero.Sesgo {
+        t.Errorf("sesgo %g, se esperaba el guardado %g", segundo.Sesgo, primero.Sesgo)
+    }
+    olvidarPlegado("a")
+    if _, tercero, _, _ := plegarEnModelo(modelo, "a"); math.Abs(tercero.Sesgo-1) > 1e-9 {
+        t.Errorf("sesgo %g tras olvidar el plegado, se esperaba 1", tercero.Sesgo)
+    }
+    // Otro modelo no usa los plegados del anterior
+    otro := &ModeloPeliculas{Factores: 1, Items: map[string][]float64{"2": {0}}, Media: 0.5}
+    if _, cuarto, _, _ := plegarEnModelo(otro, "a"); math.Abs(cuarto.Sesgo-0.5) > 1e-9 {
+        t.Errorf("sesgo %g en otro modelo, se esperaba 0.5", cuarto.Sesgo)
+    }
+}
+
+func TestModeloIdaYVuelta(t *testing.T) {
+    completo := &ModeloPeliculas{
+        Version:        "v3",
+        JobID:          "job-7",
+        Modo:           modoProcrustes,
+        Factores:       2,
+        Items:          map[string][]float64{"10": {0.1, -2.5e-7}, "2": {1.0 / 3, 4}},
+        Soporte:        map[string]int{"10": 3},
+        Usuarios:       map[string][]float64{"122": {-0.75, 1e10}},
+        Media:          3.6042,
+        SesgosItems:    map[string]float64{"10": -0.25, "2": 1.0 / 7},
+        SesgosUsuarios: map[string]float64{"122": 0.3},
+        Parametros:     map[string]string{"seed": "1", "particion": "roundrobin"},
+        Metricas:       map[string]float64{"rmse": 0.8123456789},
+        Huella:         "abc123",
+        Creado:         time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC),
+    }
+    sinUsuarios := &ModeloPeliculas{
+        Version:    "v1",
+        JobID:      "job-1",
+        Modo:       modoFederado,
+        Factores:   1,
+        Items:      map[string][]float64{"1": {2}},
+        Parametros: map[string]string{},
+        Metricas:   map[string]float64{},
+        Creado:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+    }
+
+    casos := []struct {
+        nombre  string
+        modelo  *ModeloPeliculas
+        alterar func(string) string
+        error   bool
+    }{
+        {"modelo procrustes con soporte y usuario", completo, nil, false},
+        {"modelo federado sin usuarios", sinUsuarios, nil, false},
+        {"archivo truncado", completo, func(texto string) string { return strings.TrimSuffix(texto, "FIN\n") }, true},
+        {"formato desconocido", completo, func(texto string) string { return strings.Replace(texto, "MODELO 1", "MODELO 9", 1) }, true},
+        {"fila con un factor de menos", sinUsuarios, func(texto string) string { return strings.Replace(texto, "0,0,0,2\n", "0,0,0\n", 1) }, true},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            ruta := filepath.Join(t.TempDir(), "modelo")
+            if err := escribirModelo(caso.modelo, ruta); err != nil {
+                t.Fatal(err)
+            }
+            if caso.alterar != nil {
+                contenido, err := os.ReadFile(ruta)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if err := os.WriteFile(ruta, []byte(caso.alterar(string(contenido))), 0644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            leido, err := leerModelo(ruta)
+            if (err != nil) != caso.error {
+                t.Fatalf("error %v, se esperaba error: %t", err, caso.error)
+            }
+            if caso.error {
+                return
+            }
+            esperado := *caso.modelo
+            if !leido.Creado.Equal(esperado.Creado) {
+                t.Errorf("creado %v, se esperaba %v", leido.Creado, esperado.Creado)
+            }
+            leido.Creado, esperado.Creado = time.Time{}, time.Time{}
+            if !reflect.DeepEqual(*leido, esperado) {
+                t.Errorf("se leyó\n%+v\nse esperaba\n%+v", *leido, esperado)
+            }
+        })
+    }
+}
+
+func TestPredecirRatingsRecorte(t *testing.T) {
+    modelo := &ModeloPeliculas{
+        Version:  "v1",
+        Factores: 1,
+        Items: map[string][]float64{
+            "alta":  {3.1},
+            "baja":  {-0.5},
+            "media": {1.7},
+            "borde": {2.5},
+        },
+        Usuarios:   map[string][]float64{"u": {2}},
+        Parametros: map[string]string{"objetivo": objetivoRMSE},
+    }
+
+    casos := []struct {
+        movieID     string
+        sinRecortar float64
+        rating      float64
+        recortada   bool
+        desconocida bool
+    }{
+        {"alta", 6.2, ratingMaximo, true, false},
+        {"baja", -1, ratingMinimo, true, false},
+        {"media", 3.4, 3.4, false, false},
+        {"borde", ratingMaximo, ratingMaximo, false, false},
+        {"nueva", 0, 0, false, true},
+    }
+    for _, caso := range casos {
+        t.Run(caso.movieID, func(t *testing.T) {
+            predicciones, desconocidas, usuario, err := predecirRatings(modelo, "u", []string{caso.movieID})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if usuario.Origen != "modelo" || usuario.Sesgo != 0 {
+                t.Errorf("usuario %+v, se esperaba el del modelo sin sesgo", usuario)
+            }
+            if caso.desconocida {
+                if len(predicciones) != 0 || len(desconocidas) != 1 {
+                    t.Errorf("predicciones %v y desconocidas %v, se esperaba solo la desconocida", predicciones, desconocidas)
+                }
+                return
+            }
+            if len(predicciones) != 1 {
+                t.Fatalf("%d predicciones, se esperaba 1", len(predicciones))
+            }
+            prediccion := predicciones[0]
+            if math.Abs(prediccion.SinRecortar-caso.sinRecortar) > 1e-9 || math.Abs(prediccion.Rating-caso.rating) > 1e-9 || prediccion.Recortada != caso.recortada {
+                t.Errorf("sinRecortar=%g rating=%g recortada=%t, se esperaba %g, %g y %t",
+                    prediccion.SinRecortar, prediccion.Rating, prediccion.Recortada, caso.sinRecortar, caso.rating, caso.recortada)
+            }
+            if prediccion.Media != 0 || prediccion.SesgoPelicula != 0 || prediccion.SinRecortar != prediccion.SesgoUsuario+prediccion.Interaccion {
+                t.Errorf("términos %+v, se esperaba solo la interacción", prediccion)
+            }
+        })
+    }
+
+    // Con sesgos la predicción es μ + b_u + b_i + pᵀq: 3 - 0.25 + 0.5 - 1
+    modelo.Media = 3
+    modelo.SesgosUsuarios = map[string]float64{"u": -0.25}
+    modelo.SesgosItems = map[string]float64{"baja": 0.5}
+    predicciones, _, usuario, err := predecirRatings(modelo, "u", []string{"baja"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if usuario.Sesgo != -0.25 {
+        t.Errorf("sesgo del usuario %g, se esperaba -0.25", usuario.Sesgo)
+    }
+    prediccion := predicciones[0]
+    if prediccion.Media != 3 || prediccion.SesgoUsuario != -0.25 || prediccion.SesgoPelicula != 0.5 || prediccion.Interaccion != -1 || prediccion.SinRecortar != 2.25 {
+        t.Errorf("términos %+v, se esperaba 3 - 0.25 + 0.5 - 1 = 2.25", prediccion)
+    }
+
+    modelo.Parametros["objetivo"] = objetivoBPR
+    if _, _, _, err := predecirRatings(modelo, "u", []string{"media"}); err == nil {
+        t.Error("un modelo BPR no debería predecir ratings")
+    }
+}
+
+func TestPodarRegistroConservaHistorial(t *testing.T) {
+    registro, historial, siguiente, maximo, directorio, activo := registroModelos, historialModelos, siguienteModelo, maximoModelos, directorioModelos, modeloPeliculas
+    defer func() {
+        registroModelos, historialModelos, siguienteModelo, maximoModelos, directorioModelos, modeloPeliculas = registro, historial, siguiente, maximo, directorio, activo
+    }()
+    maximoModelos, directorioModelos = 3, ""
+
+    casos := []struct {
+        nombre string
+        // Activar tras registrar cada versión
+        activar       []bool
+        conservadas   []string
+        rollbackHacia string
+    }{
+        {"sin activaciones quedan las más nuevas", []bool{false, false, false, false, false}, []string{"v3", "v4", "v5"}, ""},
+        {"las activadas sobreviven a la poda", []bool{true, true, false, false, false, false}, []string{"v1", "v2", "v6"}, "v1"},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            registroModelos, historialModelos, siguienteModelo = nil, nil, 1
+            for _, activar := range caso.activar {
+                modelo := &ModeloPeliculas{Factores: 1, Items: map[string][]float64{"1": {1}}}
+                if _, err := registrarModelo(modelo); err != nil {
+                    t.Fatal(err)
+                }
+                if activar {
+                    if err := activarModelo(modelo); err != nil {
+                        t.Fatal(err)
+                    }
+                }
+            }
+            conservadas := []string{}
+            for _, version := range registroModelos {
+                conservadas = append(conservadas, version.Version)
+            }
+            if !reflect.DeepEqual(conservadas, caso.conservadas) {
+                t.Errorf("quedaron %v, se esperaba %v", conservadas, caso.conservadas)
+            }
+            version, err := retrocederModelo()
+            if caso.rollbackHacia == "" {
+                if err == nil {
+                    t.Errorf("se volvió a %s sin versiones anteriores", version.Version)
+                }
+                return
+            }
+            if err != nil || version.Version != caso.rollbackHacia {
+                t.Errorf("rollback a %v (%v), se esperaba %s", version, err, caso.rollbackHacia)
+            }
+        })
+    }
+}
+
+func TestModeloParaConsultasSinModelo(t *testing.T) {
+    anteriorDataset, anteriorModelo := dataset, modeloPeliculas
+    defer func() { dataset, modeloPeliculas, entrenandoInicial, errorInicial = anteriorDataset, anteriorModelo, false, nil }()
+    modeloPeliculas = nil
+
+    // Sin dataset no hay nada que entrenar ni que esperar
+    dataset = nil
+    _, err := modeloParaConsultas()
+    if err != errSinModelo {
+        t.Fatalf("error %v, se esperaba errSinModelo", err)
+    }
+    w := httptest.NewRecorder()
+    avisarReintento(w, err)
+    if w.Header().Get("Retry-After") != "" {
+        t.Error("sin entrenamiento en curso no debería sugerir reintentar")
+    }
+
+    // Con un entrenamiento en curso se responde enseguida, sin lanzar otro
+    dataset = map[string][]Rating{"a": {{"a", "1", 4}}}
+    entrenandoInicial, errorInicial = true, fmt.Errorf("nodos caídos")
+    _, err = modeloParaConsultas()
+    if !errors.Is(err, errEntrenandoModelo) || !sinModeloActivo(err) || !strings.Contains(err.Error(), "nodos caídos") {
+        t.Fatalf("error %v, se esperaba errEntrenandoModelo con el fallo anterior", err)
+    }
+    w = httptest.NewRecorder()
+    avisarReintento(w, err)
+    if w.Header().Get("Retry-After") != strconv.Itoa(esperaModeloInicial) {
+        t.Errorf("Retry-After %q, se esperaba %d", w.Header().Get("Retry-After"), esperaModeloInicial)
+    }
+
+    modelo := &ModeloPeliculas{Version: "v1"}
+    modeloPeliculas = modelo
+    if activo, err := modeloParaConsultas(); activo != modelo || err != nil {
+        t.Errorf("modelo %v y error %v, se esperaba el activo", activo, err)
+    }
+}
+
+func TestManejarConexionTruncada(t *testing.T) {
+    // El canal de rechazados tiene lugar para un rechazo por nodo
+    anteriores := addrs
+    addrs = []string{"nodo"}
+    defer func() { addrs = anteriores }()
+    casos := []struct {
+        nombre    string
+        respuesta string
+        aceptado  bool
+    }{
+        {"resultado completo", "10,4.5\n20,3.9\nFIN_TOP5\n", true},
+        {"conexión cerrada antes de FIN_TOP5", "10,4.5\n20,3.9\n", false},
+        {"línea cortada", "10,4.5\n20,3.", false},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            job := nuevoJob("u", OpcionesJob{Objetivo: objetivoRMSE})
+            defer terminarJob(job)
+            manejarConexion(bufio.NewReader(strings.NewReader(caso.respuesta)), job, 0, "nodo")
+            select {
+            case <-job.resultados:
+                if !caso.aceptado {
+                    t.Fatal("un resultado truncado no debería aceptarse")
+                }
+            case <-job.rechazados:
+                if caso.aceptado {
+                    t.Fatalf("resultado rechazado: %+v", job.reporte.Exclusiones)
+                }
+                if len(job.reporte.Exclusiones) != 1 {
+                    t.Errorf("exclusiones %+v, se esperaba una", job.reporte.Exclusiones)
+                }
+            default:
+                t.Fatal("el resultado no se aceptó ni se rechazó, así que el shard esperaría al timeout de la réplica")
+            }
+        })
+    }
+}
+
+// modeloAleatorio crea un modelo indexado con vectores gaussianos de k
+// factores para las películas 1..peliculas; con sesgos agrega la media y un
+// b_i por película.
+func modeloAleatorio(r *rand.Rand, peliculas, k int, sesgos bool) *ModeloPeliculas {
+    modelo := &ModeloPeliculas{Factores: k, Items: map[string][]float64{}, Parametros: map[string]string{"seed": "7"}}
+    if sesgos {
+        modelo.Media = 3.5
+        modelo.SesgosItems = map[string]float64{}
+    }
+    for i, fila := range matrizAleatoria(r, peliculas, k) {
+        movieID := strconv.Itoa(i + 1)
+        modelo.Items[movieID] = fila
+        if sesgos {
+            modelo.SesgosItems[movieID] = 0.5 * r.NormFloat64()
+        }
+    }
+    indexarModelo(modelo)
+    return modelo
+}
+
+func TestBuscarEnModeloRecall(t *testing.T) {
+    // Con la configuración por defecto (8 tablas de 10 bits), el top-10
+    // aproximado de 50 consultas debe recuperar en promedio al menos esta
+    // fracción del exacto. La transformación MIPS agrupa peor las películas,
+    // así que el producto interno necesita sondeo 2 para un recall parecido
+    const n, consultas = 10, 50
+    casos := []struct {
+        nombre       string
+        producto     bool
+        sesgos       bool
+        sondeo       int
+        recallMinimo float64
+    }{
+        {"coseno", false, false, 1, 0.9},
+        {"producto interno", true, false, 2, 0.85},
+        {"producto interno con sesgos", true, true, 2, 0.85},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            r := rand.New(rand.NewSource(42))
+            modelo := modeloAleatorio(r, 2000, 8, caso.sesgos)
+            if modelo.indiceCoseno == nil || modelo.indiceProducto == nil {
+                t.Fatal("con 2000 películas el modelo debería tener índices")
+            }
+            ninguna := func(string) bool { return false }
+            aciertos, aproximadas := 0, 0
+            for c := 0; c < consultas; c++ {
+                consulta := matrizAleatoria(r, 1, 8)[0]
+                exactas, resultado := buscarEnModelo(modelo, consulta, n, caso.producto, ninguna, OpcionesBusqueda{Exacta: true})
+                if !resultado.Exacta || resultado.Candidatos != 2000 {
+                    t.Fatalf("la búsqueda exacta se resolvió %+v", resultado)
+                }
+                encontradas, resultado := buscarEnModelo(modelo, consulta, n, caso.producto, ninguna, OpcionesBusqueda{Sondeo: caso.sondeo})
+                if !resultado.Exacta {
+                    aproximadas++
+                    if resultado.Candidatos >= 2000 {
+                        t.Errorf("el índice revisó %d candidatos, no menos que el modelo", resultado.Candidatos)
+                    }
+                }
+                esperadas := map[string]bool{}
+                for _, pelicula := range exactas {
+                    esperadas[pelicula.MovieID] = true
+                }
+                for _, pelicula := range encontradas {
+                    if esperadas[pelicula.MovieID] {
+                        aciertos++
+                    }
+                }
+            }
+            if aproximadas == 0 {
+                t.Fatal("ninguna consulta usó el índice")
+            }
+            recall := float64(aciertos) / float64(n*consultas)
+            t.Logf("recall %.3f con %d de %d consultas por el índice", recall, aproximadas, consultas)
+            if recall < caso.recallMinimo {
+                t.Errorf("recall %.3f, se esperaba al menos %.2f", recall, caso.recallMinimo)
+            }
+        })
+    }
+}
+
+func TestBuscarEnModeloRecurreAExacta(t *testing.T) {
+    r := rand.New(rand.NewSource(42))
+    modelo := modeloAleatorio(r, 2000, 8, false)
+    consulta := matrizAleatoria(r, 1, 8)[0]
+    ninguna := func(string) bool { return false }
+    cubetas := modelo.indiceProducto.candidatos(consulta, 0)
+    candidatos := len(cubetas)
+    if candidatos < 3 || candidatos >= 2000 {
+        t.Fatalf("sin sondeo el índice dio %d candidatos", candidatos)
+    }
+    // Todos los candidatos menos dos quedan excluidos
+    libres := 0
+    excluidos := map[string]bool{}
+    for movieID := range cubetas {
+        if libres < 2 {
+            libres++
+        } else {
+            excluidos[movieID] = true
+        }
+    }
+
+    casos := []struct {
+        nombre  string
+        n       int
+        excluir func(string) bool
+    }{
+        // Se piden más películas de las que devuelven las cubetas
+        {"pocos candidatos", candidatos + 1, ninguna},
+        // Las cubetas tienen películas de sobra, pero quedan dos sin excluir
+        {"candidatos excluidos", 5, func(movieID string) bool { return excluidos[movieID] }},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            encontradas, resultado := buscarEnModelo(modelo, consulta, caso.n, true, caso.excluir, OpcionesBusqueda{Sondeo: 0})
+            if !resultado.Exacta {
+                t.Fatalf("se resolvió %+v con el índice, se esperaba recorrer el modelo", resultado)
+            }
+            if len(encontradas) != caso.n {
+                t.Fatalf("%d películas, se esperaban %d", len(encontradas), caso.n)
+            }
+            esperadas, _ := buscarEnModelo(modelo, consulta, caso.n, true, caso.excluir, OpcionesBusqueda{Exacta: true})
+            if !reflect.DeepEqual(encontradas, esperadas) {
+                t.Errorf("se encontró\n%v\nla búsqueda exacta da\n%v", encontradas, esperadas)
+            }
+        })
+    }
+}
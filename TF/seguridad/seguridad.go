@@ -0,0 +1,575 @@
+// seguridad.go
+
+// Package seguridad autentica las conexiones entre el coordinador y los
+// nodos. Con TLS_DIR se usa TLS mutuo con certificados firmados por la CA del
+// clúster; con una clave HMAC ambos extremos se autentican con un desafío y
+// cada trama posterior lleva su propio HMAC. Ambos mecanismos pueden
+// combinarse. Sin ninguno de los dos el proceso no arranca, salvo que
+// INSEGURO=true lo autorice explícitamente.
+//
+// En modo HMAC el coordinador tiene el secreto del clúster (CLUSTER_SECRET)
+// y cada nodo solo la clave derivada de ese secreto y de su IP
+// (CLUSTER_CLAVE). Cada par coordinador–nodo comparte así una clave que
+// ningún otro nodo conoce: un nodo no puede presentarse como el coordinador
+// ante otro nodo ni como otro nodo ante el coordinador.
+package seguridad
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+    RolCoordinador = "coordinador"
+    RolNodo        = "nodo"
+    maxTrama       = 1 << 20
+)
+
+var (
+    tlsServidor *tls.Config
+    tlsCliente  *tls.Config
+    local       identidad
+)
+
+// identidad es el rol y la IP con que el proceso se presenta, el rol que
+// espera del par y su clave HMAC.
+type identidad struct {
+    rol       string
+    id        string
+    rolRemoto string
+    // Secreto del clúster en el coordinador, clave propia en un nodo
+    secreto []byte
+}
+
+// HostsPorDefecto son los hosts del docker-compose, con el nombre del
+// directorio de certificados de cada uno.
+var HostsPorDefecto = []string{
+    "servidor=172.30.0.5", "nodo1=172.30.0.2", "nodo2=172.30.0.3",
+    "nodo3=172.30.0.4", "nodo4=172.30.0.6", "nodo5=172.30.0.7",
+}
+
+// Configurar carga los certificados y la clave HMAC del proceso, que tiene el
+// rol rol y se identifica ante sus pares con id (su IP).
+func Configurar(rol, id string) error {
+    local = identidad{rol: rol, id: id, rolRemoto: RolNodo}
+    if rol == RolNodo {
+        local.rolRemoto = RolCoordinador
+    }
+    tlsServidor, tlsCliente = nil, nil
+
+    // El secreto del clúster solo lo tiene el coordinador; con él cualquier
+    // nodo podría derivar las claves de los demás
+    variable := "CLUSTER_SECRET"
+    if rol == RolNodo {
+        variable = "CLUSTER_CLAVE"
+        if strings.TrimSpace(os.Getenv("CLUSTER_SECRET")) != "" {
+            return fmt.Errorf("CLUSTER_SECRET es solo del coordinador: los nodos usan CLUSTER_CLAVE (go run ./nodoServer claves)")
+        }
+    }
+    if valor := strings.TrimSpace(os.Getenv(variable)); valor != "" {
+        local.secreto = []byte(valor)
+    }
+
+    dir := strings.TrimSpace(os.Getenv("TLS_DIR"))
+    if dir == "" {
+        if local.secreto != nil {
+            return nil
+        }
+        inseguro, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv("INSEGURO")))
+        if !inseguro {
+            return fmt.Errorf("sin TLS_DIR ni %s las conexiones no se autenticarían; defina INSEGURO=true para aceptarlo", variable)
+        }
+        fmt.Println("ADVERTENCIA: INSEGURO=true, las conexiones no se autentican")
+        return nil
+    }
+
+    certificado, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+    if err != nil {
+        return fmt.Errorf("cargando el certificado: %v", err)
+    }
+    pemCA, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+    if err != nil {
+        return fmt.Errorf("cargando la CA: %v", err)
+    }
+    ca := x509.NewCertPool()
+    if !ca.AppendCertsFromPEM(pemCA) {
+        return fmt.Errorf("ca.pem no contiene certificados")
+    }
+
+    // Además de estar firmado por la CA, el par debe tener el rol esperado
+    // para que un nodo no pueda hacerse pasar por el coordinador
+    rolRemoto := local.rolRemoto
+    verificarRol := func(cadenas [][]byte, _ [][]*x509.Certificate) error {
+        if len(cadenas) == 0 {
+            return fmt.Errorf("el par no presentó certificado")
+        }
+        cert, err := x509.ParseCertificate(cadenas[0])
+        if err != nil {
+            return err
+        }
+        if cert.Subject.CommonName != rolRemoto {
+            return fmt.Errorf("se esperaba un certificado de %s y se recibió %q", rolRemoto, cert.Subject.CommonName)
+        }
+        return nil
+    }
+
+    tlsServidor = &tls.Config{
+        Certificates:          []tls.Certificate{certificado},
+        ClientCAs:             ca,
+        ClientAuth:            tls.RequireAndVerifyClientCert,
+        MinVersion:            tls.VersionTLS12,
+        VerifyPeerCertificate: verificarRol,
+    }
+    tlsCliente = &tls.Config{
+        Certificates:          []tls.Certificate{certificado},
+        RootCAs:               ca,
+        MinVersion:            tls.VersionTLS12,
+        VerifyPeerCertificate: verificarRol,
+    }
+    fmt.Printf("TLS mutuo habilitado con los certificados de %s\n", dir)
+    return nil
+}
+
+// ClaveNodo deriva del secreto del clúster la clave HMAC del nodo con la IP
+// dada.
+func ClaveNodo(secretoCluster []byte, ip string) string {
+    mac := hmac.New(sha256.New, secretoCluster)
+    mac.Write([]byte("nodo|" + ip))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// claveCon devuelve la clave compartida con el par idPar: el coordinador la
+// deriva de la IP del nodo y el nodo usa siempre la suya.
+func (yo identidad) claveCon(idPar string) []byte {
+    if yo.rol == RolCoordinador {
+        return []byte(ClaveNodo(yo.secreto, idPar))
+    }
+    return yo.secreto
+}
+
+// Escuchar abre el listener TCP, envuelto en TLS si está configurado.
+func Escuchar(dir string) (net.Listener, error) {
+    ln, err := net.Listen("tcp", dir)
+    if err != nil {
+        return nil, err
+    }
+    if tlsServidor != nil {
+        ln = tls.NewListener(ln, tlsServidor)
+    }
+    return ln, nil
+}
+
+// transcripcion reúne lo que firman ambos extremos: el rol, la identidad y
+// el nonce de cada uno. Cambiar cualquiera de ellos invalida las firmas.
+func transcripcion(rolAcc, idAcc, nonceAcc, rolDial, idDial, nonceDial string) string {
+    return strings.Join([]string{rolAcc, idAcc, nonceAcc, rolDial, idDial, nonceDial}, "|")
+}
+
+// AutenticarEntrante completa el handshake TLS y el desafío HMAC de una
+// conexión aceptada, que debe venir de un par con el rol opuesto al local.
+// Se llama desde la goroutine que atiende la conexión para no bloquear el
+// bucle de Accept.
+func AutenticarEntrante(con net.Conn) (net.Conn, error) {
+    con.SetDeadline(time.Now().Add(10 * time.Second))
+    defer con.SetDeadline(time.Time{})
+
+    if tlsCon, ok := con.(*tls.Conn); ok {
+        if err := tlsCon.Handshake(); err != nil {
+            return nil, fmt.Errorf("handshake TLS: %v", err)
+        }
+    }
+    return local.desafiar(con)
+}
+
+// desafiar envía el desafío HMAC a un par entrante y verifica su respuesta.
+func (yo identidad) desafiar(con net.Conn) (net.Conn, error) {
+    if yo.secreto == nil {
+        return con, nil
+    }
+
+    nonceLocal, err := nuevoNonce()
+    if err != nil {
+        return nil, err
+    }
+    fmt.Fprintf(con, "RETO %s %s %s\n", yo.rol, yo.id, nonceLocal)
+
+    linea, err := leerLineaCruda(con)
+    if err != nil {
+        return nil, err
+    }
+    campos := strings.Fields(linea)
+    if len(campos) != 5 || campos[0] != "AUTH" {
+        fmt.Fprintln(con, "AUTH_ERROR")
+        return nil, fmt.Errorf("respuesta al desafío no válida")
+    }
+    rol, id, nonceRemoto := campos[1], campos[2], campos[3]
+    if rol != yo.rolRemoto {
+        fmt.Fprintln(con, "AUTH_ERROR")
+        return nil, fmt.Errorf("el par se presentó como %q y se esperaba %s", rol, yo.rolRemoto)
+    }
+    clave := yo.claveCon(id)
+    texto := transcripcion(yo.rol, yo.id, nonceLocal, rol, id, nonceRemoto)
+    recibido, err := hex.DecodeString(campos[4])
+    if err != nil || !hmac.Equal(recibido, firmar(clave, "dialer", texto)) {
+        fmt.Fprintln(con, "AUTH_ERROR")
+        return nil, fmt.Errorf("el par no tiene la clave de %s %s", rol, id)
+    }
+    fmt.Fprintf(con, "AUTH_OK %s\n", hex.EncodeToString(firmar(clave, "acceptor", texto)))
+
+    return &conexionAutenticada{
+        Conn:           con,
+        idPar:          id,
+        claveEscritura: firmar(clave, "trama", "acceptor", texto),
+        claveLectura:   firmar(clave, "trama", "dialer", texto),
+    }, nil
+}
+
+// Conectar abre una conexión autenticada hacia dir, que debe atender un par
+// con el rol opuesto al local.
+func Conectar(dir string) (net.Conn, error) {
+    var con net.Conn
+    var err error
+    dialer := &net.Dialer{Timeout: 10 * time.Second}
+    if tlsCliente != nil {
+        con, err = tls.DialWithDialer(dialer, "tcp", dir, tlsCliente)
+    } else {
+        con, err = dialer.Dial("tcp", dir)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return local.responderDesafio(con, dir)
+}
+
+// responderDesafio responde el desafío HMAC del par en dir y verifica que
+// el par también tenga la clave.
+func (yo identidad) responderDesafio(con net.Conn, dir string) (net.Conn, error) {
+    if yo.secreto == nil {
+        return con, nil
+    }
+
+    con.SetDeadline(time.Now().Add(10 * time.Second))
+    linea, err := leerLineaCruda(con)
+    campos := strings.Fields(linea)
+    if err != nil || len(campos) != 4 || campos[0] != "RETO" {
+        con.Close()
+        return nil, fmt.Errorf("desafío de autenticación no recibido de %s", dir)
+    }
+    rol, id, nonceRemoto := campos[1], campos[2], campos[3]
+    if rol != yo.rolRemoto {
+        con.Close()
+        return nil, fmt.Errorf("%s se presentó como %q y se esperaba %s", dir, rol, yo.rolRemoto)
+    }
+    // El coordinador usa la clave del nodo al que llamó, no la de la
+    // identidad que el nodo declare
+    idPar := id
+    if yo.rol == RolCoordinador {
+        idPar, _, _ = net.SplitHostPort(dir)
+    }
+    clave := yo.claveCon(idPar)
+    nonceLocal, err := nuevoNonce()
+    if err != nil {
+        con.Close()
+        return nil, err
+    }
+    texto := transcripcion(rol, id, nonceRemoto, yo.rol, yo.id, nonceLocal)
+    fmt.Fprintf(con, "AUTH %s %s %s %s\n", yo.rol, yo.id, nonceLocal, hex.EncodeToString(firmar(clave, "dialer", texto)))
+
+    linea, err = leerLineaCruda(con)
+    campos = strings.Fields(linea)
+    if err != nil || len(campos) != 2 || campos[0] != "AUTH_OK" {
+        con.Close()
+        return nil, fmt.Errorf("%s rechazó la autenticación", dir)
+    }
+    recibido, err := hex.DecodeString(campos[1])
+    if err != nil || !hmac.Equal(recibido, firmar(clave, "acceptor", texto)) {
+        con.Close()
+        return nil, fmt.Errorf("%s no demostró tener la clave de %s", dir, rol)
+    }
+    con.SetDeadline(time.Time{})
+
+    return &conexionAutenticada{
+        Conn:           con,
+        idPar:          idPar,
+        claveEscritura: firmar(clave, "trama", "dialer", texto),
+        claveLectura:   firmar(clave, "trama", "acceptor", texto),
+    }, nil
+}
+
+func nuevoNonce() (string, error) {
+    nonce := make([]byte, 16)
+    if _, err := crand.Read(nonce); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(nonce), nil
+}
+
+func firmar(clave []byte, partes ...string) []byte {
+    mac := hmac.New(sha256.New, clave)
+    mac.Write([]byte(strings.Join(partes, "|")))
+    return mac.Sum(nil)
+}
+
+// leerLineaCruda lee byte a byte hasta el salto de línea para no consumir
+// datos que pertenecen a las tramas siguientes.
+func leerLineaCruda(con net.Conn) (string, error) {
+    linea := make([]byte, 0, 128)
+    var b [1]byte
+    for len(linea) < 256 {
+        if _, err := io.ReadFull(con, b[:]); err != nil {
+            return "", err
+        }
+        if b[0] == '\n' {
+            return strings.TrimSpace(string(linea)), nil
+        }
+        linea = append(linea, b[0])
+    }
+    return "", fmt.Errorf("línea de autenticación demasiado larga")
+}
+
+// conexionAutenticada envuelve cada escritura en tramas con longitud, datos y
+// HMAC-SHA256 sobre un número de secuencia y los datos. Cada sentido usa su
+// propia clave de sesión, derivada de los nonces del desafío, así que una
+// trama no puede reordenarse, repetirse ni trasladarse a otra conexión.
+type conexionAutenticada struct {
+    net.Conn
+    idPar          string
+    claveEscritura []byte
+    claveLectura   []byte
+    secEscritura   uint64
+    secLectura     uint64
+    pendiente      []byte
+}
+
+func macTrama(clave []byte, secuencia uint64, datos []byte) []byte {
+    mac := hmac.New(sha256.New, clave)
+    var sec [8]byte
+    binary.BigEndian.PutUint64(sec[:], secuencia)
+    mac.Write(sec[:])
+    mac.Write(datos)
+    return mac.Sum(nil)
+}
+
+func (c *conexionAutenticada) Write(p []byte) (int, error) {
+    escritos := 0
+    for len(p) > 0 {
+        n := len(p)
+        if n > maxTrama {
+            n = maxTrama
+        }
+        trama := make([]byte, 4, 4+n+sha256.Size)
+        binary.BigEndian.PutUint32(trama, uint32(n))
+        trama = append(trama, p[:n]...)
+        trama = append(trama, macTrama(c.claveEscritura, c.secEscritura, p[:n])...)
+        if _, err := c.Conn.Write(trama); err != nil {
+            return escritos, err
+        }
+        c.secEscritura++
+        escritos += n
+        p = p[n:]
+    }
+    return escritos, nil
+}
+
+func (c *conexionAutenticada) Read(p []byte) (int, error) {
+    if len(c.pendiente) == 0 {
+        var cabecera [4]byte
+        if _, err := io.ReadFull(c.Conn, cabecera[:]); err != nil {
+            return 0, err
+        }
+        n := binary.BigEndian.Uint32(cabecera[:])
+        if n > maxTrama {
+            return 0, fmt.Errorf("trama de %d bytes excede el máximo", n)
+        }
+        trama := make([]byte, int(n)+sha256.Size)
+        if _, err := io.ReadFull(c.Conn, trama); err != nil {
+            return 0, io.ErrUnexpectedEOF
+        }
+        datos, mac := trama[:n], trama[n:]
+        if !hmac.Equal(mac, macTrama(c.claveLectura, c.secLectura, datos)) {
+            return 0, fmt.Errorf("HMAC de trama inválido, se descarta la conexión")
+        }
+        c.secLectura++
+        c.pendiente = datos
+    }
+    n := copy(p, c.pendiente)
+    c.pendiente = c.pendiente[n:]
+    return n, nil
+}
+
+// IdentidadPar devuelve la IP con la que el par se autenticó por HMAC, o ""
+// si la conexión no usa HMAC.
+func IdentidadPar(con net.Conn) string {
+    if autenticada, ok := con.(*conexionAutenticada); ok {
+        return autenticada.idPar
+    }
+    return ""
+}
+
+// CertificadoPar devuelve el certificado TLS del extremo remoto, si lo hay.
+func CertificadoPar(con net.Conn) *x509.Certificate {
+    if autenticada, ok := con.(*conexionAutenticada); ok {
+        con = autenticada.Conn
+    }
+    if tlsCon, ok := con.(*tls.Conn); ok {
+        if certs := tlsCon.ConnectionState().PeerCertificates; len(certs) > 0 {
+            return certs[0]
+        }
+    }
+    return nil
+}
+
+// hostsDe separa los argumentos nombre=ip, con HostsPorDefecto si no hay.
+func hostsDe(args []string) ([][2]string, error) {
+    if len(args) == 0 {
+        args = HostsPorDefecto
+    }
+    var hosts [][2]string
+    for _, host := range args {
+        nombre, ip, ok := strings.Cut(host, "=")
+        if !ok || net.ParseIP(ip) == nil {
+            return nil, fmt.Errorf("host %q no tiene la forma nombre=ip", host)
+        }
+        hosts = append(hosts, [2]string{nombre, ip})
+    }
+    return hosts, nil
+}
+
+// GenerarClaves imprime, a partir de CLUSTER_SECRET, la clave HMAC de cada
+// nodo como variables CLUSTER_CLAVE_<NOMBRE> listas para el archivo .env del
+// docker-compose.
+func GenerarClaves(args []string) error {
+    secretoCluster := strings.TrimSpace(os.Getenv("CLUSTER_SECRET"))
+    if secretoCluster == "" {
+        return fmt.Errorf("CLUSTER_SECRET no está definido")
+    }
+    hosts, err := hostsDe(args)
+    if err != nil {
+        return err
+    }
+    for _, host := range hosts {
+        if host[0] == "servidor" {
+            continue
+        }
+        fmt.Printf("CLUSTER_CLAVE_%s=%s\n", strings.ToUpper(host[0]), ClaveNodo([]byte(secretoCluster), host[1]))
+    }
+    return nil
+}
+
+// GenerarCertificados crea una CA de desarrollo y un certificado por host,
+// en dir/<nombre>/{ca.pem,cert.pem,key.pem}, listo para montar como TLS_DIR.
+// El host "servidor" recibe el rol de coordinador y el resto el de nodo.
+func GenerarCertificados(args []string) error {
+    dir := "certs"
+    if len(args) > 0 && !strings.Contains(args[0], "=") {
+        dir = args[0]
+        args = args[1:]
+    }
+    hosts, err := hostsDe(args)
+    if err != nil {
+        return err
+    }
+
+    claveCA, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+    if err != nil {
+        return err
+    }
+    ahora := time.Now()
+    plantillaCA := &x509.Certificate{
+        SerialNumber:          big.NewInt(ahora.UnixNano()),
+        Subject:               pkix.Name{CommonName: "CA del clúster de recomendaciones"},
+        NotBefore:             ahora.Add(-time.Hour),
+        NotAfter:              ahora.AddDate(1, 0, 0),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    derCA, err := x509.CreateCertificate(crand.Reader, plantillaCA, plantillaCA, &claveCA.PublicKey, claveCA)
+    if err != nil {
+        return err
+    }
+    certCA, err := x509.ParseCertificate(derCA)
+    if err != nil {
+        return err
+    }
+    pemCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCA})
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    if err := os.WriteFile(filepath.Join(dir, "ca.pem"), pemCA, 0644); err != nil {
+        return err
+    }
+    derClaveCA, err := x509.MarshalECPrivateKey(claveCA)
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(filepath.Join(dir, "ca-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: derClaveCA}), 0600); err != nil {
+        return err
+    }
+
+    for i, host := range hosts {
+        nombre, ip := host[0], net.ParseIP(host[1])
+        rol := RolNodo
+        if nombre == "servidor" {
+            rol = RolCoordinador
+        }
+
+        clave, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+        if err != nil {
+            return err
+        }
+        plantilla := &x509.Certificate{
+            SerialNumber: big.NewInt(ahora.UnixNano() + int64(i) + 1),
+            Subject:      pkix.Name{CommonName: rol},
+            DNSNames:     []string{nombre},
+            IPAddresses:  []net.IP{ip},
+            NotBefore:    ahora.Add(-time.Hour),
+            NotAfter:     ahora.AddDate(1, 0, 0),
+            KeyUsage:     x509.KeyUsageDigitalSignature,
+            ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        }
+        der, err := x509.CreateCertificate(crand.Reader, plantilla, certCA, &clave.PublicKey, claveCA)
+        if err != nil {
+            return err
+        }
+        derClave, err := x509.MarshalECPrivateKey(clave)
+        if err != nil {
+            return err
+        }
+
+        dirHost := filepath.Join(dir, nombre)
+        if err := os.MkdirAll(dirHost, 0755); err != nil {
+            return err
+        }
+        archivos := map[string][]byte{
+            "ca.pem":   pemCA,
+            "cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+            "key.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: derClave}),
+        }
+        for archivo, contenido := range archivos {
+            if err := os.WriteFile(filepath.Join(dirHost, archivo), contenido, 0600); err != nil {
+                return err
+            }
+        }
+        fmt.Printf("Certificado de %s (%s, %s) generado en %s\n", nombre, rol, ip, dirHost)
+    }
+    return nil
+}
@@ -0,0 +1,199 @@
+package seguridad
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const secretoPrueba = "secreto-de-prueba"
+
+func coordinador() identidad {
+    return identidad{rol: RolCoordinador, id: "10.0.0.5", rolRemoto: RolNodo, secreto: []byte(secretoPrueba)}
+}
+
+func nodo(ip string, clave string) identidad {
+    return identidad{rol: RolNodo, id: ip, rolRemoto: RolCoordinador, secreto: []byte(clave)}
+}
+
+// autenticarPar corre el desafío sobre un net.Pipe: aceptante atiende y
+// llamante se conecta a dir. Si un extremo falla cierra su conexión para que
+// el otro no quede esperando.
+func autenticarPar(aceptante, llamante identidad, dir string) (entrante, saliente net.Conn, errEntrante, errSaliente error) {
+    conA, conL := net.Pipe()
+    listo := make(chan struct{})
+    go func() {
+        defer close(listo)
+        if entrante, errEntrante = aceptante.desafiar(conA); errEntrante != nil {
+            conA.Close()
+        }
+    }()
+    if saliente, errSaliente = llamante.responderDesafio(conL, dir); errSaliente != nil {
+        conL.Close()
+    }
+    <-listo
+    return entrante, saliente, errEntrante, errSaliente
+}
+
+func TestDesafioIdaYVuelta(t *testing.T) {
+    ip := "10.0.0.2"
+    nodoValido := nodo(ip, ClaveNodo([]byte(secretoPrueba), ip))
+    entrante, saliente, errEntrante, errSaliente := autenticarPar(nodoValido, coordinador(), ip+":9001")
+    if errEntrante != nil || errSaliente != nil {
+        t.Fatalf("errores %v y %v, se esperaba autenticar", errEntrante, errSaliente)
+    }
+    defer entrante.Close()
+    defer saliente.Close()
+    if IdentidadPar(entrante) != "10.0.0.5" || IdentidadPar(saliente) != ip {
+        t.Errorf("identidades %q y %q, se esperaba 10.0.0.5 y %s", IdentidadPar(entrante), IdentidadPar(saliente), ip)
+    }
+
+    // Los datos cruzan en ambos sentidos dentro de tramas autenticadas
+    go func() {
+        fmt.Fprintln(saliente, "SHARD 3")
+        fmt.Fprintln(saliente, "FIN")
+    }()
+    lector := bufio.NewReader(entrante)
+    for _, esperada := range []string{"SHARD 3\n", "FIN\n"} {
+        if linea, err := lector.ReadString('\n'); err != nil || linea != esperada {
+            t.Fatalf("se leyó %q (%v), se esperaba %q", linea, err, esperada)
+        }
+    }
+    go fmt.Fprintln(entrante, "FIN_TOP5")
+    if linea, err := bufio.NewReader(saliente).ReadString('\n'); err != nil || linea != "FIN_TOP5\n" {
+        t.Fatalf("se leyó %q (%v), se esperaba la respuesta del nodo", linea, err)
+    }
+}
+
+func TestDesafioRechazado(t *testing.T) {
+    ip := "10.0.0.2"
+    casos := []struct {
+        nombre    string
+        aceptante identidad
+        llamante  identidad
+        dir       string
+    }{
+        // La clave de otro nodo no sirve para presentarse con esta IP
+        {"clave de otro nodo", nodo(ip, ClaveNodo([]byte(secretoPrueba), "10.0.0.3")), coordinador(), ip + ":9001"},
+        {"secreto equivocado", nodo(ip, ClaveNodo([]byte("otro"), ip)), coordinador(), ip + ":9001"},
+        // Un nodo no puede presentarse como coordinador ante otro nodo
+        {"nodo como coordinador", nodo(ip, ClaveNodo([]byte(secretoPrueba), ip)), identidad{rol: RolNodo, id: "10.0.0.3", rolRemoto: RolNodo, secreto: []byte(ClaveNodo([]byte(secretoPrueba), "10.0.0.3"))}, ip + ":9001"},
+        {"coordinador ante coordinador", coordinador(), coordinador(), "10.0.0.5:9002"},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            entrante, saliente, errEntrante, errSaliente := autenticarPar(caso.aceptante, caso.llamante, caso.dir)
+            if errEntrante == nil || errSaliente == nil {
+                t.Errorf("errores %v y %v, se esperaba que ambos extremos rechazaran", errEntrante, errSaliente)
+            }
+            for _, con := range []net.Conn{entrante, saliente} {
+                if con != nil {
+                    con.Close()
+                }
+            }
+        })
+    }
+}
+
+// conexionEnMemoria guarda lo que se escribe y lo devuelve al leer.
+type conexionEnMemoria struct {
+    net.Conn
+    datos *bytes.Buffer
+}
+
+func (c conexionEnMemoria) Read(p []byte) (int, error)  { return c.datos.Read(p) }
+func (c conexionEnMemoria) Write(p []byte) (int, error) { return c.datos.Write(p) }
+
+func TestTramasAlteradas(t *testing.T) {
+    clave := []byte("clave de sesión")
+    // Dos tramas de 5 bytes de datos: 4 de longitud, los datos y el HMAC
+    escritas := &bytes.Buffer{}
+    escritor := &conexionAutenticada{Conn: conexionEnMemoria{datos: escritas}, claveEscritura: clave}
+    fmt.Fprint(escritor, "uno\n\n")
+    fmt.Fprint(escritor, "dos\n\n")
+    tramas := escritas.Bytes()
+    largo := len(tramas) / 2
+    primera, segunda := tramas[:largo], tramas[largo:]
+    unir := func(partes ...[]byte) []byte { return bytes.Join(partes, nil) }
+
+    alterada := unir(primera)
+    alterada[5] ^= 1
+
+    casos := []struct {
+        nombre    string
+        datos     []byte
+        leidas    []string
+        rechazada bool
+    }{
+        {"tramas intactas", unir(primera, segunda), []string{"uno\n\n", "dos\n\n"}, false},
+        {"datos alterados", alterada, nil, true},
+        // El número de secuencia entra en el HMAC de cada trama
+        {"trama repetida", unir(primera, primera), []string{"uno\n\n"}, true},
+        {"tramas reordenadas", unir(segunda, primera), nil, true},
+        {"trama truncada", unir(primera[:largo-1]), nil, true},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            lector := &conexionAutenticada{Conn: conexionEnMemoria{datos: bytes.NewBuffer(caso.datos)}, claveLectura: clave}
+            for _, esperada := range caso.leidas {
+                leida := make([]byte, 64)
+                n, err := lector.Read(leida)
+                if err != nil || string(leida[:n]) != esperada {
+                    t.Fatalf("se leyó %q (%v), se esperaba %q", leida[:n], err, esperada)
+                }
+            }
+            _, err := lector.Read(make([]byte, 64))
+            if rechazada := err != nil && err != io.EOF; rechazada != caso.rechazada {
+                t.Errorf("error %v, se esperaba rechazada=%t", err, caso.rechazada)
+            }
+        })
+    }
+}
+
+func TestConfigurar(t *testing.T) {
+    certificados := t.TempDir()
+    if err := GenerarCertificados([]string{certificados, "servidor=10.0.0.5", "nodo1=10.0.0.2"}); err != nil {
+        t.Fatal(err)
+    }
+    casos := []struct {
+        nombre  string
+        rol     string
+        entorno map[string]string
+        error   string
+    }{
+        {"sin TLS ni clave", RolCoordinador, nil, "INSEGURO=true"},
+        {"nodo sin TLS ni clave", RolNodo, nil, "CLUSTER_CLAVE"},
+        {"inseguro autorizado", RolNodo, map[string]string{"INSEGURO": "true"}, ""},
+        {"inseguro falso", RolNodo, map[string]string{"INSEGURO": "false"}, "INSEGURO=true"},
+        {"coordinador con secreto", RolCoordinador, map[string]string{"CLUSTER_SECRET": secretoPrueba}, ""},
+        {"nodo con su clave", RolNodo, map[string]string{"CLUSTER_CLAVE": "abc"}, ""},
+        {"nodo con el secreto del clúster", RolNodo, map[string]string{"CLUSTER_SECRET": secretoPrueba}, "solo del coordinador"},
+        {"TLS sin certificados", RolNodo, map[string]string{"TLS_DIR": t.TempDir()}, "cargando el certificado"},
+        {"TLS con certificados", RolNodo, map[string]string{"TLS_DIR": filepath.Join(certificados, "nodo1")}, ""},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            for _, variable := range []string{"TLS_DIR", "CLUSTER_SECRET", "CLUSTER_CLAVE", "INSEGURO"} {
+                t.Setenv(variable, caso.entorno[variable])
+            }
+            err := Configurar(caso.rol, "10.0.0.2")
+            if caso.error == "" && err != nil {
+                t.Fatalf("error %v, se esperaba configurar", err)
+            }
+            if caso.error != "" && (err == nil || !strings.Contains(err.Error(), caso.error)) {
+                t.Fatalf("error %v, se esperaba uno que mencionara %q", err, caso.error)
+            }
+        })
+    }
+    // Una configuración no hereda la clave de la anterior
+    t.Setenv("CLUSTER_CLAVE", "")
+    t.Setenv("TLS_DIR", "")
+    if err := Configurar(RolNodo, "10.0.0.2"); err == nil || local.secreto != nil {
+        t.Errorf("error %v y clave %q, se esperaba rechazar sin clave", err, local.secreto)
+    }
+}
@@ -0,0 +1,75 @@
+// similitud.go
+
+// Package similitud calcula las medidas de similitud de los vecinos más
+// cercanos. Los nodos acumulan los co-ratings de cada par en Estadisticas y,
+// con knn-usuarios, el coordinador combina las de todos los rangos antes de
+// calcular la similitud, así que ambos lados deben usar la misma fórmula.
+package similitud
+
+import (
+	"math"
+)
+
+// Medidas de similitud.
+const (
+    Coseno         = "coseno"
+    CosenoAjustado = "coseno-ajustado"
+    Pearson        = "pearson"
+)
+
+// Estadisticas acumula los co-ratings de un par. Son sumas, así que las de
+// distintos rangos de películas se combinan sumándolas.
+type Estadisticas struct {
+    N   int
+    Sx  float64
+    Sy  float64
+    Sxx float64
+    Syy float64
+    Sxy float64
+}
+
+// Sumar agrega un co-rating (x, y).
+func (e *Estadisticas) Sumar(x, y float64) {
+    e.N++
+    e.Sx += x
+    e.Sy += y
+    e.Sxx += x * x
+    e.Syy += y * y
+    e.Sxy += x * y
+}
+
+// Combinar agrega las estadísticas de otro rango.
+func (e *Estadisticas) Combinar(otra Estadisticas) {
+    e.N += otra.N
+    e.Sx += otra.Sx
+    e.Sy += otra.Sy
+    e.Sxx += otra.Sxx
+    e.Syy += otra.Syy
+    e.Sxy += otra.Sxy
+}
+
+// Similitud calcula la medida pedida, encogida por n/(n+encogimiento) para
+// que los pares con pocos co-ratings pesen menos. En coseno ajustado los
+// valores ya llegan centrados, así que se calcula como el coseno.
+func (e Estadisticas) Similitud(medida string, encogimiento float64) float64 {
+    if e.N == 0 {
+        return 0
+    }
+    n := float64(e.N)
+    var sim float64
+    if medida == Pearson {
+        covarianza := e.Sxy - e.Sx*e.Sy/n
+        varianzaX := e.Sxx - e.Sx*e.Sx/n
+        varianzaY := e.Syy - e.Sy*e.Sy/n
+        if varianzaX <= 0 || varianzaY <= 0 {
+            return 0
+        }
+        sim = covarianza / math.Sqrt(varianzaX*varianzaY)
+    } else {
+        if e.Sxx == 0 || e.Syy == 0 {
+            return 0
+        }
+        sim = e.Sxy / math.Sqrt(e.Sxx*e.Syy)
+    }
+    return sim * n / (n + encogimiento)
+}
@@ -0,0 +1,54 @@
+// similitud_test.go
+
+package similitud
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSimilitud(t *testing.T) {
+    casos := []struct {
+        nombre       string
+        medida       string
+        pares        [][2]float64
+        encogimiento float64
+        esperada     float64
+    }{
+        {"pearson con ratings proporcionales", Pearson, [][2]float64{{1, 2}, {2, 4}, {3, 6}}, 0, 1},
+        {"pearson con ratings opuestos", Pearson, [][2]float64{{1, 3}, {2, 2}, {3, 1}}, 0, -1},
+        {"pearson sin varianza", Pearson, [][2]float64{{4, 1}, {4, 5}}, 0, 0},
+        {"coseno", Coseno, [][2]float64{{1, 0}, {0, 1}, {1, 1}}, 0, 0.5},
+        {"coseno encogido", Coseno, [][2]float64{{2, 2}, {3, 3}}, 2, 0.5},
+        {"sin co-ratings", Coseno, nil, 0, 0},
+    }
+    for _, caso := range casos {
+        t.Run(caso.nombre, func(t *testing.T) {
+            var e Estadisticas
+            for _, par := range caso.pares {
+                e.Sumar(par[0], par[1])
+            }
+            if obtenida := e.Similitud(caso.medida, caso.encogimiento); math.Abs(obtenida-caso.esperada) > 1e-12 {
+                t.Errorf("se obtuvo %g, se esperaba %g", obtenida, caso.esperada)
+            }
+        })
+    }
+}
+
+func TestCombinar(t *testing.T) {
+    // Sumar por rangos y combinar da lo mismo que sumar todo junto
+    pares := [][2]float64{{5, 4}, {3, 1}, {4, 4}, {1, 2}, {2, 3}}
+    var todo, primero, segundo Estadisticas
+    for i, par := range pares {
+        todo.Sumar(par[0], par[1])
+        if i < 2 {
+            primero.Sumar(par[0], par[1])
+        } else {
+            segundo.Sumar(par[0], par[1])
+        }
+    }
+    primero.Combinar(segundo)
+    if primero != todo {
+        t.Errorf("combinadas %+v, se esperaba %+v", primero, todo)
+    }
+}